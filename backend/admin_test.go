@@ -0,0 +1,123 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestSystemStatsRequiresAdmin(t *testing.T) {
+	setupTestDB(t)
+	_, userToken := createTestUser(t, "user")
+	adminID, adminToken := createTestUser(t, "admin")
+	if err := SetUserAdmin(adminID, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if ctx := doRequest("GET", "/admin/system", userToken, nil); ctx.Response.StatusCode() != fasthttp.StatusForbidden {
+		t.Fatalf("non-admin got %d, want 403", ctx.Response.StatusCode())
+	}
+
+	ctx := doRequest("GET", "/admin/system", adminToken, nil)
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("admin got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	var stats struct {
+		UptimeSeconds float64 `json:"uptimeSeconds"`
+		Goroutines    int     `json:"goroutines"`
+		AllocBytes    uint64  `json:"allocBytes"`
+		SysBytes      uint64  `json:"sysBytes"`
+	}
+	decodeBody(t, ctx, &stats)
+	if stats.UptimeSeconds <= 0 || stats.Goroutines <= 0 || stats.AllocBytes == 0 || stats.SysBytes == 0 {
+		t.Fatalf("expected non-zero uptime and memory figures, got %+v", stats)
+	}
+}
+
+func TestRoomLogsFilteredByRoom(t *testing.T) {
+	setupTestDB(t)
+	_, userToken := createTestUser(t, "user")
+	adminID, adminToken := createTestUser(t, "admin")
+	if err := SetUserAdmin(adminID, true); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		logRoomEvent("room-one", "INFO", "User joined room %s (%d)", "room-one", i)
+		logRoomEvent("room-two", "INFO", "User joined room %s (%d)", "room-two", i)
+	}
+	logRoomEvent("room-one", "WARN", "Dropped offer in room %s", "room-one")
+	logRoomEvent("room-two", "ERROR", "Error in room %s", "room-two")
+
+	if ctx := doRequest("GET", "/rooms/room-one/logs", userToken, nil); ctx.Response.StatusCode() != fasthttp.StatusForbidden {
+		t.Fatalf("non-admin got %d, want 403", ctx.Response.StatusCode())
+	}
+
+	type logPage struct {
+		RoomID  string         `json:"roomId"`
+		Total   int            `json:"total"`
+		Entries []RoomLogEntry `json:"entries"`
+	}
+	fetch := func(query string) logPage {
+		t.Helper()
+		ctx := doRequest("GET", "/rooms/room-one/logs"+query, adminToken, nil)
+		if ctx.Response.StatusCode() != fasthttp.StatusOK {
+			t.Fatalf("admin got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+		}
+		var page logPage
+		decodeBody(t, ctx, &page)
+		return page
+	}
+
+	page := fetch("")
+	if page.Total != 4 || len(page.Entries) != 4 {
+		t.Fatalf("got %d of %d entries, want 4", len(page.Entries), page.Total)
+	}
+	for _, entry := range page.Entries {
+		if !strings.Contains(entry.Message, "room-one") {
+			t.Fatalf("entry from another room: %+v", entry)
+		}
+	}
+	if page.Entries[0].Level != "WARN" {
+		t.Fatalf("newest entry first: got %+v", page.Entries[0])
+	}
+
+	if page := fetch("?level=warn"); page.Total != 1 || page.Entries[0].Level != "WARN" {
+		t.Fatalf("level filter: %+v", page)
+	}
+	if page := fetch("?limit=2&offset=3"); page.Total != 4 || len(page.Entries) != 1 || !strings.HasSuffix(page.Entries[0].Message, "(0)") {
+		t.Fatalf("last page: %+v", page)
+	}
+}
+
+func TestServerLogRequiresAdmin(t *testing.T) {
+	setupTestDB(t)
+	_, userToken := createTestUser(t, "user")
+	// The built-in accounts are admins, as they have always been
+	addTestUser("ashu", "admin", true)
+	admin, err := GetUserByUsername("ashu")
+	if err != nil || admin == nil || !admin.IsAdmin {
+		t.Fatalf("seeded admin = %+v, %v", admin, err)
+	}
+	adminToken, err := generateToken("ashu", admin.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	captureLog(t)
+	logMessage("ERROR", "User 'alice' connected from 203.0.113.7")
+
+	ctx := doRequest("GET", "/logs", userToken, nil)
+	if ctx.Response.StatusCode() != fasthttp.StatusForbidden || strings.Contains(string(ctx.Response.Body()), "203.0.113.7") {
+		t.Fatalf("non-admin got %d %s, want 403", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+
+	ctx = doRequest("GET", "/logs", adminToken, nil)
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("admin got %d %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	if !strings.Contains(string(ctx.Response.Body()), "User 'alice' connected from 203.0.113.7") {
+		t.Fatalf("log download is missing the logged line: %q", ctx.Response.Body())
+	}
+}
@@ -1,15 +1,26 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
 	"crypto/sha256"
+	"database/sql"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/mail"
 	"os"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/fasthttp/websocket"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/valyala/fasthttp"
 )
@@ -22,10 +33,42 @@ var (
 	activeRooms = sync.Map{}
 	roomsMutex  = &sync.RWMutex{}
 
-	// Token management
+	// Token management: revoked token strings mapped to when the token expires anyway
 	tokenBlacklist = sync.Map{}
+
+	// IDs of tokens the database says aren't revoked, mapped to when the token expires, so each
+	// token is looked up once after a restart rather than on every request
+	checkedTokenIDs = sync.Map{}
+
+	// IDs of single-use invites that have been redeemed, mapped to their expiry
+	consumedInvites = sync.Map{}
+
+	// Users' current token versions by user ID, so validating a token doesn't look the user up
+	// every time
+	tokenVersions = sync.Map{}
+
+	// One-time WebSocket tickets handed out by /ws-ticket, keyed by ticket
+	wsTickets      = make(map[string]wsTicket)
+	wsTicketsMutex = sync.Mutex{}
 )
 
+// wsTicketProtocol is the WebSocket subprotocol clients offer alongside a token passed in the
+// Sec-WebSocket-Protocol header; the server selects it so browsers accept the upgrade
+const wsTicketProtocol = "monkeychat"
+
+// cachedTokenVersion is a user's token version as read from the database at some point
+type cachedTokenVersion struct {
+	version   int
+	expiresAt time.Time
+}
+
+// wsTicket is a short-lived, single-use credential for opening a WebSocket
+type wsTicket struct {
+	Username  string
+	UserID    int64
+	ExpiresAt time.Time
+}
+
 // User represents a registered user
 type User struct {
 	Username     string    `json:"username"`
@@ -42,22 +85,57 @@ type ActiveRoom struct {
 
 // JWT claims structure
 type Claims struct {
-	Username string `json:"username"`
-	UserID   int64  `json:"userId"`
+	Username     string `json:"username"`
+	UserID       int64  `json:"userId"`
+	TokenVersion int    `json:"tokenVersion,omitempty"` // Must match the user's token_version
 	jwt.RegisteredClaims
 }
 
 // Init initializes the auth module with test users
 func InitAuth() {
-	// Add test users if they don't exist
-	addTestUser("ashu", "admin")
-	addTestUser("rijey", "admin")
+	// Add test users if they don't exist; they have always been the admins
+	addTestUser("ashu", "admin", true)
+	addTestUser("rijey", "admin", true)
+
+	// Revoked tokens are kept in the database until they would have expired anyway
+	go sweepRevokedTokens()
 
 	logMessage("INFO", "Auth module initialized with test users")
 }
 
+// sweepRevokedTokens periodically forgets revoked tokens that have expired, since expired tokens
+// are rejected anyway (REVOKED_TOKEN_SWEEP_INTERVAL, default 1h)
+func sweepRevokedTokens() {
+	ticker := time.NewTicker(getEnvDuration("REVOKED_TOKEN_SWEEP_INTERVAL", time.Hour))
+	defer ticker.Stop()
+	for range ticker.C {
+		purgeExpiredTokens(time.Now())
+	}
+}
+
+// purgeExpiredTokens forgets tokens that expired before now, from memory and the database
+func purgeExpiredTokens(now time.Time) {
+	for _, cache := range []*sync.Map{&tokenBlacklist, &checkedTokenIDs} {
+		cache.Range(func(key, value interface{}) bool {
+			if value.(time.Time).Before(now) {
+				cache.Delete(key)
+			}
+			return true
+		})
+	}
+
+	purged, err := PurgeExpiredRevokedTokens(now)
+	if err != nil {
+		logMessage("ERROR", "Error purging expired revoked tokens: %v", err)
+		return
+	}
+	if purged > 0 {
+		logMessage("INFO", "Purged %d expired revoked tokens", purged)
+	}
+}
+
 // Initialize test users
-func addTestUser(username, password string) {
+func addTestUser(username, password string, admin bool) {
 	// Check if user already exists
 	existingUser, err := GetUserByUsername(username)
 	if err != nil {
@@ -67,16 +145,26 @@ func addTestUser(username, password string) {
 
 	if existingUser != nil {
 		logMessage("INFO", "Test user %s already exists, skipping creation", username)
+		if admin && !existingUser.IsAdmin {
+			if err := SetUserAdmin(existingUser.ID, true); err != nil {
+				logMessage("ERROR", "Error making test user %s an admin: %v", username, err)
+			}
+		}
 		return
 	}
 
 	// Create user in the database
 	passwordHash := hashPassword(password)
-	_, err = CreateUser(username, passwordHash)
+	user, err := CreateUser(username, passwordHash, "")
 	if err != nil {
 		logMessage("ERROR", "Error creating test user: %v", err)
 		return
 	}
+	if admin {
+		if err := SetUserAdmin(user.ID, true); err != nil {
+			logMessage("ERROR", "Error making test user %s an admin: %v", username, err)
+		}
+	}
 
 	logMessage("INFO", "Created test user: %s", username)
 }
@@ -88,26 +176,163 @@ func hashPassword(password string) string {
 	return base64.StdEncoding.EncodeToString(hasher.Sum(nil))
 }
 
+// generateRandomToken returns a URL-safe random token with n bytes of entropy
+func generateRandomToken(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		logMessage("ERROR", "Error generating random token: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// joinCodeAlphabet leaves out characters easily mistaken for one another (0/O, 1/I/L)
+const joinCodeAlphabet = "23456789ABCDEFGHJKMNPQRSTUVWXYZ"
+
+// joinCodeLength is how many characters a room's join code has
+const joinCodeLength = 6
+
+// generateJoinCode returns a random join code, short enough to read out over the phone
+func generateJoinCode() string {
+	code := make([]byte, 0, joinCodeLength)
+	b := make([]byte, 1)
+	for len(code) < joinCodeLength {
+		if _, err := rand.Read(b); err != nil {
+			logMessage("ERROR", "Error generating join code: %v", err)
+		}
+		// Bytes past the last whole multiple of the alphabet would favour its first letters
+		if int(b[0]) < 256-256%len(joinCodeAlphabet) {
+			code = append(code, joinCodeAlphabet[int(b[0])%len(joinCodeAlphabet)])
+		}
+	}
+	return string(code)
+}
+
 // Verify a password against a hash
 func verifyPassword(password, hash string) bool {
 	return hashPassword(password) == hash
 }
 
+// tokenAudience is the audience login tokens are issued for and must carry, so tokens from one
+// deployment (e.g. staging) are refused by another. It's derived from ENV unless JWT_AUDIENCE is set.
+func tokenAudience() string {
+	if audience := os.Getenv("JWT_AUDIENCE"); audience != "" {
+		return audience
+	}
+	env := strings.ToLower(os.Getenv("ENV"))
+	if env == "" {
+		env = "development"
+	}
+	return "monkeychat-" + env
+}
+
+// tokenKeys holds the algorithm and keys for login tokens; HS256 with JWT_SECRET unless
+// loadTokenKeys configured something else
+var tokenKeys = struct {
+	method    jwt.SigningMethod
+	signKey   interface{} // nil when this server can only verify tokens
+	verifyKey interface{}
+}{jwt.SigningMethodHS256, jwtSecret, jwtSecret}
+
+// loadTokenKeys configures login token signing from JWT_ALGORITHM: HS256 (the default), HS384 and
+// HS512 use JWT_SECRET, while RS256, RS384 and RS512 use the PEM keys in JWT_PRIVATE_KEY and
+// JWT_PUBLIC_KEY (or the files named by JWT_PRIVATE_KEY_FILE and JWT_PUBLIC_KEY_FILE). A server
+// with only the public key can verify tokens but not issue them.
+func loadTokenKeys() error {
+	alg := strings.ToUpper(os.Getenv("JWT_ALGORITHM"))
+	if alg == "" {
+		alg = "HS256"
+	}
+
+	switch alg {
+	case "HS256", "HS384", "HS512":
+		tokenKeys.method = jwt.GetSigningMethod(alg)
+		tokenKeys.signKey = jwtSecret
+		tokenKeys.verifyKey = jwtSecret
+		return nil
+
+	case "RS256", "RS384", "RS512":
+		publicPEM, err := readKeyConfig("JWT_PUBLIC_KEY")
+		if err != nil {
+			return err
+		}
+		if publicPEM == nil {
+			return fmt.Errorf("JWT_PUBLIC_KEY or JWT_PUBLIC_KEY_FILE is required for %s", alg)
+		}
+		publicKey, err := jwt.ParseRSAPublicKeyFromPEM(publicPEM)
+		if err != nil {
+			return fmt.Errorf("invalid JWT public key: %v", err)
+		}
+
+		privatePEM, err := readKeyConfig("JWT_PRIVATE_KEY")
+		if err != nil {
+			return err
+		}
+		tokenKeys.method = jwt.GetSigningMethod(alg)
+		tokenKeys.verifyKey = publicKey
+		tokenKeys.signKey = nil
+		if privatePEM != nil {
+			privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(privatePEM)
+			if err != nil {
+				return fmt.Errorf("invalid JWT private key: %v", err)
+			}
+			tokenKeys.signKey = privateKey
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unsupported JWT_ALGORITHM '%s'", alg)
+}
+
+// readKeyConfig reads a PEM key from the named variable, or from the file named by <name>_FILE.
+// It returns nil when neither is set.
+func readKeyConfig(name string) ([]byte, error) {
+	if value := os.Getenv(name); value != "" {
+		return []byte(value), nil
+	}
+	path := os.Getenv(name + "_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s_FILE: %v", name, err)
+	}
+	return data, nil
+}
+
+// tokenLifetime is how long a login token stays valid
+const tokenLifetime = 30 * 24 * time.Hour
+
 // Generate a JWT token for a user
 func generateToken(username string, userID int64) (string, error) {
-	expirationTime := time.Now().Add(30 * 24 * time.Hour)
+	user, err := GetUserByID(userID)
+	if err != nil {
+		return "", err
+	}
+	version := 0
+	if user != nil {
+		version = user.TokenVersion
+	}
+
+	expirationTime := time.Now().Add(tokenLifetime)
 	claims := &Claims{
-		Username: username,
-		UserID:   userID,
+		Username:     username,
+		UserID:       userID,
+		TokenVersion: version,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        generateRandomToken(16),
+			Audience:  jwt.ClaimStrings{tokenAudience()},
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			Subject:   username,
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(jwtSecret)
+	if tokenKeys.signKey == nil {
+		return "", fmt.Errorf("this server has no key for signing tokens")
+	}
+	token := jwt.NewWithClaims(tokenKeys.method, claims)
+	tokenString, err := token.SignedString(tokenKeys.signKey)
 
 	if err != nil {
 		return "", err
@@ -124,24 +349,314 @@ func validateToken(tokenString string) (*Claims, error) {
 	}
 
 	claims := &Claims{}
+	// Only the configured algorithm is accepted, so e.g. an HMAC token can't be forged with the RSA public key
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if token.Method.Alg() != tokenKeys.method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return tokenKeys.verifyKey, nil
+	}, jwt.WithAudience(tokenAudience()), jwt.WithValidMethods([]string{tokenKeys.method.Alg()}))
+
+	if errors.Is(err, jwt.ErrTokenInvalidAudience) {
+		return nil, fmt.Errorf("token was issued for a different environment")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !token.Valid {
+		return nil, fmt.Errorf("invalid token")
+	}
+
+	// Tokens revoked before a restart are only known to the database, which is asked the first
+	// time a token is seen; revocations since then are already in the blacklist
+	if _, checked := checkedTokenIDs.Load(claims.ID); claims.ID != "" && !checked {
+		revoked, err := IsTokenRevoked(claims.ID)
+		if err != nil {
+			return nil, err
+		}
+		expiresAt := time.Now().Add(tokenLifetime)
+		if claims.ExpiresAt != nil {
+			expiresAt = claims.ExpiresAt.Time
+		}
+		if revoked {
+			tokenBlacklist.Store(tokenString, expiresAt)
+			return nil, fmt.Errorf("token is blacklisted")
+		}
+		checkedTokenIDs.Store(claims.ID, expiresAt)
+	}
+
+	// Logging out everywhere bumps the user's token version, retiring every older token
+	if claims.UserID > 0 {
+		version, found, err := currentTokenVersion(claims.UserID)
+		if err != nil {
+			return nil, err
+		}
+		if found && version != claims.TokenVersion {
+			return nil, fmt.Errorf("token has been revoked")
+		}
+	}
+
+	return claims, nil
+}
+
+// currentTokenVersion returns a user's token version, reporting false if the user doesn't exist.
+// Versions are cached for TOKEN_VERSION_CACHE_TTL (default 10s), which bounds how long another
+// server keeps accepting tokens after a revoke-all there; this server forgets the entry at once.
+func currentTokenVersion(userID int64) (int, bool, error) {
+	if cached, ok := tokenVersions.Load(userID); ok {
+		if entry := cached.(cachedTokenVersion); time.Now().Before(entry.expiresAt) {
+			return entry.version, true, nil
+		}
+		tokenVersions.Delete(userID)
+	}
+
+	user, err := GetUserByID(userID)
+	if err != nil || user == nil {
+		return 0, false, err
+	}
+	if ttl := getEnvDuration("TOKEN_VERSION_CACHE_TTL", 10*time.Second); ttl > 0 {
+		tokenVersions.Store(userID, cachedTokenVersion{version: user.TokenVersion, expiresAt: time.Now().Add(ttl)})
+	}
+	return user.TokenVersion, true, nil
+}
+
+// revokeToken blacklists a login token, persisting its ID so it stays revoked across restarts
+func revokeToken(tokenString string) {
+	// Parse without validating, the token may already be expired or otherwise invalid
+	claims := &Claims{}
+	_, _, err := jwt.NewParser().ParseUnverified(tokenString, claims)
+	expiresAt := time.Now().Add(tokenLifetime)
+	if err == nil && claims.ExpiresAt != nil {
+		expiresAt = claims.ExpiresAt.Time
+	}
+	tokenBlacklist.Store(tokenString, expiresAt)
+
+	if err != nil || claims.ID == "" {
+		return
+	}
+	checkedTokenIDs.Delete(claims.ID)
+	if err := RevokeToken(claims.ID, expiresAt); err != nil {
+		logMessage("ERROR", "Error persisting revoked token: %v", err)
+	}
+}
+
+// InviteClaims is the payload of a room invite token
+type InviteClaims struct {
+	RoomID    string `json:"roomId"`
+	SingleUse bool   `json:"singleUse,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// derivedSigningKey derives a key for one kind of token from the JWT secret, so e.g. an invite
+// can never pass as a login token or the other way round
+func derivedSigningKey(purpose string) []byte {
+	mac := hmac.New(sha256.New, jwtSecret)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// inviteSigningKey is the key room invites are signed with
+func inviteSigningKey() []byte {
+	return derivedSigningKey("room-invite")
+}
+
+// Generate a signed invite token for a room that expires after ttl
+func generateInviteToken(roomID string, createdBy string, ttl time.Duration, singleUse bool) (string, *InviteClaims, error) {
+	now := time.Now()
+	claims := &InviteClaims{
+		RoomID:    roomID,
+		SingleUse: singleUse,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        generateRandomToken(16),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			Issuer:    createdBy,
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	tokenString, err := token.SignedString(inviteSigningKey())
+	if err != nil {
+		return "", nil, err
+	}
+
+	return tokenString, claims, nil
+}
+
+// Validate an invite token's signature and expiry, and that it hasn't been redeemed if single-use
+func validateInviteToken(tokenString string) (*InviteClaims, error) {
+	claims := &InviteClaims{}
 	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
-		return jwtSecret, nil
+		return inviteSigningKey(), nil
 	})
 
 	if err != nil {
 		return nil, err
 	}
 
-	if !token.Valid {
+	if !token.Valid || claims.RoomID == "" || claims.ID == "" {
+		return nil, fmt.Errorf("invalid invite")
+	}
+
+	if _, used := consumedInvites.Load(claims.ID); used {
+		return nil, fmt.Errorf("invite has already been used")
+	}
+
+	return claims, nil
+}
+
+// Redeem an invite, marking single-use invites as consumed. Fails if another
+// join redeemed the same single-use invite first.
+func redeemInvite(claims *InviteClaims) error {
+	if !claims.SingleUse {
+		return nil
+	}
+
+	// Forget consumed invites that have expired anyway
+	now := time.Now()
+	consumedInvites.Range(func(key, value interface{}) bool {
+		if value.(time.Time).Before(now) {
+			consumedInvites.Delete(key)
+		}
+		return true
+	})
+
+	if _, used := consumedInvites.LoadOrStore(claims.ID, claims.ExpiresAt.Time); used {
+		return fmt.Errorf("invite has already been used")
+	}
+	return nil
+}
+
+// EmailClaims is the payload of an email verification token
+type EmailClaims struct {
+	UserID int64  `json:"userId"`
+	Email  string `json:"email"`
+	jwt.RegisteredClaims
+}
+
+// emailVerificationTTL is how long an email verification token stays valid (EMAIL_VERIFICATION_TTL)
+func emailVerificationTTL() time.Duration {
+	return getEnvDuration("EMAIL_VERIFICATION_TTL", 24*time.Hour)
+}
+
+// Generate a signed token proving control of an email address
+func generateEmailToken(userID int64, email string) (string, error) {
+	now := time.Now()
+	claims := &EmailClaims{
+		UserID: userID,
+		Email:  email,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(now.Add(emailVerificationTTL())),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(derivedSigningKey("email-verification"))
+}
+
+// Validate an email verification token
+func validateEmailToken(tokenString string) (*EmailClaims, error) {
+	claims := &EmailClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return derivedSigningKey("email-verification"), nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !token.Valid || claims.UserID == 0 || claims.Email == "" {
 		return nil, fmt.Errorf("invalid token")
 	}
 
 	return claims, nil
 }
 
+// sendVerificationEmail issues a verification token for the address. There is no mail
+// delivery yet, so the token is logged for the operator to pass on.
+func sendVerificationEmail(userID int64, email string) error {
+	token, err := generateEmailToken(userID, email)
+	if err != nil {
+		return err
+	}
+	logMessage("INFO", "Email verification token for user %d <%s>: %s", userID, email, token)
+	return nil
+}
+
+// validateEmail checks that email is a bare address such as "name@example.com"
+func validateEmail(email string) error {
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || len(email) > 255 {
+		return fmt.Errorf("invalid email address")
+	}
+	if at := strings.LastIndex(email, "@"); !strings.Contains(email[at+1:], ".") {
+		return fmt.Errorf("invalid email address")
+	}
+	return nil
+}
+
+// passwordResetTTL is how long a password reset token stays valid (PASSWORD_RESET_TTL)
+func passwordResetTTL() time.Duration {
+	return getEnvDuration("PASSWORD_RESET_TTL", time.Hour)
+}
+
+// hashResetToken is how reset tokens are stored, so a leaked table can't be used to reset passwords
+func hashResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// generateTURNCredentials creates an ephemeral TURN username and password using the coturn REST
+// API scheme: the username is "<expiry unix time>:<user>" and the password is the base64
+// HMAC-SHA1 of the username keyed with the shared secret (coturn's static-auth-secret)
+func generateTURNCredentials(secret, user string, expiresAt time.Time) (string, string) {
+	username := fmt.Sprintf("%d:%s", expiresAt.Unix(), user)
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return username, base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// isAdmin reports whether username has the admin role, or is listed in the comma-separated
+// ADMIN_USERS. The role is looked up on every call so revoking it takes effect right away.
+func isAdmin(username string) bool {
+	if username == "" {
+		return false
+	}
+	for _, admin := range splitList(os.Getenv("ADMIN_USERS")) {
+		if admin == username {
+			return true
+		}
+	}
+	user, err := GetUserByUsername(username)
+	if err != nil {
+		logMessage("ERROR", "Error checking admin role for %s: %v", username, err)
+		return false
+	}
+	return user != nil && user.IsAdmin
+}
+
+// usernamePattern is the character set allowed in a new username
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// validateUsername checks a requested username's length and characters
+func validateUsername(username string) error {
+	if len(username) < 3 || len(username) > 32 {
+		return fmt.Errorf("username must be between 3 and 32 characters")
+	}
+	if !usernamePattern.MatchString(username) {
+		return fmt.Errorf("username may only contain letters, digits, '_', '.' and '-'")
+	}
+	return nil
+}
+
 // Extract token from Authorization header
 func extractToken(ctx *fasthttp.RequestCtx) string {
 	auth := string(ctx.Request.Header.Peek("Authorization"))
@@ -157,28 +672,175 @@ func extractToken(ctx *fasthttp.RequestCtx) string {
 	return parts[1]
 }
 
+// issueWSTicket hands out a single-use ticket for the given user, valid for WS_TICKET_TTL (default 30s)
+func issueWSTicket(username string, userID int64) (string, time.Duration) {
+	ttl := getEnvDuration("WS_TICKET_TTL", 30*time.Second)
+	ticket := generateRandomToken(32)
+
+	wsTicketsMutex.Lock()
+	defer wsTicketsMutex.Unlock()
+	// Forget tickets that expired without being used
+	now := time.Now()
+	for key, t := range wsTickets {
+		if t.ExpiresAt.Before(now) {
+			delete(wsTickets, key)
+		}
+	}
+	wsTickets[ticket] = wsTicket{Username: username, UserID: userID, ExpiresAt: now.Add(ttl)}
+	return ticket, ttl
+}
+
+// redeemWSTicket consumes a ticket, returning who it was issued to
+func redeemWSTicket(ticket string) (*wsTicket, error) {
+	wsTicketsMutex.Lock()
+	t, ok := wsTickets[ticket]
+	delete(wsTickets, ticket)
+	wsTicketsMutex.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown or already used ticket")
+	}
+	if t.ExpiresAt.Before(time.Now()) {
+		return nil, fmt.Errorf("ticket expired")
+	}
+	return &t, nil
+}
+
+// wsCredentials authenticates a WebSocket upgrade request. It accepts, in order, a one-time
+// ?ticket= from /ws-ticket, a token offered in Sec-WebSocket-Protocol next to wsTicketProtocol,
+// and the deprecated ?token= query parameter, which leaks the token into logs and history.
+func wsCredentials(ctx *fasthttp.RequestCtx) (string, int64, bool) {
+	if ticket := string(ctx.QueryArgs().Peek("ticket")); ticket != "" {
+		t, err := redeemWSTicket(ticket)
+		if err != nil {
+			logMessage("WARN", "Rejected WebSocket ticket from %s: %v", ctx.RemoteIP(), err)
+			return "", 0, false
+		}
+		return t.Username, t.UserID, true
+	}
+
+	for _, protocol := range strings.Split(string(ctx.Request.Header.Peek("Sec-WebSocket-Protocol")), ",") {
+		protocol = strings.TrimSpace(protocol)
+		if protocol == "" || protocol == wsTicketProtocol {
+			continue
+		}
+		if claims, err := validateToken(protocol); err == nil {
+			return claims.Username, claims.UserID, true
+		}
+	}
+
+	if token := string(ctx.QueryArgs().Peek("token")); token != "" {
+		claims, err := validateToken(token)
+		if err == nil {
+			logMessage("WARN", "User '%s' authenticated a WebSocket with the deprecated token query parameter", claims.Username)
+			return claims.Username, claims.UserID, true
+		}
+	}
+
+	return "", 0, false
+}
+
+// handleWSTicket exchanges the caller's bearer token for a one-time WebSocket ticket
+func handleWSTicket(ctx *fasthttp.RequestCtx, username string, userID int64) {
+	ticket, ttl := issueWSTicket(username, userID)
+
+	resp := struct {
+		Ticket    string `json:"ticket"`
+		ExpiresIn int64  `json:"expiresIn"` // seconds
+	}{
+		Ticket:    ticket,
+		ExpiresIn: int64(ttl.Seconds()),
+	}
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(resp)
+}
+
+// wsAuthRequired reports whether WebSocket connections must carry a valid token (WS_AUTH=required)
+// rather than being allowed in anonymously (WS_AUTH=optional). Unset, it is required in production only.
+func wsAuthRequired() bool {
+	switch strings.ToLower(os.Getenv("WS_AUTH")) {
+	case "required":
+		return true
+	case "optional":
+		return false
+	}
+	return os.Getenv("ENV") == "production"
+}
+
+// publicPaths are served without a login token
+var publicPaths = map[string]bool{
+	"/login":           true,
+	"/register":        true,
+	"/health":          true,
+	"/livez":           true,
+	"/readyz":          true,
+	"/ws":              true,
+	"/rooms/join":      true,
+	"/verify-email":    true,
+	"/forgot-password": true,
+	"/reset-password":  true,
+}
+
+// fixedRoomPaths are the /rooms/ paths that aren't a room ID
+var fixedRoomPaths = map[string]bool{
+	"join":       true,
+	"rejoinable": true,
+	"delete":     true,
+	"mine":       true,
+}
+
+// roomDetailID returns the {id} of a /rooms/{id} path, or "" for any other path
+func roomDetailID(path string) string {
+	id, ok := strings.CutPrefix(path, "/rooms/")
+	if !ok || id == "" || strings.Contains(id, "/") || fixedRoomPaths[id] {
+		return ""
+	}
+	return id
+}
+
+// isRoomDetailPath reports whether path is /rooms/{id} rather than one of the fixed /rooms/ paths
+func isRoomDetailPath(path string) bool {
+	return roomDetailID(path) != ""
+}
+
 // Authentication middleware for fasthttp
 func authMiddleware(next func(ctx *fasthttp.RequestCtx, username string, userID int64)) fasthttp.RequestHandler {
 	return func(ctx *fasthttp.RequestCtx) {
 		// Skip auth for certain endpoints
 		path := string(ctx.Path())
-		if path == "/login" || path == "/register" || path == "/health" || path == "/ws" {
+		if publicPaths[path] {
 			if path == "/ws" {
-				// For WebSocket, check for token in query param
-				token := string(ctx.QueryArgs().Peek("token"))
-				if token != "" {
-					claims, err := validateToken(token)
-					if err == nil {
-						next(ctx, claims.Username, claims.UserID)
-						return
-					}
+				// For WebSocket, check for a ticket or token (see wsCredentials)
+				if username, userID, ok := wsCredentials(ctx); ok {
+					next(ctx, username, userID)
+					return
 				}
+				// Production (or WS_AUTH=required) refuses the upgrade without a valid token
+				if wsAuthRequired() {
+					logMessage("WARN", "Rejected unauthenticated WebSocket connection from %s", ctx.RemoteIP())
+					ctx.SetStatusCode(fasthttp.StatusUnauthorized)
+					ctx.SetBodyString(`{"error":"unauthorized: missing or invalid token"}`)
+					return
+				}
+
 				// Continue without authentication for WebSocket if no valid token
 				next(ctx, "", 0)
 				return
 			}
 
-			// No auth for login, register, health
+			// No auth for login, register, health, invite lookup, email verification, password reset
+			next(ctx, "", 0)
+			return
+		}
+
+		// Room details are public for the pre-join screen; a valid token only adds to them
+		if string(ctx.Method()) == "GET" && (isRoomDetailPath(path) || strings.HasPrefix(path, "/join/")) {
+			if tokenString := extractToken(ctx); tokenString != "" {
+				if claims, err := validateToken(tokenString); err == nil {
+					next(ctx, claims.Username, claims.UserID)
+					return
+				}
+			}
 			next(ctx, "", 0)
 			return
 		}
@@ -272,6 +934,9 @@ func handleLogin(ctx *fasthttp.RequestCtx) {
 	fmt.Println("handleLogin: response sent")
 }
 
+// minPasswordLength is the shortest password accepted on registration, reset or change
+const minPasswordLength = 8
+
 // Handler for user registration
 func handleRegister(ctx *fasthttp.RequestCtx) {
 	logMessage("INFO", "Registration request received")
@@ -279,6 +944,7 @@ func handleRegister(ctx *fasthttp.RequestCtx) {
 	var creds struct {
 		Username string `json:"username"`
 		Password string `json:"password"`
+		Email    string `json:"email"`
 	}
 
 	// Parse request body
@@ -292,11 +958,11 @@ func handleRegister(ctx *fasthttp.RequestCtx) {
 	logMessage("INFO", "Registration request for username: %s", creds.Username)
 
 	// Validate input
-	if len(creds.Username) < 3 || len(creds.Password) < 4 {
+	if len(creds.Username) < 3 || len(creds.Password) < minPasswordLength {
 		logMessage("WARN", "Registration validation failed - username: %d chars, password: %d chars",
 			len(creds.Username), len(creds.Password))
 		ctx.SetStatusCode(fasthttp.StatusBadRequest)
-		ctx.SetBodyString(`{"error":"username must be at least 3 characters and password at least 4 characters"}`)
+		ctx.SetBodyString(fmt.Sprintf(`{"error":"username must be at least 3 characters and password at least %d characters"}`, minPasswordLength))
 		return
 	}
 
@@ -317,10 +983,31 @@ func handleRegister(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
+	// Email is optional, but must be valid and unused when given
+	if creds.Email != "" {
+		if err := validateEmail(creds.Email); err != nil {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			ctx.SetBodyString(`{"error":"invalid email address"}`)
+			return
+		}
+		emailUser, err := GetUserByEmail(creds.Email)
+		if err != nil {
+			logMessage("ERROR", "Error checking if email exists: %v", err)
+			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+			ctx.SetBodyString(`{"error":"internal server error"}`)
+			return
+		}
+		if emailUser != nil {
+			ctx.SetStatusCode(fasthttp.StatusConflict)
+			ctx.SetBodyString(`{"error":"email already in use"}`)
+			return
+		}
+	}
+
 	// Create user
 	logMessage("DEBUG", "Creating new user: %s", creds.Username)
 	passwordHash := hashPassword(creds.Password)
-	user, err := CreateUser(creds.Username, passwordHash)
+	user, err := CreateUser(creds.Username, passwordHash, creds.Email)
 	if err != nil {
 		logMessage("ERROR", "Error creating user '%s': %v", creds.Username, err)
 		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
@@ -330,6 +1017,12 @@ func handleRegister(ctx *fasthttp.RequestCtx) {
 
 	logMessage("INFO", "User created successfully: %s (ID: %d)", creds.Username, user.ID)
 
+	if creds.Email != "" {
+		if err := sendVerificationEmail(user.ID, creds.Email); err != nil {
+			logMessage("ERROR", "Error issuing email verification for user '%s': %v", creds.Username, err)
+		}
+	}
+
 	// Generate token
 	logMessage("DEBUG", "Generating JWT token for user: %s", creds.Username)
 	token, err := generateToken(creds.Username, user.ID)
@@ -355,6 +1048,159 @@ func handleRegister(ctx *fasthttp.RequestCtx) {
 	logMessage("INFO", "Registration completed successfully for user: %s", creds.Username)
 }
 
+// handleSendVerificationEmail issues a new verification token for the caller's current email
+func handleSendVerificationEmail(ctx *fasthttp.RequestCtx, username string, userID int64) {
+	user, err := GetUserByID(userID)
+	if err != nil {
+		logMessage("ERROR", "Error fetching user %d: %v", userID, err)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString(`{"error":"internal server error"}`)
+		return
+	}
+	if user == nil {
+		ctx.SetStatusCode(fasthttp.StatusNotFound)
+		ctx.SetBodyString(`{"error":"user not found"}`)
+		return
+	}
+	if user.Email == "" {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(`{"error":"no email address set"}`)
+		return
+	}
+	if user.EmailVerified {
+		ctx.SetStatusCode(fasthttp.StatusConflict)
+		ctx.SetBodyString(`{"error":"email already verified"}`)
+		return
+	}
+
+	if err := sendVerificationEmail(user.ID, user.Email); err != nil {
+		logMessage("ERROR", "Error issuing email verification for user '%s': %v", username, err)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString(`{"error":"error sending verification email"}`)
+		return
+	}
+
+	ctx.SetContentType("application/json")
+	ctx.SetBodyString(`{"message":"verification email sent"}`)
+}
+
+// handleVerifyEmail redeems a verification token and marks the email as verified. It needs no
+// login, since the token itself identifies the user.
+func handleVerifyEmail(ctx *fasthttp.RequestCtx) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(ctx.PostBody(), &req); err != nil || req.Token == "" {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(`{"error":"token is required"}`)
+		return
+	}
+
+	claims, err := validateEmailToken(req.Token)
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(`{"error":"invalid or expired token"}`)
+		return
+	}
+
+	// The token is stale if the email was changed after it was issued
+	verified, err := MarkEmailVerified(claims.UserID, claims.Email)
+	if err != nil {
+		logMessage("ERROR", "Error verifying email for user %d: %v", claims.UserID, err)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString(`{"error":"internal server error"}`)
+		return
+	}
+	if !verified {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(`{"error":"invalid or expired token"}`)
+		return
+	}
+
+	logMessage("INFO", "Email <%s> verified for user %d", claims.Email, claims.UserID)
+	ctx.SetContentType("application/json")
+	ctx.SetBodyString(`{"message":"email verified"}`)
+}
+
+// handleForgotPassword issues a password reset token for the account matching a username or
+// email. It answers the same way whether or not the account exists, so it can't be used to
+// find out which accounts do.
+func handleForgotPassword(ctx *fasthttp.RequestCtx) {
+	var req struct {
+		Username string `json:"username"`
+		Email    string `json:"email"`
+	}
+	if err := json.Unmarshal(ctx.PostBody(), &req); err != nil || (req.Username == "" && req.Email == "") {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(`{"error":"username or email is required"}`)
+		return
+	}
+
+	var user *DbUser
+	var err error
+	if req.Username != "" {
+		user, err = GetUserByUsername(req.Username)
+	} else {
+		user, err = GetUserByEmail(req.Email)
+	}
+	if err != nil {
+		logMessage("ERROR", "Error looking up account for password reset: %v", err)
+	} else if user != nil {
+		token := generateRandomToken(32)
+		if err := CreatePasswordReset(user.ID, hashResetToken(token), time.Now().Add(passwordResetTTL())); err != nil {
+			logMessage("ERROR", "Error creating password reset for user %d: %v", user.ID, err)
+		} else {
+			// There is no mail delivery yet, so the token is logged for the operator to pass on
+			logMessage("INFO", "Password reset token for user %s <%s>: %s", user.Username, user.Email, token)
+		}
+	}
+
+	ctx.SetContentType("application/json")
+	ctx.SetBodyString(`{"message":"if the account exists, a password reset link has been sent"}`)
+}
+
+// handleResetPassword sets a new password using a token from /forgot-password
+func handleResetPassword(ctx *fasthttp.RequestCtx) {
+	var req struct {
+		Token       string `json:"token"`
+		NewPassword string `json:"newPassword"`
+	}
+	if err := json.Unmarshal(ctx.PostBody(), &req); err != nil || req.Token == "" {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(`{"error":"token is required"}`)
+		return
+	}
+	if len(req.NewPassword) < minPasswordLength {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(fmt.Sprintf(`{"error":"password must be at least %d characters"}`, minPasswordLength))
+		return
+	}
+
+	userID, err := ResetPassword(hashResetToken(req.Token), hashPassword(req.NewPassword))
+	if err == sql.ErrNoRows {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(`{"error":"invalid or expired token"}`)
+		return
+	} else if err != nil {
+		logMessage("ERROR", "Error resetting password: %v", err)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString(`{"error":"internal server error"}`)
+		return
+	}
+	// Whoever knew the old password may still be signed in, so sign everyone out
+	if _, err := BumpTokenVersion(userID); err != nil {
+		logMessage("ERROR", "Error revoking sessions for user %d after a password reset: %v", userID, err)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString(`{"error":"password updated but failed to sign out other sessions"}`)
+		return
+	}
+	tokenVersions.Delete(userID)
+
+	logMessage("INFO", "Password reset for user %d", userID)
+	ctx.SetContentType("application/json")
+	ctx.SetBodyString(`{"message":"password updated"}`)
+}
+
 // Handler for user logout
 func handleLogout(ctx *fasthttp.RequestCtx, username string, userID int64) {
 	tokenString := extractToken(ctx)
@@ -365,58 +1211,177 @@ func handleLogout(ctx *fasthttp.RequestCtx, username string, userID int64) {
 	}
 
 	// Add token to blacklist
-	tokenBlacklist.Store(tokenString, true)
+	revokeToken(tokenString)
 
 	ctx.SetContentType("application/json")
 	ctx.SetBodyString(`{"message":"successfully logged out"}`)
 }
 
-// Handler for getting active rooms
+// handleRevokeAllSessions logs the user out everywhere: every token issued so far stops working,
+// including the caller's, their open sockets are closed, and a fresh token is returned for this device
+func handleRevokeAllSessions(ctx *fasthttp.RequestCtx, username string, userID int64) {
+	version, err := BumpTokenVersion(userID)
+	if err != nil {
+		logMessage("ERROR", "Error revoking sessions for %s: %v", username, err)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString(`{"error":"error revoking sessions"}`)
+		return
+	}
+	tokenVersions.Delete(userID)
+	token, err := generateToken(username, userID)
+	if err != nil {
+		logMessage("ERROR", "Error generating token for %s after revoking sessions: %v", username, err)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString(`{"error":"sessions revoked but failed to issue a new token, please log in again"}`)
+		return
+	}
+
+	closed := 0
+	liveConnections.Range(func(key, _ interface{}) bool {
+		conn := key.(*Connection)
+		if conn.UserID == userID {
+			notifyEvent(conn, "session-revoked", "", "You were signed out on all devices. Please sign in again.")
+			conn.closeAfterSend(websocket.ClosePolicyViolation, "session revoked")
+			closed++
+		}
+		return true
+	})
+
+	logMessage("INFO", "User %s (%d) revoked all sessions (token version %d), closing %d sockets", username, userID, version, closed)
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(map[string]string{
+		"message": "all sessions revoked",
+		"token":   token,
+	})
+}
+
+// maxRoomPageSize caps ?limit on GET /rooms and GET /rooms/mine
+const maxRoomPageSize = 100
+
+// Handler for getting active rooms. All rooms are returned newest first unless ?limit= (at most
+// maxRoomPageSize) and ?offset= ask for a page; ?sort=participants orders by live participants and
+// ?sort=lastActive by most recent activity, ?createdBy= keeps one creator's rooms and X-Total-Count gives the number of matching rooms.
 func handleGetRooms(ctx *fasthttp.RequestCtx, username string, userID int64) {
-	// Get all rooms from database
-	dbRooms, err := GetAllRooms()
+	writeRoomListing(ctx, RoomListFilter{CreatedBy: string(ctx.QueryArgs().Peek("createdBy"))})
+}
+
+// handleGetOwnRooms lists the rooms the caller created, in the same shape and with the same
+// paging and sorting as GET /rooms
+func handleGetOwnRooms(ctx *fasthttp.RequestCtx, username string, userID int64) {
+	writeRoomListing(ctx, RoomListFilter{CreatorID: userID})
+}
+
+// writeRoomListing answers a room listing request for the rooms matching filter, applying the
+// ?includeEnded=, ?limit=, ?offset= and ?sort= parameters on top of it
+func writeRoomListing(ctx *fasthttp.RequestCtx, filter RoomListFilter) {
+	args := ctx.QueryArgs()
+	// Ended rooms are left out unless asked for
+	filter.IncludeEnded = string(args.Peek("includeEnded")) == "true"
+	if value := string(args.Peek("limit")); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 || n > maxRoomPageSize {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			ctx.SetBodyString(fmt.Sprintf(`{"error":"limit must be between 1 and %d"}`, maxRoomPageSize))
+			return
+		}
+		filter.Limit = n
+	}
+	if value := string(args.Peek("offset")); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			ctx.SetBodyString(`{"error":"offset must not be negative"}`)
+			return
+		}
+		filter.Offset = n
+		if filter.Limit == 0 {
+			filter.Limit = maxRoomPageSize
+		}
+	}
+	sortBy := string(args.Peek("sort"))
+	if sortBy != "" && sortBy != "createdAt" && sortBy != "participants" && sortBy != "lastActive" {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(`{"error":"sort must be createdAt, participants or lastActive"}`)
+		return
+	}
+	filter.ByActivity = sortBy == "lastActive"
+
+	// Participants are only known in memory, so that order is applied to every matching room here
+	query := filter
+	if sortBy == "participants" {
+		query.Limit, query.Offset = 0, 0
+	}
+	listings, total, err := ListRooms(query)
 	if err != nil {
 		logMessage("ERROR", "Error fetching rooms: %v", err)
 		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
 		ctx.SetBodyString(`{"error":"error fetching rooms"}`)
 		return
 	}
+	// Live participants come from memory, only after the database work is done
+	participants := liveParticipantCounts()
+	if sortBy == "participants" {
+		sort.SliceStable(listings, func(i, j int) bool {
+			return participants[listings[i].ID] > participants[listings[j].ID]
+		})
+		if filter.Offset >= len(listings) {
+			listings = nil
+		} else {
+			listings = listings[filter.Offset:]
+		}
+		if filter.Limit > 0 && len(listings) > filter.Limit {
+			listings = listings[:filter.Limit]
+		}
+	}
 
 	// Convert to response format
 	type roomResponse struct {
-		ID        string    `json:"id"`
-		CreatedBy string    `json:"createdBy"`
-		CreatedAt time.Time `json:"createdAt"`
+		ID             string     `json:"id"`
+		Name           string     `json:"name,omitempty"`
+		Description    string     `json:"description,omitempty"`
+		CreatedBy      string     `json:"createdBy"`
+		CreatedAt      time.Time  `json:"createdAt"`
+		AllowAnonymous bool       `json:"allowAnonymous"`
+		ReadOnly       bool       `json:"readOnly"`
+		SystemMessages bool       `json:"systemMessages"`
+		WaitingRoom    bool       `json:"waitingRoom"`
+		EndedAt        *time.Time `json:"endedAt,omitempty"`
+		LastActiveAt   *time.Time `json:"lastActiveAt,omitempty"`
+
+		ParticipantCount int  `json:"participantCount"`
+		IsActive         bool `json:"isActive"` // Whether anyone is connected right now
+		Locked           bool `json:"locked"`   // Whether joiners can't walk straight in: ended, or behind a waiting room
 	}
 
 	rooms := []roomResponse{}
-	for _, dbRoom := range dbRooms {
-		// Get creator's username
-		creator, err := GetUserByID(dbRoom.CreatedBy)
-		if err != nil {
-			logMessage("ERROR", "Error fetching room creator: %v", err)
-			continue
-		}
-
-		if creator == nil {
-			logMessage("WARN", "Room creator not found for room %s", dbRoom.ID)
-			continue
-		}
-
+	for _, listing := range listings {
 		rooms = append(rooms, roomResponse{
-			ID:        dbRoom.ID,
-			CreatedBy: creator.Username,
-			CreatedAt: dbRoom.CreatedAt,
+			ID:             listing.ID,
+			Name:           listing.Name,
+			Description:    listing.Description,
+			CreatedBy:      listing.CreatorName,
+			CreatedAt:      listing.CreatedAt,
+			AllowAnonymous: listing.AllowAnonymous,
+			ReadOnly:       listing.ReadOnly,
+			SystemMessages: listing.SystemMessages,
+			WaitingRoom:    listing.WaitingRoom,
+			EndedAt:        listing.EndedAt,
+			LastActiveAt:   listing.LastActiveAt,
+
+			ParticipantCount: participants[listing.ID],
+			IsActive:         participants[listing.ID] > 0,
+			Locked:           listing.EndedAt != nil || listing.WaitingRoom,
 		})
 	}
 
 	responseJSON, _ := json.Marshal(rooms)
+	ctx.Response.Header.Set("X-Total-Count", strconv.Itoa(total))
 	ctx.SetContentType("application/json")
 	ctx.SetBody(responseJSON)
 }
 
 // Add a new room to active rooms and database
-func addActiveRoom(roomID string, createdBy string, userID int64) {
+func addActiveRoom(roomID string, createdBy string, userID int64, waitingRoom bool) {
 	// Add to in-memory active rooms (for WebSocket connections)
 	room := ActiveRoom{
 		ID:        roomID,
@@ -426,11 +1391,19 @@ func addActiveRoom(roomID string, createdBy string, userID int64) {
 	activeRooms.Store(roomID, room)
 
 	// Add to database
-	_, err := CreateRoom(roomID, userID)
+	_, err := CreateRoom(&DbRoom{
+		ID:             roomID,
+		CreatedBy:      userID,
+		AllowAnonymous: true,
+		WaitingRoom:    waitingRoom,
+	})
 	if err != nil {
 		logMessage("ERROR", "Error adding room to database: %v", err)
 		return
 	}
+	if _, err := assignJoinCode(roomID); err != nil {
+		logMessage("ERROR", "Error assigning a join code to room %s: %v", roomID, err)
+	}
 
 	logMessage("INFO", "New active room added: %s created by %s (ID: %d)", roomID, createdBy, userID)
 }
@@ -0,0 +1,529 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/valyala/fasthttp"
+)
+
+// register signs a user up through the API
+func register(username, password, email string) *fasthttp.RequestCtx {
+	return doRequest("POST", "/register", "", map[string]string{"username": username, "password": password, "email": email})
+}
+
+func TestRegisterValidatesEmail(t *testing.T) {
+	setupTestDB(t)
+
+	for _, email := range []string{"alice", "alice@", "@example.com", "alice@localhost", "Alice <alice@example.com>", "alice@example.com\n"} {
+		if ctx := register("alice", "password", email); ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+			t.Errorf("registering with %q: got %d, want 400", email, ctx.Response.StatusCode())
+		}
+	}
+
+	if ctx := register("alice", "password", "alice@example.com"); ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	if ctx := register("bob", "password", "alice@example.com"); ctx.Response.StatusCode() != fasthttp.StatusConflict {
+		t.Fatalf("reusing alice's email: got %d, want 409", ctx.Response.StatusCode())
+	}
+
+	// Nor can it be taken over from the profile
+	_, bobToken := createTestUser(t, "bob")
+	if ctx := doRequest("PUT", "/users/bob/profile", bobToken, map[string]string{"email": "alice@example.com"}); ctx.Response.StatusCode() != fasthttp.StatusConflict {
+		t.Fatalf("changing to alice's email: got %d, want 409", ctx.Response.StatusCode())
+	}
+}
+
+func TestVerifyEmailToken(t *testing.T) {
+	setupTestDB(t)
+	user, err := CreateUser("alice", hashPassword("password"), "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	verify := func(token string) int {
+		return doRequest("POST", "/verify-email", "", map[string]string{"token": token}).Response.StatusCode()
+	}
+
+	token, err := generateEmailToken(user.ID, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := verify(token[:len(token)-2] + "xx"); code != fasthttp.StatusBadRequest {
+		t.Errorf("tampered token: got %d, want 400", code)
+	}
+	if code := verify(token); code != fasthttp.StatusOK {
+		t.Fatalf("valid token: got %d", code)
+	}
+	if found, _ := GetUserByID(user.ID); !found.EmailVerified {
+		t.Fatal("email not marked verified")
+	}
+
+	// A token for an address the user has since changed is stale
+	stale, _ := generateEmailToken(user.ID, "old@example.com")
+	if code := verify(stale); code != fasthttp.StatusBadRequest {
+		t.Errorf("token for another address: got %d, want 400", code)
+	}
+}
+
+// /forgot-password answers the same whether or not the account exists
+func TestForgotPasswordDoesNotEnumerate(t *testing.T) {
+	setupTestDB(t)
+	if _, err := CreateUser("alice", hashPassword("password"), "alice@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	var bodies []string
+	for _, req := range []map[string]string{
+		{"username": "alice"}, {"username": "nobody"},
+		{"email": "alice@example.com"}, {"email": "nobody@example.com"},
+	} {
+		ctx := doRequest("POST", "/forgot-password", "", req)
+		if ctx.Response.StatusCode() != fasthttp.StatusOK {
+			t.Fatalf("%v: got %d", req, ctx.Response.StatusCode())
+		}
+		bodies = append(bodies, string(ctx.Response.Body()))
+	}
+	for _, body := range bodies[1:] {
+		if body != bodies[0] {
+			t.Fatalf("responses differ: %q vs %q", bodies[0], body)
+		}
+	}
+
+	var resets int
+	if err := dbQueryRow("SELECT COUNT(*) FROM password_resets").Scan(&resets); err != nil {
+		t.Fatal(err)
+	}
+	if resets != 2 {
+		t.Fatalf("%d reset tokens issued, want 2 for the existing account", resets)
+	}
+}
+
+func TestResetPasswordToken(t *testing.T) {
+	setupTestDB(t)
+	userID, session := createTestUser(t, "alice")
+	reset := func(token, password string) int {
+		return doRequest("POST", "/reset-password", "", map[string]string{"token": token, "newPassword": password}).Response.StatusCode()
+	}
+
+	if err := CreatePasswordReset(userID, hashResetToken("expired"), time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if code := reset("expired", "new-password"); code != fasthttp.StatusBadRequest {
+		t.Errorf("expired token: got %d, want 400", code)
+	}
+
+	if err := CreatePasswordReset(userID, hashResetToken("fresh"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if code := reset("fresh", "new-password"); code != fasthttp.StatusOK {
+		t.Fatalf("valid token: got %d", code)
+	}
+	if user, _ := GetUserByID(userID); !verifyPassword("new-password", user.Password) {
+		t.Fatal("password wasn't changed")
+	}
+	if _, err := validateToken(session); err == nil {
+		t.Error("a session signed in before the reset still works")
+	}
+
+	// Each token works once
+	if code := reset("fresh", "other-password"); code != fasthttp.StatusBadRequest {
+		t.Errorf("reused token: got %d, want 400", code)
+	}
+	if user, _ := GetUserByID(userID); !verifyPassword("new-password", user.Password) {
+		t.Fatal("a reused token changed the password")
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	setupTestDB(t)
+	userID, token := createTestUser(t, "alice")
+	otherDevice, err := generateToken("alice", userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	change := func(token, current, next string, logout bool) *fasthttp.RequestCtx {
+		return doRequest("POST", "/users/alice/password", token, map[string]interface{}{
+			"currentPassword": current, "newPassword": next, "logout": logout,
+		})
+	}
+
+	if ctx := change(token, "wrong", "new-password", false); ctx.Response.StatusCode() != fasthttp.StatusUnauthorized {
+		t.Errorf("wrong current password: got %d, want 401", ctx.Response.StatusCode())
+	}
+	if ctx := change(token, "password", "1234567", false); ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+		t.Errorf("weak new password: got %d, want 400", ctx.Response.StatusCode())
+	}
+	if user, _ := GetUserByID(userID); !verifyPassword("password", user.Password) {
+		t.Fatal("a rejected change altered the password")
+	}
+
+	// Every other session is signed out; the caller carries on with the token handed back
+	ctx := change(token, "password", "new-password", false)
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	var resp struct {
+		Token string `json:"token"`
+	}
+	decodeBody(t, ctx, &resp)
+	if user, _ := GetUserByID(userID); !verifyPassword("new-password", user.Password) {
+		t.Fatal("password wasn't changed")
+	}
+	for name, old := range map[string]string{"the caller's old token": token, "another session's token": otherDevice} {
+		if _, err := validateToken(old); err == nil {
+			t.Errorf("%s still works after the password change", name)
+		}
+	}
+	if _, err := validateToken(resp.Token); err != nil {
+		t.Fatalf("the token issued with the change doesn't work: %v", err)
+	}
+
+	// Asking to log out too hands back no token at all
+	ctx = change(resp.Token, "new-password", "newer-password", true)
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	resp.Token = ""
+	decodeBody(t, ctx, &resp)
+	if resp.Token != "" {
+		t.Error("a token was issued after asking to log out")
+	}
+}
+
+// Registration, reset and change all hold passwords to the same minimum length
+func TestPasswordMinimumLength(t *testing.T) {
+	setupTestDB(t)
+	short := strings.Repeat("x", minPasswordLength-1)
+	if ctx := register("alice", short, ""); ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+		t.Errorf("registering with a %d character password: got %d, want 400", len(short), ctx.Response.StatusCode())
+	}
+	if ctx := register("alice", short+"x", ""); ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("registering with a %d character password: got %d %s", len(short)+1, ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+
+	user, err := GetUserByUsername("alice")
+	if err != nil || user == nil {
+		t.Fatalf("alice = %+v, %v", user, err)
+	}
+	if err := CreatePasswordReset(user.ID, hashResetToken("reset"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	ctx := doRequest("POST", "/reset-password", "", map[string]string{"token": "reset", "newPassword": short})
+	if ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+		t.Errorf("resetting to a %d character password: got %d, want 400", len(short), ctx.Response.StatusCode())
+	}
+}
+
+// A logged-out token stays rejected after a restart empties the in-memory blacklist
+func TestRevocationSurvivesRestart(t *testing.T) {
+	setupTestDB(t)
+	_, token := createTestUser(t, "alice")
+	_, other := createTestUser(t, "bob")
+
+	if _, err := validateToken(token); err != nil {
+		t.Fatal(err)
+	}
+	if ctx := doRequest("POST", "/logout", token, nil); ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("logout: got %d", ctx.Response.StatusCode())
+	}
+	if _, err := validateToken(token); err == nil {
+		t.Fatal("logged-out token still valid")
+	}
+
+	resetServerState()
+	if _, err := validateToken(token); err == nil {
+		t.Fatal("logged-out token valid again after a restart")
+	}
+
+	// Once a token has been checked, the database isn't asked again
+	if _, err := validateToken(other); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dbExec("DROP TABLE revoked_tokens"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := validateToken(other); err != nil {
+		t.Fatalf("checked token went back to the database: %v", err)
+	}
+}
+
+// Expired revocations are forgotten, while tokens that could still be used stay blacked out
+func TestPurgeExpiredTokens(t *testing.T) {
+	setupTestDB(t)
+	_, token := createTestUser(t, "alice")
+	revokeToken(token)
+
+	tokenBlacklist.Store("long-expired-token", time.Now().Add(-time.Minute))
+	if err := RevokeToken("long-expired-jti", time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	purgeExpiredTokens(time.Now())
+
+	if _, ok := tokenBlacklist.Load("long-expired-token"); ok {
+		t.Error("expired token still in the blacklist")
+	}
+	if revoked, err := IsTokenRevoked("long-expired-jti"); err != nil || revoked {
+		t.Errorf("expired token still revoked in the database (%v)", err)
+	}
+	if _, ok := tokenBlacklist.Load(token); !ok {
+		t.Error("unexpired revoked token dropped from the blacklist")
+	}
+	if _, err := validateToken(token); err == nil {
+		t.Error("unexpired revoked token accepted after the purge")
+	}
+}
+
+func TestTURNCredentialVectors(t *testing.T) {
+	for _, tc := range []struct {
+		secret, user string
+		expiry       int64
+		username     string
+		password     string
+	}{
+		{"north", "42", 1700000000, "1700000000:42", "DWX3FI7DiPIpadEYQAZsnZBAagI="},
+		{"static-auth-secret", "anonymous-guest", 1234567890, "1234567890:anonymous-guest", "ysmZP1atlqKlkMW4SUa97ng/0Rc="},
+	} {
+		username, password := generateTURNCredentials(tc.secret, tc.user, time.Unix(tc.expiry, 0))
+		if username != tc.username || password != tc.password {
+			t.Errorf("generateTURNCredentials(%q, %q) = %q, %q; want %q, %q", tc.secret, tc.user, username, password, tc.username, tc.password)
+		}
+	}
+}
+
+// coturnAccepts checks credentials the way coturn does with static-auth-secret
+func coturnAccepts(secret, username, password string) bool {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return hmac.Equal([]byte(base64.StdEncoding.EncodeToString(mac.Sum(nil))), []byte(password))
+}
+
+func TestTURNCredentialsRejectTampering(t *testing.T) {
+	username, password := generateTURNCredentials("north", "42", time.Unix(1700000000, 0))
+	if !coturnAccepts("north", username, password) {
+		t.Fatal("genuine credentials rejected")
+	}
+
+	// Stretching the expiry, posing as another user, or guessing the password all fail
+	for _, tampered := range []string{"1900000000:42", "1700000000:1"} {
+		if coturnAccepts("north", tampered, password) {
+			t.Errorf("tampered username %q accepted", tampered)
+		}
+	}
+	if coturnAccepts("north", username, "A"+password[1:]) {
+		t.Error("tampered password accepted")
+	}
+	if coturnAccepts("south", username, password) {
+		t.Error("credentials accepted with another secret")
+	}
+}
+
+func TestTURNCredentialsEndpoint(t *testing.T) {
+	setupTestDB(t)
+	userID, token := createTestUser(t, "alice")
+
+	if ctx := doRequest("GET", "/turn-credentials", token, nil); ctx.Response.StatusCode() != fasthttp.StatusServiceUnavailable {
+		t.Fatalf("without TURN configured: got %d, want 503", ctx.Response.StatusCode())
+	}
+
+	t.Setenv("TURN_SECRET", "north")
+	t.Setenv("TURN_URIS", "turn:turn.monkeychat.test:3478")
+	t.Setenv("TURN_CREDENTIAL_TTL", "1h")
+	ctx := doRequest("GET", "/turn-credentials", token, nil)
+	var resp struct {
+		IceServers []ICEServer `json:"iceServers"`
+		TTLSeconds int64       `json:"ttlSeconds"`
+	}
+	decodeBody(t, ctx, &resp)
+	if len(resp.IceServers) == 0 || resp.TTLSeconds != 3600 {
+		t.Fatalf("response = %+v", resp)
+	}
+	turn := resp.IceServers[len(resp.IceServers)-1]
+	if !strings.HasSuffix(turn.Username, fmt.Sprintf(":%d", userID)) || !coturnAccepts("north", turn.Username, turn.Credential) {
+		t.Fatalf("TURN server entry %+v doesn't verify", turn)
+	}
+}
+
+// Tokens are only good in the environment that issued them
+func TestTokenAudiencePerEnvironment(t *testing.T) {
+	setupTestDB(t)
+	userID, _ := createTestUser(t, "alice")
+
+	t.Setenv("ENV", "staging")
+	stagingToken, err := generateToken("alice", userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := validateToken(stagingToken); err != nil {
+		t.Fatalf("staging rejected its own token: %v", err)
+	}
+
+	t.Setenv("ENV", "production")
+	if _, err := validateToken(stagingToken); err == nil || !strings.Contains(err.Error(), "different environment") {
+		t.Fatalf("production accepted a staging token (%v)", err)
+	}
+	if ctx := doRequest("GET", "/me/rooms", stagingToken, nil); ctx.Response.StatusCode() != fasthttp.StatusUnauthorized {
+		t.Fatalf("staging token on a production API: got %d, want 401", ctx.Response.StatusCode())
+	}
+	prodToken, _ := generateToken("alice", userID)
+	if _, err := validateToken(prodToken); err != nil {
+		t.Fatalf("production rejected its own token: %v", err)
+	}
+}
+
+// useRSAKeys switches token signing to RS256 with a fresh key pair, returning the public key PEM
+func useRSAKeys(t *testing.T) []byte {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER})
+
+	saved := tokenKeys
+	t.Cleanup(func() { tokenKeys = saved })
+	t.Setenv("JWT_ALGORITHM", "RS256")
+	t.Setenv("JWT_PUBLIC_KEY", string(publicPEM))
+	t.Setenv("JWT_PRIVATE_KEY", string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})))
+	if err := loadTokenKeys(); err != nil {
+		t.Fatal(err)
+	}
+	return publicPEM
+}
+
+func TestRS256Tokens(t *testing.T) {
+	setupTestDB(t)
+	userID, _ := createTestUser(t, "alice")
+	publicPEM := useRSAKeys(t)
+
+	tokenString, err := generateToken("alice", userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := jwt.NewParser().ParseUnverified(tokenString, &Claims{})
+	if err != nil || token.Method.Alg() != "RS256" {
+		t.Fatalf("token signed with %v (%v), want RS256", token.Header["alg"], err)
+	}
+	claims, err := validateToken(tokenString)
+	if err != nil || claims.UserID != userID {
+		t.Fatalf("validateToken = %+v, %v", claims, err)
+	}
+
+	// The same claims signed with HMAC, using the public key as the secret, must not pass
+	forged, err := jwt.NewWithClaims(jwt.SigningMethodHS256, token.Claims).SignedString(publicPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := validateToken(forged); err == nil {
+		t.Fatal("accepted an HS256 token signed with the RSA public key")
+	}
+	unsigned, err := jwt.NewWithClaims(jwt.SigningMethodNone, token.Claims).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := validateToken(unsigned); err == nil {
+		t.Fatal("accepted an unsigned token")
+	}
+}
+
+// A server holding only the public key verifies tokens but can't issue them
+func TestRS256VerifyOnly(t *testing.T) {
+	setupTestDB(t)
+	userID, _ := createTestUser(t, "alice")
+	useRSAKeys(t)
+	tokenString, err := generateToken("alice", userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("JWT_PRIVATE_KEY", "")
+	if err := loadTokenKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := validateToken(tokenString); err != nil {
+		t.Fatalf("verify-only server rejected a valid token: %v", err)
+	}
+	if _, err := generateToken("alice", userID); err == nil {
+		t.Fatal("verify-only server issued a token")
+	}
+}
+
+func TestRevokeAllSessions(t *testing.T) {
+	setupTestDB(t)
+	t.Setenv("TOKEN_VERSION_CACHE_TTL", "1h")
+	ln := startTestServer(t)
+	userID, token := createTestUser(t, "alice")
+	otherDevice, err := generateToken("alice", userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Validating caches the current token version
+	for _, tok := range []string{token, otherDevice} {
+		if _, err := validateToken(tok); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client := dialTestClient(t, ln, otherDevice)
+	client.join("revoke-room", "alice")
+
+	ctx := doRequest("POST", "/auth/revoke-all", token, nil)
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("revoke-all: got %d %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	var resp struct {
+		Token string `json:"token"`
+	}
+	decodeBody(t, ctx, &resp)
+
+	// The cached version is dropped right away, so old tokens fail despite the long TTL
+	for _, tok := range []string{token, otherDevice} {
+		if _, err := validateToken(tok); err == nil {
+			t.Fatal("a token issued before revoke-all is still accepted")
+		}
+		if ctx := doRequest("GET", "/me/rooms", tok, nil); ctx.Response.StatusCode() != fasthttp.StatusUnauthorized {
+			t.Fatalf("old token on the API: got %d, want 401", ctx.Response.StatusCode())
+		}
+	}
+	client.expect("session-revoked")
+	client.expectClosed()
+
+	if ctx := doRequest("GET", "/me/rooms", resp.Token, nil); ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("new token: got %d %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+}
+
+// A revoke-all on another server is noticed here once the cached version expires
+func TestTokenVersionCacheTTL(t *testing.T) {
+	setupTestDB(t)
+	t.Setenv("TOKEN_VERSION_CACHE_TTL", "100ms")
+	userID, token := createTestUser(t, "alice")
+	if _, err := validateToken(token); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := BumpTokenVersion(userID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := validateToken(token); err != nil {
+		t.Fatalf("token rejected while its version was still cached: %v", err)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if _, err := validateToken(token); err == nil {
+		t.Fatal("token accepted after the cached version expired")
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cloudinary/cloudinary-go/v2"
+	"github.com/valyala/fasthttp"
+)
+
+// testImage encodes a blank PNG of the given size
+func testImage(t *testing.T, width, height int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// uploadAvatar posts an image as username's profile picture, saving uploads under a temporary directory
+func uploadAvatar(t *testing.T, username, token string, data []byte) *fasthttp.RequestCtx {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("image", "avatar.png")
+	part.Write(data)
+	form.Close()
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetMethod("POST")
+	ctx.Request.SetRequestURI("/users/" + username + "/upload-profile-pic")
+	ctx.Request.Header.Set("Authorization", "Bearer "+token)
+	ctx.Request.Header.SetContentType(form.FormDataContentType())
+	ctx.Request.SetBody(body.Bytes())
+	authMiddleware(routeRequest)(ctx)
+	return ctx
+}
+
+// savedAvatarSize decodes the dimensions of an avatar saved to local storage
+func savedAvatarSize(t *testing.T, ctx *fasthttp.RequestCtx) (int, int) {
+	t.Helper()
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("upload got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	var resp struct {
+		URL string `json:"url"`
+	}
+	decodeBody(t, ctx, &resp)
+	data, err := os.ReadFile(filepath.Join("uploads", strings.TrimPrefix(resp.URL, "/uploads/")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg.Width, cfg.Height
+}
+
+// chdirTemp moves into a fresh directory for the test, so local uploads don't land in the tree
+func chdirTemp(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestSquareAvatarPolicy(t *testing.T) {
+	setupTestDB(t)
+	chdirTemp(t)
+	_, token := createTestUser(t, "alice")
+
+	t.Setenv("AVATAR_SQUARE_POLICY", "crop")
+	if w, h := savedAvatarSize(t, uploadAvatar(t, "alice", token, testImage(t, 32, 32))); w != 32 || h != 32 {
+		t.Errorf("square avatar saved as %dx%d, want 32x32", w, h)
+	}
+	if w, h := savedAvatarSize(t, uploadAvatar(t, "alice", token, testImage(t, 40, 20))); w != 20 || h != 20 {
+		t.Errorf("40x20 avatar cropped to %dx%d, want 20x20", w, h)
+	}
+
+	t.Setenv("AVATAR_SQUARE_POLICY", "reject")
+	if ctx := uploadAvatar(t, "alice", token, testImage(t, 40, 20)); ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+		t.Errorf("non-square avatar under the reject policy: got %d, want 400", ctx.Response.StatusCode())
+	}
+}
+
+// fakeCloudinary serves uploads locally, failing the first few requests with a server error
+func fakeCloudinary(t *testing.T, failures int) (*cloudinary.Cloudinary, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if int(calls.Add(1)) <= failures {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":{"message":"try again later"}}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"secure_url":"https://res.cloudinary.test/avatar.png"}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	cld, err := cloudinary.NewFromParams("monkeychat", "key", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cld.Upload.Config.API.UploadPrefix = srv.URL
+	return cld, &calls
+}
+
+func TestCloudinaryUploadRetries(t *testing.T) {
+	t.Setenv("CLOUDINARY_MAX_ATTEMPTS", "3")
+	t.Setenv("CLOUDINARY_RETRY_BACKOFF", "1ms")
+
+	cld, calls := fakeCloudinary(t, 2)
+	url, err := uploadToCloudinary(context.Background(), cld, testImage(t, 8, 8), "alice")
+	if err != nil || url != "https://res.cloudinary.test/avatar.png" {
+		t.Fatalf("upload = %q, %v", url, err)
+	}
+	if calls.Load() != 3 {
+		t.Fatalf("%d attempts, want 3", calls.Load())
+	}
+
+	// Out of attempts, the last error is reported
+	cld, calls = fakeCloudinary(t, 3)
+	if _, err := uploadToCloudinary(context.Background(), cld, testImage(t, 8, 8), "alice"); err == nil {
+		t.Fatal("upload succeeded after every attempt failed")
+	}
+	if calls.Load() != 3 {
+		t.Fatalf("%d attempts, want 3", calls.Load())
+	}
+}
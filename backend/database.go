@@ -1,15 +1,34 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
 )
 
-var db *sql.DB
+var (
+	db *sql.DB
+
+	// dbDriver is the database/sql driver in use: "mysql" (MySQL/TiDB) or "postgres"
+	dbDriver = "mysql"
+
+	// pingDatabase checks the database is reachable; a variable so health checks can be exercised
+	// without a real database
+	pingDatabase = func(ctx context.Context) error {
+		if db == nil {
+			return errors.New("database not initialized")
+		}
+		return db.PingContext(ctx)
+	}
+)
 
 // DbUser represents a user record in the database
 type DbUser struct {
@@ -19,21 +38,99 @@ type DbUser struct {
 	Bio        string    `json:"bio"`
 	ProfilePic string    `json:"profilePic"`
 	CreatedAt  time.Time `json:"createdAt"`
+
+	Email         string `json:"email,omitempty"` // Empty when the user hasn't set one
+	EmailVerified bool   `json:"emailVerified"`
+
+	DND     bool `json:"dnd"`     // Do not disturb: invites addressed to the user are refused
+	IsAdmin bool `json:"isAdmin"` // May read server logs and other operator endpoints
+
+	TokenVersion int `json:"-"` // Login tokens carrying an older version are no longer accepted
 }
 
 // DbRoom represents a room record in the database
 type DbRoom struct {
-	ID        string    `json:"id"`
-	CreatedBy int64     `json:"createdBy"` // Foreign key to users.id
+	ID              string     `json:"id"`
+	Name            string     `json:"name,omitempty"`        // Optional display name
+	Description     string     `json:"description,omitempty"` // Optional longer description
+	CreatedBy       int64      `json:"createdBy"`             // Foreign key to users.id
+	CreatedAt       time.Time  `json:"createdAt"`
+	AllowAnonymous  bool       `json:"allowAnonymous"`         // Whether users without an account may join
+	ReadOnly        bool       `json:"readOnly"`               // Whether only the creator may chat
+	SystemMessages  bool       `json:"systemMessages"`         // Whether joins and leaves are announced in the chat
+	WaitingRoom     bool       `json:"waitingRoom"`            // Whether joiners wait for the creator to admit them
+	EndedAt         *time.Time `json:"endedAt,omitempty"`      // Set once the host ended the room for good
+	Ephemeral       bool       `json:"ephemeral"`              // Whether the live room may be dropped from memory once empty
+	Persistent      bool       `json:"persistent"`             // Whether the room is exempt from ROOM_RETENTION
+	SlowModeSeconds int        `json:"slowModeSeconds"`        // Least time between a guest's chat messages; 0 when off
+	LastActiveAt    *time.Time `json:"lastActiveAt,omitempty"` // Last join, leave or chat message; nil if nobody has used the room
+	JoinCode        string     `json:"joinCode,omitempty"`     // Short code for GET /join/{code}; shown to the creator only
+}
+
+// DbRoomBan represents a user banned from a room
+type DbRoomBan struct {
+	RoomID    string    `json:"roomId"`
+	UserID    int64     `json:"userId"`
+	Username  string    `json:"username"`
+	BannedBy  int64     `json:"bannedBy"`
 	CreatedAt time.Time `json:"createdAt"`
 }
 
+// userColumns lists the users columns read by scanUser, in order
+const userColumns = "id, username, password, COALESCE(bio, ''), COALESCE(profile_pic, ''), created_at, COALESCE(email, ''), email_verified, dnd, is_admin, token_version"
+
+// roomColumns lists the rooms columns read by scanRoom, in order
+const roomColumns = "id, name, description, created_by, created_at, allow_anonymous, read_only, system_messages, waiting_room, ended_at, ephemeral, persistent, slow_mode_seconds, last_active_at, join_code"
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanUser reads a user selected with userColumns
+func scanUser(row rowScanner) (*DbUser, error) {
+	var user DbUser
+	if err := row.Scan(&user.ID, &user.Username, &user.Password, &user.Bio, &user.ProfilePic, &user.CreatedAt,
+		&user.Email, &user.EmailVerified, &user.DND, &user.IsAdmin, &user.TokenVersion); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// scanRoom reads a room selected with roomColumns, followed by any extra columns into extra
+func scanRoom(row rowScanner, extra ...interface{}) (*DbRoom, error) {
+	var room DbRoom
+	var endedAt, lastActiveAt sql.NullTime
+	var joinCode sql.NullString
+	dest := []interface{}{&room.ID, &room.Name, &room.Description, &room.CreatedBy, &room.CreatedAt, &room.AllowAnonymous, &room.ReadOnly,
+		&room.SystemMessages, &room.WaitingRoom, &endedAt, &room.Ephemeral, &room.Persistent, &room.SlowModeSeconds, &lastActiveAt, &joinCode}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+	if endedAt.Valid {
+		room.EndedAt = &endedAt.Time
+	}
+	if lastActiveAt.Valid {
+		room.LastActiveAt = &lastActiveAt.Time
+	}
+	room.JoinCode = joinCode.String
+	return &room, nil
+}
+
 // InitDatabase initializes the database connection and creates tables if they don't exist
 func InitDatabase() error {
 	// Check if we're in production or development
 	isProd := os.Getenv("ENV") == "production"
 
 	// Read DB config from environment variables (after godotenv.Load)
+	switch driver := strings.ToLower(os.Getenv("DB_DRIVER")); driver {
+	case "", "mysql":
+		dbDriver = "mysql"
+	case "postgres", "postgresql":
+		dbDriver = "postgres"
+	default:
+		return fmt.Errorf("unsupported DB_DRIVER '%s' (expected mysql or postgres)", driver)
+	}
 	dbUsername := os.Getenv("DB_USERNAME")
 	dbPassword := os.Getenv("DB_PASSWORD")
 	dbHost := os.Getenv("DB_HOST")
@@ -41,16 +138,24 @@ func InitDatabase() error {
 	dbName := os.Getenv("DB_NAME")
 
 	// Log environment variables
-	logMessage("DEBUG", "Database configuration: username=%s, host=%s, port=%s, dbname=%s",
-		dbUsername, dbHost, dbPort, dbName)
+	logMessage("DEBUG", "Database configuration: driver=%s, username=%s, host=%s, port=%s, dbname=%s",
+		dbDriver, dbUsername, dbHost, dbPort, dbName)
 
-	// Configure DSN based on environment
+	// Configure DSN based on driver and environment
 	var dsn string
-	if isProd {
+	switch {
+	case dbDriver == "postgres":
+		sslMode := "disable"
+		if isProd {
+			sslMode = "require"
+		}
+		dsn = fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
+			dbHost, dbPort, dbUsername, dbPassword, dbName, sslMode)
+	case isProd:
 		// Production: Use TiDB Cloud with TLS
 		dsn = fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true&tls=skip-verify",
 			dbUsername, dbPassword, dbHost, dbPort, dbName)
-	} else {
+	default:
 		// Development: Use local MySQL
 		dsn = fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true",
 			dbUsername, dbPassword, dbHost, dbPort, dbName)
@@ -65,7 +170,7 @@ func InitDatabase() error {
 
 	var err error
 	logMessage("DEBUG", "Opening database connection...")
-	db, err = sql.Open("mysql", dsn)
+	db, err = sql.Open(dbDriver, dsn)
 	if err != nil {
 		logMessage("ERROR", "Failed to open database connection: %v", err)
 		return fmt.Errorf("error opening database connection: %v", err)
@@ -99,85 +204,95 @@ func InitDatabase() error {
 	}
 	logMessage("INFO", "Connected to %s database in %s environment", dbName, envMsg)
 
-	// Create tables if they don't exist
-	if err = createTables(); err != nil {
-		return fmt.Errorf("error creating tables: %v", err)
+	// Bring the schema up to date
+	if err = runMigrations(); err != nil {
+		return fmt.Errorf("error running migrations: %v", err)
 	}
 
-	// --- AUTO-MIGRATION: Add missing columns if needed ---
-	if err = autoMigrateUsersTable(); err != nil {
-		return fmt.Errorf("error in auto-migration: %v", err)
+	return nil
+}
+
+// rebind rewrites ?-style placeholders into the $1, $2, ... style Postgres expects
+func rebind(query string) string {
+	if dbDriver != "postgres" {
+		return query
 	}
 
-	return nil
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
 }
 
-// createTables creates the necessary tables if they don't exist
-func createTables() error {
-	logMessage("DEBUG", "Creating database tables if they don't exist...")
+// dbExec runs a statement written with ? placeholders against the configured driver
+func dbExec(query string, args ...interface{}) (sql.Result, error) {
+	return db.Exec(rebind(query), args...)
+}
 
-	// Create users table
-	logMessage("DEBUG", "Creating users table...")
-	_, err := db.Exec(`
-		CREATE TABLE IF NOT EXISTS users (
-			id BIGINT NOT NULL AUTO_INCREMENT,
-			username VARCHAR(50) NOT NULL UNIQUE,
-			password VARCHAR(100) NOT NULL,
-			bio TEXT,
-			profile_pic TEXT,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			PRIMARY KEY (id)
-		)
-	`)
-	if err != nil {
-		logMessage("ERROR", "Failed to create users table: %v", err)
-		return fmt.Errorf("error creating users table: %v", err)
+// dbQuery runs a query written with ? placeholders against the configured driver
+func dbQuery(query string, args ...interface{}) (*sql.Rows, error) {
+	return db.Query(rebind(query), args...)
+}
+
+// dbQueryRow runs a single-row query written with ? placeholders against the configured driver
+func dbQueryRow(query string, args ...interface{}) *sql.Row {
+	return db.QueryRow(rebind(query), args...)
+}
+
+// dbInsertReturningID runs an INSERT and returns the generated id column.
+// Postgres has no LastInsertId, so it uses RETURNING instead.
+func dbInsertReturningID(query string, args ...interface{}) (int64, error) {
+	if dbDriver == "postgres" {
+		var id int64
+		err := db.QueryRow(rebind(query)+" RETURNING id", args...).Scan(&id)
+		return id, err
 	}
-	logMessage("DEBUG", "Users table created successfully")
 
-	// Create rooms table
-	logMessage("DEBUG", "Creating rooms table...")
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS rooms (
-			id VARCHAR(50) NOT NULL,
-			created_by BIGINT NOT NULL,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			PRIMARY KEY (id),
-			FOREIGN KEY (created_by) REFERENCES users(id)
-		)
-	`)
+	result, err := db.Exec(query, args...)
 	if err != nil {
-		logMessage("ERROR", "Failed to create rooms table: %v", err)
-		return fmt.Errorf("error creating rooms table: %v", err)
+		return 0, err
 	}
-	logMessage("DEBUG", "Rooms table created successfully")
+	return result.LastInsertId()
+}
 
-	logMessage("INFO", "All database tables created successfully")
-	return nil
+// autoIncrementPK returns the column definition for an auto-incrementing BIGINT primary key
+func autoIncrementPK() string {
+	if dbDriver == "postgres" {
+		return "BIGSERIAL"
+	}
+	return "BIGINT NOT NULL AUTO_INCREMENT"
+}
+
+// currentSchema returns the SQL expression naming the schema our tables live in
+func currentSchema() string {
+	if dbDriver == "postgres" {
+		return "current_schema()"
+	}
+	return "DATABASE()"
 }
 
 // CreateUser creates a new user in the database
-func CreateUser(username, passwordHash string) (*DbUser, error) {
+func CreateUser(username, passwordHash, email string) (*DbUser, error) {
 	logMessage("DEBUG", "Attempting to create user: %s", username)
 
-	result, err := db.Exec(
-		"INSERT INTO users (username, password) VALUES (?, ?)",
+	userID, err := dbInsertReturningID(
+		"INSERT INTO users (username, password, email) VALUES (?, ?, ?)",
 		username,
 		passwordHash,
+		nullableString(email),
 	)
 	if err != nil {
 		logMessage("ERROR", "Failed to execute INSERT query for user '%s': %v", username, err)
 		return nil, fmt.Errorf("error creating user: %v", err)
 	}
 
-	logMessage("DEBUG", "INSERT query executed successfully for user: %s", username)
-
-	userID, err := result.LastInsertId()
-	if err != nil {
-		logMessage("ERROR", "Failed to get last insert ID for user '%s': %v", username, err)
-		return nil, fmt.Errorf("error getting user ID: %v", err)
-	}
-
 	logMessage("DEBUG", "User '%s' inserted with ID: %d", username, userID)
 
 	// Fetch the created user
@@ -194,11 +309,10 @@ func CreateUser(username, passwordHash string) (*DbUser, error) {
 
 // GetUserByUsername retrieves a user by username
 func GetUserByUsername(username string) (*DbUser, error) {
-	var user DbUser
-	err := db.QueryRow(
-		"SELECT id, username, password, COALESCE(bio, ''), COALESCE(profile_pic, ''), created_at FROM users WHERE username = ?",
+	user, err := scanUser(dbQueryRow(
+		"SELECT "+userColumns+" FROM users WHERE username = ?",
 		username,
-	).Scan(&user.ID, &user.Username, &user.Password, &user.Bio, &user.ProfilePic, &user.CreatedAt)
+	))
 
 	if err == sql.ErrNoRows {
 		return nil, nil // User not found, but not an error
@@ -206,16 +320,48 @@ func GetUserByUsername(username string) (*DbUser, error) {
 		return nil, fmt.Errorf("error fetching user: %v", err)
 	}
 
-	return &user, nil
+	return user, nil
+}
+
+// GetUsersByUsernames retrieves the users with the given usernames; unknown names are skipped
+func GetUsersByUsernames(usernames []string) ([]*DbUser, error) {
+	if len(usernames) == 0 {
+		return []*DbUser{}, nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(usernames)), ", ")
+	args := make([]interface{}, len(usernames))
+	for i, username := range usernames {
+		args[i] = username
+	}
+	rows, err := dbQuery("SELECT "+userColumns+" FROM users WHERE username IN ("+placeholders+")", args...)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching users: %v", err)
+	}
+	defer rows.Close()
+
+	users := []*DbUser{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning user row: %v", err)
+		}
+		users = append(users, user)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating user rows: %v", err)
+	}
+
+	return users, nil
 }
 
 // GetUserByID retrieves a user by ID
 func GetUserByID(id int64) (*DbUser, error) {
-	var user DbUser
-	err := db.QueryRow(
-		"SELECT id, username, password, COALESCE(bio, ''), COALESCE(profile_pic, ''), created_at FROM users WHERE id = ?",
+	user, err := scanUser(dbQueryRow(
+		"SELECT "+userColumns+" FROM users WHERE id = ?",
 		id,
-	).Scan(&user.ID, &user.Username, &user.Password, &user.Bio, &user.ProfilePic, &user.CreatedAt)
+	))
 
 	if err == sql.ErrNoRows {
 		return nil, nil // User not found, but not an error
@@ -223,37 +369,307 @@ func GetUserByID(id int64) (*DbUser, error) {
 		return nil, fmt.Errorf("error fetching user: %v", err)
 	}
 
-	return &user, nil
+	return user, nil
 }
 
 // CreateRoom creates a new room in the database
-func CreateRoom(roomID string, userID int64) (*DbRoom, error) {
-	_, err := db.Exec(
-		"INSERT INTO rooms (id, created_by) VALUES (?, ?)",
-		roomID,
-		userID,
+func CreateRoom(room *DbRoom) (*DbRoom, error) {
+	_, err := dbExec(
+		"INSERT INTO rooms (id, name, description, created_by, allow_anonymous, read_only, system_messages, waiting_room, ephemeral) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		room.ID,
+		room.Name,
+		room.Description,
+		room.CreatedBy,
+		room.AllowAnonymous,
+		room.ReadOnly,
+		room.SystemMessages,
+		room.WaitingRoom,
+		room.Ephemeral,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("error creating room: %v", err)
 	}
 
 	// Fetch the created room
-	room, err := GetRoomByID(roomID)
+	created, err := GetRoomByID(room.ID)
 	if err != nil {
 		return nil, fmt.Errorf("error fetching created room: %v", err)
 	}
 
-	logMessage("INFO", "Room created in database: %s (Created by: %d)", roomID, userID)
+	logMessage("INFO", "Room created in database: %s (Created by: %d)", room.ID, room.CreatedBy)
+	return created, nil
+}
+
+// GetUserByEmail retrieves a user by email address
+func GetUserByEmail(email string) (*DbUser, error) {
+	user, err := scanUser(dbQueryRow(
+		"SELECT "+userColumns+" FROM users WHERE email = ?",
+		email,
+	))
+
+	if err == sql.ErrNoRows {
+		return nil, nil // User not found, but not an error
+	} else if err != nil {
+		return nil, fmt.Errorf("error fetching user: %v", err)
+	}
+
+	return user, nil
+}
+
+// SetUserEmail changes a user's email, which then has to be verified again. An empty email clears it.
+func SetUserEmail(userID int64, email string) error {
+	_, err := dbExec("UPDATE users SET email = ?, email_verified = FALSE WHERE id = ?", nullableString(email), userID)
+	if err != nil {
+		return fmt.Errorf("error updating email: %v", err)
+	}
+	return nil
+}
+
+// MarkEmailVerified flags a user's email as verified, provided it is still the given address.
+// It reports whether a row was updated.
+func MarkEmailVerified(userID int64, email string) (bool, error) {
+	result, err := dbExec("UPDATE users SET email_verified = TRUE WHERE id = ? AND email = ?", userID, email)
+	if err != nil {
+		return false, fmt.Errorf("error verifying email: %v", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("error verifying email: %v", err)
+	}
+	return affected > 0, nil
+}
+
+// UpdatePassword replaces a user's password hash
+func UpdatePassword(userID int64, passwordHash string) error {
+	result, err := dbExec("UPDATE users SET password = ? WHERE id = ?", passwordHash, userID)
+	if err != nil {
+		return fmt.Errorf("error updating password: %v", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// CreatePasswordReset stores the hash of a password reset token for a user
+func CreatePasswordReset(userID int64, tokenHash string, expiresAt time.Time) error {
+	_, err := dbExec(
+		"INSERT INTO password_resets (token_hash, user_id, expires_at) VALUES (?, ?, ?)",
+		tokenHash, userID, expiresAt,
+	)
+	if err != nil {
+		return fmt.Errorf("error creating password reset: %v", err)
+	}
+	return nil
+}
+
+// ResetPassword redeems an unused, unexpired reset token and sets the user's new password hash
+// in one transaction, so a token can only ever be used once. It returns sql.ErrNoRows if the
+// token is unknown, expired or already used.
+func ResetPassword(tokenHash, passwordHash string) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	result, err := tx.Exec(
+		rebind("UPDATE password_resets SET used_at = ? WHERE token_hash = ? AND used_at IS NULL AND expires_at > ?"),
+		now, tokenHash, now,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("error redeeming password reset: %v", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return 0, sql.ErrNoRows
+	}
+
+	var userID int64
+	if err := tx.QueryRow(rebind("SELECT user_id FROM password_resets WHERE token_hash = ?"), tokenHash).Scan(&userID); err != nil {
+		return 0, fmt.Errorf("error fetching password reset: %v", err)
+	}
+	if _, err := tx.Exec(rebind("UPDATE users SET password = ? WHERE id = ?"), passwordHash, userID); err != nil {
+		return 0, fmt.Errorf("error updating password: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error committing password reset: %v", err)
+	}
+	return userID, nil
+}
+
+// RevokeToken records a revoked login token's ID until the token expires
+func RevokeToken(jti string, expiresAt time.Time) error {
+	query := "INSERT IGNORE INTO revoked_tokens (jti, expires_at) VALUES (?, ?)"
+	if dbDriver == "postgres" {
+		query = "INSERT INTO revoked_tokens (jti, expires_at) VALUES (?, ?) ON CONFLICT (jti) DO NOTHING"
+	}
+	if _, err := dbExec(query, jti, expiresAt); err != nil {
+		return fmt.Errorf("error revoking token: %v", err)
+	}
+	return nil
+}
+
+// IsTokenRevoked reports whether a login token's ID has been revoked
+func IsTokenRevoked(jti string) (bool, error) {
+	var count int
+	if err := dbQueryRow("SELECT COUNT(*) FROM revoked_tokens WHERE jti = ?", jti).Scan(&count); err != nil {
+		return false, fmt.Errorf("error checking revoked token: %v", err)
+	}
+	return count > 0, nil
+}
+
+// PurgeExpiredRevokedTokens deletes revoked tokens that expired before now, returning how many
+func PurgeExpiredRevokedTokens(now time.Time) (int64, error) {
+	result, err := dbExec("DELETE FROM revoked_tokens WHERE expires_at < ?", now)
+	if err != nil {
+		return 0, fmt.Errorf("error purging revoked tokens: %v", err)
+	}
+	return result.RowsAffected()
+}
+
+// RecordRecordingEvent adds an audit row for a recording being started or stopped in a room
+func RecordRecordingEvent(roomID string, userID int64, action string) error {
+	_, err := dbExec("INSERT INTO recording_events (room_id, user_id, action) VALUES (?, ?, ?)", roomID, userID, action)
+	if err != nil {
+		return fmt.Errorf("error recording recording event: %v", err)
+	}
+	return nil
+}
+
+// TransferRoomOwnership makes toUserID the creator of a room currently owned by fromUserID and
+// records who made the change. Any role the new owner held in the room is dropped, since the
+// creator is always the host. sql.ErrNoRows means the room no longer belongs to fromUserID.
+func TransferRoomOwnership(roomID string, fromUserID, toUserID, byUserID int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(rebind("UPDATE rooms SET created_by = ? WHERE id = ? AND created_by = ?"), toUserID, roomID, fromUserID)
+	if err != nil {
+		return fmt.Errorf("error updating room owner: %v", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	if _, err := tx.Exec(rebind("DELETE FROM room_members WHERE room_id = ? AND user_id = ?"), roomID, toUserID); err != nil {
+		return fmt.Errorf("error removing room role: %v", err)
+	}
+	if _, err := tx.Exec(
+		rebind("INSERT INTO room_transfers (room_id, from_user_id, to_user_id, transferred_by) VALUES (?, ?, ?, ?)"),
+		roomID, fromUserID, toUserID, byUserID,
+	); err != nil {
+		return fmt.Errorf("error recording room transfer: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing room transfer: %v", err)
+	}
+	return nil
+}
+
+// GetRoomByJoinCode retrieves the room a join code belongs to, or nil if no room has it
+func GetRoomByJoinCode(code string) (*DbRoom, error) {
+	room, err := scanRoom(dbQueryRow("SELECT "+roomColumns+" FROM rooms WHERE join_code = ?", code))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error fetching room by join code: %v", err)
+	}
 	return room, nil
 }
 
+// SetRoomJoinCode gives a room a new join code, retiring its old one
+func SetRoomJoinCode(roomID, code string) error {
+	_, err := dbExec("UPDATE rooms SET join_code = ? WHERE id = ?", code, roomID)
+	if err != nil {
+		return fmt.Errorf("error setting join code: %v", err)
+	}
+	return nil
+}
+
+// RoomSession is one stay of a participant in a room, from joining to leaving
+type RoomSession struct {
+	RoomID           string
+	UserID           int64 // 0 for anonymous participants
+	UserName         string
+	JoinedAt         time.Time
+	LeftAt           time.Time
+	Messages         int // Chat messages sent during the stay
+	PeakParticipants int // Most people in the room at once during the stay
+}
+
+// RecordRoomSession saves a finished stay in a room, for its aggregated stats
+func RecordRoomSession(session RoomSession) error {
+	_, err := dbExec(
+		"INSERT INTO room_sessions (room_id, user_id, user_name, joined_at, left_at, seconds, messages, peak_participants) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		session.RoomID, session.UserID, session.UserName, session.JoinedAt, session.LeftAt,
+		int64(session.LeftAt.Sub(session.JoinedAt).Seconds()), session.Messages, session.PeakParticipants,
+	)
+	if err != nil {
+		return fmt.Errorf("error recording room session: %v", err)
+	}
+	return nil
+}
+
+// RoomTotals sums up every stay in a room
+type RoomTotals struct {
+	Messages         int   `json:"messages"`
+	Participants     int   `json:"participants"` // Distinct participants, by user name
+	PeakParticipants int   `json:"peakParticipants"`
+	SessionSeconds   int64 `json:"sessionSeconds"` // Time spent in the room, added up over everyone
+}
+
+// GetRoomTotals sums up the finished stays in a room, also returning the names of everyone who
+// stayed so callers can count distinct participants along with those still in the room
+func GetRoomTotals(roomID string) (RoomTotals, map[string]bool, error) {
+	var totals RoomTotals
+	err := dbQueryRow(
+		"SELECT COALESCE(SUM(messages), 0), COALESCE(MAX(peak_participants), 0), COALESCE(SUM(seconds), 0) FROM room_sessions WHERE room_id = ?",
+		roomID,
+	).Scan(&totals.Messages, &totals.PeakParticipants, &totals.SessionSeconds)
+	if err != nil {
+		return totals, nil, fmt.Errorf("error summing room sessions: %v", err)
+	}
+
+	rows, err := dbQuery("SELECT DISTINCT user_name FROM room_sessions WHERE room_id = ?", roomID)
+	if err != nil {
+		return totals, nil, fmt.Errorf("error fetching room participants: %v", err)
+	}
+	defer rows.Close()
+
+	names := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return totals, nil, fmt.Errorf("error scanning room session row: %v", err)
+		}
+		names[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return totals, nil, fmt.Errorf("error iterating room session rows: %v", err)
+	}
+	totals.Participants = len(names)
+	return totals, names, nil
+}
+
+// nullableString stores empty strings as NULL, so optional unique columns don't collide on empty values
+func nullableString(value string) interface{} {
+	if value == "" {
+		return nil
+	}
+	return value
+}
+
 // GetRoomByID retrieves a room by ID
 func GetRoomByID(roomID string) (*DbRoom, error) {
-	var room DbRoom
-	err := db.QueryRow(
-		"SELECT id, created_by, created_at FROM rooms WHERE id = ?",
+	room, err := scanRoom(dbQueryRow(
+		"SELECT "+roomColumns+" FROM rooms WHERE id = ?",
 		roomID,
-	).Scan(&room.ID, &room.CreatedBy, &room.CreatedAt)
+	))
 
 	if err == sql.ErrNoRows {
 		return nil, nil // Room not found, but not an error
@@ -261,13 +677,13 @@ func GetRoomByID(roomID string) (*DbRoom, error) {
 		return nil, fmt.Errorf("error fetching room: %v", err)
 	}
 
-	return &room, nil
+	return room, nil
 }
 
 // GetRoomsByUserID retrieves all rooms created by a specific user
 func GetRoomsByUserID(userID int64) ([]*DbRoom, error) {
-	rows, err := db.Query(
-		"SELECT id, created_by, created_at FROM rooms WHERE created_by = ?",
+	rows, err := dbQuery(
+		"SELECT "+roomColumns+" FROM rooms WHERE created_by = ?",
 		userID,
 	)
 	if err != nil {
@@ -277,11 +693,11 @@ func GetRoomsByUserID(userID int64) ([]*DbRoom, error) {
 
 	var rooms []*DbRoom
 	for rows.Next() {
-		var room DbRoom
-		if err := rows.Scan(&room.ID, &room.CreatedBy, &room.CreatedAt); err != nil {
+		room, err := scanRoom(rows)
+		if err != nil {
 			return nil, fmt.Errorf("error scanning room row: %v", err)
 		}
-		rooms = append(rooms, &room)
+		rooms = append(rooms, room)
 	}
 
 	if err := rows.Err(); err != nil {
@@ -291,90 +707,757 @@ func GetRoomsByUserID(userID int64) ([]*DbRoom, error) {
 	return rooms, nil
 }
 
-// GetAllRooms retrieves all rooms
-func GetAllRooms() ([]*DbRoom, error) {
-	rows, err := db.Query("SELECT id, created_by, created_at FROM rooms")
+// CountRoomsByUserID returns how many rooms a user has created
+func CountRoomsByUserID(userID int64) (int, error) {
+	var count int
+	err := dbQueryRow("SELECT COUNT(*) FROM rooms WHERE created_by = ?", userID).Scan(&count)
 	if err != nil {
-		return nil, fmt.Errorf("error fetching all rooms: %v", err)
+		return 0, fmt.Errorf("error counting user's rooms: %v", err)
+	}
+	return count, nil
+}
+
+// CountRooms returns how many rooms are saved
+func CountRooms() (int, error) {
+	var count int
+	if err := dbQueryRow("SELECT COUNT(*) FROM rooms").Scan(&count); err != nil {
+		return 0, fmt.Errorf("error counting rooms: %v", err)
+	}
+	return count, nil
+}
+
+// RoomListFilter narrows and pages the rooms returned by ListRooms
+type RoomListFilter struct {
+	CreatedBy    string // Creator's username; empty for every creator
+	CreatorID    int64  // Creator's user ID; 0 for every creator
+	IncludeEnded bool   // Whether rooms ended by their host are included
+	ByActivity   bool   // Most recently active first, rather than newest first
+	Limit        int    // At most this many rooms; 0 for all of them
+	Offset       int
+}
+
+// RoomListing is a room along with its creator's username
+type RoomListing struct {
+	*DbRoom
+	CreatorName string
+}
+
+// ListRooms returns one page of rooms matching filter, newest first, along with how many rooms
+// match in total. Rooms whose creator no longer exists are left out.
+func ListRooms(filter RoomListFilter) ([]*RoomListing, int, error) {
+	where := " FROM rooms r JOIN users u ON u.id = r.created_by WHERE 1 = 1"
+	var args []interface{}
+	if filter.CreatedBy != "" {
+		where += " AND u.username = ?"
+		args = append(args, filter.CreatedBy)
+	}
+	if filter.CreatorID != 0 {
+		where += " AND r.created_by = ?"
+		args = append(args, filter.CreatorID)
+	}
+	if !filter.IncludeEnded {
+		where += " AND r.ended_at IS NULL"
+	}
+
+	var total int
+	if err := dbQueryRow("SELECT COUNT(*)"+where, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("error counting rooms: %v", err)
+	}
+
+	order := " ORDER BY r.created_at DESC, r.id"
+	if filter.ByActivity {
+		order = " ORDER BY COALESCE(r.last_active_at, r.created_at) DESC, r.id"
+	}
+	query := "SELECT r." + strings.ReplaceAll(roomColumns, ", ", ", r.") + ", u.username" + where + order
+	if filter.Limit > 0 {
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, filter.Limit, filter.Offset)
+	}
+	rows, err := dbQuery(query, args...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error listing rooms: %v", err)
 	}
 	defer rows.Close()
 
-	var rooms []*DbRoom
+	var listings []*RoomListing
 	for rows.Next() {
-		var room DbRoom
-		if err := rows.Scan(&room.ID, &room.CreatedBy, &room.CreatedAt); err != nil {
+		var listing RoomListing
+		room, err := scanRoom(rows, &listing.CreatorName)
+		if err != nil {
+			return nil, 0, fmt.Errorf("error scanning room row: %v", err)
+		}
+		listing.DbRoom = room
+		listings = append(listings, &listing)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("error iterating room rows: %v", err)
+	}
+
+	return listings, total, nil
+}
+
+// GetOrphanedRoomIDs returns the IDs of rooms whose creator no longer exists
+func GetOrphanedRoomIDs() ([]string, error) {
+	rows, err := dbQuery("SELECT r.id FROM rooms r LEFT JOIN users u ON u.id = r.created_by WHERE u.id IS NULL")
+	if err != nil {
+		return nil, fmt.Errorf("error fetching orphaned rooms: %v", err)
+	}
+	defer rows.Close()
+
+	var roomIDs []string
+	for rows.Next() {
+		var roomID string
+		if err := rows.Scan(&roomID); err != nil {
 			return nil, fmt.Errorf("error scanning room row: %v", err)
 		}
-		rooms = append(rooms, &room)
+		roomIDs = append(roomIDs, roomID)
 	}
 
 	if err := rows.Err(); err != nil {
 		return nil, fmt.Errorf("error iterating room rows: %v", err)
 	}
 
-	return rooms, nil
+	return roomIDs, nil
+}
+
+// ReassignRoom makes another user the creator of a room
+func ReassignRoom(roomID string, userID int64) error {
+	_, err := dbExec("UPDATE rooms SET created_by = ? WHERE id = ?", userID, roomID)
+	if err != nil {
+		return fmt.Errorf("error reassigning room: %v", err)
+	}
+	return nil
+}
+
+// GetRoomRoles returns the roles handed out in a room, by user ID
+func GetRoomRoles(roomID string) (map[int64]string, error) {
+	rows, err := dbQuery("SELECT user_id, role FROM room_members WHERE room_id = ?", roomID)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching room roles: %v", err)
+	}
+	defer rows.Close()
+
+	roles := make(map[int64]string)
+	for rows.Next() {
+		var userID int64
+		var role string
+		if err := rows.Scan(&userID, &role); err != nil {
+			return nil, fmt.Errorf("error scanning room member row: %v", err)
+		}
+		roles[userID] = role
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating room member rows: %v", err)
+	}
+
+	return roles, nil
+}
+
+// SetRoomRole gives a user a role in a room; an empty role removes it
+func SetRoomRole(roomID string, userID int64, role string) error {
+	if role == "" {
+		if _, err := dbExec("DELETE FROM room_members WHERE room_id = ? AND user_id = ?", roomID, userID); err != nil {
+			return fmt.Errorf("error removing room role: %v", err)
+		}
+		return nil
+	}
+
+	query := "INSERT INTO room_members (room_id, user_id, role) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE role = VALUES(role)"
+	if dbDriver == "postgres" {
+		query = "INSERT INTO room_members (room_id, user_id, role) VALUES (?, ?, ?) ON CONFLICT (room_id, user_id) DO UPDATE SET role = EXCLUDED.role"
+	}
+	if _, err := dbExec(query, roomID, userID, role); err != nil {
+		return fmt.Errorf("error setting room role: %v", err)
+	}
+	return nil
+}
+
+// BanUser bans a user from a room; banning someone already banned is not an error
+func BanUser(roomID string, userID, bannedBy int64) error {
+	query := "INSERT IGNORE INTO room_bans (room_id, user_id, banned_by) VALUES (?, ?, ?)"
+	if dbDriver == "postgres" {
+		query = "INSERT INTO room_bans (room_id, user_id, banned_by) VALUES (?, ?, ?) ON CONFLICT (room_id, user_id) DO NOTHING"
+	}
+	if _, err := dbExec(query, roomID, userID, bannedBy); err != nil {
+		return fmt.Errorf("error banning user: %v", err)
+	}
+	return nil
+}
+
+// UnbanUser lifts a ban, reporting whether there was one
+func UnbanUser(roomID string, userID int64) (bool, error) {
+	result, err := dbExec("DELETE FROM room_bans WHERE room_id = ? AND user_id = ?", roomID, userID)
+	if err != nil {
+		return false, fmt.Errorf("error unbanning user: %v", err)
+	}
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
+
+// IsUserBanned reports whether a user is banned from a room
+func IsUserBanned(roomID string, userID int64) (bool, error) {
+	var count int
+	err := dbQueryRow("SELECT COUNT(*) FROM room_bans WHERE room_id = ? AND user_id = ?", roomID, userID).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("error checking room ban: %v", err)
+	}
+	return count > 0, nil
 }
 
-// DeleteRoom deletes a room by ID
+// GetRoomBans lists the users banned from a room, oldest ban first
+func GetRoomBans(roomID string) ([]*DbRoomBan, error) {
+	rows, err := dbQuery(
+		"SELECT b.room_id, b.user_id, u.username, b.banned_by, b.created_at FROM room_bans b "+
+			"JOIN users u ON u.id = b.user_id WHERE b.room_id = ? ORDER BY b.created_at",
+		roomID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching room bans: %v", err)
+	}
+	defer rows.Close()
+
+	bans := []*DbRoomBan{}
+	for rows.Next() {
+		var ban DbRoomBan
+		if err := rows.Scan(&ban.RoomID, &ban.UserID, &ban.Username, &ban.BannedBy, &ban.CreatedAt); err != nil {
+			return nil, fmt.Errorf("error scanning room ban row: %v", err)
+		}
+		bans = append(bans, &ban)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating room ban rows: %v", err)
+	}
+
+	return bans, nil
+}
+
+// UpdateRoomSettings saves a room's creator-controlled settings
+func UpdateRoomSettings(room *DbRoom) error {
+	_, err := dbExec("UPDATE rooms SET allow_anonymous = ?, read_only = ?, system_messages = ?, persistent = ?, slow_mode_seconds = ? WHERE id = ?",
+		room.AllowAnonymous, room.ReadOnly, room.SystemMessages, room.Persistent, room.SlowModeSeconds, room.ID)
+	if err != nil {
+		return fmt.Errorf("error updating room settings: %v", err)
+	}
+	return nil
+}
+
+// UpdateRoomDetails saves a room's name and description
+func UpdateRoomDetails(room *DbRoom) error {
+	_, err := dbExec("UPDATE rooms SET name = ?, description = ? WHERE id = ?", room.Name, room.Description, room.ID)
+	if err != nil {
+		return fmt.Errorf("error updating room details: %v", err)
+	}
+	return nil
+}
+
+// MarkRoomEnded records that a room's host ended it, keeping the room itself
+func MarkRoomEnded(roomID string) error {
+	_, err := dbExec("UPDATE rooms SET ended_at = CURRENT_TIMESTAMP WHERE id = ?", roomID)
+	if err != nil {
+		return fmt.Errorf("error marking room ended: %v", err)
+	}
+	return nil
+}
+
+// DeleteRoom deletes a room by ID, along with its bans
 func DeleteRoom(roomID string) error {
-	_, err := db.Exec("DELETE FROM rooms WHERE id = ?", roomID)
+	tx, err := db.Begin()
 	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(rebind("DELETE FROM room_bans WHERE room_id = ?"), roomID); err != nil {
+		return fmt.Errorf("error deleting room bans: %v", err)
+	}
+	if _, err := tx.Exec(rebind("DELETE FROM room_members WHERE room_id = ?"), roomID); err != nil {
+		return fmt.Errorf("error deleting room members: %v", err)
+	}
+	if _, err := tx.Exec(rebind("DELETE FROM room_sessions WHERE room_id = ?"), roomID); err != nil {
+		return fmt.Errorf("error deleting room sessions: %v", err)
+	}
+	if _, err := tx.Exec(rebind("DELETE FROM rooms WHERE id = ?"), roomID); err != nil {
 		return fmt.Errorf("error deleting room: %v", err)
 	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing room deletion: %v", err)
+	}
 
 	logMessage("INFO", "Room deleted from database: %s", roomID)
 	return nil
 }
 
+// UpdateRoomActivity records activity in a room at the given time: a join, a leave or a chat
+// message. The time comes from the server rather than the database clock, since expiry compares
+// it against cutoffs computed here.
+func UpdateRoomActivity(roomID string, at time.Time) error {
+	_, err := dbExec("UPDATE rooms SET last_active_at = ? WHERE id = ?", at, roomID)
+	if err != nil {
+		return fmt.Errorf("error updating room activity: %v", err)
+	}
+	return nil
+}
+
+// expiredRoomCondition matches rooms that aren't persistent and have seen no activity since
+// the cutoff, counting from creation for rooms nobody has used
+const expiredRoomCondition = "persistent = FALSE AND COALESCE(last_active_at, created_at) < ?"
+
+// GetExpiredRoomIDs returns the IDs of rooms idle since before cutoff
+func GetExpiredRoomIDs(cutoff time.Time) ([]string, error) {
+	rows, err := dbQuery("SELECT id FROM rooms WHERE "+expiredRoomCondition, cutoff)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching expired rooms: %v", err)
+	}
+	defer rows.Close()
+
+	var roomIDs []string
+	for rows.Next() {
+		var roomID string
+		if err := rows.Scan(&roomID); err != nil {
+			return nil, fmt.Errorf("error scanning expired room row: %v", err)
+		}
+		roomIDs = append(roomIDs, roomID)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating expired room rows: %v", err)
+	}
+
+	return roomIDs, nil
+}
+
+// DeleteExpiredRoom deletes a room along with its bans and roles, but only if it is still idle
+// since before cutoff, reporting whether it was deleted
+func DeleteExpiredRoom(roomID string, cutoff time.Time) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(rebind("DELETE FROM rooms WHERE id = ? AND "+expiredRoomCondition), roomID, cutoff)
+	if err != nil {
+		return false, fmt.Errorf("error deleting expired room: %v", err)
+	}
+	if deleted, err := result.RowsAffected(); err != nil || deleted == 0 {
+		return false, err
+	}
+	if _, err := tx.Exec(rebind("DELETE FROM room_bans WHERE room_id = ?"), roomID); err != nil {
+		return false, fmt.Errorf("error deleting room bans: %v", err)
+	}
+	if _, err := tx.Exec(rebind("DELETE FROM room_members WHERE room_id = ?"), roomID); err != nil {
+		return false, fmt.Errorf("error deleting room members: %v", err)
+	}
+	if _, err := tx.Exec(rebind("DELETE FROM room_sessions WHERE room_id = ?"), roomID); err != nil {
+		return false, fmt.Errorf("error deleting room sessions: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("error committing room deletion: %v", err)
+	}
+	return true, nil
+}
+
 // UpdateUserProfile updates a user's profile by username
 func UpdateUserProfile(oldUsername, newUsername, bio, profilePic string) error {
-	_, err := db.Exec("UPDATE users SET username = ?, bio = ?, profile_pic = ? WHERE username = ?", newUsername, bio, profilePic, oldUsername)
+	_, err := dbExec("UPDATE users SET username = ?, bio = ?, profile_pic = ? WHERE username = ?", newUsername, bio, profilePic, oldUsername)
 	return err
 }
 
-// autoMigrateUsersTable checks and adds missing columns to the users table
-func autoMigrateUsersTable() error {
-	columns := []struct {
-		Name       string
-		Definition string
-	}{
-		{"bio", "TEXT"},
-		{"profile_pic", "TEXT"},
+// SetUserDND turns a user's do-not-disturb preference on or off
+func SetUserDND(userID int64, dnd bool) error {
+	_, err := dbExec("UPDATE users SET dnd = ? WHERE id = ?", dnd, userID)
+	if err != nil {
+		return fmt.Errorf("error updating notification preferences: %v", err)
+	}
+	return nil
+}
+
+// BumpTokenVersion invalidates every login token issued to a user so far, returning the new version
+func BumpTokenVersion(userID int64) (int, error) {
+	if _, err := dbExec("UPDATE users SET token_version = token_version + 1 WHERE id = ?", userID); err != nil {
+		return 0, fmt.Errorf("error bumping token version: %v", err)
+	}
+	var version int
+	if err := dbQueryRow("SELECT token_version FROM users WHERE id = ?", userID).Scan(&version); err != nil {
+		return 0, fmt.Errorf("error reading token version: %v", err)
+	}
+	return version, nil
+}
+
+// SetUserAdmin grants or revokes a user's admin role
+func SetUserAdmin(userID int64, admin bool) error {
+	_, err := dbExec("UPDATE users SET is_admin = ? WHERE id = ?", admin, userID)
+	if err != nil {
+		return fmt.Errorf("error updating admin role: %v", err)
+	}
+	return nil
+}
+
+// DeleteUser removes a user and everything that depends on it (their rooms) in one transaction,
+// returning the IDs of the rooms that were deleted so callers can drop them from memory
+func DeleteUser(userID int64) ([]string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(rebind("SELECT id FROM rooms WHERE created_by = ?"), userID)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching user's rooms: %v", err)
+	}
+	var roomIDs []string
+	for rows.Next() {
+		var roomID string
+		if err := rows.Scan(&roomID); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("error scanning room row: %v", err)
+		}
+		roomIDs = append(roomIDs, roomID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating room rows: %v", err)
+	}
+
+	if _, err := tx.Exec(rebind("DELETE FROM room_bans WHERE user_id = ? OR room_id IN (SELECT id FROM rooms WHERE created_by = ?)"), userID, userID); err != nil {
+		return nil, fmt.Errorf("error deleting room bans: %v", err)
+	}
+	if _, err := tx.Exec(rebind("DELETE FROM room_members WHERE user_id = ? OR room_id IN (SELECT id FROM rooms WHERE created_by = ?)"), userID, userID); err != nil {
+		return nil, fmt.Errorf("error deleting room members: %v", err)
+	}
+	if _, err := tx.Exec(rebind("DELETE FROM room_sessions WHERE room_id IN (SELECT id FROM rooms WHERE created_by = ?)"), userID); err != nil {
+		return nil, fmt.Errorf("error deleting room sessions: %v", err)
+	}
+	if _, err := tx.Exec(rebind("DELETE FROM rooms WHERE created_by = ?"), userID); err != nil {
+		return nil, fmt.Errorf("error deleting user's rooms: %v", err)
+	}
+	if _, err := tx.Exec(rebind("DELETE FROM password_resets WHERE user_id = ?"), userID); err != nil {
+		return nil, fmt.Errorf("error deleting user's password resets: %v", err)
+	}
+	result, err := tx.Exec(rebind("DELETE FROM users WHERE id = ?"), userID)
+	if err != nil {
+		return nil, fmt.Errorf("error deleting user: %v", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error committing user deletion: %v", err)
 	}
-	for _, col := range columns {
-		var exists int
-		query := `SELECT COUNT(*) FROM INFORMATION_SCHEMA.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'users' AND COLUMN_NAME = ?`
-		err := db.QueryRow(query, col.Name).Scan(&exists)
+
+	logMessage("INFO", "User %d deleted from database along with %d rooms", userID, len(roomIDs))
+	return roomIDs, nil
+}
+
+// Migration is a single schema change. Apply must be idempotent so a migration that failed
+// half way (MySQL can't roll back DDL) can safely be retried on the next start.
+type Migration struct {
+	Version     int
+	Description string
+	Apply       func() error
+}
+
+// migrations is the ordered schema history. Append new entries; never edit or reorder applied ones.
+var migrations = []Migration{
+	{1, "create users table", func() error {
+		_, err := db.Exec(fmt.Sprintf(`
+			CREATE TABLE IF NOT EXISTS users (
+				id %s,
+				username VARCHAR(50) NOT NULL UNIQUE,
+				password VARCHAR(100) NOT NULL,
+				bio TEXT,
+				profile_pic TEXT,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				PRIMARY KEY (id)
+			)
+		`, autoIncrementPK()))
+		return err
+	}},
+	{2, "create rooms table", func() error {
+		_, err := db.Exec(`
+			CREATE TABLE IF NOT EXISTS rooms (
+				id VARCHAR(50) NOT NULL,
+				created_by BIGINT NOT NULL,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				PRIMARY KEY (id),
+				FOREIGN KEY (created_by) REFERENCES users(id)
+			)
+		`)
+		return err
+	}},
+	{3, "add users.bio and users.profile_pic", func() error {
+		// Databases created from setup_database.sql predate these columns
+		if err := addColumnIfMissing("users", "bio", "TEXT"); err != nil {
+			return err
+		}
+		return addColumnIfMissing("users", "profile_pic", "TEXT")
+	}},
+	{4, "make users.bio and users.profile_pic nullable", func() error {
+		for _, col := range []string{"bio", "profile_pic"} {
+			alter := fmt.Sprintf("ALTER TABLE users MODIFY COLUMN %s TEXT", col)
+			if dbDriver == "postgres" {
+				alter = fmt.Sprintf("ALTER TABLE users ALTER COLUMN %s DROP NOT NULL", col)
+			}
+			if _, err := db.Exec(alter); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{5, "add rooms.allow_anonymous", func() error {
+		return addColumnIfMissing("rooms", "allow_anonymous", "BOOLEAN NOT NULL DEFAULT TRUE")
+	}},
+	{6, "add rooms.read_only", func() error {
+		return addColumnIfMissing("rooms", "read_only", "BOOLEAN NOT NULL DEFAULT FALSE")
+	}},
+	{7, "add users.email and users.email_verified", func() error {
+		if err := addColumnIfMissing("users", "email", "VARCHAR(255) UNIQUE"); err != nil {
+			return err
+		}
+		return addColumnIfMissing("users", "email_verified", "BOOLEAN NOT NULL DEFAULT FALSE")
+	}},
+	{8, "create password_resets table", func() error {
+		_, err := db.Exec(`
+			CREATE TABLE IF NOT EXISTS password_resets (
+				token_hash VARCHAR(64) NOT NULL,
+				user_id BIGINT NOT NULL,
+				expires_at TIMESTAMP NOT NULL,
+				used_at TIMESTAMP NULL,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				PRIMARY KEY (token_hash),
+				FOREIGN KEY (user_id) REFERENCES users(id)
+			)
+		`)
+		return err
+	}},
+	{9, "create revoked_tokens table", func() error {
+		_, err := db.Exec(`
+			CREATE TABLE IF NOT EXISTS revoked_tokens (
+				jti VARCHAR(64) NOT NULL,
+				expires_at TIMESTAMP NOT NULL,
+				PRIMARY KEY (jti)
+			)
+		`)
+		return err
+	}},
+	{10, "create recording_events table", func() error {
+		// No foreign keys: the audit trail outlives deleted rooms and users
+		_, err := db.Exec(fmt.Sprintf(`
+			CREATE TABLE IF NOT EXISTS recording_events (
+				id %s,
+				room_id VARCHAR(50) NOT NULL,
+				user_id BIGINT NOT NULL,
+				action VARCHAR(32) NOT NULL,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				PRIMARY KEY (id)
+			)
+		`, autoIncrementPK()))
+		return err
+	}},
+	{11, "add rooms.system_messages", func() error {
+		return addColumnIfMissing("rooms", "system_messages", "BOOLEAN NOT NULL DEFAULT FALSE")
+	}},
+	{12, "create room_bans table", func() error {
+		_, err := db.Exec(`
+			CREATE TABLE IF NOT EXISTS room_bans (
+				room_id VARCHAR(50) NOT NULL,
+				user_id BIGINT NOT NULL,
+				banned_by BIGINT NOT NULL,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				PRIMARY KEY (room_id, user_id),
+				FOREIGN KEY (room_id) REFERENCES rooms(id) ON DELETE CASCADE,
+				FOREIGN KEY (user_id) REFERENCES users(id)
+			)
+		`)
+		return err
+	}},
+	{13, "add rooms.waiting_room", func() error {
+		return addColumnIfMissing("rooms", "waiting_room", "BOOLEAN NOT NULL DEFAULT FALSE")
+	}},
+	{14, "create room_members table", func() error {
+		_, err := db.Exec(`
+			CREATE TABLE IF NOT EXISTS room_members (
+				room_id VARCHAR(50) NOT NULL,
+				user_id BIGINT NOT NULL,
+				role VARCHAR(16) NOT NULL,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				PRIMARY KEY (room_id, user_id),
+				FOREIGN KEY (room_id) REFERENCES rooms(id) ON DELETE CASCADE,
+				FOREIGN KEY (user_id) REFERENCES users(id)
+			)
+		`)
+		return err
+	}},
+	{15, "add rooms.ended_at", func() error {
+		return addColumnIfMissing("rooms", "ended_at", "TIMESTAMP NULL")
+	}},
+	{16, "add rooms.name", func() error {
+		return addColumnIfMissing("rooms", "name", "VARCHAR(100) NOT NULL DEFAULT ''")
+	}},
+	{17, "add users.dnd", func() error {
+		return addColumnIfMissing("users", "dnd", "BOOLEAN NOT NULL DEFAULT FALSE")
+	}},
+	{18, "add rooms.ephemeral", func() error {
+		return addColumnIfMissing("rooms", "ephemeral", "BOOLEAN NOT NULL DEFAULT FALSE")
+	}},
+	{19, "add users.is_admin", func() error {
+		return addColumnIfMissing("users", "is_admin", "BOOLEAN NOT NULL DEFAULT FALSE")
+	}},
+	{20, "add rooms.description", func() error {
+		return addColumnIfMissing("rooms", "description", "VARCHAR(500) NOT NULL DEFAULT ''")
+	}},
+	{21, "add users.token_version", func() error {
+		return addColumnIfMissing("users", "token_version", "INT NOT NULL DEFAULT 0")
+	}},
+	{22, "add rooms.last_active_at and rooms.persistent", func() error {
+		if err := addColumnIfMissing("rooms", "last_active_at", "TIMESTAMP NULL"); err != nil {
+			return err
+		}
+		return addColumnIfMissing("rooms", "persistent", "BOOLEAN NOT NULL DEFAULT FALSE")
+	}},
+	{23, "create room_transfers table", func() error {
+		// No foreign keys: like recording_events, the audit trail outlives deleted rooms and users
+		_, err := db.Exec(fmt.Sprintf(`
+			CREATE TABLE IF NOT EXISTS room_transfers (
+				id %s,
+				room_id VARCHAR(50) NOT NULL,
+				from_user_id BIGINT NOT NULL,
+				to_user_id BIGINT NOT NULL,
+				transferred_by BIGINT NOT NULL,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				PRIMARY KEY (id)
+			)
+		`, autoIncrementPK()))
+		return err
+	}},
+	{24, "add rooms.slow_mode_seconds", func() error {
+		return addColumnIfMissing("rooms", "slow_mode_seconds", "INT NOT NULL DEFAULT 0")
+	}},
+	{25, "create room_sessions table", func() error {
+		_, err := db.Exec(fmt.Sprintf(`
+			CREATE TABLE IF NOT EXISTS room_sessions (
+				id %s,
+				room_id VARCHAR(50) NOT NULL,
+				user_id BIGINT NOT NULL,
+				user_name VARCHAR(50) NOT NULL,
+				joined_at TIMESTAMP NOT NULL,
+				left_at TIMESTAMP NOT NULL,
+				seconds BIGINT NOT NULL,
+				messages INT NOT NULL,
+				peak_participants INT NOT NULL,
+				PRIMARY KEY (id)
+			)
+		`, autoIncrementPK()))
+		return err
+	}},
+	{26, "add rooms.join_code", func() error {
+		if err := addColumnIfMissing("rooms", "join_code", "VARCHAR(6) UNIQUE"); err != nil {
+			return err
+		}
+		// Rooms created before join codes get one too
+		rows, err := db.Query("SELECT id FROM rooms WHERE join_code IS NULL")
 		if err != nil {
-			return fmt.Errorf("error checking for column '%s': %v", col.Name, err)
+			return err
 		}
-		if exists == 0 {
-			alter := fmt.Sprintf("ALTER TABLE users ADD COLUMN %s %s", col.Name, col.Definition)
-			_, err := db.Exec(alter)
-			if err != nil {
-				return fmt.Errorf("error adding '%s' column: %v", col.Name, err)
+		var roomIDs []string
+		for rows.Next() {
+			var roomID string
+			if err := rows.Scan(&roomID); err != nil {
+				rows.Close()
+				return err
 			}
-			logMessage("INFO", "Added missing column '%s' to users table", col.Name)
-		} else {
-			// Column exists, check if it's nullable and fix if needed
-			logMessage("DEBUG", "Column '%s' already exists, checking if it needs to be made nullable", col.Name)
-			var isNullable string
-			nullQuery := `SELECT IS_NULLABLE FROM INFORMATION_SCHEMA.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'users' AND COLUMN_NAME = ?`
-			err := db.QueryRow(nullQuery, col.Name).Scan(&isNullable)
-			if err != nil {
-				logMessage("WARN", "Could not check nullability of column '%s': %v", col.Name, err)
-			} else if isNullable == "NO" {
-				// Column is NOT NULL, make it nullable
-				logMessage("INFO", "Making column '%s' nullable", col.Name)
-				alter := fmt.Sprintf("ALTER TABLE users MODIFY COLUMN %s %s", col.Name, col.Definition)
-				_, err := db.Exec(alter)
-				if err != nil {
-					logMessage("ERROR", "Failed to modify column '%s' to be nullable: %v", col.Name, err)
-				} else {
-					logMessage("INFO", "Successfully modified column '%s' to be nullable", col.Name)
-				}
+			roomIDs = append(roomIDs, roomID)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, roomID := range roomIDs {
+			if _, err := assignJoinCode(roomID); err != nil {
+				return err
 			}
 		}
+		return nil
+	}},
+}
+
+// runMigrations applies every migration not yet recorded in the migrations table, in order
+func runMigrations() error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS migrations (
+			version INT NOT NULL,
+			description VARCHAR(255) NOT NULL,
+			applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (version)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating migrations table: %v", err)
+	}
+
+	rows, err := db.Query("SELECT version FROM migrations")
+	if err != nil {
+		return fmt.Errorf("error reading applied migrations: %v", err)
+	}
+	applied := make(map[int]bool)
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			rows.Close()
+			return fmt.Errorf("error scanning migration row: %v", err)
+		}
+		applied[version] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating migration rows: %v", err)
+	}
+
+	for _, m := range migrations {
+		if applied[m.Version] {
+			continue
+		}
+
+		logMessage("INFO", "Applying migration %d: %s", m.Version, m.Description)
+		if err := m.Apply(); err != nil {
+			logMessage("ERROR", "Migration %d failed: %v", m.Version, err)
+			return fmt.Errorf("error applying migration %d (%s): %v", m.Version, m.Description, err)
+		}
+
+		if _, err := dbExec("INSERT INTO migrations (version, description) VALUES (?, ?)", m.Version, m.Description); err != nil {
+			return fmt.Errorf("error recording migration %d: %v", m.Version, err)
+		}
+	}
+
+	logMessage("INFO", "Database schema is up to date (%d migrations)", len(migrations))
+	return nil
+}
+
+// columnExists reports whether table has the named column
+func columnExists(table, column string) (bool, error) {
+	var exists int
+	query := `SELECT COUNT(*) FROM INFORMATION_SCHEMA.COLUMNS WHERE TABLE_SCHEMA = ` + currentSchema() + ` AND TABLE_NAME = ? AND COLUMN_NAME = ?`
+	if err := dbQueryRow(query, table, column).Scan(&exists); err != nil {
+		return false, fmt.Errorf("error checking for column '%s.%s': %v", table, column, err)
+	}
+	return exists > 0, nil
+}
+
+// addColumnIfMissing adds a column to a table unless it's already there
+func addColumnIfMissing(table, column, definition string) error {
+	exists, err := columnExists(table, column)
+	if err != nil || exists {
+		return err
+	}
+
+	if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return fmt.Errorf("error adding '%s.%s' column: %v", table, column, err)
 	}
+	logMessage("INFO", "Added missing column '%s' to %s table", column, table)
 	return nil
 }
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+// failPing makes database pings fail until the test ends
+func failPing(t *testing.T) {
+	t.Helper()
+	saved := pingDatabase
+	t.Cleanup(func() { pingDatabase = saved })
+	pingDatabase = func(ctx context.Context) error { return errors.New("connection refused") }
+}
+
+type healthStatus struct {
+	Status            string  `json:"status"`
+	DB                string  `json:"db"`
+	Uptime            float64 `json:"uptime"`
+	ActiveRooms       int     `json:"activeRooms"`
+	ActiveConnections int64   `json:"activeConnections"`
+}
+
+func TestHealth(t *testing.T) {
+	setupTestDB(t)
+	ln := startTestServer(t)
+	alice, _ := dialTestUser(t, ln, "alice")
+	alice.join("health-room", "alice")
+
+	ctx := doRequest("GET", "/health", "", nil)
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("healthy: got %d %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	var health healthStatus
+	decodeBody(t, ctx, &health)
+	if health.Status != "ok" || health.DB != "ok" || health.Uptime <= 0 || health.ActiveRooms != 1 || health.ActiveConnections != 1 {
+		t.Fatalf("healthy status = %+v", health)
+	}
+
+	failPing(t)
+	ctx = doRequest("GET", "/health", "", nil)
+	if ctx.Response.StatusCode() != fasthttp.StatusServiceUnavailable {
+		t.Fatalf("database down: got %d, want 503", ctx.Response.StatusCode())
+	}
+	health = healthStatus{}
+	decodeBody(t, ctx, &health)
+	if health.Status != "unavailable" || health.DB != "unreachable" {
+		t.Fatalf("database down status = %+v", health)
+	}
+}
+
+func TestLivenessAndReadiness(t *testing.T) {
+	setupTestDB(t)
+	defer ready.Store(ready.Load())
+	ready.Store(false)
+
+	status := func(path string) int {
+		return doRequest("GET", path, "", nil).Response.StatusCode()
+	}
+
+	// Still starting up: alive, but not ready for traffic
+	if code := status("/livez"); code != fasthttp.StatusOK {
+		t.Fatalf("/livez during startup: got %d, want 200", code)
+	}
+	if code := status("/readyz"); code != fasthttp.StatusServiceUnavailable {
+		t.Fatalf("/readyz during startup: got %d, want 503", code)
+	}
+
+	// main marks the server ready once migrations have run and auth is set up
+	if err := runMigrations(); err != nil {
+		t.Fatal(err)
+	}
+	ready.Store(true)
+	if code := status("/readyz"); code != fasthttp.StatusOK {
+		t.Fatalf("/readyz after startup: got %d, want 200", code)
+	}
+
+	failPing(t)
+	if code := status("/readyz"); code != fasthttp.StatusServiceUnavailable {
+		t.Fatalf("/readyz with the database down: got %d, want 503", code)
+	}
+	if code := status("/livez"); code != fasthttp.StatusOK {
+		t.Fatalf("/livez with the database down: got %d, want 200", code)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// createTestInvite issues an invite for roomID through the API
+func createTestInvite(t *testing.T, roomID, token string, singleUse bool) string {
+	t.Helper()
+	ctx := doRequest("POST", "/rooms/"+roomID+"/invite", token, map[string]interface{}{"singleUse": singleUse})
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("creating invite: got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	var resp struct {
+		Invite string `json:"invite"`
+	}
+	decodeBody(t, ctx, &resp)
+	return resp.Invite
+}
+
+func TestInviteTokens(t *testing.T) {
+	setupTestDB(t)
+	aliceID, aliceToken := createTestUser(t, "alice")
+	_, bobToken := createTestUser(t, "bob")
+	createTestRoom(t, "private", aliceID)
+
+	if ctx := doRequest("POST", "/rooms/private/invite", bobToken, nil); ctx.Response.StatusCode() != fasthttp.StatusForbidden {
+		t.Fatalf("non-creator invite: got %d, want 403", ctx.Response.StatusCode())
+	}
+
+	invite := createTestInvite(t, "private", aliceToken, false)
+	if ctx := doRequest("GET", "/rooms/join?invite="+invite, "", nil); ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("valid invite: got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+
+	// A tampered signature, an expired invite or a login token don't pass
+	tampered := invite[:len(invite)-2] + "xx"
+	expired, _, err := generateInviteToken("private", "alice", -time.Minute, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, token := range map[string]string{"tampered": tampered, "expired": expired, "login token": aliceToken} {
+		if _, err := validateInviteToken(token); err == nil {
+			t.Errorf("%s invite validated", name)
+		}
+		if ctx := doRequest("GET", "/rooms/join?invite="+token, "", nil); ctx.Response.StatusCode() != fasthttp.StatusUnauthorized {
+			t.Errorf("%s invite: got %d, want 401", name, ctx.Response.StatusCode())
+		}
+	}
+}
+
+// A single-use invite lets one anonymous user into a closed room, and nobody after them
+func TestSingleUseInvite(t *testing.T) {
+	setupTestDB(t)
+	ln := startTestServer(t)
+	aliceID, aliceToken := createTestUser(t, "alice")
+	createTestRoom(t, "private", aliceID)
+	invite := createTestInvite(t, "private", aliceToken, true)
+
+	guest := dialTestClient(t, ln, "")
+	guest.send("join", "private", UserInfo{UserName: "guest"})
+	guest.expect("auth-required")
+
+	guest.send("join", "private", UserInfo{UserName: "guest", Invite: invite})
+	guest.expect("joined")
+
+	other := dialTestClient(t, ln, "")
+	other.send("join", "private", UserInfo{UserName: "other", Invite: invite})
+	other.expect("invite-invalid")
+	if ctx := doRequest("GET", "/rooms/join?invite="+invite, "", nil); ctx.Response.StatusCode() != fasthttp.StatusUnauthorized {
+		t.Errorf("redeemed invite: got %d, want 401", ctx.Response.StatusCode())
+	}
+}
+
+func TestInviteRespectsDoNotDisturb(t *testing.T) {
+	setupTestDB(t)
+	ln := startTestServer(t)
+	aliceID, aliceToken := createTestUser(t, "alice")
+	createTestRoom(t, "standup", aliceID)
+	_, bobToken := createTestUser(t, "bob")
+	_, carolToken := createTestUser(t, "carol")
+	bob := dialTestClient(t, ln, bobToken)
+	carol := dialTestClient(t, ln, carolToken)
+	// Joining somewhere makes sure both sockets are registered before invites go out
+	bob.join("lobby", "bob")
+	carol.join("lobby", "carol")
+
+	if ctx := doRequest("PUT", "/users/carol/preferences", carolToken, map[string]bool{"dnd": true}); ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("enabling dnd: got %d %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	ctx := doRequest("POST", "/rooms/standup/invite", aliceToken, map[string]string{"invitee": "carol"})
+	if ctx.Response.StatusCode() != fasthttp.StatusConflict || !strings.Contains(string(ctx.Response.Body()), "user-unavailable") {
+		t.Fatalf("invite to a dnd user: got %d %s, want 409 user-unavailable", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	carol.expectNone("room-invite", 200*time.Millisecond)
+
+	ctx = doRequest("POST", "/rooms/standup/invite", aliceToken, map[string]string{"invitee": "bob"})
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("invite to bob: got %d %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	var delivered struct {
+		FromUserName string `json:"fromUserName"`
+		Invite       struct {
+			RoomID string `json:"roomId"`
+		} `json:"invite"`
+	}
+	payloadOf(t, bob.expect("room-invite"), &delivered)
+	if delivered.FromUserName != "alice" || delivered.Invite.RoomID != "standup" {
+		t.Fatalf("bob's invite = %+v", delivered)
+	}
+
+	// Once carol is available again she can be invited
+	doRequest("PUT", "/users/carol/preferences", carolToken, map[string]bool{"dnd": false})
+	if ctx := doRequest("POST", "/rooms/standup/invite", aliceToken, map[string]string{"invitee": "carol"}); ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("invite after dnd was lifted: got %d %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	carol.expect("room-invite")
+}
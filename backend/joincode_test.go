@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestJoinCodeAlphabet(t *testing.T) {
+	for _, ambiguous := range "01OIL" {
+		if strings.ContainsRune(joinCodeAlphabet, ambiguous) {
+			t.Errorf("join code alphabet contains %q", ambiguous)
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		if code := generateJoinCode(); !joinCodePattern.MatchString(code) {
+			t.Fatalf("generated join code %q", code)
+		}
+	}
+}
+
+// Every room gets its own code, and the unique column refuses to hand one out twice
+func TestJoinCodesUnique(t *testing.T) {
+	setupTestDB(t)
+	aliceID, _ := createTestUser(t, "alice")
+
+	codes := make(map[string]string)
+	for i := 0; i < 50; i++ {
+		roomID := fmt.Sprintf("room-%d", i)
+		createTestRoom(t, roomID, aliceID)
+		code, err := assignJoinCode(roomID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if other, taken := codes[code]; taken {
+			t.Fatalf("rooms %s and %s both got join code %s", other, roomID, code)
+		}
+		codes[code] = roomID
+	}
+
+	room, err := GetRoomByID("room-0")
+	if err != nil || room == nil {
+		t.Fatalf("room-0 = %+v, %v", room, err)
+	}
+	createTestRoom(t, "late-room", aliceID)
+	if err := SetRoomJoinCode("late-room", room.JoinCode); err == nil {
+		t.Fatalf("join code %s was given to a second room", room.JoinCode)
+	}
+}
+
+func TestJoinCodeLookup(t *testing.T) {
+	setupTestDB(t)
+	t.Setenv("JOIN_CODE_LOOKUP_TIME", "0")
+	aliceID, aliceToken := createTestUser(t, "alice")
+	_, bobToken := createTestUser(t, "bob")
+	createTestRoom(t, "code-room", aliceID)
+	code, err := assignJoinCode("code-room")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Codes are read back case-insensitively, as people type them
+	ctx := doRequest("GET", "/join/"+strings.ToLower(code), bobToken, nil)
+	var room struct {
+		ID string `json:"id"`
+	}
+	decodeBody(t, ctx, &room)
+	if ctx.Response.StatusCode() != fasthttp.StatusOK || room.ID != "code-room" {
+		t.Fatalf("looking up %s: got %d %s", code, ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+
+	if ctx := doRequest("POST", "/rooms/code-room/regenerate-code", bobToken, nil); ctx.Response.StatusCode() != fasthttp.StatusForbidden {
+		t.Fatalf("regenerating another user's code: got %d, want 403", ctx.Response.StatusCode())
+	}
+	ctx = doRequest("POST", "/rooms/code-room/regenerate-code", aliceToken, nil)
+	var regenerated struct {
+		JoinCode string `json:"joinCode"`
+	}
+	decodeBody(t, ctx, &regenerated)
+	if regenerated.JoinCode == "" || regenerated.JoinCode == code {
+		t.Fatalf("regenerating: got %d %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+
+	if ctx := doRequest("GET", "/join/"+code, bobToken, nil); ctx.Response.StatusCode() != fasthttp.StatusNotFound {
+		t.Fatalf("old code after regenerating: got %d, want 404", ctx.Response.StatusCode())
+	}
+	if ctx := doRequest("GET", "/join/"+regenerated.JoinCode, bobToken, nil); ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("new code: got %d, want 200", ctx.Response.StatusCode())
+	}
+}
+
+// Found, unknown and malformed codes all take the lookup time; a failed lookup doesn't wait
+func TestJoinCodeLookupTime(t *testing.T) {
+	setupTestDB(t)
+	t.Setenv("JOIN_CODE_LOOKUP_TIME", "150ms")
+	aliceID, aliceToken := createTestUser(t, "alice")
+	createTestRoom(t, "timed-room", aliceID)
+	code, err := assignJoinCode("timed-room")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknown := "222222"
+	if unknown == code {
+		unknown = "333333"
+	}
+
+	lookup := func(code string) (int, time.Duration) {
+		started := time.Now()
+		ctx := doRequest("GET", "/join/"+code, aliceToken, nil)
+		return ctx.Response.StatusCode(), time.Since(started)
+	}
+	for _, c := range []struct {
+		code   string
+		status int
+	}{
+		{code, fasthttp.StatusOK},
+		{unknown, fasthttp.StatusNotFound},
+		{"not-a-code", fasthttp.StatusNotFound},
+	} {
+		status, took := lookup(c.code)
+		if status != c.status {
+			t.Fatalf("%s: got %d, want %d", c.code, status, c.status)
+		}
+		if took < 150*time.Millisecond {
+			t.Errorf("%s answered after %v, want at least 150ms", c.code, took)
+		}
+	}
+
+	if _, err := dbExec("DROP TABLE rooms"); err != nil {
+		t.Fatal(err)
+	}
+	status, took := lookup(unknown)
+	if status != fasthttp.StatusInternalServerError {
+		t.Fatalf("lookup with the database failing: got %d, want 500", status)
+	}
+	if took >= 150*time.Millisecond {
+		t.Errorf("failed lookup answered after %v, want no padding", took)
+	}
+}
+
+// Each client gets JOIN_CODE_RATE_LIMIT lookups a minute, so held-back answers can't tie up every worker
+func TestJoinCodeRateLimit(t *testing.T) {
+	setupTestDB(t)
+	t.Setenv("JOIN_CODE_LOOKUP_TIME", "0")
+	t.Setenv("JOIN_CODE_RATE_LIMIT", "3")
+
+	for i := 0; i < 3; i++ {
+		if ctx := doRequest("GET", "/join/222222", "", nil); ctx.Response.StatusCode() != fasthttp.StatusNotFound {
+			t.Fatalf("lookup %d: got %d, want 404", i+1, ctx.Response.StatusCode())
+		}
+	}
+	ctx := doRequest("GET", "/join/222222", "", nil)
+	if ctx.Response.StatusCode() != fasthttp.StatusTooManyRequests || len(ctx.Response.Header.Peek("Retry-After")) == 0 {
+		t.Fatalf("lookup over the limit: got %d, want 429 with Retry-After", ctx.Response.StatusCode())
+	}
+
+	// Other clients have their own allowance, and a client's comes back once its minute is up
+	if !allowJoinCodeLookup("203.0.113.7") {
+		t.Error("another client was limited too")
+	}
+	joinCodeLookupsMutex.Lock()
+	for _, window := range joinCodeLookups {
+		window.start = window.start.Add(-time.Minute)
+	}
+	joinCodeLookupsMutex.Unlock()
+	if ctx := doRequest("GET", "/join/222222", "", nil); ctx.Response.StatusCode() != fasthttp.StatusNotFound {
+		t.Fatalf("lookup in the next minute: got %d, want 404", ctx.Response.StatusCode())
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// captureLog points the log file at a temporary file until the test ends, returning a function
+// that reads what has been written to it
+func captureLog(t *testing.T) func() string {
+	t.Helper()
+	file, err := os.CreateTemp(t.TempDir(), "monkeychat-*.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := logFile
+	logFile = file
+	t.Cleanup(func() {
+		logFile = saved
+		file.Close()
+	})
+	return func() string {
+		data, err := os.ReadFile(file.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+}
+
+func TestLogLevelThreshold(t *testing.T) {
+	t.Setenv("LOG_LEVEL", "warn")
+	logged := captureLog(t)
+
+	for _, level := range []string{"DEBUG", "INFO", "WARN", "ERROR"} {
+		logMessage(level, "%s line", level)
+	}
+
+	out := logged()
+	for _, dropped := range []string{"DEBUG line", "INFO line"} {
+		if strings.Contains(out, dropped) {
+			t.Errorf("%q was logged at LOG_LEVEL=WARN", dropped)
+		}
+	}
+	for _, kept := range []string{"[WARN] WARN line", "[ERROR] ERROR line"} {
+		if !strings.Contains(out, kept) {
+			t.Errorf("%q is missing from the log:\n%s", kept, out)
+		}
+	}
+}
+
+func TestLogLevelDefaults(t *testing.T) {
+	t.Setenv("LOG_LEVEL", "")
+	if got := minLogLevel(true); got != logLevels["INFO"] {
+		t.Errorf("production default = %d, want INFO", got)
+	}
+	if got := minLogLevel(false); got != logLevels["DEBUG"] {
+		t.Errorf("development default = %d, want DEBUG", got)
+	}
+
+	// An unknown level falls back to the default rather than silencing everything
+	t.Setenv("LOG_LEVEL", "verbose")
+	if got := minLogLevel(true); got != logLevels["INFO"] {
+		t.Errorf("LOG_LEVEL=verbose in production = %d, want INFO", got)
+	}
+}
@@ -1,15 +1,35 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
 	"io"
 	"log"
+	"math"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/cloudinary/cloudinary-go/v2"
 	"github.com/cloudinary/cloudinary-go/v2/api/uploader"
@@ -19,9 +39,26 @@ import (
 )
 
 var (
-	rooms   = make(map[string][]*Connection)
-	mutex   = sync.RWMutex{}
+	rooms   = make(map[string]*Room)
+	mutex   = sync.RWMutex{} // Guards the rooms map only; each Room guards its own connections
 	logFile *os.File
+
+	// Process start time and number of open WebSocket connections, for /admin/system
+	serverStartTime   = time.Now()
+	activeConnections atomic.Int64
+
+	// Set once the database is migrated and auth is initialized, and cleared again on shutdown, for /readyz
+	ready atomic.Bool
+
+	// Joins refused because a room limit was reached, for /admin/system
+	roomLimitRejections atomic.Int64
+
+	// Every open WebSocket connection, used to notify clients on shutdown
+	liveConnections = sync.Map{}
+
+	// Rooms each signed-in user joined recently, by user ID, for /rooms/rejoinable
+	recentJoins      = make(map[int64]map[string]time.Time)
+	recentJoinsMutex = sync.Mutex{}
 )
 
 func init() {
@@ -39,597 +76,5954 @@ type Connection struct {
 	Conn     *websocket.Conn
 	UserName string
 	UserID   int64
-}
 
-type Message struct {
-	Event   string          `json:"event"`
-	RoomID  string          `json:"roomId"`
-	Payload json.RawMessage `json:"payload,omitempty"`
-}
+	// The websocket package allows only one concurrent writer, so every data frame goes through writeFrame
+	writeMu sync.Mutex
 
-// UserInfo holds user information from join payload
-type UserInfo struct {
-	UserName string `json:"userName"`
+	mu     sync.Mutex                 // Guards the cached per-connection state below
+	rooms  map[string]*Room           // Rooms joined over this connection, by ID
+	typing map[string]map[string]bool // Current typing state per room and scope, replayed to late joiners
+
+	// Resume support: while detached the socket is gone and outgoing frames are queued
+	resumeToken string
+	detached    bool
+	queued      [][]byte
+
+	// Frames waiting for the writer goroutine, which runs while writing is set
+	send    chan outboundFrame
+	writing bool
+
+	// Frames whose write failed and are waiting to be retried, in order
+	outbox   [][]byte
+	retrying bool
+
+	// Rate-limited events sent in the current one-second window, by event
+	eventWindows map[string]*eventWindow
+
+	lastStatsReport time.Time // When the last accepted stats-report arrived
 }
 
-// Logger function with environment-based logging
-func logMessage(level, format string, v ...interface{}) {
-	isProd := os.Getenv("ENV") == "production"
-	timestamp := time.Now().Format("2006-01-02 15:04:05.000")
-	logMsg := fmt.Sprintf("[%s] [%s] %s", timestamp, level, fmt.Sprintf(format, v...))
+// joinedRooms returns the rooms joined over this connection
+func (c *Connection) joinedRooms() []*Room {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	// Always write to the log file
-	if logFile != nil {
-		if _, err := logFile.WriteString(logMsg + "\n"); err != nil {
-			fmt.Printf("Error writing to log file: %v\n", err)
-		}
-		logFile.Sync() // Ensure the log is written to disk
+	joined := make([]*Room, 0, len(c.rooms))
+	for _, room := range c.rooms {
+		joined = append(joined, room)
 	}
+	return joined
+}
 
-	// Always print to console, but with colors only in development
-	if isProd {
-		// Production: Simple console output without colors
-		fmt.Println(logMsg)
-	} else {
-		// Development: Console output with colors
-		var color string
-		switch level {
-		case "ERROR":
-			color = "\033[31m" // Red
-		case "WARN":
-			color = "\033[33m" // Yellow
-		case "INFO":
-			color = "\033[32m" // Green
-		case "DEBUG":
-			color = "\033[36m" // Cyan
-		default:
-			color = "\033[0m" // Reset
-		}
-		fmt.Printf("%s%s\033[0m\n", color, logMsg)
+// joinedRoomIDs returns the IDs of the rooms joined over this connection, sorted
+func (c *Connection) joinedRoomIDs() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ids := make([]string, 0, len(c.rooms))
+	for id := range c.rooms {
+		ids = append(ids, id)
 	}
+	sort.Strings(ids)
+	return ids
 }
 
-func main() {
-	fmt.Println("================ MonkeyChat server starting ================")
-	fmt.Printf("ENV: '%s'\n", os.Getenv("ENV"))
-	fmt.Printf("PORT: '%s'\n", os.Getenv("PORT"))
-	fmt.Printf("DB_USERNAME: '%s'\n", os.Getenv("DB_USERNAME"))
-	fmt.Printf("DB_PASSWORD: '%s'\n", os.Getenv("DB_PASSWORD"))
-	fmt.Printf("DB_HOST: '%s'\n", os.Getenv("DB_HOST"))
-	fmt.Printf("DB_PORT: '%s'\n", os.Getenv("DB_PORT"))
-	fmt.Printf("DB_NAME: '%s'\n", os.Getenv("DB_NAME"))
-	fmt.Printf("JWT_SECRET: '%s'\n", os.Getenv("JWT_SECRET"))
-	fmt.Printf("CLOUDINARY_URL: '%s'\n", os.Getenv("CLOUDINARY_URL"))
+// forgetRoom drops the connection's record of room, along with its typing state there
+func (c *Connection) forgetRoom(room *Room) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	// Get port from environment or use default
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080" // Default port if not specified
-		log.Printf("No PORT environment variable set, using default port: %s", port)
-	} else {
-		log.Printf("Using PORT from environment: %s", port)
+	if c.rooms[room.ID] == room {
+		delete(c.rooms, room.ID)
+		delete(c.typing, room.ID)
 	}
+}
 
-	// Set up server address
-	addr := ":" + port // Ensure we bind to all interfaces with the specified port
-	log.Printf("Server will bind to address: %s", addr)
+// ephemeralEvents are signaling frames that are useless once stale, so failed writes aren't retried
+var ephemeralEvents = map[string]bool{
+	"offer":         true,
+	"answer":        true,
+	"ice-candidate": true,
+	"ice-complete":  true,
+	"typing":        true,
+	"reaction":      true,
+}
 
-	// Set up logging based on environment
-	isProd := os.Getenv("ENV") == "production"
-	log.Printf("Environment: %s", os.Getenv("ENV"))
-	if isProd {
-		log.Printf("Setting up production logging")
-		setupProductionLogging()
-	} else {
-		log.Printf("Setting up development logging")
-		setupDevelopmentLogging()
-	}
-	defer logFile.Close()
+// socket returns the connection's current WebSocket, which changes when a session is resumed
+func (c *Connection) socket() *websocket.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Conn
+}
 
-	// Initialize database
-	logMessage("INFO", "Initializing database...")
-	log.Printf("Database configuration - Host: %s, Port: %s, User: %s, DB: %s",
-		os.Getenv("DB_HOST"),
-		os.Getenv("DB_PORT"),
-		os.Getenv("DB_USER"),
-		os.Getenv("DB_NAME"))
+// writeFrame writes a text frame to ws, serialized with every other write on this connection
+func (c *Connection) writeFrame(ws *websocket.Conn, data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return writeTextFrame(ws, data)
+}
 
-	if err := InitDatabase(); err != nil {
-		logMessage("ERROR", "Failed to initialize database: %v", err)
-		log.Printf("Fatal error initializing database: %v", err)
-		os.Exit(1)
-	}
+// writeTextFrame puts one text frame on the wire; a variable so failed writes can be exercised
+// without a real socket
+var writeTextFrame = func(ws *websocket.Conn, data []byte) error {
+	return ws.WriteMessage(websocket.TextMessage, data)
+}
 
-	// Initialize authentication system with test users
-	log.Printf("Initializing auth system...")
-	InitAuth()
+// outboundFrame is a frame waiting in a connection's send buffer
+type outboundFrame struct {
+	event string
+	data  []byte
 
-	logMessage("INFO", "Starting MonkeyChat server on %s", addr)
-	log.Printf("Server starting on %s", addr)
+	// When set, the socket is closed with this close frame instead of data being sent,
+	// and done is closed once that has happened
+	closeMsg []byte
+	done     chan struct{}
+}
 
-	// Create a CORS middleware
-	corsMiddleware := func(next fasthttp.RequestHandler) fasthttp.RequestHandler {
-		return func(ctx *fasthttp.RequestCtx) {
-			// fmt.Printf("CORS middleware: %s %s\n", ctx.Method(), ctx.Path())
-			origin := string(ctx.Request.Header.Peek("Origin"))
-			if origin == "" {
-				origin = "*"
-			}
+// errSendBufferFull is returned when a peer is too slow to keep up with its messages
+var errSendBufferFull = errors.New("send buffer full")
 
-			// Always set CORS headers
-			ctx.Response.Header.Set("Access-Control-Allow-Origin", origin)
-			ctx.Response.Header.Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, DELETE")
-			ctx.Response.Header.Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-			ctx.Response.Header.Set("Access-Control-Allow-Credentials", "true")
+// sendBufferSize is how many frames may wait for a slow peer before it is dropped (WS_SEND_BUFFER, default 256)
+func sendBufferSize() int {
+	return getEnvInt("WS_SEND_BUFFER", 256)
+}
 
-			if !isProd {
-				logMessage("DEBUG", "Request from origin: %s, path: %s, method: %s", origin, ctx.Path(), ctx.Method())
-			}
+// writeMessage sends a text frame carrying the given event to the peer, or queues it while the
+// peer is detached waiting to resume (bounded, dropping the oldest frames first). Frames are
+// buffered and written by a separate goroutine, so a slow peer never blocks the sender; one that
+// lets the buffer fill up is disconnected.
+func (c *Connection) writeMessage(event string, data []byte) error {
+	c.mu.Lock()
+	if c.detached {
+		c.queueLocked(data)
+		c.mu.Unlock()
+		return nil
+	}
+	c.mu.Unlock()
 
-			// Handle preflight requests
-			if string(ctx.Method()) == "OPTIONS" {
-				fmt.Println("CORS middleware: OPTIONS preflight handled")
-				ctx.SetStatusCode(fasthttp.StatusOK)
-				return
-			}
+	return c.enqueue(outboundFrame{event: event, data: data})
+}
 
-			next(ctx)
-		}
+// closeAfterSend closes the socket with the given close code once every frame already buffered
+// has been written. The returned channel is closed when that is done.
+func (c *Connection) closeAfterSend(code int, text string) <-chan struct{} {
+	frame := outboundFrame{
+		closeMsg: websocket.FormatCloseMessage(code, text),
+		done:     make(chan struct{}),
 	}
+	if err := c.enqueue(frame); err != nil {
+		// The socket was closed right away
+		close(frame.done)
+	}
+	return frame.done
+}
 
-	// Serve static files from /uploads/ in development (before auth)
-	var handler fasthttp.RequestHandler
-	if !isProd {
-		handler = func(ctx *fasthttp.RequestCtx) {
-			path := string(ctx.Path())
-			if strings.HasPrefix(path, "/uploads/") {
-				absUploadDir, _ := filepath.Abs("uploads")
-				filename := strings.TrimPrefix(path, "/uploads/")
-				filePath := filepath.Join(absUploadDir, filename)
-				fasthttp.ServeFile(ctx, filePath)
-				return
-			}
-			authMiddleware(func(ctx *fasthttp.RequestCtx, username string, userID int64) {
-				path := string(ctx.Path())
-				method := string(ctx.Method())
-				switch {
-				case path == "/ws":
-					handleWebSocket(ctx, username, userID)
-				case path == "/health":
-					ctx.SetBodyString("OK")
-				case path == "/logs":
-					serveLogFile(ctx)
-				case path == "/login" && method == "POST":
-					handleLogin(ctx)
-				case path == "/register" && method == "POST":
-					handleRegister(ctx)
-				case path == "/logout" && method == "POST":
-					handleLogout(ctx, username, userID)
-				case path == "/rooms" && method == "GET":
-					handleGetRooms(ctx, username, userID)
-				case path == "/rooms/delete" && method == "POST":
-					handleDeleteRoom(ctx, username, userID)
-				case strings.HasPrefix(path, "/users/") && strings.HasSuffix(path, "/profile") && method == "GET":
-					handleGetUserProfile(ctx, username, userID)
-				case strings.HasPrefix(path, "/users/") && strings.HasSuffix(path, "/profile") && method == "PUT":
-					handleUpdateUserProfile(ctx, username, userID)
-				case strings.HasPrefix(path, "/users/") && strings.HasSuffix(path, "/upload-profile-pic") && method == "POST":
-					handleUploadProfilePic(ctx, username, userID)
-				default:
-					logMessage("WARN", "404 Not Found: %s", path)
-					ctx.SetStatusCode(fasthttp.StatusNotFound)
-				}
-			})(ctx)
-		}
-	} else {
-		handler = func(ctx *fasthttp.RequestCtx) {
-			authMiddleware(func(ctx *fasthttp.RequestCtx, username string, userID int64) {
-				path := string(ctx.Path())
-				method := string(ctx.Method())
-				switch {
-				case path == "/ws":
-					handleWebSocket(ctx, username, userID)
-				case path == "/health":
-					ctx.SetBodyString("OK")
-				case path == "/logs":
-					serveLogFile(ctx)
-				case path == "/login" && method == "POST":
-					handleLogin(ctx)
-				case path == "/register" && method == "POST":
-					handleRegister(ctx)
-				case path == "/logout" && method == "POST":
-					handleLogout(ctx, username, userID)
-				case path == "/rooms" && method == "GET":
-					handleGetRooms(ctx, username, userID)
-				case path == "/rooms/delete" && method == "POST":
-					handleDeleteRoom(ctx, username, userID)
-				case strings.HasPrefix(path, "/users/") && strings.HasSuffix(path, "/profile") && method == "GET":
-					handleGetUserProfile(ctx, username, userID)
-				case strings.HasPrefix(path, "/users/") && strings.HasSuffix(path, "/profile") && method == "PUT":
-					handleUpdateUserProfile(ctx, username, userID)
-				case strings.HasPrefix(path, "/users/") && strings.HasSuffix(path, "/upload-profile-pic") && method == "POST":
-					handleUploadProfilePic(ctx, username, userID)
-				default:
-					logMessage("WARN", "404 Not Found: %s", path)
-					ctx.SetStatusCode(fasthttp.StatusNotFound)
-				}
-			})(ctx)
-		}
+// enqueue adds a frame to the send buffer, starting the writer goroutine if it isn't running.
+// If the buffer is full the peer is not keeping up, so its socket is closed instead.
+func (c *Connection) enqueue(frame outboundFrame) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.send == nil {
+		c.send = make(chan outboundFrame, sendBufferSize())
 	}
-	// Apply CORS middleware
-	h := corsMiddleware(handler)
-	// Start the server
-	logMessage("INFO", "Server started on %s", addr)
-	log.Printf("Attempting to start server on %s", addr)
-	server := &fasthttp.Server{
-		Handler:            h,
-		MaxRequestBodySize: 100 * 1024 * 1024, // 100 MB
+	select {
+	case c.send <- frame:
+	default:
+		logMessage("WARN", "Send buffer for '%s' is full, dropping the slow connection", c.UserName)
+		c.Conn.Close()
+		return errSendBufferFull
 	}
-	if err := server.ListenAndServe(addr); err != nil {
-		logMessage("ERROR", "Error in ListenAndServe: %v", err)
-		log.Printf("Fatal error starting server: %v", err)
-		os.Exit(1)
+
+	if !c.writing {
+		c.writing = true
+		go c.writeLoop()
 	}
+	return nil
 }
 
-func setupProductionLogging() {
-	// Just log to stdout in production for Render
-	log.SetOutput(os.Stdout)
+// writeLoop writes buffered frames in order until the buffer is empty
+func (c *Connection) writeLoop() {
+	for {
+		c.mu.Lock()
+		if len(c.send) == 0 {
+			c.writing = false
+			c.mu.Unlock()
+			return
+		}
+		c.mu.Unlock()
+
+		c.deliver(<-c.send)
+	}
 }
 
-func setupDevelopmentLogging() {
-	// Create logs directory if it doesn't exist
-	if _, err := os.Stat("logs"); os.IsNotExist(err) {
-		if err := os.Mkdir("logs", 0755); err != nil {
-			log.Fatalf("Failed to create logs directory: %v", err)
+// deliver writes one buffered frame. A failed write of a non-ephemeral event goes to the outbox
+// and is retried with backoff.
+func (c *Connection) deliver(frame outboundFrame) {
+	if frame.closeMsg != nil {
+		ws := c.socket()
+		if err := ws.WriteControl(websocket.CloseMessage, frame.closeMsg, time.Now().Add(time.Second)); err != nil {
+			logMessage("WARN", "Error sending close frame to '%s': %v", c.UserName, err)
 		}
+		ws.Close()
+		close(frame.done)
+		return
 	}
 
-	// In development, log to both console and a development log file
-	var err error
-	logFile, err = os.OpenFile("logs/monkeychat.dev.log",
-		os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
-	if err != nil {
-		log.Fatalf("Failed to open development log file: %v", err)
+	event, data := frame.event, frame.data
+	retry := !ephemeralEvents[event] && outboxMaxRetries() > 0
+
+	c.mu.Lock()
+	if c.detached {
+		c.queueLocked(data)
+		c.mu.Unlock()
+		return
+	}
+	if retry && len(c.outbox) > 0 {
+		// Keep ordering behind frames that are already waiting to be retried
+		c.outbox = append(c.outbox, data)
+		c.mu.Unlock()
+		return
 	}
+	ws := c.Conn
+	c.mu.Unlock()
 
-	// Set up multi-writer to log to both console and file
-	mw := io.MultiWriter(os.Stdout, logFile)
-	log.SetOutput(mw)
-}
+	err := c.writeFrame(ws, data)
+	if err == nil {
+		return
+	}
+	if !retry {
+		logMessage("ERROR", "Error sending %s to '%s': %v", event, c.UserName, err)
+		return
+	}
 
-func serveLogFile(ctx *fasthttp.RequestCtx) {
-	// Set headers for file download
-	ctx.Response.Header.Set("Content-Type", "text/plain")
-	ctx.Response.Header.Set("Content-Disposition", "attachment; filename=monkeychat_server_logs.log")
+	logMessage("WARN", "Write of %s to '%s' failed, will retry: %v", event, c.UserName, err)
+	c.mu.Lock()
+	c.outbox = append(c.outbox, data)
+	start := !c.retrying
+	c.retrying = true
+	c.mu.Unlock()
 
-	// Create a copy of the current log file
-	if logFile != nil {
-		logFile.Sync() // Flush any buffers
-		data, err := os.ReadFile(logFile.Name())
-		if err != nil {
-			logMessage("ERROR", "Failed to read log file: %v", err)
-			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
-			return
-		}
-		ctx.SetBody(data)
-	} else {
-		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+	if start {
+		go c.drainOutbox()
 	}
 }
 
-var upgrader = websocket.FastHTTPUpgrader{
-	CheckOrigin: func(ctx *fasthttp.RequestCtx) bool {
-		// Log origin information
-		origin := string(ctx.Request.Header.Peek("Origin"))
-		logMessage("DEBUG", "WebSocket connection from origin: %s", origin)
-		return true
-	},
+// queueLocked stores a frame for a detached peer; c.mu must be held
+func (c *Connection) queueLocked(data []byte) {
+	if len(c.queued) >= resumeQueueSize() {
+		c.queued = c.queued[1:]
+	}
+	c.queued = append(c.queued, data)
 }
 
-func handleWebSocket(ctx *fasthttp.RequestCtx, authUsername string, userID int64) {
-	clientIP := ctx.RemoteIP().String()
-	logMessage("INFO", "WebSocket connection request from %s", clientIP)
+// drainOutbox retries the outbox with exponential backoff. If the peer detaches meanwhile the
+// frames move to its resume queue; if retries run out the socket is closed, which makes the
+// read loop clean the connection up.
+func (c *Connection) drainOutbox() {
+	backoff := getEnvDuration("OUTBOX_RETRY_BACKOFF", 200*time.Millisecond)
+	maxRetries := outboxMaxRetries()
 
-	err := upgrader.Upgrade(ctx, func(ws *websocket.Conn) {
-		// Create a new connection without user info yet
-		conn := &Connection{
-			Conn:     ws,
-			UserName: authUsername, // Use the authenticated username if available
-			UserID:   userID,       // Use the authenticated user ID if available
-		}
+	for attempt := 1; ; attempt++ {
+		time.Sleep(backoff)
 
-		defer ws.Close()
-		logMessage("INFO", "WebSocket connection established from %s", clientIP)
+		c.mu.Lock()
+		if c.detached {
+			for _, data := range c.outbox {
+				c.queueLocked(data)
+			}
+			c.outbox = nil
+			c.retrying = false
+			c.mu.Unlock()
+			return
+		}
+		pending := c.outbox
+		ws := c.Conn
+		c.mu.Unlock()
 
-		// Process messages
-		for {
-			_, message, err := ws.ReadMessage()
-			if err != nil {
-				logMessage("WARN", "Error reading message from %s: %v", clientIP, err)
-				cleanupConnection(conn)
+		sent := 0
+		var err error
+		for _, data := range pending {
+			if err = c.writeFrame(ws, data); err != nil {
 				break
 			}
+			sent++
+		}
 
-			var msg Message
-			if err := json.Unmarshal(message, &msg); err != nil {
-				logMessage("ERROR", "Error unmarshaling message from %s: %v", clientIP, err)
-				continue
-			}
+		c.mu.Lock()
+		c.outbox = c.outbox[sent:]
+		if len(c.outbox) == 0 {
+			c.retrying = false
+			c.mu.Unlock()
+			logMessage("INFO", "Delivered %d queued messages to '%s' after %d retries", sent, c.UserName, attempt)
+			return
+		}
+		if attempt >= maxRetries {
+			dropped := len(c.outbox)
+			c.outbox = nil
+			c.retrying = false
+			c.mu.Unlock()
+			logMessage("ERROR", "Giving up on '%s' after %d retries, dropping %d messages: %v", c.UserName, attempt, dropped, err)
+			ws.Close()
+			return
+		}
+		c.mu.Unlock()
 
-			roomID := msg.RoomID
-			logMessage("INFO", "Received %s message from %s for room %s", msg.Event, clientIP, roomID)
+		backoff *= 2
+	}
+}
 
-			switch msg.Event {
-			case "join":
-				// Extract user name from payload if not authenticated
-				if conn.UserName == "" && len(msg.Payload) > 0 {
-					var userInfo UserInfo
-					if err := json.Unmarshal(msg.Payload, &userInfo); err == nil && userInfo.UserName != "" {
-						conn.UserName = userInfo.UserName
-						logMessage("INFO", "User '%s' is joining room %s", conn.UserName, roomID)
-					} else {
-						conn.UserName = "Anonymous"
-					}
-				}
+// outboxMaxRetries is how many times a failed write is retried before the connection is dropped
+func outboxMaxRetries() int {
+	return getEnvInt("OUTBOX_MAX_RETRIES", 3)
+}
 
-				// Add connection to room
-				mutex.Lock()
-				if _, ok := rooms[roomID]; !ok {
-					rooms[roomID] = []*Connection{}
-					logMessage("INFO", "New room created: %s", roomID)
-
-					// If user is authenticated, add room to active rooms and database
-					if conn.UserName != "" && conn.UserName != "Anonymous" && conn.UserID > 0 {
-						addActiveRoom(roomID, conn.UserName, conn.UserID)
-					}
-				}
+// Room holds the live connections of a single room behind its own lock
+type Room struct {
+	ID          string
+	mu          sync.RWMutex
+	Connections map[*Connection]struct{} // Set of joined connections
+	Info        *DbRoom                  // Cached database row with the room's creator and settings; nil for unsaved rooms
 
-				// Notify existing peers about the new user
-				for _, existingConn := range rooms[roomID] {
-					// Tell existing user about the new user
-					notifyUserJoined(existingConn, roomID, conn.UserName)
+	// Set while the creator is recording the call, so joiners can be told straight away
+	recording   bool
+	recordingBy string
 
-					// Tell the new user about existing users
-					notifyUserJoined(conn, roomID, existingConn.UserName)
-				}
+	// Set while the creator has muted everyone, so joiners are muted straight away too
+	forceMuted   bool
+	forceMutedBy string
 
-				// Add the new connection to the room
-				rooms[roomID] = append(rooms[roomID], conn)
-				connectionCount := len(rooms[roomID])
-				mutex.Unlock()
+	// When the last member left, or the room was created if nobody joined yet; zero while occupied
+	emptySince time.Time
 
-				logMessage("INFO", "User '%s' joined room %s, connections: %d", conn.UserName, roomID, connectionCount)
+	// Set once the room is dropped from the rooms map, so a join racing the removal goes to
+	// whatever room now has this ID instead
+	closed bool
 
-				// Send join confirmation
-				response := Message{
-					Event:  "joined",
-					RoomID: roomID,
-				}
-				respondJSON(conn, response)
+	// Ring buffer of recent connection stats reports, cleared when the room empties
+	stats     []StatsSample
+	statsNext int
 
-				// Log room status
-				logRoomStatus()
+	// Last known microphone and camera state of each member
+	media map[*Connection]MediaState
 
-			case "leave":
-				// Notify other users in the room that this user is leaving
-				var userInfo UserInfo
-				if err := json.Unmarshal(msg.Payload, &userInfo); err == nil {
-					// Use the provided username or the connection's username
-					leavingUserName := userInfo.UserName
-					if leavingUserName == "" {
-						leavingUserName = conn.UserName
-					}
+	// Latest call-metadata from each participant, by user name, kept when CALL_METADATA_RETAIN is
+	// set and cleared when the room empties
+	callMetadata map[string]CallMetadata
 
-					logMessage("INFO", "User '%s' is leaving room %s", leavingUserName, roomID)
+	// Reactions to chat messages, by message ID, emoji and reacting user, for enforcing limits;
+	// the oldest messages are forgotten first and everything is cleared when the room empties
+	reactions     map[string]map[string]map[string]bool
+	reactionOrder []string
 
-					// Notify other users in the room
-					notifyUserLeft(conn, roomID, leavingUserName)
-				}
+	// When each user last chatted, by user name, for slow mode; cleared when the room empties
+	lastChat map[string]time.Time
 
-				// Clean up the connection
-				cleanupConnection(conn)
-				break
+	// Each member's stay so far, saved to room_sessions when they leave a saved room
+	sessions map[*Connection]*roomSession
 
-			case "offer", "answer", "ice-candidate":
-				// Relay message to other peers in the room
-				relayMessageToRoom(conn, roomID, message)
-			}
-		}
-	})
+	// Last connection state each member reported to the whole room, replayed to late joiners
+	connStates map[*Connection]string
 
-	if err != nil {
-		logMessage("ERROR", "Error upgrading to websocket: %v", err)
-		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
-	}
-}
+	// Connections in the waiting room, by peer ID
+	pending map[string]*pendingJoin
 
-func notifyUserJoined(conn *Connection, roomID, userName string) {
-	payload, _ := json.Marshal(map[string]string{
-		"userName": userName,
-	})
+	// Roles handed out by the host, by user ID, loaded along with Info
+	roles map[int64]string
 
-	userJoinedMsg := Message{
+	// ICE restarts awaiting an answer, by offering and answering peer
+	renegotiations map[renegotiationKey]*renegotiation
+
+	sendMu sync.Mutex // Serializes relays so frames reach every receiver in sequence order
+	seq    uint64     // Last sequence number stamped on a relayed frame, guarded by sendMu
+}
+
+// MediaState is a participant's microphone and camera state, as reported by the client or
+// requested by the room creator
+type MediaState struct {
+	UserName   string `json:"userName"`
+	UserID     int64  `json:"userId,omitempty"`
+	AudioMuted bool   `json:"audioMuted"`
+	VideoMuted bool   `json:"videoMuted"`
+	Pending    bool   `json:"pending,omitempty"` // Muted by the creator but not yet confirmed by the client
+}
+
+// updateMediaState applies update to conn's cached media state and returns the result
+func (r *Room) updateMediaState(conn *Connection, update func(*MediaState)) MediaState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.media == nil {
+		r.media = make(map[*Connection]MediaState)
+	}
+	state := r.media[conn]
+	state.UserName = conn.UserName
+	state.UserID = conn.UserID
+	update(&state)
+	r.media[conn] = state
+	return state
+}
+
+// broadcastMediaState tells everyone in the room, including its subject, about a media state change
+func broadcastMediaState(room *Room, state MediaState) {
+	payload, _ := json.Marshal(state)
+	broadcastJSON(nil, room.ID, Message{
+		Event:   "media-state",
+		RoomID:  room.ID,
+		Payload: payload,
+	})
+}
+
+// requestMute asks a participant to mute their microphone on behalf of the room creator, marking
+// them muted until their client confirms with a media-state event
+func requestMute(creator *Connection, room *Room, conn *Connection) {
+	payload, _ := json.Marshal(map[string]string{"fromUserName": creator.UserName})
+	respondJSON(conn, Message{
+		Event:   "mute-request",
+		RoomID:  room.ID,
+		Payload: payload,
+	})
+	markMutePending(room, conn)
+}
+
+// markMutePending records that conn was asked to mute and tells the room
+func markMutePending(room *Room, conn *Connection) {
+	state := room.updateMediaState(conn, func(state *MediaState) {
+		if !state.AudioMuted {
+			state.AudioMuted = true
+			state.Pending = true
+		}
+	})
+	broadcastMediaState(room, state)
+}
+
+// ChatMessage is the payload of a chat event
+type ChatMessage struct {
+	ID       string    `json:"id,omitempty"` // Chosen by the sender so it can be reacted to, or assigned by the server
+	Text     string    `json:"text"`
+	UserName string    `json:"userName,omitempty"`
+	SentAt   time.Time `json:"sentAt"`
+	System   bool      `json:"system,omitempty"` // Authored by the server, e.g. a join announcement
+}
+
+// maxChatLength bounds the size of a single chat message
+const maxChatLength = 2000
+
+var (
+	// Script and style elements are dropped with their contents when stripping markup
+	scriptOrStyleTag = regexp.MustCompile(`(?is)<(script|style)\b[^>]*>.*?</(script|style)\s*>`)
+	htmlTag          = regexp.MustCompile(`(?s)<[^>]*>`)
+)
+
+// sanitizeText neutralizes markup in user-provided display content (bios, chat) before it is
+// stored or relayed. SANITIZE_MODE picks the strictness: "escape" (the default) HTML-escapes
+// the text, "strip" removes tags and any script/style content, "off" leaves it untouched.
+func sanitizeText(text string) string {
+	switch strings.ToLower(os.Getenv("SANITIZE_MODE")) {
+	case "off":
+		return text
+	case "strip":
+		text = scriptOrStyleTag.ReplaceAllString(text, "")
+		text = htmlTag.ReplaceAllString(text, "")
+		// Anything still looking like markup, such as an unclosed tag, gets escaped
+		return html.EscapeString(html.UnescapeString(text))
+	default:
+		return html.EscapeString(text)
+	}
+}
+
+// stripControlChars removes control characters other than newlines and tabs, which would
+// otherwise end up in logs and the frontend
+func stripControlChars(text string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) && r != '\n' && r != '\t' {
+			return -1
+		}
+		return r
+	}, text)
+}
+
+// maxBioLength is the most characters a profile bio may have (PROFILE_BIO_MAX_LENGTH, default 500)
+func maxBioLength() int {
+	return getEnvInt("PROFILE_BIO_MAX_LENGTH", 500)
+}
+
+// profileFields are the fields a profile update may change, in the order they are checked
+var profileFields = []string{"username", "email", "bio", "profilePic"}
+
+// lockedProfileFields returns the profile fields named in PROFILE_LOCKED_FIELDS, which users
+// can't change after registering. Nothing is locked by default.
+func lockedProfileFields() map[string]bool {
+	locked := make(map[string]bool)
+	for _, field := range splitList(os.Getenv("PROFILE_LOCKED_FIELDS")) {
+		known := false
+		for _, name := range profileFields {
+			if field == name {
+				known = true
+				break
+			}
+		}
+		if !known {
+			logMessage("WARN", "Unknown profile field '%s' in PROFILE_LOCKED_FIELDS; ignoring it", field)
+			continue
+		}
+		locked[field] = true
+	}
+	return locked
+}
+
+// lockedFieldPolicy decides what happens to an update changing a locked profile field:
+// "reject" (the default) refuses the whole update, "ignore" keeps the stored value and applies the rest
+func lockedFieldPolicy() string {
+	switch policy := strings.ToLower(os.Getenv("PROFILE_LOCKED_FIELD_POLICY")); policy {
+	case "reject", "ignore":
+		return policy
+	case "":
+		return "reject"
+	default:
+		logMessage("WARN", "Unknown PROFILE_LOCKED_FIELD_POLICY '%s'; using reject", policy)
+		return "reject"
+	}
+}
+
+type Message struct {
+	Event   string          `json:"event"`
+	RoomID  string          `json:"roomId"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	Seq     uint64          `json:"seq,omitempty"` // Per-room sequence number of relayed messages
+}
+
+// UserInfo holds user information from join payload
+type UserInfo struct {
+	UserName    string `json:"userName"`
+	Invite      string `json:"invite,omitempty"` // Invite token letting the user into a room otherwise closed to them
+	WaitingRoom bool   `json:"waitingRoom"`      // When creating a room, hold later joiners until the creator admits them
+}
+
+// TypingInfo holds the payload of a typing event
+type TypingInfo struct {
+	Scope    string `json:"scope"`
+	IsTyping bool   `json:"isTyping"`
+	UserName string `json:"userName,omitempty"`
+}
+
+// typingScopes lists where a user can be typing, so clients can tell chat typing from other activity
+var typingScopes = map[string]bool{
+	"chat": true,
+	"call": true,
+}
+
+// ConnStateInfo holds the payload of a conn-state event, a peer's WebRTC connection state
+type ConnStateInfo struct {
+	State    string `json:"state"`
+	UserName string `json:"userName,omitempty"`
+	UserID   int64  `json:"userId,omitempty"`
+	SignalTarget
+}
+
+// connStates lists the RTCPeerConnection states a client may report
+var connStates = map[string]bool{
+	"new":          true,
+	"connecting":   true,
+	"connected":    true,
+	"disconnected": true,
+	"failed":       true,
+	"closed":       true,
+}
+
+// roomSession is a member's ongoing stay in a room
+type roomSession struct {
+	joinedAt time.Time
+	messages int
+	peak     int // Most members at once since joining
+}
+
+// countMessage adds a chat message to the sender's ongoing stay
+func (r *Room) countMessage(conn *Connection) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if session := r.sessions[conn]; session != nil {
+		session.messages++
+	}
+}
+
+// maxSlowModeSeconds caps the interval a room's creator can set for slow mode
+const maxSlowModeSeconds = 3600
+
+// slowModeWait applies the room's slow mode to a chat message from conn, returning how much
+// longer the sender has to wait, or 0 if the message may go out now. Hosts and co-hosts aren't
+// slowed down.
+func (r *Room) slowModeWait(conn *Connection) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.Info == nil || r.Info.SlowModeSeconds <= 0 || r.roleOfLocked(conn) != roleGuest {
+		return 0
+	}
+	interval := time.Duration(r.Info.SlowModeSeconds) * time.Second
+	if wait := interval - time.Since(r.lastChat[conn.UserName]); wait > 0 {
+		return wait
+	}
+	if r.lastChat == nil {
+		r.lastChat = make(map[string]time.Time)
+	}
+	r.lastChat[conn.UserName] = time.Now()
+	return 0
+}
+
+// ReactionInfo holds the payload of a reaction event
+type ReactionInfo struct {
+	Emoji     string `json:"emoji"`
+	MessageID string `json:"messageId,omitempty"` // Chat message reacted to; empty for a reaction to the call
+	Remove    bool   `json:"remove,omitempty"`    // Takes back an earlier reaction to the message
+	UserName  string `json:"userName,omitempty"`
+}
+
+// trackReaction records a reaction to a chat message, or its removal, and returns why it was
+// refused, if it was. A message takes at most REACTION_MAX_EMOJIS_PER_MESSAGE (default 20)
+// distinct emoji and REACTION_MAX_PER_USER (default 3) from each user; repeating or removing a
+// reaction the user already made is always allowed. Reactions are tracked for the last
+// REACTION_TRACKED_MESSAGES (default 500) messages reacted to in the room.
+func (r *Room) trackReaction(conn *Connection, reaction ReactionInfo) string {
+	user := conn.UserName
+	if conn.UserID > 0 {
+		user = strconv.FormatInt(conn.UserID, 10)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	byEmoji := r.reactions[reaction.MessageID]
+	if reaction.Remove {
+		if byEmoji != nil {
+			delete(byEmoji[reaction.Emoji], user)
+			if len(byEmoji[reaction.Emoji]) == 0 {
+				delete(byEmoji, reaction.Emoji)
+			}
+		}
+		return ""
+	}
+	if byEmoji[reaction.Emoji][user] {
+		return ""
+	}
+
+	if len(byEmoji[reaction.Emoji]) == 0 && len(byEmoji) >= getEnvInt("REACTION_MAX_EMOJIS_PER_MESSAGE", 20) {
+		return "This message has reached the maximum number of different reactions."
+	}
+	mine := 0
+	for _, users := range byEmoji {
+		if users[user] {
+			mine++
+		}
+	}
+	if mine >= getEnvInt("REACTION_MAX_PER_USER", 3) {
+		return "You have reached the maximum number of reactions on this message."
+	}
+
+	if byEmoji == nil {
+		if r.reactions == nil {
+			r.reactions = make(map[string]map[string]map[string]bool)
+		}
+		if limit := getEnvInt("REACTION_TRACKED_MESSAGES", 500); limit > 0 && len(r.reactionOrder) >= limit {
+			delete(r.reactions, r.reactionOrder[0])
+			r.reactionOrder = r.reactionOrder[1:]
+		}
+		byEmoji = make(map[string]map[string]bool)
+		r.reactions[reaction.MessageID] = byEmoji
+		r.reactionOrder = append(r.reactionOrder, reaction.MessageID)
+	}
+	if byEmoji[reaction.Emoji] == nil {
+		byEmoji[reaction.Emoji] = make(map[string]bool)
+	}
+	byEmoji[reaction.Emoji][user] = true
+	return ""
+}
+
+// maxReactionLength bounds a reaction in bytes, enough for emoji built from several code points
+const maxReactionLength = 32
+
+// validReaction reports whether emoji is a short, non-blank reaction with no markup
+func validReaction(emoji string) bool {
+	if emoji == "" || len(emoji) > maxReactionLength || utf8.RuneCountInString(emoji) > 8 {
+		return false
+	}
+	return strings.TrimSpace(emoji) == emoji && !strings.ContainsAny(emoji, "<>&\"'")
+}
+
+// eventWindow counts how often an event was sent in the current one-second window
+type eventWindow struct {
+	start time.Time
+	count int
+}
+
+// allowEvent counts an event against the connection's limit of perSecond such events,
+// reporting whether it may be sent
+func (c *Connection) allowEvent(event string, perSecond int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.eventWindows == nil {
+		c.eventWindows = make(map[string]*eventWindow)
+	}
+	window := c.eventWindows[event]
+	if window == nil {
+		window = &eventWindow{}
+		c.eventWindows[event] = window
+	}
+
+	now := time.Now()
+	if now.Sub(window.start) >= time.Second {
+		window.start = now
+		window.count = 0
+	}
+	if window.count >= perSecond {
+		return false
+	}
+	window.count++
+	return true
+}
+
+// FileOffer is the payload of a file-offer event, announcing a file to send over a data channel
+type FileOffer struct {
+	OfferID      string `json:"offerId"`
+	FileName     string `json:"fileName"`
+	Size         int64  `json:"size"`
+	MimeType     string `json:"mimeType"`
+	FromUserName string `json:"fromUserName,omitempty"`
+	FromUserID   int64  `json:"fromUserId,omitempty"`
+	SignalTarget
+}
+
+// FileAnswer is the payload of a file-answer event, accepting or declining a file offer
+type FileAnswer struct {
+	OfferID      string `json:"offerId"`
+	Accepted     bool   `json:"accepted"`
+	Reason       string `json:"reason,omitempty"` // "declined" or "timeout" when not accepted
+	FromUserName string `json:"fromUserName,omitempty"`
+	FromUserID   int64  `json:"fromUserId,omitempty"`
+}
+
+// pendingFileOffer is a file offer waiting for its answer
+type pendingFileOffer struct {
+	sender *Connection
+	roomID string
+	timer  *time.Timer
+}
+
+var (
+	// File offers waiting for an answer, by offer ID
+	fileOffers      = make(map[string]*pendingFileOffer)
+	fileOffersMutex = sync.Mutex{}
+)
+
+// validFileOffer checks a file offer's metadata against FILE_OFFER_MAX_SIZE (default 100 MB)
+func validFileOffer(offer FileOffer) bool {
+	maxSize := int64(getEnvInt("FILE_OFFER_MAX_SIZE", 100*1024*1024))
+	return offer.OfferID != "" && len(offer.OfferID) <= 64 &&
+		strings.TrimSpace(offer.FileName) != "" && len(offer.FileName) <= 255 &&
+		len(offer.MimeType) <= 100 && offer.Size > 0 && offer.Size <= maxSize &&
+		offer.isSet()
+}
+
+// expireFileOffer tells the sender of an unanswered file offer that it timed out
+func expireFileOffer(offerID string) {
+	fileOffersMutex.Lock()
+	pending, ok := fileOffers[offerID]
+	delete(fileOffers, offerID)
+	fileOffersMutex.Unlock()
+	if !ok {
+		return
+	}
+
+	payload, _ := json.Marshal(FileAnswer{OfferID: offerID, Reason: "timeout"})
+	respondJSON(pending.sender, Message{
+		Event:   "file-answer",
+		RoomID:  pending.roomID,
+		Payload: payload,
+	})
+}
+
+// dtmfTones matches a DTMF digit sequence; ',' is a pause
+var dtmfTones = regexp.MustCompile(`^[0-9A-D*#,]{1,32}$`)
+
+// DTMFInfo holds the payload of a dtmf event
+type DTMFInfo struct {
+	Tones        string `json:"tones"`
+	FromUserName string `json:"fromUserName,omitempty"`
+	FromUserID   int64  `json:"fromUserId,omitempty"`
+	SignalTarget
+}
+
+// BWEFeedback is the payload of a bwe-feedback event: a receiver's bandwidth estimate for the
+// media it gets from one sender, relayed to that sender only so it can adapt its bitrate
+type BWEFeedback struct {
+	BitrateKbps  float64 `json:"bitrateKbps"`
+	PacketLoss   float64 `json:"packetLoss,omitempty"` // Fraction of packets lost, from 0 to 1
+	FromUserName string  `json:"fromUserName,omitempty"`
+	FromUserID   int64   `json:"fromUserId,omitempty"`
+	SignalTarget
+}
+
+// maxBWEBitrateKbps bounds a bandwidth estimate; anything higher is a client bug
+const maxBWEBitrateKbps = 100000
+
+// valid reports whether the feedback names a sender and carries a plausible estimate
+func (f BWEFeedback) valid() bool {
+	return f.isSet() && f.BitrateKbps > 0 && f.BitrateKbps <= maxBWEBitrateKbps &&
+		f.PacketLoss >= 0 && f.PacketLoss <= 1
+}
+
+// CallMetadata is the payload of a call-metadata event: the codecs and resolution a client
+// negotiated when its call started, for analytics and UI. The server never interprets it.
+type CallMetadata struct {
+	Codecs     []string  `json:"codecs"`               // e.g. "audio/opus", "video/VP8"
+	Resolution string    `json:"resolution,omitempty"` // e.g. "1280x720"
+	UserName   string    `json:"userName,omitempty"`
+	UserID     int64     `json:"userId,omitempty"`
+	ReportedAt time.Time `json:"reportedAt"`
+}
+
+var (
+	codecPattern      = regexp.MustCompile(`^[A-Za-z0-9/._+-]{1,64}$`)
+	resolutionPattern = regexp.MustCompile(`^[0-9]{1,5}x[0-9]{1,5}$`)
+)
+
+// maxCallMetadataCodecs bounds the codecs listed in one call-metadata event
+const maxCallMetadataCodecs = 16
+
+// valid reports whether the metadata has the expected shape
+func (m CallMetadata) valid() bool {
+	if len(m.Codecs) == 0 || len(m.Codecs) > maxCallMetadataCodecs {
+		return false
+	}
+	for _, codec := range m.Codecs {
+		if !codecPattern.MatchString(codec) {
+			return false
+		}
+	}
+	return m.Resolution == "" || resolutionPattern.MatchString(m.Resolution)
+}
+
+// StatsReport is the payload of a stats-report event, a client's periodic call quality summary
+type StatsReport struct {
+	RTTMs       float64 `json:"rttMs"`
+	PacketLoss  float64 `json:"packetLoss"` // Fraction of packets lost, from 0 to 1
+	BitrateKbps float64 `json:"bitrateKbps"`
+}
+
+// valid reports whether every field is a finite, non-negative number in range
+func (r StatsReport) valid() bool {
+	for _, v := range []float64{r.RTTMs, r.PacketLoss, r.BitrateKbps} {
+		if math.IsNaN(v) || math.IsInf(v, 0) || v < 0 {
+			return false
+		}
+	}
+	return r.PacketLoss <= 1
+}
+
+// StatsSample is a stats report as kept by the room
+type StatsSample struct {
+	StatsReport
+	UserName   string    `json:"userName"`
+	ReportedAt time.Time `json:"reportedAt"`
+}
+
+// addStats records a stats sample, overwriting the oldest once ROOM_STATS_SAMPLES are kept
+func (r *Room) addStats(sample StatsSample) {
+	limit := getEnvInt("ROOM_STATS_SAMPLES", 200)
+	if limit <= 0 {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.stats) < limit {
+		r.stats = append(r.stats, sample)
+		return
+	}
+	r.stats[r.statsNext%len(r.stats)] = sample
+	r.statsNext = (r.statsNext + 1) % len(r.stats)
+}
+
+// statsSnapshot returns the room's kept stats samples, oldest first
+func (r *Room) statsSnapshot() []StatsSample {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	samples := make([]StatsSample, 0, len(r.stats))
+	samples = append(samples, r.stats[r.statsNext:]...)
+	return append(samples, r.stats[:r.statsNext]...)
+}
+
+// SignalTarget holds the optional recipient of a signaling message.
+// When neither field is set the message is broadcast to the whole room.
+type SignalTarget struct {
+	Target       string `json:"target"`
+	TargetUserID int64  `json:"targetUserId"`
+}
+
+// isSet reports whether the message was addressed to a specific peer
+func (t SignalTarget) isSet() bool {
+	return t.Target != "" || t.TargetUserID > 0
+}
+
+// matches reports whether conn is the addressed peer, preferring the user ID when given
+func (t SignalTarget) matches(conn *Connection) bool {
+	if t.TargetUserID > 0 {
+		return conn.UserID == t.TargetUserID
+	}
+	return conn.UserName == t.Target
+}
+
+// Logger function with environment-based logging
+func logMessage(level, format string, v ...interface{}) {
+	isProd := os.Getenv("ENV") == "production"
+	if severity, known := logLevels[level]; known && severity < minLogLevel(isProd) {
+		return
+	}
+	timestamp := time.Now().Format("2006-01-02 15:04:05.000")
+	logMsg := fmt.Sprintf("[%s] [%s] %s", timestamp, level, fmt.Sprintf(format, v...))
+
+	// Always write to the log file
+	if logFile != nil {
+		if _, err := logFile.WriteString(logMsg + "\n"); err != nil {
+			fmt.Printf("Error writing to log file: %v\n", err)
+		}
+		logFile.Sync() // Ensure the log is written to disk
+	}
+
+	// Always print to console, but with colors only in development
+	if isProd {
+		// Production: Simple console output without colors
+		fmt.Println(logMsg)
+	} else {
+		// Development: Console output with colors
+		var color string
+		switch level {
+		case "ERROR":
+			color = "\033[31m" // Red
+		case "WARN":
+			color = "\033[33m" // Yellow
+		case "INFO":
+			color = "\033[32m" // Green
+		case "DEBUG":
+			color = "\033[36m" // Cyan
+		default:
+			color = "\033[0m" // Reset
+		}
+		fmt.Printf("%s%s\033[0m\n", color, logMsg)
+	}
+}
+
+// RoomLogEntry is a log line recorded against a room, for /rooms/{id}/logs
+type RoomLogEntry struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Message string    `json:"message"`
+}
+
+// roomLog keeps a room's most recent log entries in a ring buffer
+type roomLog struct {
+	entries []RoomLogEntry
+	next    int
+	updated time.Time
+}
+
+var (
+	// Recent log entries per room ID; kept after the room empties so a finished call can be debugged
+	roomLogs      = make(map[string]*roomLog)
+	roomLogsMutex = sync.Mutex{}
+)
+
+// logLevels orders log levels by severity, for filtering
+var logLevels = map[string]int{"DEBUG": 0, "INFO": 1, "WARN": 2, "ERROR": 3}
+
+// minLogLevel is the least severe level logMessage writes: LOG_LEVEL if it names one of
+// logLevels, otherwise INFO in production and DEBUG elsewhere
+func minLogLevel(isProd bool) int {
+	if severity, ok := logLevels[strings.ToUpper(os.Getenv("LOG_LEVEL"))]; ok {
+		return severity
+	}
+	if isProd {
+		return logLevels["INFO"]
+	}
+	return logLevels["DEBUG"]
+}
+
+// logRoomEvent logs like logMessage and also records the entry under roomID. The last
+// ROOM_LOG_ENTRIES (default 500) entries are kept for up to ROOM_LOG_ROOMS (default 1000)
+// rooms, forgetting the room that has been quiet the longest when more are seen.
+func logRoomEvent(roomID, level, format string, v ...interface{}) {
+	logMessage(level, format, v...)
+
+	limit := getEnvInt("ROOM_LOG_ENTRIES", 500)
+	if roomID == "" || limit <= 0 {
+		return
+	}
+	entry := RoomLogEntry{Time: time.Now(), Level: level, Message: fmt.Sprintf(format, v...)}
+
+	roomLogsMutex.Lock()
+	defer roomLogsMutex.Unlock()
+
+	rl, ok := roomLogs[roomID]
+	if !ok {
+		if len(roomLogs) >= getEnvInt("ROOM_LOG_ROOMS", 1000) {
+			var oldest string
+			for id, other := range roomLogs {
+				if oldest == "" || other.updated.Before(roomLogs[oldest].updated) {
+					oldest = id
+				}
+			}
+			delete(roomLogs, oldest)
+		}
+		rl = &roomLog{}
+		roomLogs[roomID] = rl
+	}
+
+	rl.updated = entry.Time
+	if len(rl.entries) < limit {
+		rl.entries = append(rl.entries, entry)
+		return
+	}
+	rl.entries[rl.next%len(rl.entries)] = entry
+	rl.next = (rl.next + 1) % len(rl.entries)
+}
+
+// roomLogSnapshot returns the log entries kept for a room, oldest first
+func roomLogSnapshot(roomID string) []RoomLogEntry {
+	roomLogsMutex.Lock()
+	defer roomLogsMutex.Unlock()
+
+	rl, ok := roomLogs[roomID]
+	if !ok {
+		return nil
+	}
+	entries := make([]RoomLogEntry, 0, len(rl.entries))
+	entries = append(entries, rl.entries[rl.next:]...)
+	return append(entries, rl.entries[:rl.next]...)
+}
+
+// getEnvDuration reads a duration such as "30m" from the environment, falling back when unset or invalid
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		logMessage("WARN", "Invalid duration for %s: '%s', using default %s", key, value, fallback)
+		return fallback
+	}
+	return d
+}
+
+// getEnvInt reads an integer from the environment, falling back when unset or invalid
+func getEnvInt(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		logMessage("WARN", "Invalid integer for %s: '%s', using default %d", key, value, fallback)
+		return fallback
+	}
+	return n
+}
+
+// getEnvBool reads a boolean such as "true" or "1" from the environment, falling back when unset or invalid
+func getEnvBool(key string, fallback bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		logMessage("WARN", "Invalid boolean for %s: '%s', using default %t", key, value, fallback)
+		return fallback
+	}
+	return b
+}
+
+func main() {
+	fmt.Println("================ MonkeyChat server starting ================")
+	fmt.Printf("ENV: '%s'\n", os.Getenv("ENV"))
+	fmt.Printf("PORT: '%s'\n", os.Getenv("PORT"))
+	fmt.Printf("DB_DRIVER: '%s'\n", os.Getenv("DB_DRIVER"))
+	fmt.Printf("DB_USERNAME: '%s'\n", os.Getenv("DB_USERNAME"))
+	fmt.Printf("DB_PASSWORD: '%s'\n", os.Getenv("DB_PASSWORD"))
+	fmt.Printf("DB_HOST: '%s'\n", os.Getenv("DB_HOST"))
+	fmt.Printf("DB_PORT: '%s'\n", os.Getenv("DB_PORT"))
+	fmt.Printf("DB_NAME: '%s'\n", os.Getenv("DB_NAME"))
+	fmt.Printf("JWT_SECRET: '%s'\n", os.Getenv("JWT_SECRET"))
+	fmt.Printf("CLOUDINARY_URL: '%s'\n", os.Getenv("CLOUDINARY_URL"))
+
+	// Get port from environment or use default
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080" // Default port if not specified
+		log.Printf("No PORT environment variable set, using default port: %s", port)
+	} else {
+		log.Printf("Using PORT from environment: %s", port)
+	}
+
+	// Set up server address
+	addr := ":" + port // Ensure we bind to all interfaces with the specified port
+	log.Printf("Server will bind to address: %s", addr)
+
+	// Set up logging based on environment
+	isProd := os.Getenv("ENV") == "production"
+	log.Printf("Environment: %s", os.Getenv("ENV"))
+	if isProd {
+		log.Printf("Setting up production logging")
+		setupProductionLogging()
+	} else {
+		log.Printf("Setting up development logging")
+		setupDevelopmentLogging()
+	}
+	defer logFile.Close()
+
+	// WS_COMPRESSION enables permessage-deflate negotiation with clients that offer it (default off).
+	// SDP and ICE JSON compresses well, which helps on slow mobile links, but every compressed
+	// connection holds its own flate writer/reader state (several hundred KB while active), so
+	// memory per connection goes up noticeably and CPU is spent on each frame.
+	upgrader.EnableCompression = getEnvBool("WS_COMPRESSION", false)
+	logMessage("INFO", "WebSocket compression enabled: %t", upgrader.EnableCompression)
+
+	// ICE servers are sent to clients on join, so a bad configuration should stop startup
+	servers, err := loadICEServers()
+	if err != nil {
+		logMessage("ERROR", "Failed to load ICE servers: %v", err)
+		log.Printf("Fatal error loading ICE servers: %v", err)
+		os.Exit(1)
+	}
+	configuredICEServers = servers
+	logMessage("INFO", "Loaded %d ICE servers", len(configuredICEServers))
+
+	// Login tokens can't be issued or checked without their keys
+	if err := loadTokenKeys(); err != nil {
+		logMessage("ERROR", "Failed to load JWT keys: %v", err)
+		log.Printf("Fatal error loading JWT keys: %v", err)
+		os.Exit(1)
+	}
+	logMessage("INFO", "Login tokens use %s", tokenKeys.method.Alg())
+
+	// Initialize database
+	logMessage("INFO", "Initializing database...")
+	log.Printf("Database configuration - Host: %s, Port: %s, User: %s, DB: %s",
+		os.Getenv("DB_HOST"),
+		os.Getenv("DB_PORT"),
+		os.Getenv("DB_USER"),
+		os.Getenv("DB_NAME"))
+
+	if err := InitDatabase(); err != nil {
+		logMessage("ERROR", "Failed to initialize database: %v", err)
+		log.Printf("Fatal error initializing database: %v", err)
+		os.Exit(1)
+	}
+
+	// Initialize authentication system with test users
+	log.Printf("Initializing auth system...")
+	InitAuth()
+	ready.Store(true)
+
+	// Rooms left behind by users removed directly from the database are cleaned up in the background
+	go reconcileOrphanedRooms()
+
+	// Empty rooms that aren't saved, or are saved as ephemeral, are dropped from memory over time
+	go compactRooms()
+
+	// Saved rooms left idle for ROOM_RETENTION are deleted, unless marked persistent
+	go expireRooms()
+
+	logMessage("INFO", "Starting MonkeyChat server on %s", addr)
+	log.Printf("Server starting on %s", addr)
+
+	// Serve static files from /uploads/ in development, or when uploads may fall back to local storage (before auth)
+	serveUploads := !isProd || uploadLocalFallback()
+	handler := func(ctx *fasthttp.RequestCtx) {
+		path := string(ctx.Path())
+		if serveUploads && strings.HasPrefix(path, "/uploads/") {
+			absUploadDir, _ := filepath.Abs("uploads")
+			filename := strings.TrimPrefix(path, "/uploads/")
+			filePath := filepath.Join(absUploadDir, filename)
+			fasthttp.ServeFile(ctx, filePath)
+			return
+		}
+		authMiddleware(routeRequest)(ctx)
+	}
+	// Apply CORS middleware
+	h := corsMiddleware(handler)
+	// Start the server
+	logMessage("INFO", "Server started on %s", addr)
+	log.Printf("Attempting to start server on %s", addr)
+	server := &fasthttp.Server{
+		Handler:            h,
+		MaxRequestBodySize: 100 * 1024 * 1024, // 100 MB
+		// WebSocket handlers close their own sockets. Otherwise fasthttp recycles a hijacked
+		// connection as soon as the handler returns, and a write still in flight from another
+		// goroutine would land on a nil or reused socket.
+		KeepHijackedConns: true,
+	}
+	go func() {
+		if err := server.ListenAndServe(addr); err != nil {
+			logMessage("ERROR", "Error in ListenAndServe: %v", err)
+			log.Printf("Fatal error starting server: %v", err)
+			os.Exit(1)
+		}
+	}()
+
+	// Block until we're asked to stop, then drain connections
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	logMessage("INFO", "Received %s, shutting down", sig)
+	shutdownServer(server)
+}
+
+// shutdownServer stops accepting requests, tells every WebSocket client the server is going away,
+// closes their sockets and releases the log file and database within the configured grace period
+func shutdownServer(server *fasthttp.Server) {
+	gracePeriod := getEnvDuration("SHUTDOWN_GRACE_PERIOD", 10*time.Second)
+	reconnectDelay := getEnvDuration("SHUTDOWN_RECONNECT_DELAY", 5*time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+
+	// Take the instance out of rotation before anything else
+	ready.Store(false)
+
+	// Stop listening right away; this returns once open connections have finished
+	shutdownDone := make(chan error, 1)
+	go func() {
+		shutdownDone <- server.ShutdownWithContext(ctx)
+	}()
+
+	payload, _ := json.Marshal(map[string]int64{
+		"reconnectDelayMs": reconnectDelay.Milliseconds(),
+	})
+	shutdownMsg := Message{
+		Event:   "server-shutdown",
+		Payload: payload,
+	}
+	var closed []<-chan struct{}
+	liveConnections.Range(func(key, _ interface{}) bool {
+		conn := key.(*Connection)
+		respondJSON(conn, shutdownMsg)
+		closed = append(closed, conn.closeAfterSend(websocket.CloseGoingAway, "server shutting down"))
+		return true
+	})
+	// Let the buffered notices go out, within the grace period
+	for _, done := range closed {
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+	}
+	logMessage("INFO", "Notified %d WebSocket clients of shutdown", len(closed))
+
+	select {
+	case err := <-shutdownDone:
+		if err != nil {
+			logMessage("WARN", "Server shutdown finished with error: %v", err)
+		}
+	case <-ctx.Done():
+		logMessage("WARN", "Grace period of %s elapsed before all connections closed", gracePeriod)
+	}
+
+	if db != nil {
+		if err := db.Close(); err != nil {
+			logMessage("ERROR", "Error closing database: %v", err)
+		}
+	}
+	logMessage("INFO", "MonkeyChat server stopped")
+	if logFile != nil {
+		logFile.Sync()
+	}
+}
+
+// routeRequest dispatches an authenticated request to its handler
+func routeRequest(ctx *fasthttp.RequestCtx, username string, userID int64) {
+	path := string(ctx.Path())
+	method := string(ctx.Method())
+	switch {
+	case path == "/ws":
+		handleWebSocket(ctx, username, userID)
+	case path == "/health":
+		handleHealth(ctx)
+	case path == "/livez":
+		ctx.SetContentType("application/json")
+		ctx.SetBodyString(`{"status":"ok"}`)
+	case path == "/readyz":
+		handleReadyz(ctx)
+	case path == "/logs":
+		serveLogFile(ctx, username)
+	case path == "/admin/system" && method == "GET":
+		handleGetSystemStats(ctx, username, userID)
+	case path == "/login" && method == "POST":
+		handleLogin(ctx)
+	case path == "/register" && method == "POST":
+		handleRegister(ctx)
+	case path == "/ws-ticket" && method == "POST":
+		handleWSTicket(ctx, username, userID)
+	case path == "/logout" && method == "POST":
+		handleLogout(ctx, username, userID)
+	case path == "/auth/revoke-all" && method == "POST":
+		handleRevokeAllSessions(ctx, username, userID)
+	case path == "/forgot-password" && method == "POST":
+		handleForgotPassword(ctx)
+	case path == "/reset-password" && method == "POST":
+		handleResetPassword(ctx)
+	case path == "/verify-email" && method == "POST":
+		handleVerifyEmail(ctx)
+	case path == "/verify-email/send" && method == "POST":
+		handleSendVerificationEmail(ctx, username, userID)
+	case path == "/rooms" && method == "GET":
+		handleGetRooms(ctx, username, userID)
+	case path == "/rooms" && method == "POST":
+		handleCreateRoom(ctx, username, userID)
+	case path == "/rooms/mine" && method == "GET":
+		handleGetOwnRooms(ctx, username, userID)
+	case path == "/rooms/rejoinable" && method == "GET":
+		handleGetRejoinableRooms(ctx, username, userID)
+	case path == "/turn-credentials" && method == "GET":
+		handleGetTURNCredentials(ctx, username, userID)
+	case path == "/me/rooms" && method == "GET":
+		handleGetMyRooms(ctx, username, userID)
+	case path == "/rooms/join" && method == "GET":
+		handleGetInvite(ctx)
+	case strings.HasPrefix(path, "/rooms/") && strings.HasSuffix(path, "/bans") && method == "GET":
+		handleGetRoomBans(ctx, username, userID)
+	case strings.HasPrefix(path, "/rooms/") && strings.HasSuffix(path, "/bans") && method == "POST":
+		handleBanUser(ctx, username, userID)
+	case strings.HasPrefix(path, "/rooms/") && strings.Contains(path, "/bans/") && method == "DELETE":
+		handleUnbanUser(ctx, username, userID)
+	case strings.HasPrefix(path, "/rooms/") && strings.HasSuffix(path, "/transfer") && method == "POST":
+		handleTransferRoom(ctx, username, userID)
+	case strings.HasPrefix(path, "/rooms/") && strings.HasSuffix(path, "/regenerate-code") && method == "POST":
+		handleRegenerateJoinCode(ctx, username, userID)
+	case strings.HasPrefix(path, "/join/") && method == "GET":
+		handleJoinCode(ctx, username, userID)
+	case strings.HasPrefix(path, "/rooms/") && strings.HasSuffix(path, "/purge") && method == "POST":
+		handlePurgeRoom(ctx, username, userID)
+	case strings.HasPrefix(path, "/rooms/") && strings.HasSuffix(path, "/logs") && method == "GET":
+		handleGetRoomLogs(ctx, username, userID)
+	case strings.HasPrefix(path, "/rooms/") && strings.HasSuffix(path, "/call-metadata") && method == "GET":
+		handleGetCallMetadata(ctx, username, userID)
+	case strings.HasPrefix(path, "/rooms/") && strings.HasSuffix(path, "/stats") && method == "GET":
+		handleGetRoomStats(ctx, username, userID)
+	case strings.HasPrefix(path, "/rooms/") && strings.HasSuffix(path, "/invite") && method == "POST":
+		handleCreateInvite(ctx, username, userID)
+	case path == "/rooms/delete" && method == "POST":
+		handleDeleteRoom(ctx, username, userID)
+	case isRoomDetailPath(path) && method == "GET":
+		handleGetRoom(ctx, username, userID)
+	case isRoomDetailPath(path) && method == "PUT":
+		handleUpdateRoom(ctx, username, userID)
+	case isRoomDetailPath(path) && method == "DELETE":
+		handleDeleteRoomByID(ctx, username, userID)
+	case strings.HasPrefix(path, "/rooms/") && strings.HasSuffix(path, "/settings") && method == "PUT":
+		handleUpdateRoomSettings(ctx, username, userID)
+	case path == "/profiles" && method == "GET":
+		handleGetProfiles(ctx, username, userID)
+	case strings.HasPrefix(path, "/users/") && strings.HasSuffix(path, "/profile") && method == "GET":
+		handleGetUserProfile(ctx, username, userID)
+	case strings.HasPrefix(path, "/users/") && strings.HasSuffix(path, "/profile") && method == "PUT":
+		handleUpdateUserProfile(ctx, username, userID)
+	case strings.HasPrefix(path, "/users/") && strings.HasSuffix(path, "/upload-profile-pic") && method == "POST":
+		handleUploadProfilePic(ctx, username, userID)
+	case strings.HasPrefix(path, "/users/") && strings.HasSuffix(path, "/password") && method == "POST":
+		handleChangePassword(ctx, username, userID)
+	case strings.HasPrefix(path, "/users/") && strings.HasSuffix(path, "/preferences") && method == "GET":
+		handleGetPreferences(ctx, username, userID)
+	case strings.HasPrefix(path, "/users/") && strings.HasSuffix(path, "/preferences") && method == "PUT":
+		handleUpdatePreferences(ctx, username, userID)
+	case strings.HasPrefix(path, "/users/") && strings.HasSuffix(path, "/room-quota") && method == "GET":
+		handleGetRoomQuota(ctx, username, userID)
+	case strings.HasPrefix(path, "/users/") && strings.Count(path, "/") == 2 && method == "DELETE":
+		handleDeleteUser(ctx, username, userID)
+	default:
+		logMessage("WARN", "404 Not Found: %s", path)
+		ctx.SetStatusCode(fasthttp.StatusNotFound)
+	}
+}
+
+func setupProductionLogging() {
+	// Just log to stdout in production for Render
+	log.SetOutput(os.Stdout)
+}
+
+func setupDevelopmentLogging() {
+	// Create logs directory if it doesn't exist
+	if _, err := os.Stat("logs"); os.IsNotExist(err) {
+		if err := os.Mkdir("logs", 0755); err != nil {
+			log.Fatalf("Failed to create logs directory: %v", err)
+		}
+	}
+
+	// In development, log to both console and a development log file
+	var err error
+	logFile, err = os.OpenFile("logs/monkeychat.dev.log",
+		os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		log.Fatalf("Failed to open development log file: %v", err)
+	}
+
+	// Set up multi-writer to log to both console and file
+	mw := io.MultiWriter(os.Stdout, logFile)
+	log.SetOutput(mw)
+}
+
+func serveLogFile(ctx *fasthttp.RequestCtx, username string) {
+	// The log names users, IPs and origins, so only admins get it
+	if !isAdmin(username) {
+		logMessage("WARN", "Refused server log download to non-admin '%s'", username)
+		ctx.SetStatusCode(fasthttp.StatusForbidden)
+		ctx.SetBodyString(`{"error":"only admins can view server logs"}`)
+		return
+	}
+
+	// Set headers for file download
+	ctx.Response.Header.Set("Content-Type", "text/plain")
+	ctx.Response.Header.Set("Content-Disposition", "attachment; filename=monkeychat_server_logs.log")
+
+	// Create a copy of the current log file
+	if logFile != nil {
+		logFile.Sync() // Flush any buffers
+		data, err := os.ReadFile(logFile.Name())
+		if err != nil {
+			logMessage("ERROR", "Failed to read log file: %v", err)
+			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+			return
+		}
+		ctx.SetBody(data)
+	} else {
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+	}
+}
+
+// corsMiddleware answers CORS preflights and sets CORS headers for origins allowed by ALLOWED_ORIGINS
+func corsMiddleware(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	isProd := os.Getenv("ENV") == "production"
+	return func(ctx *fasthttp.RequestCtx) {
+		// fmt.Printf("CORS middleware: %s %s\n", ctx.Method(), ctx.Path())
+		origin := string(ctx.Request.Header.Peek("Origin"))
+		allowed := originAllowed(origin)
+
+		// Only set CORS headers for allowed origins. Listed origins are echoed back with
+		// credentials; when any origin is accepted the answer is "*", which can't carry credentials.
+		if allowed {
+			if origin == "" || anyOriginAllowed() {
+				ctx.Response.Header.Set("Access-Control-Allow-Origin", "*")
+			} else {
+				ctx.Response.Header.Set("Access-Control-Allow-Origin", origin)
+				ctx.Response.Header.Set("Access-Control-Allow-Credentials", "true")
+				ctx.Response.Header.Add("Vary", "Origin")
+			}
+			ctx.Response.Header.Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, DELETE")
+			ctx.Response.Header.Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+			ctx.Response.Header.Set("Access-Control-Expose-Headers", "X-Total-Count")
+		} else {
+			logMessage("WARN", "Request from disallowed origin: %s, path: %s", origin, ctx.Path())
+		}
+
+		if !isProd {
+			logMessage("DEBUG", "Request from origin: %s, path: %s, method: %s", origin, ctx.Path(), ctx.Method())
+		}
+
+		// Handle preflight requests
+		if string(ctx.Method()) == "OPTIONS" {
+			fmt.Println("CORS middleware: OPTIONS preflight handled")
+			if !allowed {
+				ctx.SetStatusCode(fasthttp.StatusForbidden)
+				ctx.SetContentType("application/json")
+				ctx.SetBodyString(`{"error":"origin not allowed"}`)
+				return
+			}
+			ctx.SetStatusCode(fasthttp.StatusOK)
+			return
+		}
+
+		next(ctx)
+	}
+}
+
+// anyOriginAllowed reports whether every origin is accepted, either through a "*" entry in
+// ALLOWED_ORIGINS or because no list is configured outside production
+func anyOriginAllowed() bool {
+	patterns := splitList(os.Getenv("ALLOWED_ORIGINS"))
+	if len(patterns) == 0 {
+		return os.Getenv("ENV") != "production"
+	}
+	for _, pattern := range patterns {
+		if pattern == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// originAllowed checks a request's Origin against the comma-separated ALLOWED_ORIGINS list.
+// Entries are exact origins ("https://monkeychat.app"), subdomain wildcards ("https://*.monkeychat.app")
+// or "*". With no list configured every origin is allowed outside production and none inside it.
+// Requests without an Origin header don't come from a browser page and are always allowed.
+func originAllowed(origin string) bool {
+	if origin == "" {
+		return true
+	}
+
+	patterns := splitList(strings.ToLower(os.Getenv("ALLOWED_ORIGINS")))
+	if len(patterns) == 0 {
+		return os.Getenv("ENV") != "production"
+	}
+
+	origin = strings.ToLower(origin)
+	for _, pattern := range patterns {
+		if pattern == "*" || pattern == origin {
+			return true
+		}
+		// "https://*.example.com" matches "https://app.example.com" but not "https://example.com"
+		if i := strings.Index(pattern, "*."); i >= 0 {
+			prefix, suffix := pattern[:i], pattern[i+1:]
+			if strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) &&
+				len(origin) > len(prefix)+len(suffix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var upgrader = websocket.FastHTTPUpgrader{
+	// Selected when a client passes its token in Sec-WebSocket-Protocol
+	Subprotocols: []string{wsTicketProtocol},
+	CheckOrigin: func(ctx *fasthttp.RequestCtx) bool {
+		// Log origin information
+		origin := string(ctx.Request.Header.Peek("Origin"))
+		logMessage("DEBUG", "WebSocket connection from origin: %s", origin)
+		if !originAllowed(origin) {
+			logMessage("WARN", "Refused WebSocket upgrade from disallowed origin: %s", origin)
+			return false
+		}
+		return true
+	},
+}
+
+func handleWebSocket(ctx *fasthttp.RequestCtx, authUsername string, userID int64) {
+	clientIP := ctx.RemoteIP().String()
+	logMessage("INFO", "WebSocket connection request from %s", clientIP)
+
+	err := upgrader.Upgrade(ctx, func(ws *websocket.Conn) {
+		// Create a new connection without user info yet
+		conn := &Connection{
+			Conn:     ws,
+			UserName: authUsername, // Use the authenticated username if available
+			UserID:   userID,       // Use the authenticated user ID if available
+		}
+
+		defer ws.Close()
+		activeConnections.Add(1)
+		defer activeConnections.Add(-1)
+		liveConnections.Store(conn, struct{}{})
+		defer func() {
+			// conn may have been swapped for a resumed session, so look it up at exit
+			liveConnections.Delete(conn)
+		}()
+		logMessage("INFO", "WebSocket connection established from %s", clientIP)
+
+		// Signaling and chat frames are small; anything bigger closes the connection instead of being buffered
+		ws.SetReadLimit(int64(getEnvInt("WS_MAX_MESSAGE_SIZE", 64*1024)))
+
+		// Anonymous connections may be limited to a maximum session duration (0 disables)
+		var sessionDeadline time.Time
+		if limit := getEnvDuration("ANON_SESSION_MAX_DURATION", 0); limit > 0 && conn.UserID == 0 {
+			sessionDeadline = time.Now().Add(limit)
+			ws.SetReadDeadline(sessionDeadline)
+			logMessage("DEBUG", "Anonymous session from %s limited to %s", clientIP, limit)
+		}
+
+		// Process messages
+		for {
+			_, message, err := ws.ReadMessage()
+			if err != nil {
+				if !sessionDeadline.IsZero() && !time.Now().Before(sessionDeadline) {
+					logMessage("INFO", "Anonymous session for '%s' from %s expired", conn.UserName, clientIP)
+					notifySessionExpired(conn)
+					dropResumeSession(conn)
+				} else if errors.Is(err, websocket.ErrReadLimit) {
+					// The library already answered with a "message too big" close frame
+					logMessage("WARN", "Closed connection from %s ('%s'): message over the size limit", clientIP, conn.UserName)
+					dropResumeSession(conn)
+				} else {
+					logMessage("WARN", "Error reading message from %s: %v", clientIP, err)
+					// Mark the peer pending-left and give it a chance to come back before telling the room
+					if detachConnection(conn) {
+						break
+					}
+				}
+				notifyDisconnected(conn)
+				cleanupConnection(conn)
+				break
+			}
+
+			var msg Message
+			if err := json.Unmarshal(message, &msg); err != nil {
+				logMessage("ERROR", "Error unmarshaling message from %s: %v", clientIP, err)
+				continue
+			}
+
+			roomID := msg.RoomID
+			logRoomEvent(roomID, "INFO", "Received %s message from %s for room %s", msg.Event, clientIP, roomID)
+
+			switch msg.Event {
+			case "join":
+				if err := validateRoomID(roomID); err != nil {
+					logMessage("WARN", "Rejected join from %s: invalid room ID %q", clientIP, roomID)
+					notifyEvent(conn, "invalid-room-id", roomID, err.Error())
+					continue
+				}
+
+				// Ended rooms stay listed for their history but can't be joined again
+				if existing, err := GetRoomByID(roomID); err == nil && existing != nil && existing.EndedAt != nil {
+					notifyEvent(conn, "room-ended", roomID, "This room has ended.")
+					continue
+				}
+
+				var userInfo UserInfo
+				if len(msg.Payload) > 0 {
+					json.Unmarshal(msg.Payload, &userInfo)
+				}
+
+				// Extract user name from payload if not authenticated
+				if conn.UserName == "" {
+					if userInfo.UserName != "" {
+						conn.UserName = userInfo.UserName
+						logRoomEvent(roomID, "INFO", "User '%s' is joining room %s", conn.UserName, roomID)
+					} else {
+						conn.UserName = "Anonymous"
+					}
+				}
+
+				// Anonymous users may be kept from creating rooms, or from rooms closed to them by their creator
+				if conn.UserID == 0 {
+					existing, err := GetRoomByID(roomID)
+					if err != nil {
+						logRoomEvent(roomID, "ERROR", "Error checking room %s: %v", roomID, err)
+					}
+					if existing == nil && err == nil && getRoom(roomID) == nil && roomCreatePolicy() != "any" {
+						logRoomEvent(roomID, "INFO", "Rejected anonymous creation of room %s by '%s'", roomID, conn.UserName)
+						if roomCreatePolicy() == "rest" {
+							notifyEvent(conn, "room-not-found", roomID, "This room doesn't exist.")
+						} else {
+							notifyEvent(conn, "auth-required-to-create", roomID, "You must sign in to create a room.")
+						}
+						continue
+					}
+					if existing != nil && !existing.AllowAnonymous {
+						if userInfo.Invite == "" {
+							logRoomEvent(roomID, "INFO", "Rejected anonymous user '%s' from room %s", conn.UserName, roomID)
+							notifyEvent(conn, "auth-required", roomID, "This room only allows signed-in users. Please sign in to join.")
+							continue
+						}
+
+						// A valid invite for this room lets the user in anyway
+						invite, err := validateInviteToken(userInfo.Invite)
+						if err == nil && invite.RoomID != roomID {
+							err = fmt.Errorf("invite is for another room")
+						}
+						if err == nil {
+							err = redeemInvite(invite)
+						}
+						if err != nil {
+							logRoomEvent(roomID, "INFO", "Rejected invite from anonymous user '%s' for room %s: %v", conn.UserName, roomID, err)
+							notifyEvent(conn, "invite-invalid", roomID, "This invite link is invalid, expired or has already been used.")
+							continue
+						}
+						logRoomEvent(roomID, "INFO", "Anonymous user '%s' joined room %s with invite %s", conn.UserName, roomID, invite.ID)
+					}
+				}
+
+				// Banned users can't come back
+				if conn.UserID > 0 {
+					banned, err := IsUserBanned(roomID, conn.UserID)
+					if err != nil {
+						logRoomEvent(roomID, "ERROR", "Error checking ban for '%s' in room %s: %v", conn.UserName, roomID, err)
+					}
+					if banned {
+						logRoomEvent(roomID, "INFO", "Rejected banned user '%s' from room %s", conn.UserName, roomID)
+						notifyEvent(conn, "banned", roomID, "You have been banned from this room.")
+						continue
+					}
+				}
+
+				// Signed-in users may only own so many rooms
+				if conn.UserID > 0 && getRoom(roomID) == nil {
+					existing, err := GetRoomByID(roomID)
+					if err != nil {
+						logRoomEvent(roomID, "ERROR", "Error checking room %s: %v", roomID, err)
+					}
+					if existing == nil && err == nil && roomCreatePolicy() == "rest" {
+						logRoomEvent(roomID, "INFO", "Rejected implicit creation of room %s by '%s'", roomID, conn.UserName)
+						notifyEvent(conn, "room-not-found", roomID, "This room doesn't exist. Create it first.")
+						continue
+					}
+					if existing == nil && err == nil {
+						owned, err := CountRoomsByUserID(conn.UserID)
+						if err != nil {
+							logMessage("ERROR", "Error counting rooms for user '%s': %v", conn.UserName, err)
+						} else if owned >= maxRoomsPerUser() {
+							roomLimitRejections.Add(1)
+							logRoomEvent(roomID, "INFO", "User '%s' reached the room limit (%d) creating room %s", conn.UserName, owned, roomID)
+							notifyEvent(conn, "room-limit-reached", roomID, "You have reached the maximum number of rooms you can create.")
+							continue
+						}
+					}
+				}
+
+				// Add connection to room
+				enterRoom(conn, roomID, userInfo.WaitingRoom)
+
+				// Log room status
+				logRoomStatus()
+
+			case "leave":
+				// Use the provided username or the connection's username
+				var userInfo UserInfo
+				json.Unmarshal(msg.Payload, &userInfo)
+				leavingUserName := userInfo.UserName
+				if leavingUserName == "" {
+					leavingUserName = conn.UserName
+				}
+
+				// Only the room named in the message is left; other rooms on this socket are kept
+				room := getRoom(roomID)
+				if room != nil {
+					for _, pending := range room.pendingJoins() {
+						if pending.Conn == conn {
+							room.takePending(pending.PeerID)
+						}
+					}
+				}
+				if room == nil || !room.removeConnection(conn) {
+					logRoomEvent(roomID, "WARN", "User '%s' tried to leave room %s without joining it", conn.UserName, roomID)
+					continue
+				}
+				conn.forgetRoom(room)
+				touchRoom(roomID)
+				logRoomEvent(roomID, "INFO", "User '%s' is leaving room %s", leavingUserName, roomID)
+
+				// Notify other users in the room
+				notifyUserLeft(conn, roomID, leavingUserName)
+
+				// Nothing is left to resume once the last room is left
+				if len(conn.joinedRooms()) == 0 {
+					dropResumeSession(conn)
+				}
+
+			case "list-rooms":
+				// Rooms this socket is in, for clients holding several rooms on one connection
+				type joinedRoom struct {
+					ID           string `json:"id"`
+					Name         string `json:"name,omitempty"`
+					Role         string `json:"role"`
+					Participants int    `json:"participants"`
+				}
+				joined := []joinedRoom{}
+				for _, room := range conn.joinedRooms() {
+					room.mu.RLock()
+					entry := joinedRoom{ID: room.ID, Role: room.roleOfLocked(conn), Participants: len(room.Connections)}
+					if room.Info != nil {
+						entry.Name = room.Info.Name
+					}
+					room.mu.RUnlock()
+					joined = append(joined, entry)
+				}
+				sort.Slice(joined, func(i, j int) bool { return joined[i].ID < joined[j].ID })
+				payload, _ := json.Marshal(map[string]interface{}{"rooms": joined})
+				respondJSON(conn, Message{
+					Event:   "rooms",
+					Payload: payload,
+				})
+
+			case "resume":
+				var resume struct {
+					Token string `json:"token"`
+				}
+				json.Unmarshal(msg.Payload, &resume)
+
+				session, newToken, queued := reattachSession(resume.Token, ws, conn)
+				if session == nil {
+					logRoomEvent(roomID, "INFO", "Rejected resume attempt from %s for room %s", clientIP, roomID)
+					notifyEvent(conn, "resume-failed", roomID, "Your session could not be resumed. Please join the room again.")
+					continue
+				}
+
+				// Carry on as the original peer; the placeholder connection was never in a room
+				liveConnections.Delete(conn)
+				conn = session.Conn
+				liveConnections.Store(conn, struct{}{})
+
+				payload, _ := json.Marshal(map[string]interface{}{
+					"resumeToken":    newToken,
+					"resumeWindowMs": resumeGracePeriod().Milliseconds(),
+					"rooms":          conn.joinedRoomIDs(),
+				})
+				respondJSON(conn, Message{
+					Event:   "resumed",
+					Payload: payload,
+				})
+				for _, frame := range queued {
+					if err := conn.writeMessage("", frame); err != nil {
+						logMessage("ERROR", "Error replaying queued message to '%s': %v", conn.UserName, err)
+						break
+					}
+				}
+				logMessage("INFO", "User '%s' resumed session from %s, replayed %d messages", conn.UserName, clientIP, len(queued))
+
+			case "chat":
+				var chat ChatMessage
+				if err := json.Unmarshal(msg.Payload, &chat); err != nil || strings.TrimSpace(chat.Text) == "" || len(chat.Text) > maxChatLength {
+					logRoomEvent(roomID, "WARN", "Invalid chat message from '%s' in room %s", conn.UserName, roomID)
+					continue
+				}
+
+				room := getRoom(roomID)
+				if room == nil || !room.hasMember(conn) {
+					logRoomEvent(roomID, "WARN", "User '%s' sent chat to room %s without joining it", conn.UserName, roomID)
+					continue
+				}
+
+				// In read-only rooms only the creator may talk; signaling and media are unaffected
+				if info := room.info(); info != nil && info.ReadOnly && info.CreatedBy != conn.UserID {
+					notifyEvent(conn, "room-read-only", roomID, "Only the room creator can send messages in this room.")
+					continue
+				}
+
+				chat.Text = sanitizeText(chat.Text)
+				if strings.TrimSpace(chat.Text) == "" {
+					logRoomEvent(roomID, "WARN", "Chat message from '%s' in room %s was empty after sanitizing", conn.UserName, roomID)
+					continue
+				}
+				if wait := room.slowModeWait(conn); wait > 0 {
+					seconds := int(math.Ceil(wait.Seconds()))
+					notifyEvent(conn, "slow-mode", roomID, fmt.Sprintf("Slow mode is on. You can send another message in %d seconds.", seconds))
+					continue
+				}
+				if len(chat.ID) > 64 || !roomIDPattern.MatchString(chat.ID) {
+					chat.ID = generateRandomToken(9)
+				}
+				chat.UserName = conn.UserName
+				chat.SentAt = time.Now()
+				payload, _ := json.Marshal(chat)
+				broadcastJSON(conn, roomID, Message{
+					Event:   "chat",
+					RoomID:  roomID,
+					Payload: payload,
+				})
+				room.countMessage(conn)
+				touchRoom(roomID)
+
+			case "recording-started", "recording-stopped":
+				room := getRoom(roomID)
+				if room == nil || !room.hasMember(conn) {
+					logRoomEvent(roomID, "WARN", "User '%s' sent %s to room %s without joining it", conn.UserName, msg.Event, roomID)
+					continue
+				}
+				if !roomPermits(conn, room, actionRecord) {
+					notifyEvent(conn, "recording-denied", roomID, "Only the host can record this room.")
+					continue
+				}
+
+				recording := msg.Event == "recording-started"
+				room.mu.Lock()
+				changed := room.recording != recording
+				room.recording = recording
+				if recording {
+					room.recordingBy = conn.UserName
+				} else {
+					room.recordingBy = ""
+				}
+				room.mu.Unlock()
+				if !changed {
+					continue
+				}
+
+				// Keep an audit trail of when participants were told about recording
+				if err := RecordRecordingEvent(roomID, conn.UserID, msg.Event); err != nil {
+					logRoomEvent(roomID, "ERROR", "Error recording %s audit row for room %s: %v", msg.Event, roomID, err)
+				}
+				logRoomEvent(roomID, "INFO", "User '%s' sent %s in room %s", conn.UserName, msg.Event, roomID)
+
+				payload, _ := json.Marshal(map[string]string{"userName": conn.UserName})
+				broadcastJSON(conn, roomID, Message{
+					Event:   msg.Event,
+					RoomID:  roomID,
+					Payload: payload,
+				})
+
+			case "media-state":
+				// A client reporting its own microphone and camera state, which confirms any pending mute
+				var reported struct {
+					AudioMuted bool `json:"audioMuted"`
+					VideoMuted bool `json:"videoMuted"`
+				}
+				if err := json.Unmarshal(msg.Payload, &reported); err != nil {
+					logRoomEvent(roomID, "WARN", "Invalid media-state from '%s' in room %s", conn.UserName, roomID)
+					continue
+				}
+				room := getRoom(roomID)
+				if room == nil || !room.hasMember(conn) {
+					logRoomEvent(roomID, "WARN", "User '%s' sent media-state to room %s without joining it", conn.UserName, roomID)
+					continue
+				}
+				broadcastMediaState(room, room.updateMediaState(conn, func(state *MediaState) {
+					state.AudioMuted = reported.AudioMuted
+					state.VideoMuted = reported.VideoMuted
+					state.Pending = false
+				}))
+
+			case "mute-request", "mute-all", "unmute-all":
+				// Moderators only: mute-request asks one peer to mute; mute-all forces everyone else in
+				// the room, including later joiners, to mute until unmute-all
+				room := getRoom(roomID)
+				if room == nil || !room.hasMember(conn) {
+					logRoomEvent(roomID, "WARN", "User '%s' sent %s to room %s without joining it", conn.UserName, msg.Event, roomID)
+					continue
+				}
+				if !roomPermits(conn, room, actionMute) {
+					notifyEvent(conn, "mute-denied", roomID, "Only the host and co-hosts can mute other participants.")
+					continue
+				}
+
+				if msg.Event == "mute-request" {
+					var target SignalTarget
+					if err := json.Unmarshal(msg.Payload, &target); err != nil || !target.isSet() {
+						logRoomEvent(roomID, "WARN", "Invalid mute-request from '%s' in room %s: no target peer", conn.UserName, roomID)
+						continue
+					}
+
+					room.mu.RLock()
+					var muted []*Connection
+					for member := range room.Connections {
+						if member != conn && target.matches(member) {
+							muted = append(muted, member)
+						}
+					}
+					room.mu.RUnlock()
+
+					for _, member := range muted {
+						requestMute(conn, room, member)
+					}
+					logRoomEvent(roomID, "INFO", "User '%s' asked %d participants to mute in room %s", conn.UserName, len(muted), roomID)
+					continue
+				}
+
+				forceMuted := msg.Event == "mute-all"
+				room.mu.Lock()
+				room.forceMuted = forceMuted
+				if forceMuted {
+					room.forceMutedBy = conn.UserName
+				} else {
+					room.forceMutedBy = ""
+				}
+				var others []*Connection
+				for member := range room.Connections {
+					if member != conn {
+						others = append(others, member)
+					}
+				}
+				room.mu.Unlock()
+
+				payload, _ := json.Marshal(map[string]interface{}{
+					"muted":        forceMuted,
+					"fromUserName": conn.UserName,
+				})
+				broadcastJSON(conn, roomID, Message{
+					Event:   "force-mute",
+					RoomID:  roomID,
+					Payload: payload,
+				})
+				if forceMuted {
+					for _, member := range others {
+						markMutePending(room, member)
+					}
+				}
+				logRoomEvent(roomID, "INFO", "User '%s' sent %s in room %s to %d participants", conn.UserName, msg.Event, roomID, len(others))
+
+			case "admit", "deny":
+				// Moderators only: let a connection out of the waiting room, or turn it away
+				var decision struct {
+					PeerID string `json:"peerId"`
+				}
+				if err := json.Unmarshal(msg.Payload, &decision); err != nil || decision.PeerID == "" {
+					logRoomEvent(roomID, "WARN", "Invalid %s from '%s' in room %s", msg.Event, conn.UserName, roomID)
+					continue
+				}
+				room := getRoom(roomID)
+				if room == nil || !room.hasMember(conn) {
+					logRoomEvent(roomID, "WARN", "User '%s' sent %s to room %s without joining it", conn.UserName, msg.Event, roomID)
+					continue
+				}
+				if !roomPermits(conn, room, actionAdmit) {
+					notifyEvent(conn, "admit-denied", roomID, "Only the host and co-hosts can admit participants.")
+					continue
+				}
+
+				if msg.Event == "deny" {
+					denyPending(room, decision.PeerID, "The host did not let you in.")
+					continue
+				}
+				pending := room.takePending(decision.PeerID)
+				if pending == nil {
+					logRoomEvent(roomID, "WARN", "User '%s' admitted unknown peer %s to room %s", conn.UserName, decision.PeerID, roomID)
+					continue
+				}
+				logRoomEvent(roomID, "INFO", "User '%s' admitted '%s' to room %s", conn.UserName, pending.Conn.UserName, roomID)
+				if !admitToRoom(pending.Conn, room) {
+					notifyEvent(pending.Conn, "room-deleted", roomID, "This room has been deleted.")
+				}
+				logRoomStatus()
+
+			case "promote", "demote":
+				// Host-only: promote makes a signed-in participant a co-host, demote makes them a guest again
+				var target SignalTarget
+				if err := json.Unmarshal(msg.Payload, &target); err != nil || !target.isSet() {
+					logRoomEvent(roomID, "WARN", "Invalid %s from '%s' in room %s: no target peer", msg.Event, conn.UserName, roomID)
+					continue
+				}
+				room := getRoom(roomID)
+				if room == nil || !room.hasMember(conn) {
+					logRoomEvent(roomID, "WARN", "User '%s' sent %s to room %s without joining it", conn.UserName, msg.Event, roomID)
+					continue
+				}
+				if !roomPermits(conn, room, actionPromote) {
+					notifyEvent(conn, "role-change-denied", roomID, "Only the host can change participant roles.")
+					continue
+				}
+
+				room.mu.RLock()
+				var member *Connection
+				for other := range room.Connections {
+					if other != conn && target.matches(other) {
+						member = other
+						break
+					}
+				}
+				room.mu.RUnlock()
+				if member == nil || member.UserID == 0 {
+					notifyEvent(conn, "role-change-denied", roomID, "Only signed-in participants in the room can be given a role.")
+					continue
+				}
+				if room.roleOf(member) == roleHost {
+					notifyEvent(conn, "role-change-denied", roomID, "The host's role can't be changed.")
+					continue
+				}
+
+				role := roleCohost
+				if msg.Event == "demote" {
+					role = roleGuest
+				}
+				stored := role
+				if role == roleGuest {
+					stored = ""
+				}
+				if err := SetRoomRole(roomID, member.UserID, stored); err != nil {
+					logRoomEvent(roomID, "ERROR", "Error setting role for '%s' in room %s: %v", member.UserName, roomID, err)
+					notifyEvent(conn, "role-change-denied", roomID, "The role could not be changed.")
+					continue
+				}
+				room.mu.Lock()
+				if room.roles == nil {
+					room.roles = make(map[int64]string)
+				}
+				if role == roleGuest {
+					delete(room.roles, member.UserID)
+				} else {
+					room.roles[member.UserID] = role
+				}
+				room.mu.Unlock()
+
+				logRoomEvent(roomID, "INFO", "User '%s' made '%s' %s in room %s", conn.UserName, member.UserName, role, roomID)
+				payload, _ := json.Marshal(map[string]interface{}{
+					"userName": member.UserName,
+					"userId":   member.UserID,
+					"role":     role,
+				})
+				broadcastJSON(nil, roomID, Message{
+					Event:   "role-changed",
+					RoomID:  roomID,
+					Payload: payload,
+				})
+
+			case "end-room":
+				room := getRoom(roomID)
+				if room == nil || !room.hasMember(conn) {
+					logRoomEvent(roomID, "WARN", "User '%s' tried to end room %s without joining it", conn.UserName, roomID)
+					continue
+				}
+				if !roomPermits(conn, room, actionEndRoom) {
+					notifyEvent(conn, "end-room-denied", roomID, "Only the host can end the room.")
+					continue
+				}
+				endRoom(conn, room)
+
+			case "end-call":
+				room := getRoom(roomID)
+				if room == nil || !room.hasMember(conn) {
+					logRoomEvent(roomID, "WARN", "User '%s' tried to end the call in room %s without joining it", conn.UserName, roomID)
+					continue
+				}
+				if !roomPermits(conn, room, actionEndCall) {
+					notifyEvent(conn, "end-call-denied", roomID, "Only the host can end the call for everyone.")
+					continue
+				}
+				endCall(conn, room)
+
+			case "ban":
+				// Moderators only: bans a signed-in user from the room and removes them from it
+				var target SignalTarget
+				if err := json.Unmarshal(msg.Payload, &target); err != nil || target.TargetUserID <= 0 {
+					logRoomEvent(roomID, "WARN", "Invalid ban from '%s' in room %s", conn.UserName, roomID)
+					notifyEvent(conn, "ban-denied", roomID, "Only signed-in users can be banned.")
+					continue
+				}
+				room := getRoom(roomID)
+				if room == nil || !room.hasMember(conn) {
+					logRoomEvent(roomID, "WARN", "User '%s' tried to ban in room %s without joining it", conn.UserName, roomID)
+					continue
+				}
+				if info := room.info(); !roomPermits(conn, room, actionBan) || target.TargetUserID == conn.UserID || info == nil || target.TargetUserID == info.CreatedBy {
+					notifyEvent(conn, "ban-denied", roomID, "Only the host and co-hosts can ban other users, and the host can't be banned.")
+					continue
+				}
+				if err := BanUser(roomID, target.TargetUserID, conn.UserID); err != nil {
+					logRoomEvent(roomID, "ERROR", "Error banning user %d from room %s: %v", target.TargetUserID, roomID, err)
+					notifyEvent(conn, "ban-denied", roomID, "The user could not be banned.")
+					continue
+				}
+				logRoomEvent(roomID, "INFO", "User '%s' banned user %d from room %s", conn.UserName, target.TargetUserID, roomID)
+				ejectBannedUser(room, target.TargetUserID)
+
+			case "stats-report":
+				var report StatsReport
+				if err := json.Unmarshal(msg.Payload, &report); err != nil || !report.valid() {
+					logRoomEvent(roomID, "WARN", "Invalid stats report from '%s' in room %s", conn.UserName, roomID)
+					continue
+				}
+
+				room := getRoom(roomID)
+				if room == nil || !room.hasMember(conn) {
+					continue
+				}
+
+				// Clients report about every 10s; anything much faster is dropped
+				conn.mu.Lock()
+				tooSoon := time.Since(conn.lastStatsReport) < getEnvDuration("STATS_MIN_INTERVAL", 2*time.Second)
+				if !tooSoon {
+					conn.lastStatsReport = time.Now()
+				}
+				conn.mu.Unlock()
+				if tooSoon {
+					continue
+				}
+
+				room.addStats(StatsSample{StatsReport: report, UserName: conn.UserName, ReportedAt: time.Now()})
+
+			case "file-offer":
+				// Only the metadata passes through the server; the file itself goes over a data channel
+				var offer FileOffer
+				if err := json.Unmarshal(msg.Payload, &offer); err != nil || !validFileOffer(offer) {
+					logRoomEvent(roomID, "WARN", "Invalid file-offer from '%s' in room %s", conn.UserName, roomID)
+					notifyEvent(conn, "file-offer-rejected", roomID, "The file offer is invalid or the file is too large.")
+					continue
+				}
+				if room := getRoom(roomID); room == nil || !room.hasMember(conn) {
+					logRoomEvent(roomID, "WARN", "User '%s' sent file-offer to room %s without joining it", conn.UserName, roomID)
+					continue
+				}
+
+				fileOffersMutex.Lock()
+				if _, exists := fileOffers[offer.OfferID]; exists {
+					fileOffersMutex.Unlock()
+					notifyEvent(conn, "file-offer-rejected", roomID, "A file offer with this ID is already pending.")
+					continue
+				}
+				offerID := offer.OfferID
+				fileOffers[offerID] = &pendingFileOffer{
+					sender: conn,
+					roomID: roomID,
+					timer: time.AfterFunc(getEnvDuration("FILE_OFFER_TIMEOUT", time.Minute), func() {
+						expireFileOffer(offerID)
+					}),
+				}
+				fileOffersMutex.Unlock()
+
+				offer.FromUserName = conn.UserName
+				offer.FromUserID = conn.UserID
+				payload, _ := json.Marshal(offer)
+				relayed, _ := json.Marshal(Message{Event: "file-offer", RoomID: roomID, Payload: payload})
+				relayMessageToUser(conn, roomID, offer.SignalTarget, relayed)
+
+			case "file-answer":
+				var answer FileAnswer
+				if err := json.Unmarshal(msg.Payload, &answer); err != nil || answer.OfferID == "" {
+					logRoomEvent(roomID, "WARN", "Invalid file-answer from '%s' in room %s", conn.UserName, roomID)
+					continue
+				}
+
+				fileOffersMutex.Lock()
+				pending, ok := fileOffers[answer.OfferID]
+				if ok && (pending.roomID != roomID || pending.sender == conn) {
+					ok = false
+				}
+				if ok {
+					pending.timer.Stop()
+					delete(fileOffers, answer.OfferID)
+				}
+				fileOffersMutex.Unlock()
+				if !ok {
+					logRoomEvent(roomID, "WARN", "User '%s' answered unknown file offer %s in room %s", conn.UserName, answer.OfferID, roomID)
+					continue
+				}
+				if room := getRoom(roomID); room == nil || !room.hasMember(conn) {
+					continue
+				}
+
+				if !answer.Accepted {
+					answer.Reason = "declined"
+				} else {
+					answer.Reason = ""
+				}
+				answer.FromUserName = conn.UserName
+				answer.FromUserID = conn.UserID
+				payload, _ := json.Marshal(answer)
+				respondJSON(pending.sender, Message{
+					Event:   "file-answer",
+					RoomID:  roomID,
+					Payload: payload,
+				})
+
+			case "dtmf":
+				// Tones go to one peer only, e.g. the participant bridging to a phone line
+				var dtmf DTMFInfo
+				if err := json.Unmarshal(msg.Payload, &dtmf); err != nil || !dtmf.isSet() || !dtmfTones.MatchString(dtmf.Tones) {
+					logRoomEvent(roomID, "WARN", "Invalid dtmf from '%s' in room %s", conn.UserName, roomID)
+					continue
+				}
+				if !conn.allowEvent("dtmf", getEnvInt("DTMF_RATE_LIMIT", 5)) {
+					logRoomEvent(roomID, "WARN", "Dropped dtmf from '%s' in room %s: rate limit exceeded", conn.UserName, roomID)
+					continue
+				}
+
+				// Relay with the sender's identity rather than whatever the client claimed
+				target := dtmf.SignalTarget
+				dtmf.SignalTarget = SignalTarget{}
+				dtmf.FromUserName = conn.UserName
+				dtmf.FromUserID = conn.UserID
+				payload, _ := json.Marshal(dtmf)
+				relayed, _ := json.Marshal(Message{
+					Event:   "dtmf",
+					RoomID:  roomID,
+					Payload: payload,
+				})
+				relayMessageToUser(conn, roomID, target, relayed)
+
+			case "bwe-feedback":
+				// Bandwidth estimates go back to the sender of the media they describe, at most
+				// BWE_RATE_LIMIT (default 2) per second
+				var feedback BWEFeedback
+				if err := json.Unmarshal(msg.Payload, &feedback); err != nil || !feedback.valid() {
+					logRoomEvent(roomID, "WARN", "Invalid bwe-feedback from '%s' in room %s", conn.UserName, roomID)
+					continue
+				}
+				if !conn.allowEvent("bwe-feedback", getEnvInt("BWE_RATE_LIMIT", 2)) {
+					logMessage("DEBUG", "Dropped bwe-feedback from '%s' in room %s: rate limit exceeded", conn.UserName, roomID)
+					continue
+				}
+
+				// Relay with the sender's identity rather than whatever the client claimed
+				target := feedback.SignalTarget
+				feedback.SignalTarget = SignalTarget{}
+				feedback.FromUserName = conn.UserName
+				feedback.FromUserID = conn.UserID
+				payload, _ := json.Marshal(feedback)
+				relayed, _ := json.Marshal(Message{
+					Event:   "bwe-feedback",
+					RoomID:  roomID,
+					Payload: payload,
+				})
+				relayMessageToUser(conn, roomID, target, relayed)
+
+			case "call-metadata":
+				var metadata CallMetadata
+				if err := json.Unmarshal(msg.Payload, &metadata); err != nil || !metadata.valid() {
+					logRoomEvent(roomID, "WARN", "Invalid call-metadata from '%s' in room %s", conn.UserName, roomID)
+					continue
+				}
+				room := getRoom(roomID)
+				if room == nil || !room.hasMember(conn) {
+					logRoomEvent(roomID, "WARN", "User '%s' sent call-metadata to room %s without joining it", conn.UserName, roomID)
+					continue
+				}
+
+				// Relay with the sender's identity rather than whatever the client claimed
+				metadata.UserName = conn.UserName
+				metadata.UserID = conn.UserID
+				metadata.ReportedAt = time.Now()
+				if getEnvBool("CALL_METADATA_RETAIN", false) {
+					room.mu.Lock()
+					if room.callMetadata == nil {
+						room.callMetadata = make(map[string]CallMetadata)
+					}
+					room.callMetadata[conn.UserName] = metadata
+					room.mu.Unlock()
+				}
+				payload, _ := json.Marshal(metadata)
+				broadcastJSON(conn, roomID, Message{
+					Event:   "call-metadata",
+					RoomID:  roomID,
+					Payload: payload,
+				})
+
+			case "reaction":
+				var reaction ReactionInfo
+				if err := json.Unmarshal(msg.Payload, &reaction); err != nil || !validReaction(reaction.Emoji) || len(reaction.MessageID) > 64 {
+					logRoomEvent(roomID, "WARN", "Invalid reaction from '%s' in room %s", conn.UserName, roomID)
+					continue
+				}
+
+				room := getRoom(roomID)
+				if room == nil || !room.hasMember(conn) {
+					logRoomEvent(roomID, "WARN", "User '%s' sent reaction to room %s without joining it", conn.UserName, roomID)
+					continue
+				}
+				if !conn.allowEvent("reaction", getEnvInt("REACTION_RATE_LIMIT", 3)) {
+					logRoomEvent(roomID, "WARN", "Dropped reaction from '%s' in room %s: rate limit exceeded", conn.UserName, roomID)
+					continue
+				}
+
+				if reaction.MessageID != "" {
+					if limited := room.trackReaction(conn, reaction); limited != "" {
+						logRoomEvent(roomID, "INFO", "Rejected reaction from '%s' in room %s: %s", conn.UserName, roomID, limited)
+						notifyEvent(conn, "reaction-limit", roomID, limited)
+						continue
+					}
+				}
+
+				// Reactions are relayed with the sender's identity and never stored
+				reaction.UserName = conn.UserName
+				payload, _ := json.Marshal(reaction)
+				broadcastJSON(conn, roomID, Message{
+					Event:   "reaction",
+					RoomID:  roomID,
+					Payload: payload,
+				})
+
+			case "typing":
+				var typing TypingInfo
+				if err := json.Unmarshal(msg.Payload, &typing); err != nil || !typingScopes[typing.Scope] {
+					logRoomEvent(roomID, "WARN", "Invalid typing event from '%s' in room %s", conn.UserName, roomID)
+					continue
+				}
+
+				conn.mu.Lock()
+				if _, member := conn.rooms[roomID]; !member {
+					conn.mu.Unlock()
+					logRoomEvent(roomID, "WARN", "User '%s' sent typing to room %s without joining it", conn.UserName, roomID)
+					continue
+				}
+				if conn.typing == nil {
+					conn.typing = make(map[string]map[string]bool)
+				}
+				if conn.typing[roomID] == nil {
+					conn.typing[roomID] = make(map[string]bool)
+				}
+				conn.typing[roomID][typing.Scope] = typing.IsTyping
+				conn.mu.Unlock()
+
+				// Relay with the sender's identity rather than whatever the client claimed
+				typing.UserName = conn.UserName
+				payload, _ := json.Marshal(typing)
+				broadcastJSON(conn, roomID, Message{
+					Event:   "typing",
+					RoomID:  roomID,
+					Payload: payload,
+				})
+
+			case "conn-state":
+				// A client reporting a change in its WebRTC connection state, either to one peer or to
+				// the whole room; only room-wide states are kept for late joiners
+				var info ConnStateInfo
+				if err := json.Unmarshal(msg.Payload, &info); err != nil || !connStates[info.State] {
+					logRoomEvent(roomID, "WARN", "Invalid conn-state from '%s' in room %s", conn.UserName, roomID)
+					continue
+				}
+				room := getRoom(roomID)
+				if room == nil || !room.hasMember(conn) {
+					logRoomEvent(roomID, "WARN", "User '%s' sent conn-state to room %s without joining it", conn.UserName, roomID)
+					continue
+				}
+
+				// Relay with the sender's identity rather than whatever the client claimed
+				info.UserName = conn.UserName
+				info.UserID = conn.UserID
+				target := info.SignalTarget
+				info.SignalTarget = SignalTarget{}
+				payload, _ := json.Marshal(info)
+				relayed := Message{
+					Event:   "conn-state",
+					RoomID:  roomID,
+					Payload: payload,
+				}
+
+				if target.isSet() {
+					data, _ := json.Marshal(relayed)
+					relayMessageToUser(conn, roomID, target, data)
+					continue
+				}
+
+				room.mu.Lock()
+				if room.connStates == nil {
+					room.connStates = make(map[*Connection]string)
+				}
+				room.connStates[conn] = info.State
+				room.mu.Unlock()
+				broadcastJSON(conn, roomID, relayed)
+
+			case "offer", "answer", "ice-candidate":
+				// Relay to the addressed peer if there is one, otherwise to everyone else in the room
+				var target SignalTarget
+				if len(msg.Payload) > 0 {
+					json.Unmarshal(msg.Payload, &target)
+				}
+				if target.isSet() && renegotiationPolicy() != "off" {
+					// Overlapping ICE restarts between the same two peers are held back or refused
+					if room := getRoom(roomID); room != nil && room.hasMember(conn) {
+						if peer := room.findMember(target); peer != nil {
+							if msg.Event == "answer" {
+								// The answer has to arrive before any offer held back behind the restart it completes
+								relayMessageToUser(conn, roomID, target, message)
+								room.finishRenegotiation(peer, conn, nil)
+								continue
+							} else if msg.Event == "offer" && isICERestart(msg.Payload) {
+								relay, deferred := room.beginRenegotiation(conn, peer, target, message)
+								if deferred {
+									logRoomEvent(roomID, "INFO", "Deferred overlapping ICE restart from '%s' to '%s' in room %s", conn.UserName, peer.UserName, roomID)
+									notifyEvent(conn, "renegotiation-in-progress", roomID, "An ICE restart with this peer is already in progress; your offer will be sent once it completes.")
+								} else if !relay {
+									logRoomEvent(roomID, "INFO", "Rejected overlapping ICE restart from '%s' to '%s' in room %s", conn.UserName, peer.UserName, roomID)
+									notifyEvent(conn, "renegotiation-in-progress", roomID, "An ICE restart with this peer is already in progress; try again once it completes.")
+								}
+								if !relay {
+									continue
+								}
+							}
+						}
+					}
+				}
+				if target.isSet() {
+					relayMessageToUser(conn, roomID, target, message)
+				} else {
+					relayMessageToRoom(conn, roomID, message)
+				}
+
+			case "ice-complete":
+				// End of trickled candidates: only meaningful to the peer the candidates were sent to
+				var target SignalTarget
+				if err := json.Unmarshal(msg.Payload, &target); err != nil || !target.isSet() {
+					logRoomEvent(roomID, "WARN", "Invalid ice-complete from '%s' in room %s: no target peer", conn.UserName, roomID)
+					continue
+				}
+				if room := getRoom(roomID); room == nil || !room.hasMember(conn) {
+					logRoomEvent(roomID, "WARN", "User '%s' sent ice-complete to room %s without joining it", conn.UserName, roomID)
+					continue
+				}
+				relayMessageToUser(conn, roomID, target, message)
+			}
+		}
+	})
+
+	if err != nil {
+		// The upgrader has already answered with the matching status, e.g. 403 for a refused origin
+		logMessage("ERROR", "Error upgrading to websocket: %v", err)
+	}
+}
+
+func notifyUserJoined(conn *Connection, roomID, userName, role string) {
+	payload, _ := json.Marshal(map[string]string{
+		"userName": userName,
+		"role":     role,
+	})
+
+	userJoinedMsg := Message{
 		Event:   "user-joined",
 		RoomID:  roomID,
-		Payload: payload,
+		Payload: payload,
+	}
+
+	respondJSON(conn, userJoinedMsg)
+}
+
+// notifyConnState tells conn the last connection state peer reported to the room
+func notifyConnState(conn *Connection, roomID string, peer *Connection, state string) {
+	payload, _ := json.Marshal(ConnStateInfo{
+		State:    state,
+		UserName: peer.UserName,
+		UserID:   peer.UserID,
+	})
+	respondJSON(conn, Message{
+		Event:   "conn-state",
+		RoomID:  roomID,
+		Payload: payload,
+	})
+}
+
+// notifyTypingState tells conn which scopes a peer is currently typing in
+func notifyTypingState(conn *Connection, roomID string, peer *Connection) {
+	peer.mu.Lock()
+	var active []string
+	for scope, isTyping := range peer.typing[roomID] {
+		if isTyping {
+			active = append(active, scope)
+		}
+	}
+	peer.mu.Unlock()
+
+	for _, scope := range active {
+		payload, _ := json.Marshal(TypingInfo{
+			Scope:    scope,
+			IsTyping: true,
+			UserName: peer.UserName,
+		})
+		respondJSON(conn, Message{
+			Event:   "typing",
+			RoomID:  roomID,
+			Payload: payload,
+		})
+	}
+}
+
+// notifyEvent sends an event whose payload carries a human-readable message
+func notifyEvent(conn *Connection, event, roomID, text string) {
+	payload, _ := json.Marshal(map[string]string{
+		"message": text,
+	})
+
+	respondJSON(conn, Message{
+		Event:   event,
+		RoomID:  roomID,
+		Payload: payload,
+	})
+}
+
+// notifySessionExpired tells an anonymous user their session is over and closes the socket
+func notifySessionExpired(conn *Connection) {
+	notifyEvent(conn, "session-expired", "", "Your anonymous session has expired. Please sign in to continue.")
+
+	// Wait briefly so the notice goes out before the read loop closes the socket
+	select {
+	case <-conn.closeAfterSend(websocket.ClosePolicyViolation, "session expired"):
+	case <-time.After(time.Second):
+	}
+}
+
+// postSystemMessage relays a server-authored chat message to the whole room, if the room's
+// creator turned on system messages
+func postSystemMessage(room *Room, text string) {
+	if info := room.info(); info == nil || !info.SystemMessages {
+		return
+	}
+
+	payload, _ := json.Marshal(ChatMessage{
+		Text:   sanitizeText(text),
+		SentAt: time.Now(),
+		System: true,
+	})
+	broadcastJSON(nil, room.ID, Message{
+		Event:   "chat",
+		RoomID:  room.ID,
+		Payload: payload,
+	})
+}
+
+func notifyUserLeft(leavingConn *Connection, roomID, userName string) {
+	payload, _ := json.Marshal(map[string]string{
+		"userName": userName,
+	})
+
+	userLeftMsg := Message{
+		Event:   "user-left",
+		RoomID:  roomID,
+		Payload: payload,
+	}
+
+	// Find the room
+	room := getRoom(roomID)
+	if room == nil {
+		return
+	}
+
+	postSystemMessage(room, fmt.Sprintf("%s left the room", userName))
+
+	room.mu.RLock()
+	defer room.mu.RUnlock()
+
+	// Notify all other users in the room
+	for conn := range room.Connections {
+		if conn != leavingConn {
+			respondJSON(conn, userLeftMsg)
+			logMessage("INFO", "Notified user '%s' that '%s' left room %s",
+				conn.UserName, userName, roomID)
+		}
+	}
+}
+
+// getRoom returns the live room for an ID, or nil if nobody has joined it
+func getRoom(roomID string) *Room {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return rooms[roomID]
+}
+
+// roomIDPattern is the character set allowed in room IDs
+var roomIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// validateRoomID checks a room ID's length (3 to 50, the rooms.id column size) and characters
+func validateRoomID(roomID string) error {
+	if len(roomID) < 3 || len(roomID) > 50 {
+		return fmt.Errorf("room ID must be between 3 and 50 characters")
+	}
+	if !roomIDPattern.MatchString(roomID) {
+		return fmt.Errorf("room ID may only contain letters, digits, '_' and '-'")
+	}
+	return nil
+}
+
+// maxLiveRooms is the most rooms the server keeps live at once (MAX_LIVE_ROOMS, default 1000, 0 for no limit)
+func maxLiveRooms() int {
+	return getEnvInt("MAX_LIVE_ROOMS", 1000)
+}
+
+// getOrCreateRoom returns the live room for an ID, creating it if needed.
+// The second return value reports whether the room was newly created; the room is nil
+// when it would have to be created but the server is already at maxLiveRooms.
+func getOrCreateRoom(roomID string) (*Room, bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if room, ok := rooms[roomID]; ok {
+		// A join is on its way in, so keep compactRooms off this room for now
+		room.mu.Lock()
+		if !room.emptySince.IsZero() {
+			room.emptySince = time.Now()
+		}
+		room.mu.Unlock()
+		return room, false
+	}
+	if limit := maxLiveRooms(); limit > 0 && len(rooms) >= limit {
+		return nil, false
+	}
+	room := &Room{ID: roomID, Connections: make(map[*Connection]struct{}), emptySince: time.Now()}
+	rooms[roomID] = room
+	return room, true
+}
+
+// snapshotRooms copies the current rooms so callers can lock them one at a time
+// without holding the map lock
+func snapshotRooms() []*Room {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	snapshot := make([]*Room, 0, len(rooms))
+	for _, room := range rooms {
+		snapshot = append(snapshot, room)
+	}
+	return snapshot
+}
+
+// liveParticipantCounts returns how many connections are in each live room, by room ID
+func liveParticipantCounts() map[string]int {
+	counts := make(map[string]int)
+	for _, room := range snapshotRooms() {
+		room.mu.RLock()
+		counts[room.ID] = len(room.Connections)
+		room.mu.RUnlock()
+	}
+	return counts
+}
+
+// loadInfo caches the room's database row if it isn't cached yet
+func (r *Room) loadInfo() {
+	r.mu.RLock()
+	loaded := r.Info != nil
+	r.mu.RUnlock()
+	if loaded {
+		return
+	}
+
+	info, err := GetRoomByID(r.ID)
+	if err != nil {
+		logMessage("ERROR", "Error loading room %s: %v", r.ID, err)
+		return
+	}
+	var roles map[int64]string
+	if info != nil {
+		if roles, err = GetRoomRoles(r.ID); err != nil {
+			logMessage("ERROR", "Error loading roles for room %s: %v", r.ID, err)
+		}
+	}
+
+	r.mu.Lock()
+	r.Info = info
+	r.roles = roles
+	r.mu.Unlock()
+}
+
+// Room roles: the creator is always the host, co-hosts are appointed by the host and everyone
+// else is a guest
+const (
+	roleHost   = "host"
+	roleCohost = "cohost"
+	roleGuest  = "guest"
+)
+
+// Room actions that need more than the guest role
+const (
+	actionRecord  = "record"
+	actionMute    = "mute"
+	actionAdmit   = "admit"
+	actionBan     = "ban"
+	actionEndCall = "end-call"
+	actionEndRoom = "end-room"
+	actionPromote = "promote"
+)
+
+// rolePermissions lists the actions each role may take. Co-hosts moderate, but only the host
+// can record, end the call or change roles.
+var rolePermissions = map[string]map[string]bool{
+	roleHost: {
+		actionRecord: true, actionMute: true, actionAdmit: true,
+		actionBan: true, actionEndCall: true, actionEndRoom: true, actionPromote: true,
+	},
+	roleCohost: {
+		actionMute: true, actionAdmit: true, actionBan: true,
+	},
+}
+
+// roleOf returns conn's role in the room
+func (r *Room) roleOf(conn *Connection) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.roleOfLocked(conn)
+}
+
+// roleOfLocked is roleOf for callers already holding r.mu
+func (r *Room) roleOfLocked(conn *Connection) string {
+	if conn.UserID == 0 {
+		return roleGuest
+	}
+	if r.Info != nil && r.Info.CreatedBy == conn.UserID {
+		return roleHost
+	}
+	if role, ok := r.roles[conn.UserID]; ok {
+		return role
+	}
+	return roleGuest
+}
+
+// roomPermits reports whether conn's role in the room allows action
+func roomPermits(conn *Connection, room *Room, action string) bool {
+	return rolePermissions[room.roleOf(conn)][action]
+}
+
+// info returns the cached database row for the room, or nil for rooms that were never saved
+func (r *Room) info() *DbRoom {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.Info
+}
+
+// findMember returns the member a signaling message is addressed to, or nil if none is in the room
+func (r *Room) findMember(target SignalTarget) *Connection {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for conn := range r.Connections {
+		if target.matches(conn) {
+			return conn
+		}
+	}
+	return nil
+}
+
+// renegotiationKey identifies an ICE restart by the peer that offered it and the peer that must answer
+type renegotiationKey struct {
+	from, to *Connection
+}
+
+// renegotiation is an ICE restart awaiting its answer, along with the latest overlapping offer
+// held back until it completes
+type renegotiation struct {
+	timer          *time.Timer
+	deferred       []byte
+	deferredFrom   *Connection
+	deferredTarget SignalTarget
+}
+
+// renegotiationPolicy decides what happens to an ICE restart offer sent while another restart
+// between the same two peers is still unanswered: "reject" it (the default), "defer" it until the
+// first one completes, or "off" to relay every offer as it comes.
+func renegotiationPolicy() string {
+	switch policy := strings.ToLower(os.Getenv("RENEGOTIATION_POLICY")); policy {
+	case "reject", "defer", "off":
+		return policy
+	case "":
+		return "reject"
+	default:
+		logMessage("WARN", "Unknown RENEGOTIATION_POLICY '%s'; using reject", policy)
+		return "reject"
+	}
+}
+
+// isICERestart reports whether the client flagged an offer as an ICE restart
+func isICERestart(payload json.RawMessage) bool {
+	var offer struct {
+		ICERestart bool `json:"iceRestart"`
+	}
+	json.Unmarshal(payload, &offer)
+	return offer.ICERestart
+}
+
+// beginRenegotiation records an ICE restart from conn to peer and reports whether its offer may be
+// relayed now. If one between the two is already in flight the offer is instead held back, replacing
+// any held back before, under the defer policy, and refused otherwise.
+func (r *Room) beginRenegotiation(conn, peer *Connection, target SignalTarget, offer []byte) (relay, deferred bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	current := r.renegotiations[renegotiationKey{conn, peer}]
+	if current == nil {
+		current = r.renegotiations[renegotiationKey{peer, conn}]
+	}
+	if current == nil {
+		r.startRenegotiationLocked(conn, peer)
+		return true, false
+	}
+	if renegotiationPolicy() != "defer" {
+		return false, false
+	}
+	current.deferred = offer
+	current.deferredFrom = conn
+	current.deferredTarget = target
+	return false, true
+}
+
+// startRenegotiationLocked marks an ICE restart from one peer to another as in flight until it is
+// answered or RENEGOTIATION_TIMEOUT (default 10s) passes. r.mu must be held.
+func (r *Room) startRenegotiationLocked(from, to *Connection) {
+	if r.renegotiations == nil {
+		r.renegotiations = make(map[renegotiationKey]*renegotiation)
+	}
+	pending := &renegotiation{}
+	pending.timer = time.AfterFunc(getEnvDuration("RENEGOTIATION_TIMEOUT", 10*time.Second), func() {
+		logRoomEvent(r.ID, "WARN", "ICE restart from '%s' to '%s' in room %s was not answered in time", from.UserName, to.UserName, r.ID)
+		r.finishRenegotiation(from, to, pending)
+	})
+	r.renegotiations[renegotiationKey{from, to}] = pending
+}
+
+// finishRenegotiation clears the ICE restart from one peer to another and relays the offer held back
+// behind it, if any. When only is given, nothing happens unless that is still the restart in flight.
+func (r *Room) finishRenegotiation(from, to *Connection, only *renegotiation) {
+	key := renegotiationKey{from, to}
+	r.mu.Lock()
+	current := r.renegotiations[key]
+	if current == nil || (only != nil && current != only) {
+		r.mu.Unlock()
+		return
+	}
+	current.timer.Stop()
+	delete(r.renegotiations, key)
+	if current.deferred != nil {
+		peer := to
+		if current.deferredFrom == to {
+			peer = from
+		}
+		r.startRenegotiationLocked(current.deferredFrom, peer)
+	}
+	r.mu.Unlock()
+
+	if current.deferred != nil {
+		relayMessageToUser(current.deferredFrom, r.ID, current.deferredTarget, current.deferred)
+	}
+}
+
+// hasMember reports whether conn has joined the room
+func (r *Room) hasMember(conn *Connection) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	_, member := r.Connections[conn]
+	return member
+}
+
+// removeConnection removes conn from the room, reporting whether it was a member
+func (r *Room) removeConnection(conn *Connection) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, member := r.Connections[conn]; !member {
+		return false
+	}
+	delete(r.Connections, conn)
+	if session := r.sessions[conn]; session != nil {
+		delete(r.sessions, conn)
+		if r.Info != nil {
+			go recordRoomSession(RoomSession{
+				RoomID:           r.ID,
+				UserID:           conn.UserID,
+				UserName:         conn.UserName,
+				JoinedAt:         session.joinedAt,
+				LeftAt:           time.Now(),
+				Messages:         session.messages,
+				PeakParticipants: session.peak,
+			})
+		}
+	}
+	delete(r.media, conn)
+	delete(r.connStates, conn)
+	for key, pending := range r.renegotiations {
+		if key.from == conn || key.to == conn {
+			pending.timer.Stop()
+			delete(r.renegotiations, key)
+		}
+	}
+	logMessage("INFO", "Removed connection for user '%s' from room %s", conn.UserName, r.ID)
+
+	// Keep the room alive even if empty
+	// Only update active room status in memory, but don't delete from database; compactRooms
+	// drops it later if it isn't a saved, persistent room
+	if len(r.Connections) == 0 {
+		logMessage("INFO", "Room %s is now empty, but will be kept alive", r.ID)
+		r.stats = nil
+		r.statsNext = 0
+		r.emptySince = time.Now()
+		r.reactions = nil
+		r.reactionOrder = nil
+		r.callMetadata = nil
+		r.lastChat = nil
+	}
+	return true
+}
+
+// ejectBannedUser removes every connection of a just-banned user from a live room
+func ejectBannedUser(room *Room, userID int64) {
+	room.mu.RLock()
+	var banned []*Connection
+	for conn := range room.Connections {
+		if conn.UserID == userID {
+			banned = append(banned, conn)
+		}
+	}
+	room.mu.RUnlock()
+
+	for _, conn := range banned {
+		if !room.removeConnection(conn) {
+			continue
+		}
+		conn.forgetRoom(room)
+		notifyEvent(conn, "banned", room.ID, "You have been banned from this room.")
+		notifyUserLeft(conn, room.ID, conn.UserName)
+		if len(conn.joinedRooms()) == 0 {
+			dropResumeSession(conn)
+		}
+	}
+}
+
+// enterRoom adds conn to the live room roomID, creating it if needed, or to its waiting room.
+// The room may be removed between looking it up and joining it, in which case the join goes to
+// the room that replaces it.
+func enterRoom(conn *Connection, roomID string, waitingRoom bool) {
+	for attempt := 0; attempt < 3; attempt++ {
+		room, created := getOrCreateRoom(roomID)
+		if room == nil {
+			roomLimitRejections.Add(1)
+			logRoomEvent(roomID, "WARN", "Live room limit reached; refused room %s for '%s'", roomID, conn.UserName)
+			notifyEvent(conn, "room-limit-reached", roomID, "The server has too many active rooms. Please try again later.")
+			return
+		}
+		if created {
+			logRoomEvent(roomID, "INFO", "New room created: %s", roomID)
+
+			// If user is authenticated, add room to active rooms and database
+			if conn.UserName != "" && conn.UserName != "Anonymous" && conn.UserID > 0 {
+				addActiveRoom(roomID, conn.UserName, conn.UserID, waitingRoom)
+			}
+		}
+		room.loadInfo()
+		// Rooms with a waiting room hold joiners until the creator admits them
+		if holdInWaitingRoom(conn, room) || admitToRoom(conn, room) {
+			return
+		}
+		logRoomEvent(roomID, "INFO", "Room %s was removed while '%s' was joining; retrying", roomID, conn.UserName)
+	}
+	notifyEvent(conn, "room-deleted", roomID, "This room has been deleted.")
+}
+
+// admitToRoom adds conn to the room: existing peers and the newcomer are told about each other
+// and the newcomer gets its joined confirmation. It reports false, leaving conn out, if the room
+// was removed from the rooms map in the meantime.
+func admitToRoom(conn *Connection, room *Room) bool {
+	roomID := room.ID
+
+	room.mu.Lock()
+	if room.closed {
+		room.mu.Unlock()
+		return false
+	}
+	if conn.UserID > 0 {
+		recordRoomJoin(conn.UserID, roomID)
+	}
+	// Notify existing peers about the new user, unless it is already here
+	_, rejoined := room.Connections[conn]
+	if !rejoined {
+		for existingConn := range room.Connections {
+			// Tell existing user about the new user
+			notifyUserJoined(existingConn, roomID, conn.UserName, room.roleOfLocked(conn))
+
+			// Tell the new user about existing users
+			notifyUserJoined(conn, roomID, existingConn.UserName, room.roleOfLocked(existingConn))
+			notifyTypingState(conn, roomID, existingConn)
+			if state, ok := room.connStates[existingConn]; ok {
+				notifyConnState(conn, roomID, existingConn, state)
+			}
+		}
+	}
+
+	// Add the new connection to the room
+	room.Connections[conn] = struct{}{}
+	room.emptySince = time.Time{}
+	connectionCount := len(room.Connections)
+	if !rejoined {
+		if room.sessions == nil {
+			room.sessions = make(map[*Connection]*roomSession)
+		}
+		room.sessions[conn] = &roomSession{joinedAt: time.Now()}
+	}
+	for _, session := range room.sessions {
+		session.peak = max(session.peak, connectionCount)
+	}
+	room.mu.Unlock()
+
+	conn.mu.Lock()
+	if conn.rooms == nil {
+		conn.rooms = make(map[string]*Room)
+	}
+	conn.rooms[roomID] = room
+	conn.mu.Unlock()
+
+	if !rejoined {
+		postSystemMessage(room, fmt.Sprintf("%s joined the room", conn.UserName))
+	}
+
+	logRoomEvent(roomID, "INFO", "User '%s' joined room %s, connections: %d", conn.UserName, roomID, connectionCount)
+	touchRoom(roomID)
+
+	// Send join confirmation along with a token for resuming after a dropped connection
+	room.mu.RLock()
+	recording, recordingBy := room.recording, room.recordingBy
+	forceMuted, forceMutedBy := room.forceMuted, room.forceMutedBy
+	info := room.Info
+	room.mu.RUnlock()
+	if info == nil {
+		info = &DbRoom{}
+	}
+	joinedPayload, _ := json.Marshal(map[string]interface{}{
+		"resumeToken":    issueResumeToken(conn),
+		"resumeWindowMs": resumeGracePeriod().Milliseconds(),
+		"recording":      recording,
+		"recordingBy":    recordingBy,
+		"forceMuted":     forceMuted,
+		"name":           info.Name,
+		"description":    info.Description,
+		"role":           room.roleOf(conn),
+		"iceServers":     iceServersFor(turnUserFor(conn)),
+	})
+	response := Message{
+		Event:   "joined",
+		RoomID:  roomID,
+		Payload: joinedPayload,
+	}
+	respondJSON(conn, response)
+
+	// Joining while the room is muted mutes the newcomer too, unless they could lift it
+	if forceMuted && !rejoined && !roomPermits(conn, room, actionMute) {
+		payload, _ := json.Marshal(map[string]interface{}{
+			"muted":        true,
+			"fromUserName": forceMutedBy,
+		})
+		respondJSON(conn, Message{
+			Event:   "force-mute",
+			RoomID:  roomID,
+			Payload: payload,
+		})
+		markMutePending(room, conn)
+	}
+
+	// A moderator arriving late gets the requests that came in while they were away
+	if roomPermits(conn, room, actionAdmit) {
+		for _, pending := range room.pendingJoins() {
+			sendJoinRequest(conn, room, pending)
+		}
+	}
+	return true
+}
+
+// pendingJoin is a connection held in a room's waiting room
+type pendingJoin struct {
+	PeerID string
+	Conn   *Connection
+	timer  *time.Timer
+}
+
+// pendingJoins returns the connections waiting to be admitted to the room
+func (r *Room) pendingJoins() []*pendingJoin {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	pending := make([]*pendingJoin, 0, len(r.pending))
+	for _, p := range r.pending {
+		pending = append(pending, p)
+	}
+	return pending
+}
+
+// takePending removes and returns a waiting connection by peer ID, or nil if it is no longer waiting
+func (r *Room) takePending(peerID string) *pendingJoin {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	p, ok := r.pending[peerID]
+	if !ok {
+		return nil
+	}
+	delete(r.pending, peerID)
+	p.timer.Stop()
+	return p
+}
+
+// permittedConnections returns the connections in the room whose role allows action
+func (r *Room) permittedConnections(action string) []*Connection {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var permitted []*Connection
+	for conn := range r.Connections {
+		if rolePermissions[r.roleOfLocked(conn)][action] {
+			permitted = append(permitted, conn)
+		}
+	}
+	return permitted
+}
+
+// sendJoinRequest asks the creator to admit or deny a waiting connection
+func sendJoinRequest(creator *Connection, room *Room, pending *pendingJoin) {
+	payload, _ := json.Marshal(map[string]interface{}{
+		"peerId":   pending.PeerID,
+		"userName": pending.Conn.UserName,
+		"userId":   pending.Conn.UserID,
+	})
+	respondJSON(creator, Message{
+		Event:   "join-request",
+		RoomID:  room.ID,
+		Payload: payload,
+	})
+}
+
+// holdInWaitingRoom puts conn in the room's waiting room if the room has one and conn can't admit
+// people itself or is already in it, reporting whether it did. The host and co-hosts are asked to
+// admit the newcomer, who is denied automatically after WAITING_ROOM_TIMEOUT (default 2m).
+func holdInWaitingRoom(conn *Connection, room *Room) bool {
+	info := room.info()
+	if info == nil || !info.WaitingRoom || roomPermits(conn, room, actionAdmit) || room.hasMember(conn) {
+		return false
+	}
+
+	room.mu.Lock()
+	for _, p := range room.pending {
+		if p.Conn == conn {
+			room.mu.Unlock()
+			notifyEvent(conn, "waiting", room.ID, "Waiting for the host to let you in.")
+			return true
+		}
+	}
+	pending := &pendingJoin{PeerID: generateRandomToken(8), Conn: conn}
+	pending.timer = time.AfterFunc(getEnvDuration("WAITING_ROOM_TIMEOUT", 2*time.Minute), func() {
+		reason := "The host did not let you in in time."
+		if len(room.permittedConnections(actionAdmit)) == 0 {
+			reason = "The host is not in the room."
+		}
+		denyPending(room, pending.PeerID, reason)
+	})
+	if room.pending == nil {
+		room.pending = make(map[string]*pendingJoin)
+	}
+	room.pending[pending.PeerID] = pending
+	room.mu.Unlock()
+
+	payload, _ := json.Marshal(map[string]string{
+		"peerId":  pending.PeerID,
+		"message": "Waiting for the host to let you in.",
+	})
+	respondJSON(conn, Message{
+		Event:   "waiting",
+		RoomID:  room.ID,
+		Payload: payload,
+	})
+	for _, moderator := range room.permittedConnections(actionAdmit) {
+		sendJoinRequest(moderator, room, pending)
+	}
+	logRoomEvent(room.ID, "INFO", "User '%s' is waiting to be admitted to room %s", conn.UserName, room.ID)
+	return true
+}
+
+// denyPending turns a waiting connection away
+func denyPending(room *Room, peerID, reason string) {
+	pending := room.takePending(peerID)
+	if pending == nil {
+		return
+	}
+	notifyEvent(pending.Conn, "join-denied", room.ID, reason)
+	logRoomEvent(room.ID, "INFO", "User '%s' was not admitted to room %s: %s", pending.Conn.UserName, room.ID, reason)
+}
+
+// forgetPending drops conn from every waiting room it is in, e.g. once it disconnects
+func forgetPending(conn *Connection) {
+	for _, room := range snapshotRooms() {
+		for _, pending := range room.pendingJoins() {
+			if pending.Conn == conn {
+				room.takePending(pending.PeerID)
+			}
+		}
+	}
+}
+
+// cleanupConnection removes conn from every room it joined
+func cleanupConnection(conn *Connection) {
+	conn.mu.Lock()
+	joined := conn.rooms
+	conn.rooms = nil
+	conn.typing = nil
+	conn.mu.Unlock()
+
+	for _, room := range joined {
+		if room.removeConnection(conn) {
+			touchRoom(room.ID)
+		}
+	}
+	forgetPending(conn)
+}
+
+// roomActivityWrites holds when each room's activity was last written, by room ID
+var roomActivityWrites sync.Map
+
+// touchRoom records activity in a saved room, which keeps it from expiring under ROOM_RETENTION
+// and orders GET /rooms?sort=lastActive. A busy room is written at most once every
+// ROOM_ACTIVITY_WRITE_INTERVAL (default 30s).
+func touchRoom(roomID string) {
+	now := time.Now()
+	if last, ok := roomActivityWrites.Load(roomID); ok && now.Sub(last.(time.Time)) < getEnvDuration("ROOM_ACTIVITY_WRITE_INTERVAL", 30*time.Second) {
+		return
+	}
+	roomActivityWrites.Store(roomID, now)
+	if err := UpdateRoomActivity(roomID, now); err != nil {
+		logMessage("ERROR", "Error recording activity in room %s: %v", roomID, err)
+	}
+}
+
+// expireRooms deletes rooms with no activity for ROOM_RETENTION, unless their creator
+// marked them persistent, every ROOM_EXPIRY_SWEEP_INTERVAL (default 1h). ROOM_RETENTION is unset
+// (rooms are kept forever) by default; e.g. 24h removes rooms idle for a day.
+func expireRooms() {
+	retention := getEnvDuration("ROOM_RETENTION", 0)
+	if retention <= 0 {
+		return
+	}
+	ticker := time.NewTicker(getEnvDuration("ROOM_EXPIRY_SWEEP_INTERVAL", time.Hour))
+	defer ticker.Stop()
+	for {
+		expireIdleRooms(time.Now().Add(-retention))
+		<-ticker.C
+	}
+}
+
+// expireIdleRooms deletes the rooms idle since before cutoff from memory and the database,
+// leaving alone any that people are in or waiting to get into
+func expireIdleRooms(cutoff time.Time) {
+	roomIDs, err := GetExpiredRoomIDs(cutoff)
+	if err != nil {
+		logMessage("ERROR", "Error looking for expired rooms: %v", err)
+		return
+	}
+
+	var expired []string
+	for _, roomID := range roomIDs {
+		if room := getRoom(roomID); room != nil && !room.idleFor(0) {
+			continue
+		}
+		// The row is only deleted if no join touched it since it was listed
+		deleted, err := DeleteExpiredRoom(roomID, cutoff)
+		if err != nil {
+			logMessage("ERROR", "Error deleting expired room %s: %v", roomID, err)
+			continue
+		}
+		if !deleted {
+			continue
+		}
+		activeRooms.Delete(roomID)
+		removeLiveRoom(roomID)
+		expired = append(expired, roomID)
+	}
+	if len(expired) > 0 {
+		logMessage("INFO", "Deleted %d expired rooms: %v", len(expired), expired)
+	}
+}
+
+// compactRooms periodically drops live rooms that have been empty for ROOM_COMPACTION_MIN_IDLE
+// (default 10m) and have no saved record or an ephemeral one, every ROOM_COMPACTION_INTERVAL
+// (default 5m; 0 disables it). Persistent rooms are kept in memory as before.
+func compactRooms() {
+	interval := getEnvDuration("ROOM_COMPACTION_INTERVAL", 5*time.Minute)
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if compacted := compactEmptyRooms(getEnvDuration("ROOM_COMPACTION_MIN_IDLE", 10*time.Minute)); compacted > 0 {
+			logMessage("INFO", "Compacted %d empty rooms from memory", compacted)
+		}
+	}
+}
+
+// compactEmptyRooms drops the live rooms empty for at least minIdle that don't need to be kept,
+// returning how many were dropped
+func compactEmptyRooms(minIdle time.Duration) int {
+	compacted := 0
+	for _, room := range snapshotRooms() {
+		if !room.idleFor(minIdle) {
+			continue
+		}
+		saved, err := GetRoomByID(room.ID)
+		if err != nil {
+			logMessage("ERROR", "Error checking room %s for compaction: %v", room.ID, err)
+			continue
+		}
+		if saved != nil && !saved.Ephemeral {
+			continue
+		}
+
+		// Someone may have joined while the database was consulted
+		mutex.Lock()
+		if rooms[room.ID] == room && room.idleFor(minIdle) {
+			delete(rooms, room.ID)
+			room.mu.Lock()
+			room.closed = true
+			room.mu.Unlock()
+			roomActivityWrites.Delete(room.ID)
+			compacted++
+		}
+		mutex.Unlock()
+	}
+	return compacted
+}
+
+// idleFor reports whether the room has had nobody in it, waiting or admitted, for at least d
+func (r *Room) idleFor(d time.Duration) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return len(r.Connections) == 0 && len(r.pending) == 0 && !r.emptySince.IsZero() && time.Since(r.emptySince) >= d
+}
+
+// removeLiveRoom drops a room from memory and tells anyone still in it that it is gone
+func removeLiveRoom(roomID string) {
+	mutex.Lock()
+	room, ok := rooms[roomID]
+	delete(rooms, roomID)
+	mutex.Unlock()
+	roomActivityWrites.Delete(roomID)
+	roomTotalsCache.Delete(roomID)
+	if !ok {
+		return
+	}
+
+	room.mu.Lock()
+	room.closed = true
+	members := room.Connections
+	room.Connections = make(map[*Connection]struct{})
+	room.mu.Unlock()
+
+	for conn := range members {
+		conn.forgetRoom(room)
+		notifyEvent(conn, "room-deleted", roomID, "This room has been deleted.")
+	}
+}
+
+// reconcileOrphanedRooms cleans up rooms whose creator was removed outside the normal user
+// deletion flow, at startup and then every ORPHANED_ROOM_SWEEP_INTERVAL (default 1h).
+// ORPHANED_ROOM_POLICY picks what happens to them: "delete" (the default), "reassign" to the
+// ORPHANED_ROOM_OWNER account (default "system", created if missing), or "off".
+func reconcileOrphanedRooms() {
+	ticker := time.NewTicker(getEnvDuration("ORPHANED_ROOM_SWEEP_INTERVAL", time.Hour))
+	defer ticker.Stop()
+	for {
+		cleanupOrphanedRooms()
+		<-ticker.C
+	}
+}
+
+// cleanupOrphanedRooms applies ORPHANED_ROOM_POLICY to every room whose creator no longer exists
+func cleanupOrphanedRooms() {
+	policy := strings.ToLower(os.Getenv("ORPHANED_ROOM_POLICY"))
+	if policy == "" {
+		policy = "delete"
+	}
+	if policy == "off" {
+		return
+	}
+
+	roomIDs, err := GetOrphanedRoomIDs()
+	if err != nil {
+		logMessage("ERROR", "Error looking for orphaned rooms: %v", err)
+		return
+	}
+	if len(roomIDs) == 0 {
+		return
+	}
+
+	switch policy {
+	case "delete":
+		for _, roomID := range roomIDs {
+			if err := DeleteRoom(roomID); err != nil {
+				logRoomEvent(roomID, "ERROR", "Error deleting orphaned room %s: %v", roomID, err)
+				continue
+			}
+			removeLiveRoom(roomID)
+		}
+		logMessage("INFO", "Deleted %d orphaned rooms", len(roomIDs))
+
+	case "reassign":
+		owner, err := orphanedRoomOwner()
+		if err != nil {
+			logMessage("ERROR", "Error finding owner for orphaned rooms: %v", err)
+			return
+		}
+		for _, roomID := range roomIDs {
+			if err := ReassignRoom(roomID, owner.ID); err != nil {
+				logRoomEvent(roomID, "ERROR", "Error reassigning orphaned room %s: %v", roomID, err)
+				continue
+			}
+			if room := getRoom(roomID); room != nil {
+				room.mu.Lock()
+				if room.Info != nil {
+					info := *room.Info
+					info.CreatedBy = owner.ID
+					room.Info = &info
+				}
+				room.mu.Unlock()
+			}
+		}
+		logMessage("INFO", "Reassigned %d orphaned rooms to '%s'", len(roomIDs), owner.Username)
+
+	default:
+		logMessage("WARN", "Unknown ORPHANED_ROOM_POLICY '%s'; leaving %d orphaned rooms alone", policy, len(roomIDs))
+	}
+}
+
+// orphanedRoomOwner returns the ORPHANED_ROOM_OWNER account, creating it with an unusable
+// random password if it doesn't exist yet
+func orphanedRoomOwner() (*DbUser, error) {
+	username := os.Getenv("ORPHANED_ROOM_OWNER")
+	if username == "" {
+		username = "system"
+	}
+
+	user, err := GetUserByUsername(username)
+	if err != nil || user != nil {
+		return user, err
+	}
+	return CreateUser(username, hashPassword(generateRandomToken(32)), "")
+}
+
+// ResumeSession tracks a joined peer that may reattach a new socket after its connection drops,
+// keeping its place in all of its rooms
+type ResumeSession struct {
+	Conn  *Connection
+	timer *time.Timer // Running while the peer is detached
+}
+
+var (
+	// Resume sessions keyed by token; resumeMutex also guards Connection.resumeToken
+	resumeSessions = make(map[string]*ResumeSession)
+	resumeMutex    = sync.Mutex{}
+)
+
+// resumeGracePeriod is how long a dropped peer stays pending-left, keeping its place in the room
+// without a user-left broadcast, before it's removed (0 removes it immediately and disables resuming)
+func resumeGracePeriod() time.Duration {
+	return getEnvDuration("RESUME_GRACE_PERIOD", 30*time.Second)
+}
+
+// resumeQueueSize bounds how many messages are kept for a detached peer
+func resumeQueueSize() int {
+	return getEnvInt("RESUME_QUEUE_SIZE", 100)
+}
+
+// issueResumeToken creates a fresh resume token for conn, replacing any previous one
+func issueResumeToken(conn *Connection) string {
+	resumeMutex.Lock()
+	defer resumeMutex.Unlock()
+
+	if old, ok := resumeSessions[conn.resumeToken]; ok && old.timer != nil {
+		old.timer.Stop()
+	}
+	delete(resumeSessions, conn.resumeToken)
+
+	token := generateRandomToken(32)
+	resumeSessions[token] = &ResumeSession{Conn: conn}
+	conn.resumeToken = token
+	return token
+}
+
+// dropResumeSession forgets conn's resume token, e.g. after an explicit leave
+func dropResumeSession(conn *Connection) {
+	resumeMutex.Lock()
+	defer resumeMutex.Unlock()
+
+	if session, ok := resumeSessions[conn.resumeToken]; ok {
+		if session.timer != nil {
+			session.timer.Stop()
+		}
+		delete(resumeSessions, conn.resumeToken)
+	}
+	conn.resumeToken = ""
+}
+
+// detachConnection keeps a dropped peer in its room for the grace window, queueing messages for it.
+// It reports false when the connection can't be resumed and should be cleaned up right away.
+func detachConnection(conn *Connection) bool {
+	window := resumeGracePeriod()
+	if window <= 0 {
+		return false
+	}
+
+	resumeMutex.Lock()
+	defer resumeMutex.Unlock()
+
+	token := conn.resumeToken
+	session, ok := resumeSessions[token]
+	if !ok {
+		return false
+	}
+
+	conn.mu.Lock()
+	conn.detached = true
+	conn.mu.Unlock()
+
+	session.timer = time.AfterFunc(window, func() {
+		expireResumeSession(token)
+	})
+	logMessage("INFO", "User '%s' detached from rooms %v, holding their place for %s", conn.UserName, conn.joinedRoomIDs(), window)
+	return true
+}
+
+// expireResumeSession cleans up a detached peer that didn't come back in time
+func expireResumeSession(token string) {
+	resumeMutex.Lock()
+	session, ok := resumeSessions[token]
+	if ok {
+		delete(resumeSessions, token)
+		session.Conn.resumeToken = ""
+	}
+	resumeMutex.Unlock()
+
+	if !ok {
+		return
+	}
+
+	logMessage("INFO", "Resume window for '%s' in rooms %v expired", session.Conn.UserName, session.Conn.joinedRoomIDs())
+	notifyDisconnected(session.Conn)
+	cleanupConnection(session.Conn)
+}
+
+// endCall ends the call in a room for everyone: each participant gets call-ended and is
+// disconnected without a chance to resume, while the creator who ended it just leaves the room.
+// Unlike deleting the room, the saved room survives; END_CALL_ROOM_POLICY=close also drops the
+// live room from memory.
+func endCall(creator *Connection, room *Room) {
+	disconnected := dismissParticipants(creator, room, "call-ended", "The call has been ended by the room creator.", "call ended")
+
+	if strings.ToLower(os.Getenv("END_CALL_ROOM_POLICY")) == "close" {
+		removeLiveRoom(room.ID)
+	}
+	logMessage("INFO", "Call in room %s ended by '%s', disconnected %d participants", room.ID, creator.UserName, disconnected)
+}
+
+// endRoom ends a room for good: everyone gets room-ended and is disconnected and the live room is
+// dropped. The saved room is marked ended so its history remains (END_ROOM_POLICY=mark, the
+// default) or deleted (END_ROOM_POLICY=delete).
+func endRoom(creator *Connection, room *Room) {
+	disconnected := dismissParticipants(creator, room, "room-ended", "The room has been ended by the host.", "room ended")
+	removeLiveRoom(room.ID)
+
+	if info := room.info(); info != nil {
+		var err error
+		if strings.ToLower(os.Getenv("END_ROOM_POLICY")) == "delete" {
+			err = DeleteRoom(room.ID)
+		} else {
+			err = MarkRoomEnded(room.ID)
+		}
+		if err != nil {
+			logRoomEvent(room.ID, "ERROR", "Error ending room %s in the database: %v", room.ID, err)
+		}
+	}
+	logRoomEvent(room.ID, "INFO", "Room %s ended by '%s', disconnected %d participants", room.ID, creator.UserName, disconnected)
+}
+
+// dismissParticipants sends event to everyone in the room and disconnects them without a chance
+// to resume, while the creator who triggered it just leaves the room. It returns how many
+// participants were disconnected.
+func dismissParticipants(creator *Connection, room *Room, event, text, closeReason string) int {
+	room.mu.RLock()
+	participants := make([]*Connection, 0, len(room.Connections))
+	for conn := range room.Connections {
+		participants = append(participants, conn)
+	}
+	room.mu.RUnlock()
+
+	payload, _ := json.Marshal(map[string]string{
+		"message": text,
+		"endedBy": creator.UserName,
+	})
+	disconnected := 0
+	for _, conn := range participants {
+		room.removeConnection(conn)
+		conn.forgetRoom(room)
+		respondJSON(conn, Message{
+			Event:   event,
+			RoomID:  room.ID,
+			Payload: payload,
+		})
+		if conn == creator {
+			continue
+		}
+
+		disconnected++
+		conn.mu.Lock()
+		detached := conn.detached
+		conn.mu.Unlock()
+		dropResumeSession(conn)
+		if detached {
+			// Its read loop is already gone, so nothing else will clean it up
+			notifyDisconnected(conn)
+			cleanupConnection(conn)
+			continue
+		}
+		conn.closeAfterSend(websocket.CloseNormalClosure, closeReason)
+	}
+	return disconnected
+}
+
+// notifyDisconnected tells each of the peer's rooms it is gone for good after its connection dropped
+func notifyDisconnected(conn *Connection) {
+	for _, roomID := range conn.joinedRoomIDs() {
+		logRoomEvent(roomID, "INFO", "User '%s' disconnected from room %s", conn.UserName, roomID)
+		notifyUserLeft(conn, roomID, conn.UserName)
+	}
+}
+
+// reattachSession moves a detached peer onto a new socket. It returns the session, a rotated
+// token and the messages queued while the peer was away, or a nil session if the token is
+// unknown, expired, belongs to another user or the peer never dropped.
+func reattachSession(token string, ws *websocket.Conn, requester *Connection) (*ResumeSession, string, [][]byte) {
+	resumeMutex.Lock()
+	defer resumeMutex.Unlock()
+
+	session, ok := resumeSessions[token]
+	if token == "" || !ok {
+		return nil, "", nil
+	}
+	conn := session.Conn
+	if requester.UserID != 0 && requester.UserID != conn.UserID {
+		return nil, "", nil
+	}
+
+	conn.mu.Lock()
+	if !conn.detached {
+		conn.mu.Unlock()
+		return nil, "", nil
+	}
+	queued := conn.queued
+	conn.queued = nil
+	conn.detached = false
+	conn.Conn = ws
+	conn.mu.Unlock()
+
+	if session.timer != nil {
+		session.timer.Stop()
+		session.timer = nil
+	}
+
+	// Rotate the token so a leaked one can only be used once
+	delete(resumeSessions, token)
+	newToken := generateRandomToken(32)
+	resumeSessions[newToken] = session
+	conn.resumeToken = newToken
+
+	return session, newToken, queued
+}
+
+func relayMessageToRoom(sender *Connection, roomID string, message []byte) {
+	room := getRoom(roomID)
+	if room == nil {
+		logRoomEvent(roomID, "WARN", "Room %s not found", roomID)
+		return
+	}
+
+	if !room.hasMember(sender) {
+		logRoomEvent(roomID, "WARN", "User '%s' relayed to room %s without joining it", sender.UserName, roomID)
+		return
+	}
+
+	// Holding sendMu while stamping and writing keeps every receiver in sequence order
+	room.sendMu.Lock()
+	defer room.sendMu.Unlock()
+	stamped, msgType := room.stampLocked(message)
+
+	room.mu.RLock()
+	defer room.mu.RUnlock()
+
+	// Every peer gets the same bytes; WriteMessage compresses per connection only when
+	// that peer negotiated permessage-deflate
+	for conn := range room.Connections {
+		if conn != sender {
+			if err := conn.writeMessage(msgType, stamped); err != nil {
+				logMessage("ERROR", "Error sending %s message: %v", msgType, err)
+			} else {
+				logMessage("INFO", "Relayed %s message from '%s' to '%s' in room %s",
+					msgType, sender.UserName, conn.UserName, roomID)
+			}
+		}
+	}
+}
+
+// relayMessageToUser sends a message only to the addressed peer within the room
+func relayMessageToUser(sender *Connection, roomID string, target SignalTarget, message []byte) {
+	room := getRoom(roomID)
+	if room == nil {
+		logRoomEvent(roomID, "WARN", "Room %s not found", roomID)
+		return
+	}
+
+	if !room.hasMember(sender) {
+		logRoomEvent(roomID, "WARN", "User '%s' relayed to room %s without joining it", sender.UserName, roomID)
+		return
+	}
+
+	room.sendMu.Lock()
+	defer room.sendMu.Unlock()
+	stamped, msgType := room.stampLocked(message)
+
+	room.mu.RLock()
+	defer room.mu.RUnlock()
+
+	for conn := range room.Connections {
+		if conn == sender || !target.matches(conn) {
+			continue
+		}
+		if err := conn.writeMessage(msgType, stamped); err != nil {
+			logMessage("ERROR", "Error sending %s message: %v", msgType, err)
+		} else {
+			logMessage("INFO", "Relayed %s message from '%s' to '%s' in room %s",
+				msgType, sender.UserName, conn.UserName, roomID)
+		}
+		return
+	}
+
+	logMessage("WARN", "Target peer '%s' (ID: %d) for %s message not found in room %s",
+		target.Target, target.TargetUserID, msgType, roomID)
+}
+
+// broadcastJSON sends msg to every connection in the room except the sender
+func broadcastJSON(sender *Connection, roomID string, msg Message) {
+	room := getRoom(roomID)
+	if room == nil {
+		logRoomEvent(roomID, "WARN", "Room %s not found", roomID)
+		return
+	}
+
+	if sender != nil && !room.hasMember(sender) {
+		logRoomEvent(roomID, "WARN", "User '%s' broadcast %s to room %s without joining it", sender.UserName, msg.Event, roomID)
+		return
+	}
+
+	room.sendMu.Lock()
+	defer room.sendMu.Unlock()
+	msg.Seq = room.nextSeqLocked()
+
+	room.mu.RLock()
+	defer room.mu.RUnlock()
+
+	for conn := range room.Connections {
+		if sender == nil || conn != sender {
+			respondJSON(conn, msg)
+		}
+	}
+}
+
+// nextSeqLocked returns the room's next sequence number; r.sendMu must be held
+func (r *Room) nextSeqLocked() uint64 {
+	r.seq++
+	return r.seq
+}
+
+// stampLocked adds the room's next sequence number to a relayed client frame so receivers can
+// detect gaps, returning the new frame and its event type; r.sendMu must be held
+func (r *Room) stampLocked(message []byte) ([]byte, string) {
+	var msg Message
+	if err := json.Unmarshal(message, &msg); err != nil {
+		return message, "unknown"
+	}
+
+	msg.Seq = r.nextSeqLocked()
+	stamped, err := json.Marshal(msg)
+	if err != nil {
+		logMessage("ERROR", "Error marshaling JSON: %v", err)
+		return message, msg.Event
+	}
+	return stamped, msg.Event
+}
+
+func respondJSON(conn *Connection, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		logMessage("ERROR", "Error marshaling JSON: %v", err)
+		return
+	}
+
+	var event string
+	if msg, ok := v.(Message); ok {
+		event = msg.Event
+	}
+
+	if err := conn.writeMessage(event, data); err != nil {
+		logMessage("ERROR", "Error sending message: %v", err)
+	}
+}
+
+func logRoomStatus() {
+	logMessage("INFO", "Current room status:")
+	for _, room := range snapshotRooms() {
+		room.mu.RLock()
+		userNames := make([]string, 0, len(room.Connections))
+		for conn := range room.Connections {
+			userNames = append(userNames, conn.UserName)
+		}
+		room.mu.RUnlock()
+		logMessage("INFO", "  Room %s: %d connections - Users: %v", room.ID, len(userNames), userNames)
+	}
+}
+
+// handleDeleteRoom is the body-based POST /rooms/delete. It is deprecated in favour of
+// DELETE /rooms/{id} and will be removed in the next release.
+func handleDeleteRoom(ctx *fasthttp.RequestCtx, username string, userID int64) {
+	ctx.Response.Header.Set("Deprecation", "true")
+
+	// Parse request body
+	var requestBody struct {
+		RoomID string `json:"roomId"`
+	}
+
+	if err := json.Unmarshal(ctx.PostBody(), &requestBody); err != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(`{"error":"invalid request body"}`)
+		return
+	}
+
+	roomID := requestBody.RoomID
+	if roomID == "" {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(`{"error":"room ID is required"}`)
+		return
+	}
+	if !deleteRoomFor(ctx, roomID, username, userID) {
+		return
+	}
+
+	ctx.SetContentType("application/json")
+	ctx.SetBodyString(`{"message":"room deleted successfully"}`)
+}
+
+// handleDeleteRoomByID deletes the room named in a DELETE /rooms/{id} request, answering 204
+func handleDeleteRoomByID(ctx *fasthttp.RequestCtx, username string, userID int64) {
+	if deleteRoomFor(ctx, roomDetailID(string(ctx.Path())), username, userID) {
+		ctx.SetStatusCode(fasthttp.StatusNoContent)
+	}
+}
+
+// deleteRoomFor deletes a room on behalf of its creator: the saved row, the live room, whose
+// members are told, and its activeRooms entry. It writes the error response and returns false
+// if the room can't be deleted.
+func deleteRoomFor(ctx *fasthttp.RequestCtx, roomID, username string, userID int64) bool {
+	if err := validateRoomID(roomID); err != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(fmt.Sprintf(`{"error":"%s"}`, err.Error()))
+		return false
+	}
+
+	// Get room from database
+	room, err := GetRoomByID(roomID)
+	if err != nil {
+		logMessage("ERROR", "Error fetching room: %v", err)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString(`{"error":"internal server error"}`)
+		return false
+	}
+
+	if room == nil {
+		ctx.SetStatusCode(fasthttp.StatusNotFound)
+		ctx.SetBodyString(`{"error":"room not found"}`)
+		return false
+	}
+
+	// Check if user is the creator of the room
+	if room.CreatedBy != userID {
+		ctx.SetStatusCode(fasthttp.StatusForbidden)
+		ctx.SetBodyString(`{"error":"only the room creator can delete the room"}`)
+		return false
+	}
+
+	// Remove room from database
+	if err := DeleteRoom(roomID); err != nil {
+		logMessage("ERROR", "Error deleting room: %v", err)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString(`{"error":"error deleting room"}`)
+		return false
+	}
+
+	// Remove room from active rooms map
+	removeLiveRoom(roomID)
+
+	// Remove from active rooms tracking
+	activeRooms.Delete(roomID)
+
+	logRoomEvent(roomID, "INFO", "Room %s deleted by user %s (%d)", roomID, username, userID)
+	return true
+}
+
+// assignJoinCode gives a room a fresh join code no other room has, returning it
+func assignJoinCode(roomID string) (string, error) {
+	var err error
+	for attempt := 0; attempt < 5; attempt++ {
+		code := generateJoinCode()
+		var existing *DbRoom
+		if existing, err = GetRoomByJoinCode(code); err != nil {
+			return "", err
+		}
+		if existing != nil {
+			continue
+		}
+		// The unique column still turns away a room that claimed the code in the meantime
+		if err = SetRoomJoinCode(roomID, code); err == nil {
+			return code, nil
+		}
+	}
+	if err == nil {
+		err = errors.New("no unused join code found")
+	}
+	return "", err
+}
+
+// joinCodePattern matches a well-formed join code
+var joinCodePattern = regexp.MustCompile(`^[` + joinCodeAlphabet + `]{6}$`)
+
+// joinCodeLookups counts each client IP's /join/ lookups in the current minute
+var (
+	joinCodeLookups      = make(map[string]*eventWindow)
+	joinCodeLookupsMutex = sync.Mutex{}
+)
+
+// allowJoinCodeLookup counts a lookup from ip against JOIN_CODE_RATE_LIMIT (default 20) a minute,
+// reporting whether it may go ahead. Every lookup holds a worker for JOIN_CODE_LOOKUP_TIME, so
+// without a limit one client guessing codes could tie up all of them.
+func allowJoinCodeLookup(ip string) bool {
+	joinCodeLookupsMutex.Lock()
+	defer joinCodeLookupsMutex.Unlock()
+
+	now := time.Now()
+	window := joinCodeLookups[ip]
+	if window == nil || now.Sub(window.start) >= time.Minute {
+		// Forget clients whose minute is up
+		for key, w := range joinCodeLookups {
+			if now.Sub(w.start) >= time.Minute {
+				delete(joinCodeLookups, key)
+			}
+		}
+		window = &eventWindow{start: now}
+		joinCodeLookups[ip] = window
+	}
+	if window.count >= getEnvInt("JOIN_CODE_RATE_LIMIT", 20) {
+		return false
+	}
+	window.count++
+	return true
+}
+
+// handleJoinCode resolves a join code to the room details, as GET /rooms/{id} returns them, so
+// the frontend can send the caller on to the call. The whole answer is worked out first and then
+// held back until JOIN_CODE_LOOKUP_TIME (default 200ms) has passed, found or not, so response
+// times don't tell which codes exist; a failed lookup answers at once, since it says nothing
+// about the code.
+func handleJoinCode(ctx *fasthttp.RequestCtx, username string, userID int64) {
+	if !allowJoinCodeLookup(ctx.RemoteIP().String()) {
+		ctx.SetStatusCode(fasthttp.StatusTooManyRequests)
+		ctx.Response.Header.Set("Retry-After", "60")
+		ctx.SetBodyString(`{"error":"too many join code lookups, please try again later"}`)
+		return
+	}
+	answerAt := time.Now().Add(getEnvDuration("JOIN_CODE_LOOKUP_TIME", 200*time.Millisecond))
+
+	code := strings.ToUpper(strings.TrimPrefix(string(ctx.Path()), "/join/"))
+	var detail *RoomDetail
+	if joinCodePattern.MatchString(code) {
+		room, err := GetRoomByJoinCode(code)
+		if err == nil && room != nil {
+			detail, err = roomDetailFor(room, userID)
+		}
+		if err != nil {
+			logMessage("ERROR", "Error looking up join code: %v", err)
+			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+			ctx.SetBodyString(`{"error":"internal server error"}`)
+			return
+		}
+	}
+
+	time.Sleep(time.Until(answerAt))
+	if detail == nil {
+		ctx.SetStatusCode(fasthttp.StatusNotFound)
+		ctx.SetBodyString(`{"error":"room not found"}`)
+		return
+	}
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(detail)
+}
+
+// handleRegenerateJoinCode gives a room a new join code; the old one stops working at once.
+// Only the room's creator may do so.
+func handleRegenerateJoinCode(ctx *fasthttp.RequestCtx, username string, userID int64) {
+	room := roomForCreator(ctx, userID, "regenerate its join code")
+	if room == nil {
+		return
+	}
+
+	code, err := assignJoinCode(room.ID)
+	if err != nil {
+		logRoomEvent(room.ID, "ERROR", "Error regenerating join code for room %s: %v", room.ID, err)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString(`{"error":"error regenerating join code"}`)
+		return
+	}
+	if liveRoom := getRoom(room.ID); liveRoom != nil {
+		liveRoom.mu.Lock()
+		if liveRoom.Info != nil {
+			updated := *liveRoom.Info
+			updated.JoinCode = code
+			liveRoom.Info = &updated
+		}
+		liveRoom.mu.Unlock()
+	}
+
+	logRoomEvent(room.ID, "INFO", "Join code for room %s regenerated by user %s (%d)", room.ID, username, userID)
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(map[string]string{
+		"roomId":   room.ID,
+		"joinCode": code,
+	})
+}
+
+// handleGetRoom returns one room for the pre-join screen. Anyone may look a room up; signed-in
+// callers also get the names of the people in it right now.
+func handleGetRoom(ctx *fasthttp.RequestCtx, username string, userID int64) {
+	roomID := roomDetailID(string(ctx.Path()))
+	if err := validateRoomID(roomID); err != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(fmt.Sprintf(`{"error":"%s"}`, err.Error()))
+		return
+	}
+
+	room, err := GetRoomByID(roomID)
+	if err != nil {
+		logMessage("ERROR", "Error fetching room: %v", err)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString(`{"error":"internal server error"}`)
+		return
+	}
+	if room == nil {
+		ctx.SetStatusCode(fasthttp.StatusNotFound)
+		ctx.SetBodyString(`{"error":"room not found"}`)
+		return
+	}
+	writeRoomDetail(ctx, room, userID)
+}
+
+// RoomDetail is a room's public details, as GET /rooms/{id} and GET /join/{code} answer with them
+type RoomDetail struct {
+	ID               string     `json:"id"`
+	Name             string     `json:"name,omitempty"`
+	Description      string     `json:"description,omitempty"`
+	CreatedBy        string     `json:"createdBy"`
+	CreatedAt        time.Time  `json:"createdAt"`
+	AllowAnonymous   bool       `json:"allowAnonymous"`
+	ReadOnly         bool       `json:"readOnly"`
+	SystemMessages   bool       `json:"systemMessages"`
+	WaitingRoom      bool       `json:"waitingRoom"`
+	SlowModeSeconds  int        `json:"slowModeSeconds"`
+	EndedAt          *time.Time `json:"endedAt,omitempty"`
+	LastActiveAt     *time.Time `json:"lastActiveAt,omitempty"`
+	ParticipantCount int        `json:"participantCount"`
+	IsActive         bool       `json:"isActive"`
+	Locked           bool       `json:"locked"`
+	Participants     []string   `json:"participants,omitempty"` // Signed-in callers only
+}
+
+// roomDetailFor gathers a room's public details, adding who is in it for signed-in callers
+func roomDetailFor(room *DbRoom, userID int64) (*RoomDetail, error) {
+	creator, err := GetUserByID(room.CreatedBy)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching room creator: %v", err)
+	}
+	creatorName := ""
+	if creator != nil {
+		creatorName = creator.Username
+	}
+
+	var participants []string
+	if liveRoom := getRoom(room.ID); liveRoom != nil {
+		liveRoom.mu.RLock()
+		for conn := range liveRoom.Connections {
+			participants = append(participants, conn.UserName)
+		}
+		liveRoom.mu.RUnlock()
+	}
+	sort.Strings(participants)
+
+	detail := &RoomDetail{
+		ID:               room.ID,
+		Name:             room.Name,
+		Description:      room.Description,
+		CreatedBy:        creatorName,
+		CreatedAt:        room.CreatedAt,
+		AllowAnonymous:   room.AllowAnonymous,
+		ReadOnly:         room.ReadOnly,
+		SystemMessages:   room.SystemMessages,
+		WaitingRoom:      room.WaitingRoom,
+		SlowModeSeconds:  room.SlowModeSeconds,
+		EndedAt:          room.EndedAt,
+		LastActiveAt:     room.LastActiveAt,
+		ParticipantCount: len(participants),
+		IsActive:         len(participants) > 0,
+		Locked:           room.EndedAt != nil || room.WaitingRoom,
+	}
+	if userID > 0 {
+		detail.Participants = participants
+	}
+	return detail, nil
+}
+
+// writeRoomDetail answers with a room's public details
+func writeRoomDetail(ctx *fasthttp.RequestCtx, room *DbRoom, userID int64) {
+	detail, err := roomDetailFor(room, userID)
+	if err != nil {
+		logMessage("ERROR", "Error fetching room details: %v", err)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString(`{"error":"internal server error"}`)
+		return
+	}
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(detail)
+}
+
+// roomCreatePolicy decides who may create a room just by joining an ID that isn't saved yet:
+// "any" user, signed-in users only ("auth", the default) or nobody ("rest"), leaving POST /rooms
+// as the only way in. ROOM_CREATE_REQUIRES_AUTH=false from older deployments still means "any".
+func roomCreatePolicy() string {
+	switch policy := strings.ToLower(os.Getenv("ROOM_CREATE_POLICY")); policy {
+	case "any", "auth", "rest":
+		return policy
+	case "":
+		if os.Getenv("ROOM_CREATE_REQUIRES_AUTH") != "" && !getEnvBool("ROOM_CREATE_REQUIRES_AUTH", true) {
+			return "any"
+		}
+		return "auth"
+	default:
+		logMessage("WARN", "Unknown ROOM_CREATE_POLICY '%s'; using auth", policy)
+		return "auth"
+	}
+}
+
+// Limits on a room's display name and description, in characters
+const (
+	maxRoomNameLength        = 100
+	maxRoomDescriptionLength = 500
+)
+
+// cleanRoomText strips control characters and surrounding space from a room's name or
+// description, checks it fits within limit characters and neutralizes any markup in it
+func cleanRoomText(field, value string, limit int) (string, error) {
+	value = strings.TrimSpace(stripControlChars(value))
+	if utf8.RuneCountInString(value) > limit {
+		return "", fmt.Errorf("%s must be at most %d characters", field, limit)
+	}
+	return sanitizeText(value), nil
+}
+
+// handleCreateRoom saves a new room for the caller under a generated ID, so a link can be shared
+// before anyone joins. The name and settings are optional and default as for rooms created by joining.
+func handleCreateRoom(ctx *fasthttp.RequestCtx, username string, userID int64) {
+	var req struct {
+		Name           string `json:"name"`
+		Description    string `json:"description"`
+		AllowAnonymous *bool  `json:"allowAnonymous"`
+		ReadOnly       bool   `json:"readOnly"`
+		SystemMessages bool   `json:"systemMessages"`
+		WaitingRoom    bool   `json:"waitingRoom"`
+		Ephemeral      bool   `json:"ephemeral"`
+	}
+	if body := ctx.PostBody(); len(body) > 0 {
+		if err := json.Unmarshal(body, &req); err != nil {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			ctx.SetBodyString(`{"error":"invalid request body"}`)
+			return
+		}
+	}
+	name, err := cleanRoomText("name", req.Name, maxRoomNameLength)
+	if err == nil {
+		req.Description, err = cleanRoomText("description", req.Description, maxRoomDescriptionLength)
+	}
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(fmt.Sprintf(`{"error":"%s"}`, err.Error()))
+		return
+	}
+
+	owned, err := CountRoomsByUserID(userID)
+	if err != nil {
+		logMessage("ERROR", "Error counting rooms for user %s: %v", username, err)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString(`{"error":"internal server error"}`)
+		return
+	}
+	if owned >= maxRoomsPerUser() {
+		roomLimitRejections.Add(1)
+		ctx.SetStatusCode(fasthttp.StatusForbidden)
+		ctx.SetBodyString(`{"error":"room limit reached"}`)
+		return
+	}
+
+	// 12 random bytes make collisions vanishingly rare, but check anyway
+	var roomID string
+	for attempt := 0; attempt < 3 && roomID == ""; attempt++ {
+		candidate := generateRandomToken(12)
+		existing, err := GetRoomByID(candidate)
+		if err != nil {
+			logMessage("ERROR", "Error checking room %s: %v", candidate, err)
+			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+			ctx.SetBodyString(`{"error":"internal server error"}`)
+			return
+		}
+		if existing == nil {
+			roomID = candidate
+		}
+	}
+	if roomID == "" {
+		logMessage("ERROR", "Could not generate a free room ID for user %s", username)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString(`{"error":"internal server error"}`)
+		return
+	}
+
+	created, err := CreateRoom(&DbRoom{
+		ID:             roomID,
+		Name:           name,
+		Description:    req.Description,
+		CreatedBy:      userID,
+		AllowAnonymous: req.AllowAnonymous == nil || *req.AllowAnonymous,
+		ReadOnly:       req.ReadOnly,
+		SystemMessages: req.SystemMessages,
+		WaitingRoom:    req.WaitingRoom,
+		Ephemeral:      req.Ephemeral,
+	})
+	if err != nil {
+		logMessage("ERROR", "Error creating room for user %s: %v", username, err)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString(`{"error":"error creating room"}`)
+		return
+	}
+	activeRooms.Store(roomID, ActiveRoom{
+		ID:        roomID,
+		CreatedBy: username,
+		CreatedAt: created.CreatedAt,
+	})
+	// The room works without a code; the creator can ask for one again later
+	if created.JoinCode, err = assignJoinCode(roomID); err != nil {
+		logMessage("ERROR", "Error assigning a join code to room %s: %v", roomID, err)
+	}
+
+	logRoomEvent(roomID, "INFO", "User %s (%d) created room %s", username, userID, roomID)
+	ctx.SetStatusCode(fasthttp.StatusCreated)
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(created)
+}
+
+// handleUpdateRoom renames a room or changes its description; only its creator may. Fields left
+// out are kept, and people in the live room get a room-updated event.
+func handleUpdateRoom(ctx *fasthttp.RequestCtx, username string, userID int64) {
+	var req struct {
+		Name        *string `json:"name"`
+		Description *string `json:"description"`
+	}
+	if err := json.Unmarshal(ctx.PostBody(), &req); err != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(`{"error":"invalid request body"}`)
+		return
+	}
+
+	room := roomForCreator(ctx, userID, "edit it")
+	if room == nil {
+		return
+	}
+
+	var err error
+	if req.Name != nil {
+		room.Name, err = cleanRoomText("name", *req.Name, maxRoomNameLength)
+	}
+	if err == nil && req.Description != nil {
+		room.Description, err = cleanRoomText("description", *req.Description, maxRoomDescriptionLength)
+	}
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(fmt.Sprintf(`{"error":"%s"}`, err.Error()))
+		return
+	}
+	if err := UpdateRoomDetails(room); err != nil {
+		logRoomEvent(room.ID, "ERROR", "Error updating room %s: %v", room.ID, err)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString(`{"error":"error updating room"}`)
+		return
+	}
+
+	// Keep the live room's cached copy in sync and refresh everyone's title
+	if liveRoom := getRoom(room.ID); liveRoom != nil {
+		liveRoom.mu.Lock()
+		liveRoom.Info = room
+		liveRoom.mu.Unlock()
+
+		payload, _ := json.Marshal(map[string]string{
+			"name":         room.Name,
+			"description":  room.Description,
+			"fromUserName": username,
+		})
+		broadcastJSON(nil, room.ID, Message{
+			Event:   "room-updated",
+			RoomID:  room.ID,
+			Payload: payload,
+		})
+	}
+
+	logRoomEvent(room.ID, "INFO", "Room %s renamed to '%s' by user %s (%d)", room.ID, room.Name, username, userID)
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(room)
+}
+
+// handleTransferRoom hands a room over to another user. Only the current creator or an admin may
+// do so; the new owner becomes the host straight away and the old one is left a guest.
+func handleTransferRoom(ctx *fasthttp.RequestCtx, username string, userID int64) {
+	parts := strings.Split(string(ctx.Path()), "/")
+	if len(parts) < 3 || parts[2] == "" {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(`{"error":"invalid path"}`)
+		return
+	}
+	roomID := parts[2]
+	if err := validateRoomID(roomID); err != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(fmt.Sprintf(`{"error":"%s"}`, err.Error()))
+		return
+	}
+
+	var req struct {
+		Username string `json:"username"`
+	}
+	if err := json.Unmarshal(ctx.PostBody(), &req); err != nil || req.Username == "" {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(`{"error":"username is required"}`)
+		return
+	}
+
+	room, err := GetRoomByID(roomID)
+	if err != nil {
+		logMessage("ERROR", "Error fetching room: %v", err)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString(`{"error":"internal server error"}`)
+		return
+	}
+	if room == nil {
+		ctx.SetStatusCode(fasthttp.StatusNotFound)
+		ctx.SetBodyString(`{"error":"room not found"}`)
+		return
+	}
+	if room.CreatedBy != userID && !isAdmin(username) {
+		ctx.SetStatusCode(fasthttp.StatusForbidden)
+		ctx.SetBodyString(`{"error":"only the room creator can transfer it"}`)
+		return
+	}
+
+	newOwner, err := GetUserByUsername(req.Username)
+	if err != nil {
+		logMessage("ERROR", "Error fetching user %s: %v", req.Username, err)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString(`{"error":"internal server error"}`)
+		return
+	}
+	if newOwner == nil {
+		ctx.SetStatusCode(fasthttp.StatusNotFound)
+		ctx.SetBodyString(`{"error":"user not found"}`)
+		return
+	}
+	if newOwner.ID == room.CreatedBy {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(`{"error":"user already owns this room"}`)
+		return
+	}
+
+	// The new owner is held to the same room limit as creating the room would
+	owned, err := CountRoomsByUserID(newOwner.ID)
+	if err != nil {
+		logMessage("ERROR", "Error counting rooms for user %s: %v", newOwner.Username, err)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString(`{"error":"internal server error"}`)
+		return
+	}
+	if owned >= maxRoomsPerUser() {
+		roomLimitRejections.Add(1)
+		ctx.SetStatusCode(fasthttp.StatusConflict)
+		ctx.SetBodyString(`{"error":"user has reached the room limit"}`)
+		return
+	}
+
+	previousOwner := room.CreatedBy
+	if err := TransferRoomOwnership(roomID, previousOwner, newOwner.ID, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			// Someone else transferred or deleted the room since it was read
+			ctx.SetStatusCode(fasthttp.StatusConflict)
+			ctx.SetBodyString(`{"error":"room changed hands, please retry"}`)
+			return
+		}
+		logRoomEvent(roomID, "ERROR", "Error transferring room %s: %v", roomID, err)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString(`{"error":"error transferring room"}`)
+		return
+	}
+	room.CreatedBy = newOwner.ID
+
+	if value, ok := activeRooms.Load(roomID); ok {
+		active := value.(ActiveRoom)
+		active.CreatedBy = newOwner.Username
+		activeRooms.Store(roomID, active)
+	}
+
+	// Roles are worked out from the cached row, so swapping it moves host permissions at once
+	if liveRoom := getRoom(roomID); liveRoom != nil {
+		liveRoom.mu.Lock()
+		liveRoom.Info = room
+		delete(liveRoom.roles, newOwner.ID)
+		liveRoom.mu.Unlock()
+
+		payload, _ := json.Marshal(map[string]interface{}{
+			"name":         room.Name,
+			"description":  room.Description,
+			"createdBy":    newOwner.Username,
+			"createdById":  newOwner.ID,
+			"fromUserName": username,
+		})
+		broadcastJSON(nil, roomID, Message{
+			Event:   "room-updated",
+			RoomID:  roomID,
+			Payload: payload,
+		})
+	}
+
+	logRoomEvent(roomID, "INFO", "Room %s transferred from user %d to '%s' (%d) by user %s (%d)", roomID, previousOwner, newOwner.Username, newOwner.ID, username, userID)
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(room)
+}
+
+func handleUpdateRoomSettings(ctx *fasthttp.RequestCtx, username string, userID int64) {
+	// Extract room ID from path
+	path := string(ctx.Path())
+	parts := strings.Split(path, "/")
+	if len(parts) < 3 || parts[2] == "" {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(`{"error":"invalid path"}`)
+		return
+	}
+	roomID := parts[2]
+
+	var req struct {
+		AllowAnonymous  *bool `json:"allowAnonymous"`
+		ReadOnly        *bool `json:"readOnly"`
+		SystemMessages  *bool `json:"systemMessages"`
+		Persistent      *bool `json:"persistent"`
+		SlowModeSeconds *int  `json:"slowModeSeconds"` // 0 turns slow mode off
+	}
+	if err := json.Unmarshal(ctx.PostBody(), &req); err != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(`{"error":"invalid request body"}`)
+		return
+	}
+
+	room, err := GetRoomByID(roomID)
+	if err != nil {
+		logMessage("ERROR", "Error fetching room: %v", err)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString(`{"error":"internal server error"}`)
+		return
+	}
+	if room == nil {
+		ctx.SetStatusCode(fasthttp.StatusNotFound)
+		ctx.SetBodyString(`{"error":"room not found"}`)
+		return
+	}
+	if room.CreatedBy != userID {
+		ctx.SetStatusCode(fasthttp.StatusForbidden)
+		ctx.SetBodyString(`{"error":"only the room creator can change room settings"}`)
+		return
+	}
+
+	// Only overwrite the settings present in the request
+	if req.AllowAnonymous != nil {
+		room.AllowAnonymous = *req.AllowAnonymous
+	}
+	if req.ReadOnly != nil {
+		room.ReadOnly = *req.ReadOnly
+	}
+	if req.SystemMessages != nil {
+		room.SystemMessages = *req.SystemMessages
+	}
+	if req.Persistent != nil {
+		room.Persistent = *req.Persistent
+	}
+	if req.SlowModeSeconds != nil {
+		if *req.SlowModeSeconds < 0 || *req.SlowModeSeconds > maxSlowModeSeconds {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			ctx.SetBodyString(fmt.Sprintf(`{"error":"slowModeSeconds must be between 0 and %d"}`, maxSlowModeSeconds))
+			return
+		}
+		room.SlowModeSeconds = *req.SlowModeSeconds
+	}
+	if err := UpdateRoomSettings(room); err != nil {
+		logRoomEvent(roomID, "ERROR", "Error updating settings for room %s: %v", roomID, err)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString(`{"error":"error updating room settings"}`)
+		return
+	}
+
+	// Keep the live room's cached copy in sync
+	if liveRoom := getRoom(roomID); liveRoom != nil {
+		liveRoom.mu.Lock()
+		liveRoom.Info = room
+		liveRoom.mu.Unlock()
+	}
+
+	logMessage("INFO", "Room %s settings updated by user %s (%d): allowAnonymous=%t, readOnly=%t, systemMessages=%t, persistent=%t, slowModeSeconds=%d",
+		roomID, username, userID, room.AllowAnonymous, room.ReadOnly, room.SystemMessages, room.Persistent, room.SlowModeSeconds)
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(room)
+}
+
+func handleGetUserProfile(ctx *fasthttp.RequestCtx, authUsername string, userID int64) {
+	// Extract username from path
+	path := string(ctx.Path())
+	parts := strings.Split(path, "/")
+	if len(parts) < 3 {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(`{"error":"invalid path"}`)
+		return
+	}
+	username := parts[2]
+	user, err := GetUserByUsername(username)
+	if err != nil || user == nil {
+		ctx.SetStatusCode(fasthttp.StatusNotFound)
+		ctx.SetBodyString(`{"error":"user not found"}`)
+		return
+	}
+	resp := struct {
+		Username      string `json:"username"`
+		Bio           string `json:"bio"`
+		ProfilePic    string `json:"profilePic"`
+		Email         string `json:"email,omitempty"`
+		EmailVerified *bool  `json:"emailVerified,omitempty"`
+	}{
+		Username:   user.Username,
+		Bio:        user.Bio,
+		ProfilePic: user.ProfilePic,
+	}
+	// Only the owner gets to see their email
+	if authUsername == user.Username {
+		resp.Email = user.Email
+		resp.EmailVerified = &user.EmailVerified
+	}
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(resp)
+}
+
+// handleGetPreferences returns the caller's notification preferences
+func handleGetPreferences(ctx *fasthttp.RequestCtx, authUsername string, userID int64) {
+	parts := strings.Split(string(ctx.Path()), "/")
+	if len(parts) < 3 || parts[2] != authUsername {
+		ctx.SetStatusCode(fasthttp.StatusForbidden)
+		ctx.SetBodyString(`{"error":"cannot view another user's preferences"}`)
+		return
+	}
+	user, err := GetUserByID(userID)
+	if err != nil || user == nil {
+		ctx.SetStatusCode(fasthttp.StatusNotFound)
+		ctx.SetBodyString(`{"error":"user not found"}`)
+		return
+	}
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(map[string]bool{"dnd": user.DND})
+}
+
+// handleUpdatePreferences changes the caller's notification preferences; fields left out are kept
+func handleUpdatePreferences(ctx *fasthttp.RequestCtx, authUsername string, userID int64) {
+	parts := strings.Split(string(ctx.Path()), "/")
+	if len(parts) < 3 || parts[2] != authUsername {
+		ctx.SetStatusCode(fasthttp.StatusForbidden)
+		ctx.SetBodyString(`{"error":"cannot edit another user's preferences"}`)
+		return
+	}
+	var req struct {
+		DND *bool `json:"dnd"`
+	}
+	if err := json.Unmarshal(ctx.PostBody(), &req); err != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(`{"error":"invalid request body"}`)
+		return
+	}
+	user, err := GetUserByID(userID)
+	if err != nil || user == nil {
+		ctx.SetStatusCode(fasthttp.StatusNotFound)
+		ctx.SetBodyString(`{"error":"user not found"}`)
+		return
+	}
+
+	if req.DND != nil && *req.DND != user.DND {
+		if err := SetUserDND(userID, *req.DND); err != nil {
+			logMessage("ERROR", "Error updating preferences for %s: %v", authUsername, err)
+			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+			ctx.SetBodyString(`{"error":"error updating preferences"}`)
+			return
+		}
+		user.DND = *req.DND
+		logMessage("INFO", "User %s set do not disturb to %t", authUsername, user.DND)
+	}
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(map[string]bool{"dnd": user.DND})
+}
+
+// truncateBio shortens a bio for batch responses to PROFILE_BATCH_BIO_LENGTH runes (default 160,
+// 0 keeps it whole), reporting whether anything was cut
+func truncateBio(bio string) (string, bool) {
+	limit := getEnvInt("PROFILE_BATCH_BIO_LENGTH", 160)
+	runes := []rune(bio)
+	if limit <= 0 || len(runes) <= limit {
+		return bio, false
+	}
+	return string(runes[:limit]) + "…", true
+}
+
+// handleGetProfiles returns public profiles for ?usernames=a,b,c (at most 100) with bios
+// truncated; the full bio is available from /users/{username}/profile
+func handleGetProfiles(ctx *fasthttp.RequestCtx, authUsername string, userID int64) {
+	usernames := splitList(string(ctx.QueryArgs().Peek("usernames")))
+	if len(usernames) == 0 || len(usernames) > 100 {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(`{"error":"usernames must list between 1 and 100 users"}`)
+		return
+	}
+
+	users, err := GetUsersByUsernames(usernames)
+	if err != nil {
+		logMessage("ERROR", "Error fetching profiles: %v", err)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString(`{"error":"internal server error"}`)
+		return
+	}
+
+	type profile struct {
+		Username     string `json:"username"`
+		Bio          string `json:"bio"`
+		BioTruncated bool   `json:"bioTruncated"`
+		ProfilePic   string `json:"profilePic"`
+	}
+	resp := make([]profile, 0, len(users))
+	for _, user := range users {
+		bio, truncated := truncateBio(user.Bio)
+		resp = append(resp, profile{
+			Username:     user.Username,
+			Bio:          bio,
+			BioTruncated: truncated,
+			ProfilePic:   user.ProfilePic,
+		})
+	}
+	sort.Slice(resp, func(i, j int) bool { return resp[i].Username < resp[j].Username })
+
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(resp)
+}
+
+func handleUpdateUserProfile(ctx *fasthttp.RequestCtx, authUsername string, userID int64) {
+	// Extract username from path
+	path := string(ctx.Path())
+	parts := strings.Split(path, "/")
+	if len(parts) < 3 {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(`{"error":"invalid path"}`)
+		return
+	}
+	username := parts[2]
+	if authUsername != username {
+		ctx.SetStatusCode(fasthttp.StatusForbidden)
+		ctx.SetBodyString(`{"error":"cannot edit another user's profile"}`)
+		return
+	}
+	var req struct {
+		Username   string  `json:"username"`
+		Bio        string  `json:"bio"`
+		ProfilePic string  `json:"profilePic"`
+		Email      *string `json:"email"` // Left unchanged when absent; "" clears it
+	}
+	if err := json.Unmarshal(ctx.PostBody(), &req); err != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(`{"error":"invalid request body"}`)
+		return
+	}
+
+	// Locked fields keep their stored value, whatever the request asks for
+	var keptBio *string
+	if locked := lockedProfileFields(); len(locked) > 0 {
+		current, err := GetUserByID(userID)
+		if err != nil || current == nil {
+			logMessage("ERROR", "Error fetching user %d: %v", userID, err)
+			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+			ctx.SetBodyString(`{"error":"internal server error"}`)
+			return
+		}
+		changed := map[string]bool{
+			"username": req.Username != "" && req.Username != username,
+			"email":    req.Email != nil && *req.Email != current.Email,
+			// The stored bio is already escaped, so either form sent back counts as unchanged
+			"bio":        req.Bio != current.Bio && sanitizeText(stripControlChars(req.Bio)) != current.Bio,
+			"profilePic": req.ProfilePic != current.ProfilePic,
+		}
+		if lockedFieldPolicy() == "reject" {
+			for _, field := range profileFields {
+				if locked[field] && changed[field] {
+					ctx.SetStatusCode(fasthttp.StatusForbidden)
+					ctx.SetBodyString(fmt.Sprintf(`{"error":"%s cannot be changed"}`, field))
+					return
+				}
+			}
+		}
+		if locked["username"] {
+			req.Username = ""
+		}
+		if locked["email"] {
+			req.Email = nil
+		}
+		if locked["bio"] {
+			keptBio = &current.Bio
+		}
+		if locked["profilePic"] {
+			req.ProfilePic = current.ProfilePic
+		}
+	}
+
+	// An empty username keeps the current one; a new one must be valid and not taken
+	newUsername := req.Username
+	if newUsername == "" {
+		newUsername = username
+	}
+	renamed := newUsername != username
+	if renamed {
+		if err := validateUsername(newUsername); err != nil {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			ctx.SetBodyString(fmt.Sprintf(`{"error":%q}`, err.Error()))
+			return
+		}
+		existingUser, err := GetUserByUsername(newUsername)
+		if err != nil {
+			logMessage("ERROR", "Error checking if username exists: %v", err)
+			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+			ctx.SetBodyString(`{"error":"internal server error"}`)
+			return
+		}
+		if existingUser != nil {
+			ctx.SetStatusCode(fasthttp.StatusConflict)
+			ctx.SetBodyString(`{"error":"username already taken"}`)
+			return
+		}
+	}
+
+	// Bios are limited in length, counted before markup is escaped
+	bio := stripControlChars(req.Bio)
+	if limit := maxBioLength(); keptBio == nil && utf8.RuneCountInString(bio) > limit {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(fmt.Sprintf(`{"error":"bio must be at most %d characters"}`, limit))
+		return
+	}
+
+	// A changed email must be valid, unused, and verified again
+	emailChanged := false
+	if req.Email != nil {
+		current, err := GetUserByID(userID)
+		if err != nil || current == nil {
+			logMessage("ERROR", "Error fetching user %d: %v", userID, err)
+			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+			ctx.SetBodyString(`{"error":"internal server error"}`)
+			return
+		}
+		emailChanged = *req.Email != current.Email
+	}
+	if emailChanged && *req.Email != "" {
+		if err := validateEmail(*req.Email); err != nil {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			ctx.SetBodyString(`{"error":"invalid email address"}`)
+			return
+		}
+		emailUser, err := GetUserByEmail(*req.Email)
+		if err != nil {
+			logMessage("ERROR", "Error checking if email exists: %v", err)
+			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+			ctx.SetBodyString(`{"error":"internal server error"}`)
+			return
+		}
+		if emailUser != nil {
+			ctx.SetStatusCode(fasthttp.StatusConflict)
+			ctx.SetBodyString(`{"error":"email already in use"}`)
+			return
+		}
+	}
+
+	storedBio := sanitizeText(bio)
+	if keptBio != nil {
+		storedBio = *keptBio
+	}
+
+	// Use helper function
+	if err := UpdateUserProfile(username, newUsername, storedBio, req.ProfilePic); err != nil {
+		logMessage("ERROR", "Error updating profile for %s: %v", username, err)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString(`{"error":"failed to update profile"}`)
+		return
+	}
+	if emailChanged {
+		if err := SetUserEmail(userID, *req.Email); err != nil {
+			logMessage("ERROR", "Error updating email for %s: %v", username, err)
+			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+			ctx.SetBodyString(`{"error":"failed to update email"}`)
+			return
+		}
+		if *req.Email != "" {
+			if err := sendVerificationEmail(userID, *req.Email); err != nil {
+				logMessage("ERROR", "Error issuing email verification for %s: %v", username, err)
+			}
+		}
+	}
+	if !renamed {
+		ctx.SetContentType("application/json")
+		ctx.SetBodyString(`{"message":"profile updated"}`)
+		return
+	}
+
+	// Every token issued so far carries the old name, which someone else may now register, so
+	// retire them all and hand the caller one for the new name
+	if _, err := BumpTokenVersion(userID); err != nil {
+		logMessage("ERROR", "Error revoking old tokens for renamed user %s: %v", newUsername, err)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString(`{"error":"profile updated but failed to issue a new token, please log in again"}`)
+		return
+	}
+	tokenVersions.Delete(userID)
+	token, err := generateToken(newUsername, userID)
+	if err != nil {
+		logMessage("ERROR", "Error generating token for renamed user %s: %v", newUsername, err)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString(`{"error":"profile updated but failed to issue a new token, please log in again"}`)
+		return
+	}
+
+	logMessage("INFO", "User %s (%d) renamed to %s", username, userID, newUsername)
+	resp := struct {
+		Message  string `json:"message"`
+		Username string `json:"username"`
+		Token    string `json:"token"`
+	}{
+		Message:  "profile updated",
+		Username: newUsername,
+		Token:    token,
+	}
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(resp)
+}
+
+func handleDeleteUser(ctx *fasthttp.RequestCtx, authUsername string, userID int64) {
+	// Extract username from path
+	path := string(ctx.Path())
+	parts := strings.Split(path, "/")
+	if len(parts) < 3 || parts[2] == "" {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(`{"error":"invalid path"}`)
+		return
+	}
+	username := parts[2]
+	if authUsername != username {
+		ctx.SetStatusCode(fasthttp.StatusForbidden)
+		ctx.SetBodyString(`{"error":"cannot delete another user's account"}`)
+		return
+	}
+
+	roomIDs, err := DeleteUser(userID)
+	if err == sql.ErrNoRows {
+		ctx.SetStatusCode(fasthttp.StatusNotFound)
+		ctx.SetBodyString(`{"error":"user not found"}`)
+		return
+	} else if err != nil {
+		logMessage("ERROR", "Error deleting user %s: %v", username, err)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString(`{"error":"error deleting user"}`)
+		return
+	}
+
+	// Drop the user's rooms from memory too
+	for _, roomID := range roomIDs {
+		removeLiveRoom(roomID)
+		activeRooms.Delete(roomID)
+	}
+	recentJoinsMutex.Lock()
+	delete(recentJoins, userID)
+	recentJoinsMutex.Unlock()
+
+	// The account is gone, so the token used for this request shouldn't work any more
+	if tokenString := extractToken(ctx); tokenString != "" {
+		revokeToken(tokenString)
+	}
+
+	logMessage("INFO", "User %s (%d) deleted their account and %d rooms", username, userID, len(roomIDs))
+	ctx.SetContentType("application/json")
+	ctx.SetBodyString(`{"message":"account deleted"}`)
+}
+
+// ICEServer is one entry of an RTCPeerConnection iceServers array
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// UnmarshalJSON accepts urls as either a single string or a list, as RTCPeerConnection does
+func (s *ICEServer) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		URLs       json.RawMessage `json:"urls"`
+		Username   string          `json:"username"`
+		Credential string          `json:"credential"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	var single string
+	if err := json.Unmarshal(raw.URLs, &single); err == nil {
+		s.URLs = []string{single}
+	} else if err := json.Unmarshal(raw.URLs, &s.URLs); err != nil {
+		return fmt.Errorf("urls must be a string or a list of strings")
+	}
+	if len(s.URLs) == 0 {
+		return fmt.Errorf("urls must not be empty")
+	}
+	s.Username = raw.Username
+	s.Credential = raw.Credential
+	return nil
+}
+
+// defaultICEServers is used when ICE_SERVERS isn't configured
+var defaultICEServers = []ICEServer{{URLs: []string{"stun:stun.l.google.com:19302"}}}
+
+// configuredICEServers holds the ICE servers parsed at startup by loadICEServers
+var configuredICEServers = defaultICEServers
+
+// loadICEServers reads the ICE servers handed to clients from ICE_SERVERS, a JSON iceServers
+// array, or from the JSON file named by ICE_SERVERS_FILE, falling back to a public STUN server
+func loadICEServers() ([]ICEServer, error) {
+	data := []byte(os.Getenv("ICE_SERVERS"))
+	if path := os.Getenv("ICE_SERVERS_FILE"); len(data) == 0 && path != "" {
+		var err error
+		if data, err = os.ReadFile(path); err != nil {
+			return nil, fmt.Errorf("error reading ICE_SERVERS_FILE: %v", err)
+		}
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return defaultICEServers, nil
+	}
+
+	var servers []ICEServer
+	if err := json.Unmarshal(data, &servers); err != nil {
+		return nil, fmt.Errorf("invalid ICE servers configuration: %v", err)
+	}
+	return servers, nil
+}
+
+// turnICEServer returns TURN_URIS with short-lived credentials derived from TURN_SECRET for user,
+// valid for TURN_CREDENTIAL_TTL, or false when TURN isn't configured
+func turnICEServer(user string) (ICEServer, time.Duration, bool) {
+	secret := os.Getenv("TURN_SECRET")
+	turnURIs := splitList(os.Getenv("TURN_URIS"))
+	if secret == "" || len(turnURIs) == 0 {
+		return ICEServer{}, 0, false
+	}
+
+	ttl := getEnvDuration("TURN_CREDENTIAL_TTL", 24*time.Hour)
+	turnUser, credential := generateTURNCredentials(secret, user, time.Now().Add(ttl))
+	return ICEServer{URLs: turnURIs, Username: turnUser, Credential: credential}, ttl, true
+}
+
+// turnUserFor names a connection in its TURN username: the user ID for accounts, the display name otherwise
+func turnUserFor(conn *Connection) string {
+	if conn.UserID > 0 {
+		return strconv.FormatInt(conn.UserID, 10)
+	}
+	return "anonymous-" + conn.UserName
+}
+
+// iceServersFor returns the configured ICE servers plus TURN credentials for user, if available
+func iceServersFor(user string) []ICEServer {
+	servers := append([]ICEServer{}, configuredICEServers...)
+	if turn, _, ok := turnICEServer(user); ok {
+		servers = append(servers, turn)
+	}
+	return servers
+}
+
+// splitList parses a comma-separated env value, dropping blank entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// handleGetTURNCredentials hands out short-lived TURN credentials, together with the other
+// configured ICE servers, ready to use as an RTCPeerConnection iceServers array
+func handleGetTURNCredentials(ctx *fasthttp.RequestCtx, username string, userID int64) {
+	user := strconv.FormatInt(userID, 10)
+	turn, ttl, ok := turnICEServer(user)
+	if !ok {
+		ctx.SetStatusCode(fasthttp.StatusServiceUnavailable)
+		ctx.SetBodyString(`{"error":"TURN is not configured"}`)
+		return
+	}
+
+	resp := struct {
+		IceServers []ICEServer `json:"iceServers"`
+		TTLSeconds int64       `json:"ttlSeconds"`
+	}{
+		IceServers: append(append([]ICEServer{}, configuredICEServers...), turn),
+		TTLSeconds: int64(ttl.Seconds()),
+	}
+	logMessage("INFO", "Issued TURN credentials to %s (%d), valid for %s", username, userID, ttl)
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(resp)
+}
+
+// handleGetMyRooms lists every room the caller's open sockets are in, with the caller's role and
+// the room's participant count, from in-memory state
+func handleGetMyRooms(ctx *fasthttp.RequestCtx, username string, userID int64) {
+	type myRoom struct {
+		ID           string `json:"id"`
+		Role         string `json:"role"`
+		Participants int    `json:"participants"`
+		Connections  int    `json:"connections"` // How many of the caller's sockets are in the room
+	}
+
+	joined := make(map[string]*myRoom)
+	liveConnections.Range(func(key, _ interface{}) bool {
+		conn := key.(*Connection)
+		if conn.UserID != userID {
+			return true
+		}
+		for _, room := range conn.joinedRooms() {
+			entry, ok := joined[room.ID]
+			if !ok {
+				room.mu.RLock()
+				entry = &myRoom{ID: room.ID, Role: room.roleOfLocked(conn), Participants: len(room.Connections)}
+				room.mu.RUnlock()
+				joined[room.ID] = entry
+			}
+			entry.Connections++
+		}
+		return true
+	})
+
+	resp := make([]myRoom, 0, len(joined))
+	for _, entry := range joined {
+		resp = append(resp, *entry)
+	}
+	sort.Slice(resp, func(i, j int) bool { return resp[i].ID < resp[j].ID })
+
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(resp)
+}
+
+// roomForCreator loads the room named in the path for its creator, writing the error response
+// and returning nil when the room doesn't exist or belongs to someone else
+func roomForCreator(ctx *fasthttp.RequestCtx, userID int64, action string) *DbRoom {
+	parts := strings.Split(string(ctx.Path()), "/")
+	if len(parts) < 3 || parts[2] == "" {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(`{"error":"invalid path"}`)
+		return nil
+	}
+
+	room, err := GetRoomByID(parts[2])
+	if err != nil {
+		logMessage("ERROR", "Error fetching room: %v", err)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString(`{"error":"internal server error"}`)
+		return nil
+	}
+	if room == nil {
+		ctx.SetStatusCode(fasthttp.StatusNotFound)
+		ctx.SetBodyString(`{"error":"room not found"}`)
+		return nil
+	}
+	if room.CreatedBy != userID {
+		ctx.SetStatusCode(fasthttp.StatusForbidden)
+		ctx.SetBodyString(fmt.Sprintf(`{"error":"only the room creator can %s"}`, action))
+		return nil
+	}
+	return room
+}
+
+func handleGetRoomBans(ctx *fasthttp.RequestCtx, username string, userID int64) {
+	room := roomForCreator(ctx, userID, "view bans")
+	if room == nil {
+		return
+	}
+
+	bans, err := GetRoomBans(room.ID)
+	if err != nil {
+		logMessage("ERROR", "Error fetching bans for room %s: %v", room.ID, err)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString(`{"error":"internal server error"}`)
+		return
+	}
+
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(bans)
+}
+
+func handleBanUser(ctx *fasthttp.RequestCtx, username string, userID int64) {
+	room := roomForCreator(ctx, userID, "ban users")
+	if room == nil {
+		return
+	}
+
+	var req struct {
+		UserID   int64  `json:"userId"`
+		Username string `json:"username"`
+	}
+	if err := json.Unmarshal(ctx.PostBody(), &req); err != nil || (req.UserID <= 0 && req.Username == "") {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(`{"error":"userId or username is required"}`)
+		return
+	}
+
+	var target *DbUser
+	var err error
+	if req.UserID > 0 {
+		target, err = GetUserByID(req.UserID)
+	} else {
+		target, err = GetUserByUsername(req.Username)
+	}
+	if err != nil {
+		logMessage("ERROR", "Error fetching user to ban: %v", err)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString(`{"error":"internal server error"}`)
+		return
+	}
+	if target == nil {
+		ctx.SetStatusCode(fasthttp.StatusNotFound)
+		ctx.SetBodyString(`{"error":"user not found"}`)
+		return
+	}
+	if target.ID == userID {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(`{"error":"cannot ban yourself"}`)
+		return
+	}
+
+	if err := BanUser(room.ID, target.ID, userID); err != nil {
+		logMessage("ERROR", "Error banning user %d from room %s: %v", target.ID, room.ID, err)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString(`{"error":"internal server error"}`)
+		return
+	}
+	if liveRoom := getRoom(room.ID); liveRoom != nil {
+		ejectBannedUser(liveRoom, target.ID)
+	}
+
+	logRoomEvent(room.ID, "INFO", "User %s (%d) banned '%s' from room %s", username, userID, target.Username, room.ID)
+	ctx.SetStatusCode(fasthttp.StatusCreated)
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(DbRoomBan{
+		RoomID:    room.ID,
+		UserID:    target.ID,
+		Username:  target.Username,
+		BannedBy:  userID,
+		CreatedAt: time.Now(),
+	})
+}
+
+func handleUnbanUser(ctx *fasthttp.RequestCtx, username string, userID int64) {
+	room := roomForCreator(ctx, userID, "lift bans")
+	if room == nil {
+		return
+	}
+
+	// Path is /rooms/{id}/bans/{userId}
+	parts := strings.Split(string(ctx.Path()), "/")
+	if len(parts) != 5 || parts[3] != "bans" {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(`{"error":"invalid path"}`)
+		return
+	}
+	bannedID, err := strconv.ParseInt(parts[4], 10, 64)
+	if err != nil || bannedID <= 0 {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(`{"error":"invalid user id"}`)
+		return
+	}
+
+	lifted, err := UnbanUser(room.ID, bannedID)
+	if err != nil {
+		logMessage("ERROR", "Error unbanning user %d from room %s: %v", bannedID, room.ID, err)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString(`{"error":"internal server error"}`)
+		return
+	}
+	if !lifted {
+		ctx.SetStatusCode(fasthttp.StatusNotFound)
+		ctx.SetBodyString(`{"error":"user is not banned"}`)
+		return
+	}
+
+	logRoomEvent(room.ID, "INFO", "User %s (%d) unbanned user %d from room %s", username, userID, bannedID, room.ID)
+	ctx.SetContentType("application/json")
+	ctx.SetBodyString(`{"message":"ban lifted"}`)
+}
+
+// handlePurgeRoom asks a room's clients to clear their chat, keeping the room itself. The server
+// doesn't persist chat, reactions or read receipts, so all it clears is the room's in-memory call
+// stats; the room-purged broadcast tells connected clients to wipe what they have shown.
+func handlePurgeRoom(ctx *fasthttp.RequestCtx, username string, userID int64) {
+	room := roomForCreator(ctx, userID, "purge it")
+	if room == nil {
+		return
+	}
+
+	notified := 0
+	if liveRoom := getRoom(room.ID); liveRoom != nil {
+		liveRoom.mu.Lock()
+		liveRoom.stats = nil
+		liveRoom.statsNext = 0
+		notified = len(liveRoom.Connections)
+		liveRoom.mu.Unlock()
+
+		payload, _ := json.Marshal(map[string]string{"fromUserName": username})
+		broadcastJSON(nil, room.ID, Message{
+			Event:   "room-purged",
+			RoomID:  room.ID,
+			Payload: payload,
+		})
+	}
+
+	logRoomEvent(room.ID, "INFO", "User %s (%d) purged room %s, notifying %d participants", username, userID, room.ID, notified)
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(map[string]interface{}{
+		"roomId":   room.ID,
+		"notified": notified,
+	})
+}
+
+// handleGetRoomLogs returns the log entries recorded for a room, newest first, to admins.
+// ?level= keeps entries at or above a severity; ?limit= (default 100, max 1000) and ?offset= page through them.
+func handleGetRoomLogs(ctx *fasthttp.RequestCtx, username string, userID int64) {
+	// Extract room ID from path
+	path := string(ctx.Path())
+	parts := strings.Split(path, "/")
+	if len(parts) < 3 || parts[2] == "" {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(`{"error":"invalid path"}`)
+		return
+	}
+	roomID := parts[2]
+
+	if !isAdmin(username) {
+		ctx.SetStatusCode(fasthttp.StatusForbidden)
+		ctx.SetBodyString(`{"error":"only admins can view room logs"}`)
+		return
+	}
+
+	minLevel := 0
+	if level := strings.ToUpper(string(ctx.QueryArgs().Peek("level"))); level != "" {
+		severity, ok := logLevels[level]
+		if !ok {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			ctx.SetBodyString(`{"error":"level must be DEBUG, INFO, WARN or ERROR"}`)
+			return
+		}
+		minLevel = severity
+	}
+
+	limit, offset := 100, 0
+	if value := string(ctx.QueryArgs().Peek("limit")); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 || n > 1000 {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			ctx.SetBodyString(`{"error":"limit must be between 1 and 1000"}`)
+			return
+		}
+		limit = n
+	}
+	if value := string(ctx.QueryArgs().Peek("offset")); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			ctx.SetBodyString(`{"error":"offset must not be negative"}`)
+			return
+		}
+		offset = n
+	}
+
+	entries := roomLogSnapshot(roomID)
+	matching := make([]RoomLogEntry, 0, len(entries))
+	for i := len(entries) - 1; i >= 0; i-- {
+		if logLevels[entries[i].Level] >= minLevel {
+			matching = append(matching, entries[i])
+		}
+	}
+
+	page := []RoomLogEntry{}
+	if offset < len(matching) {
+		end := offset + limit
+		if end > len(matching) {
+			end = len(matching)
+		}
+		page = matching[offset:end]
+	}
+
+	resp := struct {
+		RoomID  string         `json:"roomId"`
+		Total   int            `json:"total"`
+		Offset  int            `json:"offset"`
+		Limit   int            `json:"limit"`
+		Entries []RoomLogEntry `json:"entries"`
+	}{
+		RoomID:  roomID,
+		Total:   len(matching),
+		Offset:  offset,
+		Limit:   limit,
+		Entries: page,
 	}
 
-	respondJSON(conn, userJoinedMsg)
+	logMessage("DEBUG", "Room %s logs requested by %s (%d)", roomID, username, userID)
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(resp)
 }
 
-func notifyUserLeft(leavingConn *Connection, roomID, userName string) {
-	payload, _ := json.Marshal(map[string]string{
-		"userName": userName,
+// handleGetCallMetadata returns the call-metadata each participant of a live room reported, when
+// CALL_METADATA_RETAIN is set. Only the creator or an admin may see it.
+func handleGetCallMetadata(ctx *fasthttp.RequestCtx, username string, userID int64) {
+	parts := strings.Split(string(ctx.Path()), "/")
+	if len(parts) < 3 || parts[2] == "" {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(`{"error":"invalid path"}`)
+		return
+	}
+	roomID := parts[2]
+
+	room := getRoom(roomID)
+	if room == nil {
+		ctx.SetStatusCode(fasthttp.StatusNotFound)
+		ctx.SetBodyString(`{"error":"room not active"}`)
+		return
+	}
+	if info := room.info(); !isAdmin(username) && (info == nil || info.CreatedBy != userID) {
+		ctx.SetStatusCode(fasthttp.StatusForbidden)
+		ctx.SetBodyString(`{"error":"only the room creator can view call metadata"}`)
+		return
+	}
+
+	room.mu.RLock()
+	reported := make([]CallMetadata, 0, len(room.callMetadata))
+	for _, metadata := range room.callMetadata {
+		reported = append(reported, metadata)
+	}
+	room.mu.RUnlock()
+	sort.Slice(reported, func(i, j int) bool { return reported[i].UserName < reported[j].UserName })
+
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(map[string]interface{}{
+		"roomId":   roomID,
+		"retained": getEnvBool("CALL_METADATA_RETAIN", false),
+		"reports":  reported,
 	})
+}
 
-	userLeftMsg := Message{
-		Event:   "user-left",
+// recordRoomSession saves a member's finished stay in a room
+func recordRoomSession(session RoomSession) {
+	if err := RecordRoomSession(session); err != nil {
+		logMessage("ERROR", "Error recording session of '%s' in room %s: %v", session.UserName, session.RoomID, err)
+		return
+	}
+	roomTotalsCache.Delete(session.RoomID)
+}
+
+// cachedRoomTotals is a room's finished stays summed up, as last read from the database
+type cachedRoomTotals struct {
+	totals RoomTotals
+	names  map[string]bool
+	readAt time.Time
+}
+
+// roomTotalsCache holds cachedRoomTotals by room ID
+var roomTotalsCache sync.Map
+
+// roomTotals sums up every stay in a room, those still going in the live room (if any) included.
+// Finished stays are read from the database at most every ROOM_STATS_CACHE_TTL (default 30s).
+func roomTotals(roomID string, room *Room) (RoomTotals, error) {
+	var cached cachedRoomTotals
+	if value, ok := roomTotalsCache.Load(roomID); ok && time.Since(value.(cachedRoomTotals).readAt) < getEnvDuration("ROOM_STATS_CACHE_TTL", 30*time.Second) {
+		cached = value.(cachedRoomTotals)
+	} else {
+		totals, names, err := GetRoomTotals(roomID)
+		if err != nil {
+			return RoomTotals{}, err
+		}
+		cached = cachedRoomTotals{totals: totals, names: names, readAt: time.Now()}
+		roomTotalsCache.Store(roomID, cached)
+	}
+
+	totals := cached.totals
+	if room == nil {
+		return totals, nil
+	}
+	now := time.Now()
+	counted := make(map[string]bool)
+	room.mu.RLock()
+	for conn, session := range room.sessions {
+		totals.Messages += session.messages
+		totals.SessionSeconds += int64(now.Sub(session.joinedAt).Seconds())
+		totals.PeakParticipants = max(totals.PeakParticipants, session.peak)
+		if !cached.names[conn.UserName] && !counted[conn.UserName] {
+			counted[conn.UserName] = true
+			totals.Participants++
+		}
+	}
+	room.mu.RUnlock()
+	return totals, nil
+}
+
+// handleGetRoomStats returns a room's totals over its lifetime (messages, distinct participants,
+// peak concurrent participants and time spent in it) and, while it is live, its call quality: each
+// participant's latest stats report and aggregates over the recent reports kept in memory. Only
+// the creator or an admin may see it.
+func handleGetRoomStats(ctx *fasthttp.RequestCtx, username string, userID int64) {
+	// Extract room ID from path
+	path := string(ctx.Path())
+	parts := strings.Split(path, "/")
+	if len(parts) < 3 || parts[2] == "" {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(`{"error":"invalid path"}`)
+		return
+	}
+	roomID := parts[2]
+
+	// Rooms nobody is in still have their totals
+	room := getRoom(roomID)
+	var info *DbRoom
+	if room != nil {
+		info = room.info()
+	}
+	if info == nil {
+		saved, err := GetRoomByID(roomID)
+		if err != nil {
+			logMessage("ERROR", "Error fetching room: %v", err)
+			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+			ctx.SetBodyString(`{"error":"internal server error"}`)
+			return
+		}
+		info = saved
+	}
+	if room == nil && info == nil {
+		ctx.SetStatusCode(fasthttp.StatusNotFound)
+		ctx.SetBodyString(`{"error":"room not found"}`)
+		return
+	}
+	if !isAdmin(username) && (info == nil || info.CreatedBy != userID) {
+		ctx.SetStatusCode(fasthttp.StatusForbidden)
+		ctx.SetBodyString(`{"error":"only the room creator can view room stats"}`)
+		return
+	}
+
+	totals, err := roomTotals(roomID, room)
+	if err != nil {
+		logMessage("ERROR", "Error summing up room %s: %v", roomID, err)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString(`{"error":"internal server error"}`)
+		return
+	}
+
+	type aggregate struct {
+		Samples        int       `json:"samples"`
+		Since          time.Time `json:"since"`
+		AvgRTTMs       float64   `json:"avgRttMs"`
+		MaxRTTMs       float64   `json:"maxRttMs"`
+		AvgPacketLoss  float64   `json:"avgPacketLoss"`
+		MaxPacketLoss  float64   `json:"maxPacketLoss"`
+		AvgBitrateKbps float64   `json:"avgBitrateKbps"`
+	}
+
+	var samples []StatsSample
+	if room != nil {
+		samples = room.statsSnapshot()
+	}
+	var recent aggregate
+	latest := make(map[string]StatsSample)
+	for _, sample := range samples {
+		if recent.Samples == 0 {
+			recent.Since = sample.ReportedAt
+		}
+		recent.Samples++
+		recent.AvgRTTMs += sample.RTTMs
+		recent.AvgPacketLoss += sample.PacketLoss
+		recent.AvgBitrateKbps += sample.BitrateKbps
+		recent.MaxRTTMs = math.Max(recent.MaxRTTMs, sample.RTTMs)
+		recent.MaxPacketLoss = math.Max(recent.MaxPacketLoss, sample.PacketLoss)
+		latest[sample.UserName] = sample
+	}
+	if recent.Samples > 0 {
+		n := float64(recent.Samples)
+		recent.AvgRTTMs /= n
+		recent.AvgPacketLoss /= n
+		recent.AvgBitrateKbps /= n
+	}
+
+	current := make([]StatsSample, 0, len(latest))
+	for _, sample := range latest {
+		current = append(current, sample)
+	}
+	sort.Slice(current, func(i, j int) bool { return current[i].UserName < current[j].UserName })
+
+	resp := struct {
+		RoomID  string        `json:"roomId"`
+		Totals  RoomTotals    `json:"totals"`
+		Current []StatsSample `json:"current"`
+		Recent  aggregate     `json:"recent"`
+	}{
 		RoomID:  roomID,
-		Payload: payload,
+		Totals:  totals,
+		Current: current,
+		Recent:  recent,
+	}
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(resp)
+}
+
+// inviteTTL is how long a room invite stays valid unless the request asks for less (INVITE_TTL)
+func inviteTTL() time.Duration {
+	return getEnvDuration("INVITE_TTL", 24*time.Hour)
+}
+
+// handleCreateInvite issues a signed, expiring invite token for a room; only its creator may do so
+func handleCreateInvite(ctx *fasthttp.RequestCtx, username string, userID int64) {
+	// Extract room ID from path
+	path := string(ctx.Path())
+	parts := strings.Split(path, "/")
+	if len(parts) < 3 || parts[2] == "" {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(`{"error":"invalid path"}`)
+		return
+	}
+	roomID := parts[2]
+
+	var req struct {
+		TTLSeconds int    `json:"ttlSeconds"`
+		SingleUse  bool   `json:"singleUse"`
+		Invitee    string `json:"invitee"` // Username to deliver the invite to, if they're online
+	}
+	if body := ctx.PostBody(); len(body) > 0 {
+		if err := json.Unmarshal(body, &req); err != nil {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			ctx.SetBodyString(`{"error":"invalid request body"}`)
+			return
+		}
+	}
+
+	ttl := inviteTTL()
+	if req.TTLSeconds < 0 {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(`{"error":"ttlSeconds must be positive"}`)
+		return
+	}
+	if requested := time.Duration(req.TTLSeconds) * time.Second; requested > 0 && requested < ttl {
+		ttl = requested
+	}
+
+	room, err := GetRoomByID(roomID)
+	if err != nil {
+		logMessage("ERROR", "Error fetching room: %v", err)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString(`{"error":"internal server error"}`)
+		return
+	}
+	if room == nil {
+		ctx.SetStatusCode(fasthttp.StatusNotFound)
+		ctx.SetBodyString(`{"error":"room not found"}`)
+		return
+	}
+	if room.CreatedBy != userID {
+		ctx.SetStatusCode(fasthttp.StatusForbidden)
+		ctx.SetBodyString(`{"error":"only the room creator can create invites"}`)
+		return
+	}
+
+	// Users in do-not-disturb mode can't be sent invites
+	var invitee *DbUser
+	if req.Invitee != "" {
+		invitee, err = GetUserByUsername(req.Invitee)
+		if err != nil {
+			logMessage("ERROR", "Error fetching invitee: %v", err)
+			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+			ctx.SetBodyString(`{"error":"internal server error"}`)
+			return
+		}
+		if invitee == nil {
+			ctx.SetStatusCode(fasthttp.StatusNotFound)
+			ctx.SetBodyString(`{"error":"user not found"}`)
+			return
+		}
+		if invitee.DND {
+			logRoomEvent(roomID, "INFO", "Invite for room %s to '%s' refused: do not disturb", roomID, invitee.Username)
+			ctx.SetStatusCode(fasthttp.StatusConflict)
+			ctx.SetBodyString(`{"error":"user-unavailable"}`)
+			return
+		}
+	}
+
+	token, claims, err := generateInviteToken(roomID, username, ttl, req.SingleUse)
+	if err != nil {
+		logRoomEvent(roomID, "ERROR", "Error generating invite for room %s: %v", roomID, err)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString(`{"error":"error creating invite"}`)
+		return
+	}
+
+	logMessage("INFO", "Invite %s created for room %s by %s (expires %s, singleUse=%t)",
+		claims.ID, roomID, username, claims.ExpiresAt.Time.Format(time.RFC3339), req.SingleUse)
+	resp := struct {
+		Invite    string    `json:"invite"`
+		RoomID    string    `json:"roomId"`
+		ExpiresAt time.Time `json:"expiresAt"`
+		SingleUse bool      `json:"singleUse"`
+	}{
+		Invite:    token,
+		RoomID:    roomID,
+		ExpiresAt: claims.ExpiresAt.Time,
+		SingleUse: req.SingleUse,
+	}
+	if invitee != nil {
+		deliverInvite(invitee.ID, username, resp)
+	}
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(resp)
+}
+
+// deliverInvite sends an invite to every open socket of the invited user as a room-invite event
+func deliverInvite(inviteeID int64, fromUserName string, invite interface{}) {
+	payload, _ := json.Marshal(map[string]interface{}{
+		"fromUserName": fromUserName,
+		"invite":       invite,
+	})
+	delivered := 0
+	liveConnections.Range(func(key, _ interface{}) bool {
+		conn := key.(*Connection)
+		if conn.UserID == inviteeID {
+			respondJSON(conn, Message{Event: "room-invite", Payload: payload})
+			delivered++
+		}
+		return true
+	})
+	logMessage("DEBUG", "Delivered invite from %s to user %d on %d connections", fromUserName, inviteeID, delivered)
+}
+
+// handleGetInvite checks an invite token from ?invite= and tells the client which room it opens.
+// The invite is only redeemed when it is presented in the WebSocket join payload.
+func handleGetInvite(ctx *fasthttp.RequestCtx) {
+	tokenString := string(ctx.QueryArgs().Peek("invite"))
+	if tokenString == "" {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(`{"error":"invite is required"}`)
+		return
 	}
 
-	// Find the room
-	mutex.RLock()
-	defer mutex.RUnlock()
+	claims, err := validateInviteToken(tokenString)
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusUnauthorized)
+		ctx.SetBodyString(`{"error":"invalid or expired invite"}`)
+		return
+	}
 
-	connections, ok := rooms[roomID]
-	if !ok {
+	room, err := GetRoomByID(claims.RoomID)
+	if err != nil {
+		logMessage("ERROR", "Error fetching room: %v", err)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString(`{"error":"internal server error"}`)
+		return
+	}
+	if room == nil {
+		ctx.SetStatusCode(fasthttp.StatusNotFound)
+		ctx.SetBodyString(`{"error":"room not found"}`)
 		return
 	}
 
-	// Notify all other users in the room
-	for _, conn := range connections {
-		if conn.Conn != leavingConn.Conn {
-			respondJSON(conn, userLeftMsg)
-			logMessage("INFO", "Notified user '%s' that '%s' left room %s",
-				conn.UserName, userName, roomID)
-		}
+	resp := struct {
+		RoomID    string    `json:"roomId"`
+		InvitedBy string    `json:"invitedBy"`
+		ExpiresAt time.Time `json:"expiresAt"`
+		SingleUse bool      `json:"singleUse"`
+	}{
+		RoomID:    claims.RoomID,
+		InvitedBy: claims.Issuer,
+		ExpiresAt: claims.ExpiresAt.Time,
+		SingleUse: claims.SingleUse,
 	}
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(resp)
 }
 
-func cleanupConnection(conn *Connection) {
-	mutex.Lock()
-	defer mutex.Unlock()
+// rejoinWindow is how long a joined room stays in a user's join history (REJOIN_WINDOW)
+func rejoinWindow() time.Duration {
+	return getEnvDuration("REJOIN_WINDOW", 24*time.Hour)
+}
 
-	for roomID, connections := range rooms {
-		for i, c := range connections {
-			if c.Conn == conn.Conn {
-				// Remove this connection
-				rooms[roomID] = append(connections[:i], connections[i+1:]...)
-				logMessage("INFO", "Removed connection for user '%s' from room %s", conn.UserName, roomID)
+// recordRoomJoin remembers that a signed-in user joined a room, pruning expired entries
+func recordRoomJoin(userID int64, roomID string) {
+	recentJoinsMutex.Lock()
+	defer recentJoinsMutex.Unlock()
 
-				// Keep the room alive even if empty
-				// Only update active room status in memory, but don't delete from database
-				if len(rooms[roomID]) == 0 {
-					logMessage("INFO", "Room %s is now empty, but will be kept alive", roomID)
-				}
-				return
-			}
+	joined := recentJoins[userID]
+	if joined == nil {
+		joined = make(map[string]time.Time)
+		recentJoins[userID] = joined
+	}
+	cutoff := time.Now().Add(-rejoinWindow())
+	for id, at := range joined {
+		if at.Before(cutoff) {
+			delete(joined, id)
 		}
 	}
+	joined[roomID] = time.Now()
 }
 
-func relayMessageToRoom(sender *Connection, roomID string, message []byte) {
-	mutex.RLock()
-	defer mutex.RUnlock()
-
-	connections, ok := rooms[roomID]
-	if !ok {
-		logMessage("WARN", "Room %s not found", roomID)
-		return
-	}
-
-	var msgType string
-	var msg Message
-	if err := json.Unmarshal(message, &msg); err == nil {
-		msgType = msg.Event
-	} else {
-		msgType = "unknown"
-	}
+// recentRoomJoins returns the rooms a user joined within the rejoin window and when
+func recentRoomJoins(userID int64) map[string]time.Time {
+	recentJoinsMutex.Lock()
+	defer recentJoinsMutex.Unlock()
 
-	for _, conn := range connections {
-		if conn.Conn != sender.Conn {
-			if err := conn.Conn.WriteMessage(websocket.TextMessage, message); err != nil {
-				logMessage("ERROR", "Error sending %s message: %v", msgType, err)
-			} else {
-				logMessage("INFO", "Relayed %s message from '%s' to '%s' in room %s",
-					msgType, sender.UserName, conn.UserName, roomID)
-			}
+	cutoff := time.Now().Add(-rejoinWindow())
+	result := make(map[string]time.Time)
+	for id, at := range recentJoins[userID] {
+		if !at.Before(cutoff) {
+			result[id] = at
 		}
 	}
+	return result
 }
 
-func respondJSON(conn *Connection, v interface{}) {
-	data, err := json.Marshal(v)
+// handleGetRejoinableRooms lists the caller's owned or recently joined rooms that still have
+// participants connected, so a client can offer to rejoin them after a crash
+func handleGetRejoinableRooms(ctx *fasthttp.RequestCtx, username string, userID int64) {
+	owned, err := GetRoomsByUserID(userID)
 	if err != nil {
-		logMessage("ERROR", "Error marshaling JSON: %v", err)
+		logMessage("ERROR", "Error fetching rooms for user %s: %v", username, err)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString(`{"error":"internal server error"}`)
 		return
 	}
 
-	if err := conn.Conn.WriteMessage(websocket.TextMessage, data); err != nil {
-		logMessage("ERROR", "Error sending message: %v", err)
+	type rejoinableRoom struct {
+		ID           string     `json:"id"`
+		Owned        bool       `json:"owned"`
+		LastJoinedAt *time.Time `json:"lastJoinedAt,omitempty"`
+		Participants []string   `json:"participants"`
 	}
-}
 
-func logRoomStatus() {
-	mutex.RLock()
-	defer mutex.RUnlock()
+	candidates := make(map[string]*rejoinableRoom)
+	for _, dbRoom := range owned {
+		candidates[dbRoom.ID] = &rejoinableRoom{ID: dbRoom.ID, Owned: true}
+	}
+	for roomID, joinedAt := range recentRoomJoins(userID) {
+		joinedAt := joinedAt
+		if candidate, ok := candidates[roomID]; ok {
+			candidate.LastJoinedAt = &joinedAt
+			continue
+		}
+		candidates[roomID] = &rejoinableRoom{ID: roomID, LastJoinedAt: &joinedAt}
+	}
 
-	logMessage("INFO", "Current room status:")
-	for roomID, connections := range rooms {
-		userNames := make([]string, len(connections))
-		for i, conn := range connections {
-			userNames[i] = conn.UserName
+	// Only rooms with live participants can be rejoined
+	resp := []rejoinableRoom{}
+	for roomID, candidate := range candidates {
+		room := getRoom(roomID)
+		if room == nil {
+			continue
+		}
+		room.mu.RLock()
+		for conn := range room.Connections {
+			candidate.Participants = append(candidate.Participants, conn.UserName)
+		}
+		room.mu.RUnlock()
+		if len(candidate.Participants) > 0 {
+			resp = append(resp, *candidate)
 		}
-		logMessage("INFO", "  Room %s: %d connections - Users: %v", roomID, len(connections), userNames)
 	}
+	sort.Slice(resp, func(i, j int) bool { return resp[i].ID < resp[j].ID })
+
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(resp)
 }
 
-func handleDeleteRoom(ctx *fasthttp.RequestCtx, username string, userID int64) {
-	// Parse request body
-	var requestBody struct {
-		RoomID string `json:"roomId"`
-	}
+// maxRoomsPerUser is the most rooms a single account may own
+func maxRoomsPerUser() int {
+	return getEnvInt("MAX_ROOMS_PER_USER", 10)
+}
 
-	if err := json.Unmarshal(ctx.PostBody(), &requestBody); err != nil {
+// handleChangePassword replaces the caller's password once they prove they know the current one.
+// Every token issued so far stops working; the caller gets a fresh one unless they asked to log out.
+func handleChangePassword(ctx *fasthttp.RequestCtx, authUsername string, userID int64) {
+	// Extract username from path
+	path := string(ctx.Path())
+	parts := strings.Split(path, "/")
+	if len(parts) < 3 {
 		ctx.SetStatusCode(fasthttp.StatusBadRequest)
-		ctx.SetBodyString(`{"error":"invalid request body"}`)
+		ctx.SetBodyString(`{"error":"invalid path"}`)
+		return
+	}
+	username := parts[2]
+	if authUsername != username {
+		ctx.SetStatusCode(fasthttp.StatusForbidden)
+		ctx.SetBodyString(`{"error":"cannot change another user's password"}`)
 		return
 	}
 
-	roomID := requestBody.RoomID
-	if roomID == "" {
+	var req struct {
+		CurrentPassword string `json:"currentPassword"`
+		NewPassword     string `json:"newPassword"`
+		Logout          bool   `json:"logout"` // Don't issue a new token, forcing a new login here too
+	}
+	if err := json.Unmarshal(ctx.PostBody(), &req); err != nil {
 		ctx.SetStatusCode(fasthttp.StatusBadRequest)
-		ctx.SetBodyString(`{"error":"room ID is required"}`)
+		ctx.SetBodyString(`{"error":"invalid request body"}`)
 		return
 	}
 
-	// Get room from database
-	room, err := GetRoomByID(roomID)
+	user, err := GetUserByID(userID)
 	if err != nil {
-		logMessage("ERROR", "Error fetching room: %v", err)
+		logMessage("ERROR", "Error fetching user %d: %v", userID, err)
 		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
 		ctx.SetBodyString(`{"error":"internal server error"}`)
 		return
 	}
-
-	if room == nil {
+	if user == nil {
 		ctx.SetStatusCode(fasthttp.StatusNotFound)
-		ctx.SetBodyString(`{"error":"room not found"}`)
+		ctx.SetBodyString(`{"error":"user not found"}`)
 		return
 	}
-
-	// Check if user is the creator of the room
-	if room.CreatedBy != userID {
-		ctx.SetStatusCode(fasthttp.StatusForbidden)
-		ctx.SetBodyString(`{"error":"only the room creator can delete the room"}`)
+	if !verifyPassword(req.CurrentPassword, user.Password) {
+		logMessage("WARN", "Wrong current password in password change for user %s", username)
+		ctx.SetStatusCode(fasthttp.StatusUnauthorized)
+		ctx.SetBodyString(`{"error":"current password is incorrect"}`)
+		return
+	}
+	if len(req.NewPassword) < minPasswordLength {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(fmt.Sprintf(`{"error":"new password must be at least %d characters"}`, minPasswordLength))
 		return
 	}
 
-	// Remove room from database
-	if err := DeleteRoom(roomID); err != nil {
-		logMessage("ERROR", "Error deleting room: %v", err)
+	if err := UpdatePassword(userID, hashPassword(req.NewPassword)); err != nil {
+		logMessage("ERROR", "Error updating password for user %s: %v", username, err)
 		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
-		ctx.SetBodyString(`{"error":"error deleting room"}`)
+		ctx.SetBodyString(`{"error":"error updating password"}`)
 		return
 	}
 
-	// Remove room from active rooms map
-	mutex.Lock()
-	delete(rooms, roomID)
-	mutex.Unlock()
-
-	// Remove from active rooms tracking
-	activeRooms.Delete(roomID)
-
-	logMessage("INFO", "Room %s deleted by user %s (%d)", roomID, username, userID)
+	// Sessions signed in with the old password shouldn't outlive it
+	if _, err := BumpTokenVersion(userID); err != nil {
+		logMessage("ERROR", "Error revoking sessions for %s after a password change: %v", username, err)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString(`{"error":"password updated but failed to sign out other sessions"}`)
+		return
+	}
+	tokenVersions.Delete(userID)
 
+	logMessage("INFO", "User %s (%d) changed their password", username, userID)
 	ctx.SetContentType("application/json")
-	ctx.SetBodyString(`{"message":"room deleted successfully"}`)
+	if req.Logout {
+		ctx.SetBodyString(`{"message":"password updated"}`)
+		return
+	}
+	token, err := generateToken(username, userID)
+	if err != nil {
+		logMessage("ERROR", "Error generating token for %s after a password change: %v", username, err)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString(`{"error":"password updated but failed to issue a new token, please log in again"}`)
+		return
+	}
+	json.NewEncoder(ctx).Encode(map[string]string{
+		"message": "password updated",
+		"token":   token,
+	})
 }
 
-func handleGetUserProfile(ctx *fasthttp.RequestCtx, authUsername string, userID int64) {
+func handleGetRoomQuota(ctx *fasthttp.RequestCtx, authUsername string, userID int64) {
 	// Extract username from path
 	path := string(ctx.Path())
 	parts := strings.Split(path, "/")
@@ -639,58 +6033,143 @@ func handleGetUserProfile(ctx *fasthttp.RequestCtx, authUsername string, userID
 		return
 	}
 	username := parts[2]
-	user, err := GetUserByUsername(username)
-	if err != nil || user == nil {
-		ctx.SetStatusCode(fasthttp.StatusNotFound)
-		ctx.SetBodyString(`{"error":"user not found"}`)
+	if authUsername != username {
+		ctx.SetStatusCode(fasthttp.StatusForbidden)
+		ctx.SetBodyString(`{"error":"cannot view another user's room quota"}`)
+		return
+	}
+	owned, err := CountRoomsByUserID(userID)
+	if err != nil {
+		logMessage("ERROR", "Error counting rooms for user %s: %v", username, err)
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString(`{"error":"internal server error"}`)
 		return
 	}
+	maxRooms := maxRoomsPerUser()
+	remaining := maxRooms - owned
+	if remaining < 0 {
+		remaining = 0
+	}
 	resp := struct {
 		Username   string `json:"username"`
-		Bio        string `json:"bio"`
-		ProfilePic string `json:"profilePic"`
+		OwnedRooms int    `json:"ownedRooms"`
+		MaxRooms   int    `json:"maxRooms"`
+		Remaining  int    `json:"remaining"`
 	}{
-		Username:   user.Username,
-		Bio:        user.Bio,
-		ProfilePic: user.ProfilePic,
+		Username:   username,
+		OwnedRooms: owned,
+		MaxRooms:   maxRooms,
+		Remaining:  remaining,
 	}
 	ctx.SetContentType("application/json")
 	json.NewEncoder(ctx).Encode(resp)
 }
 
-func handleUpdateUserProfile(ctx *fasthttp.RequestCtx, authUsername string, userID int64) {
-	// Extract username from path
-	path := string(ctx.Path())
-	parts := strings.Split(path, "/")
-	if len(parts) < 3 {
-		ctx.SetStatusCode(fasthttp.StatusBadRequest)
-		ctx.SetBodyString(`{"error":"invalid path"}`)
-		return
+// errAvatarNotSquare is returned by enforceSquareAvatar when a non-square image is rejected
+var errAvatarNotSquare = errors.New("avatar is not square")
+
+// enforceSquareAvatar applies AVATAR_SQUARE_POLICY to an uploaded image: "reject" refuses images
+// that aren't square, "crop" cuts them down to a centered square, and "off" (the default) keeps
+// the upload as is. Cropped images are re-encoded in their original format.
+func enforceSquareAvatar(data []byte) ([]byte, error) {
+	policy := strings.ToLower(os.Getenv("AVATAR_SQUARE_POLICY"))
+	if policy != "reject" && policy != "crop" {
+		return data, nil
 	}
-	username := parts[2]
-	if authUsername != username {
-		ctx.SetStatusCode(fasthttp.StatusForbidden)
-		ctx.SetBodyString(`{"error":"cannot edit another user's profile"}`)
-		return
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("error reading image dimensions: %v", err)
 	}
-	var req struct {
-		Username   string `json:"username"`
-		Bio        string `json:"bio"`
-		ProfilePic string `json:"profilePic"`
+	if cfg.Width == cfg.Height {
+		return data, nil
 	}
-	if err := json.Unmarshal(ctx.PostBody(), &req); err != nil {
-		ctx.SetStatusCode(fasthttp.StatusBadRequest)
-		ctx.SetBodyString(`{"error":"invalid request body"}`)
-		return
+	if policy == "reject" {
+		return nil, errAvatarNotSquare
 	}
-	// Use helper function
-	if err := UpdateUserProfile(username, req.Username, req.Bio, req.ProfilePic); err != nil {
-		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
-		ctx.SetBodyString(`{"error":"failed to update profile"}`)
-		return
+
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding image: %v", err)
 	}
-	ctx.SetContentType("application/json")
-	ctx.SetBodyString(`{"message":"profile updated"}`)
+	bounds := img.Bounds()
+	side := bounds.Dx()
+	if bounds.Dy() < side {
+		side = bounds.Dy()
+	}
+	offset := image.Pt(bounds.Min.X+(bounds.Dx()-side)/2, bounds.Min.Y+(bounds.Dy()-side)/2)
+	cropped := image.NewRGBA(image.Rect(0, 0, side, side))
+	draw.Draw(cropped, cropped.Bounds(), img, offset, draw.Src)
+
+	var buf bytes.Buffer
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(&buf, cropped, &jpeg.Options{Quality: 90})
+	case "gif":
+		err = gif.Encode(&buf, cropped, nil)
+	default:
+		err = png.Encode(&buf, cropped)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error encoding cropped image: %v", err)
+	}
+	logMessage("INFO", "Cropped %dx%d avatar to %dx%d", cfg.Width, cfg.Height, side, side)
+	return buf.Bytes(), nil
+}
+
+// uploadLocalFallback reports whether uploads that Cloudinary keeps failing are saved locally
+// instead (UPLOAD_LOCAL_FALLBACK); local files are then also served in production
+func uploadLocalFallback() bool {
+	return getEnvBool("UPLOAD_LOCAL_FALLBACK", false)
+}
+
+// uploadToCloudinary uploads a profile picture, retrying transient failures with exponential
+// backoff: CLOUDINARY_MAX_ATTEMPTS tries in all, waiting CLOUDINARY_RETRY_BACKOFF, then twice as
+// long, and so on in between. It returns the image's URL.
+func uploadToCloudinary(ctx context.Context, cld *cloudinary.Cloudinary, data []byte, publicID string) (string, error) {
+	attempts := getEnvInt("CLOUDINARY_MAX_ATTEMPTS", 3)
+	if attempts < 1 {
+		attempts = 1
+	}
+	backoff := getEnvDuration("CLOUDINARY_RETRY_BACKOFF", 500*time.Millisecond)
+
+	var lastErr error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		uploadRes, err := cld.Upload.Upload(ctx, bytes.NewReader(data), uploader.UploadParams{
+			Folder:    "monkeychat/profile_pics",
+			PublicID:  publicID,
+			Overwrite: func(b bool) *bool { return &b }(true),
+		})
+		if err == nil && uploadRes.Error.Message != "" {
+			err = errors.New(uploadRes.Error.Message)
+		}
+		if err == nil {
+			return uploadRes.SecureURL, nil
+		}
+
+		lastErr = err
+		if attempt < attempts {
+			logMessage("WARN", "Cloudinary upload attempt %d/%d failed, retrying in %s: %v", attempt, attempts, backoff, err)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	return "", fmt.Errorf("cloudinary upload failed after %d attempts: %v", attempts, lastErr)
+}
+
+// saveUploadLocally writes an upload to the uploads directory and returns the URL it's served at
+func saveUploadLocally(data []byte, filename string) (string, error) {
+	uploadDir := "uploads"
+	os.MkdirAll(uploadDir, 0755)
+	out, err := os.Create(filepath.Join(uploadDir, filename))
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, bytes.NewReader(data)); err != nil {
+		return "", err
+	}
+	return "/uploads/" + filename, nil
 }
 
 func handleUploadProfilePic(ctx *fasthttp.RequestCtx, authUsername string, userID int64) {
@@ -724,7 +6203,25 @@ func handleUploadProfilePic(ctx *fasthttp.RequestCtx, authUsername string, userI
 		return
 	}
 	defer file.Close()
+	imageData, err := io.ReadAll(file)
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		ctx.SetBodyString(`{"error":"failed to read image"}`)
+		return
+	}
+	imageData, err = enforceSquareAvatar(imageData)
+	if err == errAvatarNotSquare {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(`{"error":"profile picture must be square"}`)
+		return
+	} else if err != nil {
+		logMessage("WARN", "Could not process profile picture for %s: %v", username, err)
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.SetBodyString(`{"error":"unsupported image format"}`)
+		return
+	}
 	var imageURL string
+	baseName := username + "_" + time.Now().Format("20060102150405")
 	if isProd {
 		// Upload to Cloudinary
 		cld, err := cloudinary.NewFromURL(os.Getenv("CLOUDINARY_URL"))
@@ -733,38 +6230,144 @@ func handleUploadProfilePic(ctx *fasthttp.RequestCtx, authUsername string, userI
 			ctx.SetBodyString(`{"error":"cloudinary config error"}`)
 			return
 		}
-		uploadRes, err := cld.Upload.Upload(ctx, file, uploader.UploadParams{
-			Folder:    "monkeychat/profile_pics",
-			PublicID:  username + "_" + time.Now().Format("20060102150405"),
-			Overwrite: func(b bool) *bool { return &b }(true),
-		})
+		imageURL, err = uploadToCloudinary(ctx, cld, imageData, baseName)
+		if err != nil && uploadLocalFallback() {
+			logMessage("WARN", "Cloudinary upload for %s failed, saving locally instead: %v", username, err)
+			imageURL, err = saveUploadLocally(imageData, baseName+filepath.Ext(fileHeader.Filename))
+		}
 		if err != nil {
+			logMessage("ERROR", "Profile picture upload for %s failed: %v", username, err)
 			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
 			ctx.SetBodyString(`{"error":"cloudinary upload failed"}`)
 			return
 		}
-		imageURL = uploadRes.SecureURL
 	} else {
 		// Save locally
-		uploadDir := "uploads"
-		os.MkdirAll(uploadDir, 0755)
-		filename := username + "_" + time.Now().Format("20060102150405") + filepath.Ext(fileHeader.Filename)
-		filePath := filepath.Join(uploadDir, filename)
-		out, err := os.Create(filePath)
-		if err != nil {
-			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
-			ctx.SetBodyString(`{"error":"failed to save image"}`)
-			return
-		}
-		defer out.Close()
-		_, err = io.Copy(out, file)
+		imageURL, err = saveUploadLocally(imageData, baseName+filepath.Ext(fileHeader.Filename))
 		if err != nil {
 			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
 			ctx.SetBodyString(`{"error":"failed to save image"}`)
 			return
 		}
-		imageURL = "/uploads/" + filename
 	}
 	ctx.SetContentType("application/json")
 	ctx.SetBodyString(fmt.Sprintf(`{"url":"%s"}`, imageURL))
 }
+
+// handleHealth reports whether the server can serve requests, for load balancers. It answers 503
+// when the database doesn't respond to a ping within HEALTH_DB_TIMEOUT (default 2s).
+func handleHealth(ctx *fasthttp.RequestCtx) {
+	pingCtx, cancel := context.WithTimeout(context.Background(), getEnvDuration("HEALTH_DB_TIMEOUT", 2*time.Second))
+	defer cancel()
+
+	resp := struct {
+		Status            string  `json:"status"`
+		DB                string  `json:"db"`
+		Uptime            float64 `json:"uptime"` // Seconds
+		ActiveRooms       int     `json:"activeRooms"`
+		ActiveConnections int64   `json:"activeConnections"`
+	}{
+		Status:            "ok",
+		DB:                "ok",
+		Uptime:            time.Since(serverStartTime).Seconds(),
+		ActiveRooms:       len(snapshotRooms()),
+		ActiveConnections: activeConnections.Load(),
+	}
+	if err := pingDatabase(pingCtx); err != nil {
+		logMessage("WARN", "Health check failed to reach the database: %v", err)
+		resp.Status = "unavailable"
+		resp.DB = "unreachable"
+		ctx.SetStatusCode(fasthttp.StatusServiceUnavailable)
+	}
+
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(resp)
+}
+
+// handleReadyz tells orchestrators whether to route traffic here: only once startup finished and
+// while the database answers a ping. Unlike /livez, a 503 here doesn't mean the process should restart.
+func handleReadyz(ctx *fasthttp.RequestCtx) {
+	ctx.SetContentType("application/json")
+	if !ready.Load() {
+		ctx.SetStatusCode(fasthttp.StatusServiceUnavailable)
+		ctx.SetBodyString(`{"status":"starting"}`)
+		return
+	}
+
+	pingCtx, cancel := context.WithTimeout(context.Background(), getEnvDuration("HEALTH_DB_TIMEOUT", 2*time.Second))
+	defer cancel()
+	if err := pingDatabase(pingCtx); err != nil {
+		logMessage("WARN", "Readiness check failed to reach the database: %v", err)
+		ctx.SetStatusCode(fasthttp.StatusServiceUnavailable)
+		ctx.SetBodyString(`{"status":"unavailable","db":"unreachable"}`)
+		return
+	}
+	ctx.SetBodyString(`{"status":"ok"}`)
+}
+
+// handleGetSystemStats reports process and room counters to admins
+func handleGetSystemStats(ctx *fasthttp.RequestCtx, username string, userID int64) {
+	if !isAdmin(username) {
+		ctx.SetStatusCode(fasthttp.StatusForbidden)
+		ctx.SetBodyString(`{"error":"only admins can view system stats"}`)
+		return
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	// Count live rooms and the connections in them
+	liveRooms := snapshotRooms()
+	roomConnections := 0
+	for _, room := range liveRooms {
+		room.mu.RLock()
+		roomConnections += len(room.Connections)
+		room.mu.RUnlock()
+	}
+
+	roomsInDatabase, err := CountRooms()
+	if err != nil {
+		logMessage("ERROR", "Error counting rooms: %v", err)
+	}
+
+	uptime := time.Since(serverStartTime)
+	resp := struct {
+		StartedAt           time.Time `json:"startedAt"`
+		Uptime              string    `json:"uptime"`
+		UptimeSeconds       float64   `json:"uptimeSeconds"`
+		Goroutines          int       `json:"goroutines"`
+		AllocBytes          uint64    `json:"allocBytes"`
+		TotalAllocBytes     uint64    `json:"totalAllocBytes"`
+		SysBytes            uint64    `json:"sysBytes"`
+		HeapInuseBytes      uint64    `json:"heapInuseBytes"`
+		NumGC               uint32    `json:"numGC"`
+		ActiveConnections   int64     `json:"activeConnections"`
+		RoomConnections     int       `json:"roomConnections"`
+		ActiveRooms         int       `json:"activeRooms"`
+		MaxLiveRooms        int       `json:"maxLiveRooms"`
+		MaxRoomsPerUser     int       `json:"maxRoomsPerUser"`
+		RoomsInDatabase     int       `json:"roomsInDatabase"`
+		RoomLimitRejections int64     `json:"roomLimitRejections"`
+	}{
+		StartedAt:           serverStartTime,
+		Uptime:              uptime.Round(time.Second).String(),
+		UptimeSeconds:       uptime.Seconds(),
+		Goroutines:          runtime.NumGoroutine(),
+		AllocBytes:          mem.Alloc,
+		TotalAllocBytes:     mem.TotalAlloc,
+		SysBytes:            mem.Sys,
+		HeapInuseBytes:      mem.HeapInuse,
+		NumGC:               mem.NumGC,
+		ActiveConnections:   activeConnections.Load(),
+		RoomConnections:     roomConnections,
+		ActiveRooms:         len(liveRooms),
+		MaxLiveRooms:        maxLiveRooms(),
+		MaxRoomsPerUser:     maxRoomsPerUser(),
+		RoomsInDatabase:     roomsInDatabase,
+		RoomLimitRejections: roomLimitRejections.Load(),
+	}
+
+	logMessage("DEBUG", "System stats requested by %s (%d)", username, userID)
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(resp)
+}
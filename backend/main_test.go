@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	sqle "github.com/dolthub/go-mysql-server"
+	"github.com/dolthub/go-mysql-server/memory"
+	"github.com/dolthub/go-mysql-server/server"
+	"github.com/fasthttp/websocket"
+	"github.com/go-sql-driver/mysql"
+	"github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+// The tests run against go-mysql-server, an in-process MySQL-compatible server, so the real
+// migrations and queries are exercised without a database to set up. Each test gets its own
+// freshly migrated database.
+var (
+	testDBOnce sync.Once
+	testDBAddr string
+	testDBErr  error
+	testDBSeq  atomic.Int64
+)
+
+func init() {
+	sql.Register("mysql-test", testDriver{})
+}
+
+// testDriver is the MySQL driver with foreign keys left out of CREATE TABLE. go-mysql-server's
+// in-memory tables name every unnamed foreign key "", refusing a second one in the same
+// database, and lose updates to tables referenced from several of them.
+type testDriver struct{}
+
+var foreignKeyClause = regexp.MustCompile(`,\s*FOREIGN KEY \([^)]*\) REFERENCES \w+\(\w+\)( ON DELETE CASCADE)?`)
+
+func (d testDriver) Open(dsn string) (driver.Conn, error) {
+	conn, err := mysql.MySQLDriver{}.Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return testConn{conn}, nil
+}
+
+type testConn struct{ driver.Conn }
+
+func (c testConn) Prepare(query string) (driver.Stmt, error) {
+	return c.Conn.Prepare(stripForeignKeys(query))
+}
+
+func (c testConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return c.Conn.(driver.ExecerContext).ExecContext(ctx, stripForeignKeys(query), args)
+}
+
+func (c testConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return c.Conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+}
+
+func (c testConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return c.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+}
+
+func (c testConn) CheckNamedValue(nv *driver.NamedValue) error {
+	return c.Conn.(driver.NamedValueChecker).CheckNamedValue(nv)
+}
+
+// stripForeignKeys removes the foreign key clauses from a CREATE TABLE
+func stripForeignKeys(query string) string {
+	return foreignKeyClause.ReplaceAllString(query, "")
+}
+
+func TestMain(m *testing.M) {
+	// Keep test output readable; individual tests lower this when they look at the logs
+	os.Setenv("LOG_LEVEL", "ERROR")
+	logrus.SetLevel(logrus.ErrorLevel)
+	jwtSecret = []byte("test-secret")
+	if err := loadTokenKeys(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+// startTestDB starts the shared in-process database server
+func startTestDB() {
+	provider := memory.NewDBProvider()
+	engine := sqle.NewDefault(provider)
+	srv, err := server.NewServer(server.Config{Protocol: "tcp", Address: "127.0.0.1:0"}, engine, memory.NewSessionBuilder(provider), nil)
+	if err != nil {
+		testDBErr = err
+		return
+	}
+	go srv.Start()
+	testDBAddr = srv.Listener.Addr().String()
+}
+
+// setupTestDB points db at a new, fully migrated database and resets the in-memory server state
+func setupTestDB(t testing.TB) {
+	t.Helper()
+	testDBOnce.Do(startTestDB)
+	if testDBErr != nil {
+		t.Fatalf("starting test database: %v", testDBErr)
+	}
+
+	name := fmt.Sprintf("monkeychat_%d", testDBSeq.Add(1))
+	admin, err := sql.Open("mysql", "root@tcp("+testDBAddr+")/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := admin.Exec("CREATE DATABASE " + name); err != nil {
+		admin.Close()
+		t.Fatalf("creating test database: %v", err)
+	}
+
+	dbDriver = "mysql"
+	if db, err = sql.Open("mysql-test", "root@tcp("+testDBAddr+")/"+name+"?parseTime=true"); err != nil {
+		t.Fatal(err)
+	}
+	// Left behind, every database slows down the schema lookups the migrations make in later tests
+	testDB := db
+	t.Cleanup(func() {
+		testDB.Close()
+		admin.Exec("DROP DATABASE " + name)
+		admin.Close()
+	})
+	// The in-memory engine isn't safe for concurrent sessions, so queries go through one connection
+	db.SetMaxOpenConns(1)
+	if err := runMigrations(); err != nil {
+		t.Fatalf("running migrations: %v", err)
+	}
+
+	resetServerState()
+}
+
+// resetServerState forgets the live rooms, sessions and caches a previous test left behind
+func resetServerState() {
+	mutex.Lock()
+	rooms = make(map[string]*Room)
+	mutex.Unlock()
+
+	resumeMutex.Lock()
+	resumeSessions = make(map[string]*ResumeSession)
+	resumeMutex.Unlock()
+
+	recentJoinsMutex.Lock()
+	recentJoins = make(map[int64]map[string]time.Time)
+	recentJoinsMutex.Unlock()
+
+	fileOffersMutex.Lock()
+	fileOffers = make(map[string]*pendingFileOffer)
+	fileOffersMutex.Unlock()
+
+	roomLogsMutex.Lock()
+	roomLogs = make(map[string]*roomLog)
+	roomLogsMutex.Unlock()
+
+	wsTicketsMutex.Lock()
+	wsTickets = make(map[string]wsTicket)
+	wsTicketsMutex.Unlock()
+
+	joinCodeLookupsMutex.Lock()
+	joinCodeLookups = make(map[string]*eventWindow)
+	joinCodeLookupsMutex.Unlock()
+
+	for _, m := range []*sync.Map{&activeRooms, &tokenBlacklist, &checkedTokenIDs, &consumedInvites, &tokenVersions, &liveConnections, &roomActivityWrites, &roomTotalsCache} {
+		m.Range(func(key, _ interface{}) bool {
+			m.Delete(key)
+			return true
+		})
+	}
+}
+
+// createTestUser adds a user and returns their ID and a login token
+func createTestUser(t testing.TB, username string) (int64, string) {
+	t.Helper()
+	user, err := CreateUser(username, hashPassword("password"), "")
+	if err != nil {
+		t.Fatalf("creating user %s: %v", username, err)
+	}
+	token, err := generateToken(username, user.ID)
+	if err != nil {
+		t.Fatalf("issuing token for %s: %v", username, err)
+	}
+	return user.ID, token
+}
+
+// createTestRoom saves a room owned by userID
+func createTestRoom(t testing.TB, roomID string, userID int64) *DbRoom {
+	t.Helper()
+	room, err := CreateRoom(&DbRoom{ID: roomID, Name: roomID, CreatedBy: userID})
+	if err != nil {
+		t.Fatalf("creating room %s: %v", roomID, err)
+	}
+	return room
+}
+
+// doRequest runs a request through the auth middleware and router without a network
+func doRequest(method, path, token string, body interface{}) *fasthttp.RequestCtx {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetMethod(method)
+	ctx.Request.SetRequestURI(path)
+	if token != "" {
+		ctx.Request.Header.Set("Authorization", "Bearer "+token)
+	}
+	if body != nil {
+		data, _ := json.Marshal(body)
+		ctx.Request.Header.SetContentType("application/json")
+		ctx.Request.SetBody(data)
+	}
+	authMiddleware(routeRequest)(ctx)
+	return ctx
+}
+
+// decodeBody unmarshals a JSON response body
+func decodeBody(t testing.TB, ctx *fasthttp.RequestCtx, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(ctx.Response.Body(), v); err != nil {
+		t.Fatalf("decoding %q: %v", ctx.Response.Body(), err)
+	}
+}
+
+// startTestServer serves the API on an in-memory listener
+func startTestServer(t testing.TB) *fasthttputil.InmemoryListener {
+	t.Helper()
+	ln := fasthttputil.NewInmemoryListener()
+	srv := &fasthttp.Server{Handler: authMiddleware(routeRequest), KeepHijackedConns: true}
+	go srv.Serve(ln)
+	t.Cleanup(func() { ln.Close() })
+	return ln
+}
+
+// testClient is a WebSocket client talking to a test server. Frames are read in the background,
+// since a read that times out would break the socket.
+type testClient struct {
+	t        testing.TB
+	ws       *websocket.Conn
+	frames   chan Message
+	closed   chan struct{} // Closed once the socket is closed, with the reason in closeErr
+	closeErr error
+}
+
+// dialTestClient opens a WebSocket to the test server, signed in when token is set
+func dialTestClient(t testing.TB, ln *fasthttputil.InmemoryListener, token string) *testClient {
+	t.Helper()
+	return dialTestClientWith(t, ln, token, false)
+}
+
+// dialTestClientWith is dialTestClient, offering permessage-deflate when compress is set
+func dialTestClientWith(t testing.TB, ln *fasthttputil.InmemoryListener, token string, compress bool) *testClient {
+	t.Helper()
+	dialer := websocket.Dialer{
+		NetDial:           func(network, addr string) (net.Conn, error) { return ln.Dial() },
+		HandshakeTimeout:  5 * time.Second,
+		EnableCompression: compress,
+	}
+	header := http.Header{}
+	if token != "" {
+		header.Set("Sec-WebSocket-Protocol", token)
+	}
+	ws, _, err := dialer.Dial("ws://monkeychat.test/ws", header)
+	if err != nil {
+		t.Fatalf("dialing WebSocket: %v", err)
+	}
+	c := &testClient{t: t, ws: ws, frames: make(chan Message, 1024), closed: make(chan struct{})}
+	go c.readLoop()
+	t.Cleanup(func() { ws.Close() })
+	return c
+}
+
+// readLoop queues incoming frames until the socket closes
+func (c *testClient) readLoop() {
+	defer close(c.closed)
+	for {
+		_, data, err := c.ws.ReadMessage()
+		if err != nil {
+			c.closeErr = err
+			return
+		}
+		var msg Message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			continue
+		}
+		c.frames <- msg
+	}
+}
+
+// dialTestUser creates a user and opens a WebSocket signed in as them
+func dialTestUser(t testing.TB, ln *fasthttputil.InmemoryListener, username string) (*testClient, int64) {
+	t.Helper()
+	userID, token := createTestUser(t, username)
+	return dialTestClient(t, ln, token), userID
+}
+
+// send writes an event to the server
+func (c *testClient) send(event, roomID string, payload interface{}) {
+	c.t.Helper()
+	msg := Message{Event: event, RoomID: roomID}
+	if payload != nil {
+		msg.Payload, _ = json.Marshal(payload)
+	}
+	data, _ := json.Marshal(msg)
+	if err := c.ws.WriteMessage(websocket.TextMessage, data); err != nil {
+		c.t.Fatalf("sending %s: %v", event, err)
+	}
+}
+
+// join joins roomID as userName and waits for the confirmation
+func (c *testClient) join(roomID, userName string) Message {
+	c.t.Helper()
+	c.send("join", roomID, UserInfo{UserName: userName})
+	return c.expect("joined")
+}
+
+// next returns the next event, or reports false if none arrives within wait
+func (c *testClient) next(wait time.Duration) (Message, bool) {
+	select {
+	case msg := <-c.frames:
+		return msg, true
+	case <-time.After(wait):
+		return Message{}, false
+	}
+}
+
+// expect skips other events until event arrives, failing the test if it doesn't within 5s
+func (c *testClient) expect(event string) Message {
+	c.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		msg, ok := c.next(time.Until(deadline))
+		if !ok {
+			c.t.Fatalf("timed out waiting for %s", event)
+		}
+		if msg.Event == event {
+			return msg
+		}
+	}
+}
+
+// expectClosed waits for the server to close the socket and returns the close code
+func (c *testClient) expectClosed() int {
+	c.t.Helper()
+	select {
+	case <-c.closed:
+	case <-time.After(5 * time.Second):
+		c.t.Fatal("timed out waiting for the socket to close")
+	}
+	var closeErr *websocket.CloseError
+	if errors.As(c.closeErr, &closeErr) {
+		return closeErr.Code
+	}
+	return websocket.CloseAbnormalClosure
+}
+
+// expectNone fails the test if event arrives within wait
+func (c *testClient) expectNone(event string, wait time.Duration) {
+	c.t.Helper()
+	deadline := time.Now().Add(wait)
+	for {
+		msg, ok := c.next(time.Until(deadline))
+		if !ok {
+			return
+		}
+		if msg.Event == event {
+			c.t.Fatalf("unexpected %s: %s", event, msg.Payload)
+		}
+	}
+}
+
+// payloadOf decodes a message payload
+func payloadOf(t testing.TB, msg Message, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(msg.Payload, v); err != nil {
+		t.Fatalf("decoding %s payload %q: %v", msg.Event, msg.Payload, err)
+	}
+}
+
+// newTestConnection returns a connection without a socket, whose outgoing frames collect in
+// its resume queue as they do while a peer is detached
+func newTestConnection(name string) *Connection {
+	return &Connection{UserName: name, detached: true}
+}
+
+// sentEvents lists the events queued for a connection made by newTestConnection
+func sentEvents(conn *Connection) []string {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	var events []string
+	for _, data := range conn.queued {
+		var msg Message
+		json.Unmarshal(data, &msg)
+		events = append(events, msg.Event)
+	}
+	return events
+}
+
+// hasEvent reports whether event is among events
+func hasEvent(events []string, event string) bool {
+	for _, e := range events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/valyala/fasthttp"
+)
+
+func TestOriginAllowed(t *testing.T) {
+	t.Setenv("ALLOWED_ORIGINS", "https://monkeychat.app, https://*.monkeychat.dev")
+
+	for origin, want := range map[string]bool{
+		"https://monkeychat.app":         true,
+		"HTTPS://MonkeyChat.app":         true,
+		"https://staging.monkeychat.dev": true,
+		"https://a.b.monkeychat.dev":     true,
+		"https://monkeychat.dev":         false,
+		"http://staging.monkeychat.dev":  false,
+		"https://monkeychat.app.evil.io": false,
+		"https://evilmonkeychat.dev":     false,
+		"":                               true,
+	} {
+		if got := originAllowed(origin); got != want {
+			t.Errorf("originAllowed(%q) = %v, want %v", origin, got, want)
+		}
+	}
+}
+
+func TestOriginDefaults(t *testing.T) {
+	t.Setenv("ALLOWED_ORIGINS", "")
+	t.Setenv("ENV", "development")
+	if !originAllowed("http://localhost:3000") {
+		t.Error("any origin should be allowed outside production without a list")
+	}
+	t.Setenv("ENV", "production")
+	if originAllowed("http://localhost:3000") {
+		t.Error("no origin should be allowed in production without a list")
+	}
+}
+
+// Upgrades from origins off the list are refused
+func TestWebSocketUpgradeChecksOrigin(t *testing.T) {
+	setupTestDB(t)
+	t.Setenv("ALLOWED_ORIGINS", "https://monkeychat.app")
+	ln := startTestServer(t)
+	dialer := websocket.Dialer{
+		NetDial:          func(network, addr string) (net.Conn, error) { return ln.Dial() },
+		HandshakeTimeout: 5 * time.Second,
+	}
+
+	header := http.Header{"Origin": {"https://evil.example"}}
+	if ws, resp, err := dialer.Dial("ws://monkeychat.test/ws", header); err == nil {
+		ws.Close()
+		t.Fatal("upgrade from a disallowed origin succeeded")
+	} else if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("disallowed origin: %v, %+v", err, resp)
+	}
+
+	header.Set("Origin", "https://monkeychat.app")
+	ws, _, err := dialer.Dial("ws://monkeychat.test/ws", header)
+	if err != nil {
+		t.Fatalf("upgrade from an allowed origin failed: %v", err)
+	}
+	ws.Close()
+}
+
+// corsRequest runs a request from origin through corsMiddleware, reporting whether it reached the handler
+func corsRequest(method, origin string) (*fasthttp.RequestCtx, bool) {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetMethod(method)
+	ctx.Request.SetRequestURI("/rooms")
+	if origin != "" {
+		ctx.Request.Header.Set("Origin", origin)
+	}
+	reached := false
+	corsMiddleware(func(ctx *fasthttp.RequestCtx) { reached = true })(ctx)
+	return ctx, reached
+}
+
+func TestCORSAllowlist(t *testing.T) {
+	t.Setenv("ALLOWED_ORIGINS", "https://monkeychat.app")
+	t.Setenv("ENV", "production")
+
+	ctx, reached := corsRequest("GET", "https://monkeychat.app")
+	if !reached || string(ctx.Response.Header.Peek("Access-Control-Allow-Origin")) != "https://monkeychat.app" ||
+		string(ctx.Response.Header.Peek("Access-Control-Allow-Credentials")) != "true" {
+		t.Errorf("allowed origin: reached %v, headers %s", reached, ctx.Response.Header.String())
+	}
+	if ctx, reached := corsRequest("OPTIONS", "https://monkeychat.app"); reached || ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Errorf("allowed preflight: reached %v, got %d", reached, ctx.Response.StatusCode())
+	}
+
+	ctx, _ = corsRequest("GET", "https://evil.example")
+	if len(ctx.Response.Header.Peek("Access-Control-Allow-Origin")) != 0 {
+		t.Errorf("disallowed origin got CORS headers: %s", ctx.Response.Header.String())
+	}
+	if ctx, reached := corsRequest("OPTIONS", "https://evil.example"); reached || ctx.Response.StatusCode() != fasthttp.StatusForbidden {
+		t.Errorf("disallowed preflight: reached %v, got %d, want 403", reached, ctx.Response.StatusCode())
+	}
+}
+
+// Without a list, development accepts any origin with "*", which never carries credentials
+func TestCORSWildcardInDevelopment(t *testing.T) {
+	t.Setenv("ALLOWED_ORIGINS", "")
+	t.Setenv("ENV", "development")
+
+	ctx, reached := corsRequest("GET", "http://localhost:3000")
+	if !reached || string(ctx.Response.Header.Peek("Access-Control-Allow-Origin")) != "*" {
+		t.Errorf("dev origin: reached %v, headers %s", reached, ctx.Response.Header.String())
+	}
+	if len(ctx.Response.Header.Peek("Access-Control-Allow-Credentials")) != 0 {
+		t.Error("wildcard CORS answer allows credentials")
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+)
+
+// A write that fails transiently is retried from the outbox and delivered in order
+func TestOutboxRetriesFailedWrite(t *testing.T) {
+	t.Setenv("OUTBOX_RETRY_BACKOFF", "10ms")
+	defer func(write func(*websocket.Conn, []byte) error) { writeTextFrame = write }(writeTextFrame)
+
+	var mu sync.Mutex
+	failures := 2
+	var delivered []string
+	writeTextFrame = func(ws *websocket.Conn, data []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			return errors.New("connection reset")
+		}
+		var msg Message
+		json.Unmarshal(data, &msg)
+		delivered = append(delivered, msg.Event)
+		return nil
+	}
+
+	conn := &Connection{UserName: "alice"}
+	for _, event := range []string{"chat", "user-joined"} {
+		data, _ := json.Marshal(Message{Event: event})
+		if err := conn.writeMessage(event, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		got := append([]string(nil), delivered...)
+		mu.Unlock()
+		if len(got) == 2 {
+			if got[0] != "chat" || got[1] != "user-joined" {
+				t.Fatalf("delivered %v out of order", got)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("frames weren't delivered after the failed write: %v", delivered)
+}
+
+// Writers on many goroutines never overlap on the socket and every frame gets through; run with -race
+func TestConcurrentWritersSerialized(t *testing.T) {
+	t.Setenv("WS_SEND_BUFFER", "1000")
+	defer func(write func(*websocket.Conn, []byte) error) { writeTextFrame = write }(writeTextFrame)
+
+	var active, overlaps, written int32
+	writeTextFrame = func(ws *websocket.Conn, data []byte) error {
+		if atomic.AddInt32(&active, 1) > 1 {
+			atomic.AddInt32(&overlaps, 1)
+		}
+		time.Sleep(50 * time.Microsecond)
+		atomic.AddInt32(&active, -1)
+		atomic.AddInt32(&written, 1)
+		return nil
+	}
+
+	const writers, perWriter = 20, 25
+	conn := &Connection{UserName: "alice"}
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < perWriter; j++ {
+				// Both the buffered path and direct frame writes, as the outbox retry does
+				if j%5 == 0 {
+					conn.writeFrame(nil, []byte(`{"event":"pong"}`))
+				} else {
+					respondJSON(conn, Message{Event: "chat", RoomID: "room", Payload: json.RawMessage(`{"n":1}`)})
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&written) < writers*perWriter && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := atomic.LoadInt32(&written); got != writers*perWriter {
+		t.Fatalf("%d frames written, want %d", got, writers*perWriter)
+	}
+	if n := atomic.LoadInt32(&overlaps); n != 0 {
+		t.Fatalf("%d writes overlapped on the same socket", n)
+	}
+}
+
+// A peer that stops reading is dropped once its send buffer fills, without holding up the rest of the room
+func TestSlowReaderDoesNotStallRoom(t *testing.T) {
+	setupTestDB(t)
+	t.Setenv("WS_SEND_BUFFER", "64")
+	ln := startTestServer(t)
+
+	alice, _ := dialTestUser(t, ln, "alice")
+	carol, _ := dialTestUser(t, ln, "carol")
+	alice.join("busy-room", "alice")
+	carol.join("busy-room", "carol")
+
+	// Bob joins and then never reads, so the in-memory pipe fills and writes to him block
+	_, bobToken := createTestUser(t, "bob")
+	bob, status := dialWS(t, ln, "", http.Header{"Sec-WebSocket-Protocol": {bobToken}})
+	if status != http.StatusSwitchingProtocols {
+		t.Fatalf("bob's upgrade got %d", status)
+	}
+	if err := bob.WriteJSON(Message{Event: "join", RoomID: "busy-room", Payload: json.RawMessage(`{"userName":"bob"}`)}); err != nil {
+		t.Fatal(err)
+	}
+	carol.expect("user-joined")
+
+	const messages = 150
+	start := time.Now()
+	// Sent in small bursts that a reading peer keeps up with, while bob's backlog only grows
+	for i := 0; i < messages; i += 10 {
+		for j := i; j < i+10; j++ {
+			alice.send("chat", "busy-room", map[string]string{"text": fmt.Sprintf("message %d", j)})
+		}
+		for j := i; j < i+10; j++ {
+			var chat ChatMessage
+			payloadOf(t, carol.expect("chat"), &chat)
+			if want := fmt.Sprintf("message %d", j); chat.Text != want {
+				t.Fatalf("carol got %q, want %q", chat.Text, want)
+			}
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("relaying to carol took %v with a stalled peer in the room", elapsed)
+	}
+
+	// Whatever made it into the pipe before bob was dropped is followed by the socket closing
+	bob.SetReadDeadline(time.Now().Add(5 * time.Second))
+	received := 0
+	for {
+		_, data, err := bob.ReadMessage()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				t.Fatal("bob's connection was never dropped")
+			}
+			break
+		}
+		var msg Message
+		if json.Unmarshal(data, &msg) == nil && msg.Event == "chat" {
+			received++
+		}
+	}
+	if received >= messages {
+		t.Fatalf("bob got all %d messages despite not reading", received)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// resumeTokenOf returns the resume token handed out with a joined event
+func resumeTokenOf(t *testing.T, joined Message) string {
+	t.Helper()
+	var payload struct {
+		ResumeToken string `json:"resumeToken"`
+	}
+	payloadOf(t, joined, &payload)
+	if payload.ResumeToken == "" {
+		t.Fatalf("joined without a resume token: %s", joined.Payload)
+	}
+	return payload.ResumeToken
+}
+
+// A peer that drops and comes back within the grace period keeps its place without a user-left
+func TestDroppedPeerResumesInTime(t *testing.T) {
+	setupTestDB(t)
+	ln := startTestServer(t)
+
+	_, aliceToken := createTestUser(t, "alice")
+	alice := dialTestClient(t, ln, aliceToken)
+	bob, _ := dialTestUser(t, ln, "bob")
+	token := resumeTokenOf(t, alice.join("room", "alice"))
+	bob.join("room", "bob")
+
+	alice.ws.Close()
+	time.Sleep(100 * time.Millisecond)
+	bob.send("chat", "room", ChatMessage{Text: "are you there?"})
+
+	again := dialTestClient(t, ln, aliceToken)
+	again.send("resume", "room", map[string]string{"token": token})
+	again.expect("resumed")
+	again.expect("chat")
+	bob.expectNone("user-left", 300*time.Millisecond)
+	bob.expectNone("user-joined", 100*time.Millisecond)
+
+	room := getRoom("room")
+	room.mu.RLock()
+	members := len(room.Connections)
+	room.mu.RUnlock()
+	if members != 2 {
+		t.Fatalf("room has %d members after the resume, want 2", members)
+	}
+}
+
+// A peer that stays away past the grace period is removed and can't resume; joining again is a
+// new join as far as the room is concerned
+func TestDroppedPeerTimesOut(t *testing.T) {
+	setupTestDB(t)
+	t.Setenv("RESUME_GRACE_PERIOD", "200ms")
+	ln := startTestServer(t)
+
+	_, aliceToken := createTestUser(t, "alice")
+	alice := dialTestClient(t, ln, aliceToken)
+	bob, _ := dialTestUser(t, ln, "bob")
+	token := resumeTokenOf(t, alice.join("room", "alice"))
+	bob.join("room", "bob")
+
+	alice.ws.Close()
+	bob.expectNone("user-left", 100*time.Millisecond)
+	bob.expect("user-left")
+
+	again := dialTestClient(t, ln, aliceToken)
+	again.send("resume", "room", map[string]string{"token": token})
+	again.expect("resume-failed")
+	if token2 := resumeTokenOf(t, again.join("room", "alice")); token2 == token {
+		t.Fatal("joining again reused the expired resume token")
+	}
+	var joined UserInfo
+	payloadOf(t, bob.expect("user-joined"), &joined)
+	if joined.UserName != "alice" {
+		t.Fatalf("user-joined for %+v, want alice", joined)
+	}
+}
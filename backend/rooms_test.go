@@ -0,0 +1,890 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// A join racing removeLiveRoom must never leave the joiner in a room that is no longer live
+func TestJoinRacingRoomRemoval(t *testing.T) {
+	setupTestDB(t)
+
+	const joiners = 50
+	conns := make([]*Connection, joiners)
+	var wg sync.WaitGroup
+	for i := range conns {
+		conns[i] = newTestConnection(fmt.Sprintf("guest-%d", i))
+		wg.Add(2)
+		go func(conn *Connection) {
+			defer wg.Done()
+			enterRoom(conn, "race", false)
+		}(conns[i])
+		go func() {
+			defer wg.Done()
+			removeLiveRoom("race")
+		}()
+	}
+	wg.Wait()
+
+	live := getRoom("race")
+	for _, conn := range conns {
+		conn.mu.Lock()
+		joined := conn.rooms["race"]
+		conn.mu.Unlock()
+		if joined == nil {
+			// Removed along with the room, and told so
+			if !hasEvent(sentEvents(conn), "room-deleted") {
+				t.Errorf("%s is in no room and wasn't told the room was deleted", conn.UserName)
+			}
+			continue
+		}
+		if joined != live {
+			t.Fatalf("%s joined a room that is no longer live", conn.UserName)
+		}
+		if !live.hasMember(conn) {
+			t.Errorf("%s thinks it joined but isn't a member", conn.UserName)
+		}
+	}
+}
+
+// A removed room refuses admissions
+func TestAdmitToClosedRoom(t *testing.T) {
+	setupTestDB(t)
+
+	room, _ := getOrCreateRoom("closed")
+	removeLiveRoom("closed")
+	conn := newTestConnection("late")
+	if admitToRoom(conn, room) {
+		t.Fatal("admitted to a removed room")
+	}
+	if room.hasMember(conn) {
+		t.Fatal("late joiner was added to a removed room")
+	}
+}
+
+// BenchmarkConcurrentRooms joins and leaves many rooms in parallel, each goroutine in its own rooms
+func BenchmarkConcurrentRooms(b *testing.B) {
+	setupTestDB(b)
+
+	var next sync.Mutex
+	worker := 0
+	b.RunParallel(func(pb *testing.PB) {
+		next.Lock()
+		worker++
+		id := worker
+		next.Unlock()
+
+		conn := newTestConnection(fmt.Sprintf("bench-%d", id))
+		for i := 0; pb.Next(); i++ {
+			roomID := fmt.Sprintf("bench-%d-%d", id, i%16)
+			enterRoom(conn, roomID, false)
+			if room := getRoom(roomID); room != nil {
+				room.removeConnection(conn)
+				conn.forgetRoom(room)
+			}
+			conn.mu.Lock()
+			conn.queued = nil
+			conn.mu.Unlock()
+		}
+	})
+}
+
+// Under the default "auth" policy only signed-in users create rooms by joining them
+func TestAnonymousRoomCreation(t *testing.T) {
+	setupTestDB(t)
+	ln := startTestServer(t)
+
+	anon := dialTestClient(t, ln, "")
+	anon.send("join", "fresh", map[string]interface{}{"userName": "guest"})
+	anon.expect("auth-required-to-create")
+	if getRoom("fresh") != nil {
+		t.Fatal("anonymous join created the room")
+	}
+
+	alice, _ := dialTestUser(t, ln, "alice")
+	alice.join("fresh", "alice")
+	if getRoom("fresh") == nil {
+		t.Fatal("signed-in join didn't create the room")
+	}
+
+	// The "any" policy lets anonymous users create rooms too
+	t.Setenv("ROOM_CREATE_POLICY", "any")
+	anon.join("open", "guest")
+}
+
+// Only the creator chats in a read-only room
+func TestReadOnlyRoomChat(t *testing.T) {
+	setupTestDB(t)
+	ln := startTestServer(t)
+
+	aliceID, aliceToken := createTestUser(t, "alice")
+	alice := dialTestClient(t, ln, aliceToken)
+	bob, _ := dialTestUser(t, ln, "bob")
+	if _, err := CreateRoom(&DbRoom{ID: "news", Name: "news", CreatedBy: aliceID, ReadOnly: true}); err != nil {
+		t.Fatal(err)
+	}
+	alice.join("news", "alice")
+	bob.join("news", "bob")
+
+	bob.send("chat", "news", ChatMessage{Text: "first!"})
+	bob.expect("room-read-only")
+	alice.expectNone("chat", 300*time.Millisecond)
+
+	alice.send("chat", "news", ChatMessage{Text: "welcome"})
+	var chat ChatMessage
+	payloadOf(t, bob.expect("chat"), &chat)
+	if chat.Text != "welcome" {
+		t.Fatalf("bob got chat %+v", chat)
+	}
+}
+
+// In slow mode a guest's second message inside the interval is refused; the host isn't limited
+func TestSlowModeChat(t *testing.T) {
+	setupTestDB(t)
+	ln := startTestServer(t)
+
+	aliceID, aliceToken := createTestUser(t, "alice")
+	alice := dialTestClient(t, ln, aliceToken)
+	bob, _ := dialTestUser(t, ln, "bob")
+	createTestRoom(t, "slow-room", aliceID)
+	if ctx := doRequest("PUT", "/rooms/slow-room/settings", aliceToken, map[string]int{"slowModeSeconds": 30}); ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("turning on slow mode: got %d %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	alice.join("slow-room", "alice")
+	bob.join("slow-room", "bob")
+
+	bob.send("chat", "slow-room", ChatMessage{Text: "one"})
+	alice.expect("chat")
+	bob.send("chat", "slow-room", ChatMessage{Text: "two"})
+	bob.expect("slow-mode")
+	alice.expectNone("chat", 300*time.Millisecond)
+
+	alice.send("chat", "slow-room", ChatMessage{Text: "host one"})
+	bob.expect("chat")
+	alice.send("chat", "slow-room", ChatMessage{Text: "host two"})
+	bob.expect("chat")
+
+	// Once the interval has passed the guest may talk again
+	room := getRoom("slow-room")
+	room.mu.Lock()
+	room.lastChat["bob"] = time.Now().Add(-31 * time.Second)
+	room.mu.Unlock()
+	bob.send("chat", "slow-room", ChatMessage{Text: "three"})
+	var chat ChatMessage
+	payloadOf(t, alice.expect("chat"), &chat)
+	if chat.Text != "three" {
+		t.Fatalf("alice got chat %+v", chat)
+	}
+}
+
+// Only owned or recently joined rooms that still have someone in them can be rejoined
+func TestRejoinableRoomsHaveParticipants(t *testing.T) {
+	setupTestDB(t)
+	aliceID, aliceToken := createTestUser(t, "alice")
+	bobID, _ := createTestUser(t, "bob")
+	createTestRoom(t, "busy", aliceID)
+	createTestRoom(t, "empty", aliceID)
+	createTestRoom(t, "visited", bobID)
+	createTestRoom(t, "strangers", bobID)
+
+	bob := &Connection{UserName: "bob", UserID: bobID, detached: true}
+	for _, roomID := range []string{"busy", "visited", "strangers"} {
+		enterRoom(bob, roomID, false)
+	}
+
+	// Alice was in "visited" a moment ago and still has friends there
+	alice := &Connection{UserName: "alice", UserID: aliceID, detached: true}
+	enterRoom(alice, "visited", false)
+	room := getRoom("visited")
+	room.removeConnection(alice)
+	alice.forgetRoom(room)
+
+	ctx := doRequest("GET", "/rooms/rejoinable", aliceToken, nil)
+	var rooms []struct {
+		ID           string   `json:"id"`
+		Owned        bool     `json:"owned"`
+		Participants []string `json:"participants"`
+	}
+	decodeBody(t, ctx, &rooms)
+	if len(rooms) != 2 || rooms[0].ID != "busy" || rooms[1].ID != "visited" {
+		t.Fatalf("rejoinable rooms = %+v, want busy and visited", rooms)
+	}
+	if !rooms[0].Owned || rooms[1].Owned {
+		t.Errorf("ownership reported wrong: %+v", rooms)
+	}
+	if len(rooms[1].Participants) != 1 || rooms[1].Participants[0] != "bob" {
+		t.Errorf("visited participants = %v, want bob", rooms[1].Participants)
+	}
+}
+
+// Many peers joining and leaving a few rooms at once leave membership consistent on both sides
+func TestConcurrentJoinLeave(t *testing.T) {
+	setupTestDB(t)
+
+	const peers, rounds = 20, 25
+	roomIDs := []string{"alpha", "bravo", "charlie"}
+	conns := make([]*Connection, peers)
+	var wg sync.WaitGroup
+	for i := range conns {
+		conns[i] = newTestConnection(fmt.Sprintf("peer-%d", i))
+		wg.Add(1)
+		go func(conn *Connection, i int) {
+			defer wg.Done()
+			for r := 0; r < rounds; r++ {
+				roomID := roomIDs[(i+r)%len(roomIDs)]
+				enterRoom(conn, roomID, false)
+				if r%3 == 0 {
+					cleanupConnection(conn)
+				} else if room := getRoom(roomID); room != nil && room.removeConnection(conn) {
+					conn.forgetRoom(room)
+				}
+			}
+			// Stay in one room so there is something left to check
+			enterRoom(conn, roomIDs[i%len(roomIDs)], false)
+		}(conns[i], i)
+	}
+	wg.Wait()
+
+	members := 0
+	for _, roomID := range roomIDs {
+		room := getRoom(roomID)
+		if room == nil {
+			t.Fatalf("room %s is gone with peers still in it", roomID)
+		}
+		room.mu.RLock()
+		for conn := range room.Connections {
+			if joined := conn.joinedRoomIDs(); len(joined) != 1 || joined[0] != roomID {
+				t.Errorf("%s is a member of %s but thinks it joined %v", conn.UserName, roomID, joined)
+			}
+		}
+		members += len(room.Connections)
+		room.mu.RUnlock()
+	}
+	if members != peers {
+		t.Fatalf("%d memberships across rooms, want %d", members, peers)
+	}
+}
+
+// A socket in two rooms is cleaned out of both when it disconnects
+func TestDisconnectLeavesEveryRoom(t *testing.T) {
+	setupTestDB(t)
+	t.Setenv("RESUME_GRACE_PERIOD", "0")
+	ln := startTestServer(t)
+
+	alice, _ := dialTestUser(t, ln, "alice")
+	bob, _ := dialTestUser(t, ln, "bob")
+	carol, _ := dialTestUser(t, ln, "carol")
+	alice.join("first", "alice")
+	alice.join("second", "alice")
+	bob.join("first", "bob")
+	carol.join("second", "carol")
+
+	alice.ws.Close()
+	bob.expect("user-left")
+	carol.expect("user-left")
+
+	for _, roomID := range []string{"first", "second"} {
+		room := getRoom(roomID)
+		room.mu.RLock()
+		for conn := range room.Connections {
+			if conn.UserName == "alice" {
+				t.Errorf("alice is still in room %s", roomID)
+			}
+		}
+		members := len(room.Connections)
+		room.mu.RUnlock()
+		if members != 1 {
+			t.Errorf("room %s has %d members, want 1", roomID, members)
+		}
+	}
+}
+
+// Ending the call tells everyone and disconnects them, while the saved room survives
+func TestEndCallDisconnectsEveryone(t *testing.T) {
+	setupTestDB(t)
+	ln := startTestServer(t)
+
+	aliceID, aliceToken := createTestUser(t, "alice")
+	createTestRoom(t, "standup", aliceID)
+	alice := dialTestClient(t, ln, aliceToken)
+	bob, _ := dialTestUser(t, ln, "bob")
+	carol, _ := dialTestUser(t, ln, "carol")
+	alice.join("standup", "alice")
+	token := resumeTokenOf(t, bob.join("standup", "bob"))
+	carol.join("standup", "carol")
+
+	// Only the host may end it
+	bob.send("end-call", "standup", nil)
+	bob.expect("end-call-denied")
+
+	alice.send("end-call", "standup", nil)
+	for _, peer := range []*testClient{bob, carol} {
+		var payload struct {
+			EndedBy string `json:"endedBy"`
+		}
+		payloadOf(t, peer.expect("call-ended"), &payload)
+		if payload.EndedBy != "alice" {
+			t.Errorf("call ended by %q, want alice", payload.EndedBy)
+		}
+		peer.expectClosed()
+	}
+	alice.expect("call-ended")
+
+	// The dismissed peers can't resume their way back in
+	bobAgain := dialTestClient(t, ln, "")
+	bobAgain.send("resume", "standup", map[string]string{"token": token})
+	bobAgain.expect("resume-failed")
+
+	if room, err := GetRoomByID("standup"); err != nil || room == nil {
+		t.Fatalf("ending the call deleted the room (%v)", err)
+	}
+}
+
+// /me/rooms reports each room the caller's sockets are in with their role there
+func TestMyRoomsReportsRoles(t *testing.T) {
+	setupTestDB(t)
+	ln := startTestServer(t)
+
+	aliceID, aliceToken := createTestUser(t, "alice")
+	bobID, bobToken := createTestUser(t, "bob")
+	createTestRoom(t, "alice-room", aliceID)
+	createTestRoom(t, "bob-room", bobID)
+	alice := dialTestClient(t, ln, aliceToken)
+	bob := dialTestClient(t, ln, bobToken)
+	alice.join("alice-room", "alice")
+	bob.join("bob-room", "bob")
+	alice.join("bob-room", "alice")
+
+	type myRoom struct {
+		ID           string `json:"id"`
+		Role         string `json:"role"`
+		Participants int    `json:"participants"`
+	}
+	myRooms := func() []myRoom {
+		var rooms []myRoom
+		decodeBody(t, doRequest("GET", "/me/rooms", aliceToken, nil), &rooms)
+		return rooms
+	}
+
+	rooms := myRooms()
+	if len(rooms) != 2 || rooms[0] != (myRoom{"alice-room", roleHost, 1}) || rooms[1] != (myRoom{"bob-room", roleGuest, 2}) {
+		t.Fatalf("/me/rooms = %+v", rooms)
+	}
+
+	bob.send("promote", "bob-room", map[string]interface{}{"targetUserId": aliceID})
+	alice.expect("role-changed")
+	if rooms := myRooms(); len(rooms) != 2 || rooms[1].Role != roleCohost {
+		t.Fatalf("after promotion /me/rooms = %+v", rooms)
+	}
+}
+
+// Rooms with system messages announce joins and leaves in the chat; others stay quiet
+func TestSystemMessagesOnJoinAndLeave(t *testing.T) {
+	setupTestDB(t)
+	ln := startTestServer(t)
+
+	aliceID, aliceToken := createTestUser(t, "alice")
+	if _, err := CreateRoom(&DbRoom{ID: "chatty", Name: "chatty", CreatedBy: aliceID, SystemMessages: true}); err != nil {
+		t.Fatal(err)
+	}
+	createTestRoom(t, "quiet", aliceID)
+	alice := dialTestClient(t, ln, aliceToken)
+	bob, _ := dialTestUser(t, ln, "bob")
+
+	alice.join("chatty", "alice")
+	expectSystemMessage := func(want string) {
+		t.Helper()
+		var chat ChatMessage
+		payloadOf(t, alice.expect("chat"), &chat)
+		if !chat.System || chat.Text != want {
+			t.Fatalf("system message = %+v, want %q", chat, want)
+		}
+	}
+	bob.join("chatty", "bob")
+	expectSystemMessage("bob joined the room")
+	bob.send("leave", "chatty", nil)
+	expectSystemMessage("bob left the room")
+
+	alice.join("quiet", "alice")
+	bob.join("quiet", "bob")
+	bob.send("leave", "quiet", nil)
+	alice.expect("user-left")
+	alice.expectNone("chat", 300*time.Millisecond)
+}
+
+// seedOrphanedRoom creates a room owned by a user that was removed behind the server's back
+func seedOrphanedRoom(t *testing.T, roomID string) {
+	t.Helper()
+	ghostID, _ := createTestUser(t, "ghost-"+roomID)
+	createTestRoom(t, roomID, ghostID)
+	if _, err := dbExec("DELETE FROM users WHERE id = ?", ghostID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOrphanedRoomsDeleted(t *testing.T) {
+	setupTestDB(t)
+	ownerID, _ := createTestUser(t, "alice")
+	createTestRoom(t, "owned-room", ownerID)
+	seedOrphanedRoom(t, "orphan-room")
+
+	cleanupOrphanedRooms()
+
+	if room, err := GetRoomByID("orphan-room"); err != nil || room != nil {
+		t.Fatalf("orphaned room survived cleanup: %+v, %v", room, err)
+	}
+	if room, err := GetRoomByID("owned-room"); err != nil || room == nil {
+		t.Fatalf("owned room was removed: %v", err)
+	}
+}
+
+func TestOrphanedRoomsReassigned(t *testing.T) {
+	setupTestDB(t)
+	t.Setenv("ORPHANED_ROOM_POLICY", "reassign")
+	t.Setenv("ORPHANED_ROOM_OWNER", "caretaker")
+	seedOrphanedRoom(t, "orphan-room")
+
+	cleanupOrphanedRooms()
+
+	owner, err := GetUserByUsername("caretaker")
+	if err != nil || owner == nil {
+		t.Fatalf("caretaker account wasn't created: %v", err)
+	}
+	room, err := GetRoomByID("orphan-room")
+	if err != nil || room == nil {
+		t.Fatalf("orphaned room was deleted instead of reassigned: %v", err)
+	}
+	if room.CreatedBy != owner.ID {
+		t.Fatalf("room owned by %d, want caretaker %d", room.CreatedBy, owner.ID)
+	}
+	if ids, _ := GetOrphanedRoomIDs(); len(ids) != 0 {
+		t.Fatalf("rooms still orphaned after reassigning: %v", ids)
+	}
+}
+
+func TestMuteAll(t *testing.T) {
+	setupTestDB(t)
+	ln := startTestServer(t)
+
+	host, hostID := dialTestUser(t, ln, "alice")
+	createTestRoom(t, "quiet-room", hostID)
+	bob, _ := dialTestUser(t, ln, "bob")
+	carol, _ := dialTestUser(t, ln, "carol")
+	host.join("quiet-room", "alice")
+	bob.join("quiet-room", "bob")
+	carol.join("quiet-room", "carol")
+
+	// Guests can't silence the room
+	bob.send("mute-all", "quiet-room", nil)
+	bob.expect("mute-denied")
+	carol.expectNone("force-mute", 200*time.Millisecond)
+
+	host.send("mute-all", "quiet-room", nil)
+	for _, peer := range []*testClient{bob, carol} {
+		var muted struct {
+			Muted        bool   `json:"muted"`
+			FromUserName string `json:"fromUserName"`
+		}
+		payloadOf(t, peer.expect("force-mute"), &muted)
+		if !muted.Muted || muted.FromUserName != "alice" {
+			t.Fatalf("force-mute payload = %+v", muted)
+		}
+	}
+	host.expectNone("force-mute", 200*time.Millisecond)
+
+	// A late joiner learns the room is muted and is muted too
+	type joinedState struct {
+		ForceMuted bool `json:"forceMuted"`
+	}
+	dave, _ := dialTestUser(t, ln, "dave")
+	var state joinedState
+	payloadOf(t, dave.join("quiet-room", "dave"), &state)
+	if !state.ForceMuted {
+		t.Fatal("late joiner wasn't told the room is muted")
+	}
+	var muted struct {
+		Muted        bool   `json:"muted"`
+		FromUserName string `json:"fromUserName"`
+	}
+	payloadOf(t, dave.expect("force-mute"), &muted)
+	if !muted.Muted || muted.FromUserName != "alice" {
+		t.Fatalf("late joiner's force-mute = %+v", muted)
+	}
+
+	host.send("unmute-all", "quiet-room", nil)
+	var unmuted struct {
+		Muted bool `json:"muted"`
+	}
+	payloadOf(t, bob.expect("force-mute"), &unmuted)
+	if unmuted.Muted {
+		t.Fatal("unmute-all still reported the room as muted")
+	}
+	erin, _ := dialTestUser(t, ln, "erin")
+	state = joinedState{}
+	payloadOf(t, erin.join("quiet-room", "erin"), &state)
+	if state.ForceMuted {
+		t.Fatal("joiner after unmute-all was told the room is muted")
+	}
+	erin.expectNone("force-mute", 200*time.Millisecond)
+}
+
+func TestInvalidRoomIDs(t *testing.T) {
+	setupTestDB(t)
+	ln := startTestServer(t)
+	_, token := createTestUser(t, "alice")
+	client := dialTestClient(t, ln, token)
+
+	invalid := map[string]string{
+		"empty":              "",
+		"too short":          "ab",
+		"too long":           strings.Repeat("r", 51),
+		"space":              "my room",
+		"control characters": "room\nid",
+		"path separator":     "room/../x",
+		"unicode":            "räum",
+	}
+	for name, roomID := range invalid {
+		if validateRoomID(roomID) == nil {
+			t.Errorf("%s: validateRoomID(%q) accepted it", name, roomID)
+		}
+
+		client.send("join", roomID, UserInfo{UserName: "alice"})
+		msg := client.expect("invalid-room-id")
+		if msg.RoomID != roomID {
+			t.Errorf("%s: rejection names room %q", name, msg.RoomID)
+		}
+		if getRoom(roomID) != nil {
+			t.Errorf("%s: a live room was created for %q", name, roomID)
+		}
+
+		ctx := doRequest("POST", "/rooms/delete", token, map[string]string{"roomId": roomID})
+		if ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+			t.Errorf("%s: deleting %q got %d, want 400", name, roomID, ctx.Response.StatusCode())
+		}
+	}
+
+	for _, roomID := range []string{"abc", strings.Repeat("r", 50), "Team_Sync-2"} {
+		if err := validateRoomID(roomID); err != nil {
+			t.Errorf("validateRoomID(%q) = %v", roomID, err)
+		}
+	}
+	client.join("Team_Sync-2", "alice")
+}
+
+// Purging clears what the server keeps for a live room and tells its members, but the room stays
+func TestPurgeRoomKeepsRoom(t *testing.T) {
+	setupTestDB(t)
+	ln := startTestServer(t)
+
+	hostID, hostToken := createTestUser(t, "alice")
+	createTestRoom(t, "purge-room", hostID)
+	host := dialTestClient(t, ln, hostToken)
+	_, bobToken := createTestUser(t, "bob")
+	bob := dialTestClient(t, ln, bobToken)
+	host.join("purge-room", "alice")
+	bob.join("purge-room", "bob")
+	getRoom("purge-room").addStats(StatsSample{UserName: "bob", ReportedAt: time.Now()})
+
+	if ctx := doRequest("POST", "/rooms/purge-room/purge", bobToken, nil); ctx.Response.StatusCode() != fasthttp.StatusForbidden {
+		t.Fatalf("purge by a guest: got %d, want 403", ctx.Response.StatusCode())
+	}
+
+	ctx := doRequest("POST", "/rooms/purge-room/purge", hostToken, nil)
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("purge: got %d %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	var resp struct {
+		Notified int `json:"notified"`
+	}
+	decodeBody(t, ctx, &resp)
+	if resp.Notified != 2 {
+		t.Fatalf("notified %d members, want 2", resp.Notified)
+	}
+	for _, member := range []*testClient{host, bob} {
+		var purged struct {
+			FromUserName string `json:"fromUserName"`
+		}
+		payloadOf(t, member.expect("room-purged"), &purged)
+		if purged.FromUserName != "alice" {
+			t.Fatalf("room-purged from %q", purged.FromUserName)
+		}
+	}
+
+	if stats := getRoom("purge-room").statsSnapshot(); len(stats) != 0 {
+		t.Fatalf("%d stats samples survived the purge", len(stats))
+	}
+	if room, err := GetRoomByID("purge-room"); err != nil || room == nil || room.CreatedBy != hostID {
+		t.Fatalf("room after purge = %+v, %v", room, err)
+	}
+	// Members stay in the room and can keep talking
+	host.send("chat", "purge-room", map[string]string{"text": "fresh start"})
+	bob.expect("chat")
+}
+
+func TestCompactEmptyRooms(t *testing.T) {
+	setupTestDB(t)
+	ln := startTestServer(t)
+	aliceID, aliceToken := createTestUser(t, "alice")
+	createTestRoom(t, "persistent-room", aliceID)
+	for _, id := range []string{"ephemeral-room", "occupied-room"} {
+		if _, err := CreateRoom(&DbRoom{ID: id, Name: id, CreatedBy: aliceID, Ephemeral: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range []string{"unsaved-room", "ephemeral-room", "persistent-room"} {
+		getOrCreateRoom(id)
+	}
+	alice := dialTestClient(t, ln, aliceToken)
+	alice.join("occupied-room", "alice")
+
+	// Rooms that only just emptied are left alone
+	if n := compactEmptyRooms(time.Hour); n != 0 {
+		t.Fatalf("compacted %d rooms that emptied moments ago", n)
+	}
+
+	if n := compactEmptyRooms(0); n != 2 {
+		t.Fatalf("compacted %d rooms, want 2", n)
+	}
+	for _, id := range []string{"unsaved-room", "ephemeral-room"} {
+		if getRoom(id) != nil {
+			t.Errorf("empty room %s is still in memory", id)
+		}
+	}
+	for _, id := range []string{"persistent-room", "occupied-room"} {
+		if getRoom(id) == nil {
+			t.Errorf("room %s was compacted", id)
+		}
+	}
+
+	// A compacted room comes back when someone joins it again
+	alice.join("ephemeral-room", "alice")
+	if getRoom("ephemeral-room") == nil {
+		t.Fatal("rejoining a compacted room didn't bring it back")
+	}
+}
+
+// Leaving and then dropping the socket removes the member once: one user-left, one recorded session
+func TestLeaveThenDisconnect(t *testing.T) {
+	setupTestDB(t)
+	t.Setenv("RESUME_GRACE_PERIOD", "0")
+	ln := startTestServer(t)
+
+	aliceID, aliceToken := createTestUser(t, "alice")
+	createTestRoom(t, "standup", aliceID)
+	alice := dialTestClient(t, ln, aliceToken)
+	bob, _ := dialTestUser(t, ln, "bob")
+	alice.join("standup", "alice")
+	bob.join("standup", "bob")
+
+	alice.send("leave", "standup", nil)
+	bob.expect("user-left")
+	alice.ws.Close()
+	bob.expectNone("user-left", 300*time.Millisecond)
+
+	room := getRoom("standup")
+	room.mu.RLock()
+	members := len(room.Connections)
+	room.mu.RUnlock()
+	if members != 1 {
+		t.Fatalf("room has %d members, want only bob", members)
+	}
+
+	// The second of two removals finds nothing to do
+	carol := newTestConnection("carol")
+	room.mu.Lock()
+	room.Connections[carol] = struct{}{}
+	room.mu.Unlock()
+	if !room.removeConnection(carol) {
+		t.Fatal("removing a member reported no removal")
+	}
+	if room.removeConnection(carol) {
+		t.Fatal("removing the same connection twice reported a second removal")
+	}
+
+	var sessions int
+	deadline := time.Now().Add(2 * time.Second)
+	for sessions == 0 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+		if err := dbQueryRow("SELECT COUNT(*) FROM room_sessions WHERE room_id = ? AND user_id = ?", "standup", aliceID).Scan(&sessions); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	dbQueryRow("SELECT COUNT(*) FROM room_sessions WHERE room_id = ? AND user_id = ?", "standup", aliceID).Scan(&sessions)
+	if sessions != 1 {
+		t.Fatalf("alice's stay was recorded %d times, want once", sessions)
+	}
+}
+
+// Leave notifies the room whatever the payload looks like, falling back to the socket's name
+func TestLeavePayloads(t *testing.T) {
+	setupTestDB(t)
+	ln := startTestServer(t)
+	alice, _ := dialTestUser(t, ln, "alice")
+	bob, _ := dialTestUser(t, ln, "bob")
+	bob.join("farewell", "bob")
+
+	for name, payload := range map[string]interface{}{
+		"no payload":    nil,
+		"empty payload": map[string]string{},
+		"with username": UserInfo{UserName: "alice"},
+	} {
+		alice.join("farewell", "alice")
+		bob.expect("user-joined")
+
+		alice.send("leave", "farewell", payload)
+		var left struct {
+			UserName string `json:"userName"`
+		}
+		payloadOf(t, bob.expect("user-left"), &left)
+		if left.UserName != "alice" {
+			t.Fatalf("%s: user-left names %q, want alice", name, left.UserName)
+		}
+	}
+}
+
+// Rooms idle past the retention period are deleted unless their creator pinned them or someone is in them
+func TestIdleRoomsExpire(t *testing.T) {
+	setupTestDB(t)
+	ln := startTestServer(t)
+	aliceID, aliceToken := createTestUser(t, "alice")
+	for _, id := range []string{"idle-room", "pinned-room", "recent-room", "busy-room"} {
+		createTestRoom(t, id, aliceID)
+	}
+	if ctx := doRequest("PUT", "/rooms/pinned-room/settings", aliceToken, map[string]bool{"persistent": true}); ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("pinning a room: got %d %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	alice := dialTestClient(t, ln, aliceToken)
+	alice.join("busy-room", "alice")
+
+	lastActive := time.Now().Add(-2 * time.Hour)
+	for _, id := range []string{"idle-room", "pinned-room", "busy-room"} {
+		if _, err := dbExec("UPDATE rooms SET last_active_at = ? WHERE id = ?", lastActive, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	getOrCreateRoom("idle-room")
+
+	expireIdleRooms(time.Now().Add(-time.Hour))
+
+	if room, err := GetRoomByID("idle-room"); err != nil || room != nil {
+		t.Fatalf("idle room after expiry = %+v, %v", room, err)
+	}
+	if getRoom("idle-room") != nil {
+		t.Error("expired room is still in memory")
+	}
+	for _, id := range []string{"pinned-room", "recent-room", "busy-room"} {
+		if room, err := GetRoomByID(id); err != nil || room == nil {
+			t.Errorf("room %s was expired: %v", id, err)
+		}
+	}
+}
+
+// Joins and chat record activity in the room, but a busy room is only written once per interval
+func TestRoomActivityThrottled(t *testing.T) {
+	setupTestDB(t)
+	t.Setenv("ROOM_ACTIVITY_WRITE_INTERVAL", "1h")
+	ln := startTestServer(t)
+	aliceID, aliceToken := createTestUser(t, "alice")
+	createTestRoom(t, "active-room", aliceID)
+
+	lastActive := func() time.Time {
+		t.Helper()
+		room, err := GetRoomByID("active-room")
+		if err != nil || room == nil || room.LastActiveAt == nil {
+			t.Fatalf("room = %+v, %v", room, err)
+		}
+		return *room.LastActiveAt
+	}
+
+	alice := dialTestClient(t, ln, aliceToken)
+	bob, _ := dialTestUser(t, ln, "bob")
+	alice.join("active-room", "alice")
+	if at := lastActive(); time.Since(at).Abs() > 2*time.Second {
+		t.Fatalf("last active at %v after joining, want about now", at)
+	}
+
+	// Within the interval nothing more is written, however busy the room
+	earlier := time.Now().Add(-time.Minute).Truncate(time.Second)
+	if err := UpdateRoomActivity("active-room", earlier); err != nil {
+		t.Fatal(err)
+	}
+	bob.join("active-room", "bob")
+	for i := 0; i < 5; i++ {
+		alice.send("chat", "active-room", ChatMessage{Text: "busy"})
+		bob.expect("chat")
+	}
+	if at := lastActive(); !at.Equal(earlier) {
+		t.Fatalf("last active at %v after chatting inside the interval, want %v", at, earlier)
+	}
+
+	// Once the interval has passed the next message is written again
+	roomActivityWrites.Store("active-room", time.Now().Add(-2*time.Hour))
+	alice.send("chat", "active-room", ChatMessage{Text: "later"})
+	bob.expect("chat")
+	if at := lastActive(); time.Since(at).Abs() > 2*time.Second {
+		t.Fatalf("last active at %v after the interval, want about now", at)
+	}
+}
+
+// Room stats add the stays still going in the live room to the recorded ones, which are cached
+func TestRoomStatsTotals(t *testing.T) {
+	setupTestDB(t)
+	t.Setenv("ROOM_STATS_CACHE_TTL", "1h")
+	ln := startTestServer(t)
+	aliceID, aliceToken := createTestUser(t, "alice")
+	createTestRoom(t, "stats-room", aliceID)
+
+	start := time.Now().Add(-time.Hour)
+	for _, session := range []RoomSession{
+		{UserName: "alice", UserID: aliceID, JoinedAt: start, LeftAt: start.Add(60 * time.Second), Messages: 3, PeakParticipants: 2},
+		{UserName: "bob", JoinedAt: start, LeftAt: start.Add(30 * time.Second), Messages: 1, PeakParticipants: 2},
+		{UserName: "alice", UserID: aliceID, JoinedAt: start.Add(time.Minute), LeftAt: start.Add(70 * time.Second), PeakParticipants: 1},
+	} {
+		session.RoomID = "stats-room"
+		if err := RecordRoomSession(session); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := RoomTotals{Messages: 4, Participants: 2, PeakParticipants: 2, SessionSeconds: 100}
+	if totals, err := roomTotals("stats-room", nil); err != nil || totals != want {
+		t.Fatalf("recorded totals = %+v, %v; want %+v", totals, err, want)
+	}
+
+	// Stays recorded elsewhere show up once the cached totals expire
+	late := RoomSession{RoomID: "stats-room", UserName: "carol", JoinedAt: start, LeftAt: start.Add(20 * time.Second), Messages: 2, PeakParticipants: 3}
+	if err := RecordRoomSession(late); err != nil {
+		t.Fatal(err)
+	}
+	if totals, _ := roomTotals("stats-room", nil); totals != want {
+		t.Fatalf("totals inside the cache TTL = %+v, want %+v", totals, want)
+	}
+	t.Setenv("ROOM_STATS_CACHE_TTL", "0")
+	want = RoomTotals{Messages: 6, Participants: 3, PeakParticipants: 3, SessionSeconds: 120}
+	if totals, _ := roomTotals("stats-room", nil); totals != want {
+		t.Fatalf("totals after the cache TTL = %+v, want %+v", totals, want)
+	}
+
+	// Alice has been here before; dave is new
+	alice := dialTestClient(t, ln, aliceToken)
+	dave, _ := dialTestUser(t, ln, "dave")
+	alice.join("stats-room", "alice")
+	dave.join("stats-room", "dave")
+	alice.send("chat", "stats-room", ChatMessage{Text: "hello"})
+	dave.expect("chat")
+
+	ctx := doRequest("GET", "/rooms/stats-room/stats", aliceToken, nil)
+	var stats struct {
+		Totals RoomTotals `json:"totals"`
+	}
+	decodeBody(t, ctx, &stats)
+	totals := stats.Totals
+	if totals.Messages != 7 || totals.Participants != 4 || totals.PeakParticipants != 3 || totals.SessionSeconds < 120 {
+		t.Fatalf("live totals = %+v, want 7 messages from 4 participants over at least 120s", totals)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+const scriptPayload = `hi <script>alert("pwned")</script>`
+
+func TestSanitizeTextModes(t *testing.T) {
+	for mode, want := range map[string]string{
+		"":      `hi &lt;script&gt;alert(&#34;pwned&#34;)&lt;/script&gt;`,
+		"strip": `hi `,
+		"off":   scriptPayload,
+	} {
+		t.Setenv("SANITIZE_MODE", mode)
+		if got := sanitizeText(scriptPayload); got != want {
+			t.Errorf("mode %q: sanitizeText = %q, want %q", mode, got, want)
+		}
+	}
+}
+
+// Script tags are neutralized in bios, room names and descriptions, and chat
+func TestScriptTagsNeutralized(t *testing.T) {
+	setupTestDB(t)
+	ln := startTestServer(t)
+	aliceID, aliceToken := createTestUser(t, "alice")
+
+	if ctx := doRequest("PUT", "/users/alice/profile", aliceToken, map[string]string{"bio": scriptPayload}); ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("updating profile: got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	user, err := GetUserByID(aliceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkNeutralized(t, "bio", user.Bio)
+
+	ctx := doRequest("POST", "/rooms", aliceToken, map[string]string{"name": scriptPayload, "description": scriptPayload})
+	if ctx.Response.StatusCode() != fasthttp.StatusOK && ctx.Response.StatusCode() != fasthttp.StatusCreated {
+		t.Fatalf("creating room: got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	var created DbRoom
+	decodeBody(t, ctx, &created)
+	room, err := GetRoomByID(created.ID)
+	if err != nil || room == nil {
+		t.Fatalf("room %s not saved: %v", created.ID, err)
+	}
+	checkNeutralized(t, "room name", room.Name)
+	checkNeutralized(t, "room description", room.Description)
+
+	alice := dialTestClient(t, ln, aliceToken)
+	bob, _ := dialTestUser(t, ln, "bob")
+	alice.join("chat", "alice")
+	bob.join("chat", "bob")
+	alice.send("chat", "chat", ChatMessage{Text: scriptPayload})
+	var chat ChatMessage
+	payloadOf(t, bob.expect("chat"), &chat)
+	checkNeutralized(t, "chat", chat.Text)
+}
+
+func checkNeutralized(t *testing.T, field, value string) {
+	t.Helper()
+	if strings.Contains(value, "<script") || !strings.Contains(value, "&lt;script&gt;") {
+		t.Errorf("%s = %q, want the script tag escaped", field, value)
+	}
+}
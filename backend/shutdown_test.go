@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/fasthttp/websocket"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+func TestShutdownNotifiesClientsBeforeClosing(t *testing.T) {
+	setupTestDB(t)
+	t.Setenv("SHUTDOWN_GRACE_PERIOD", "2s")
+	t.Setenv("SHUTDOWN_RECONNECT_DELAY", "3s")
+
+	ln := fasthttputil.NewInmemoryListener()
+	server := &fasthttp.Server{Handler: authMiddleware(routeRequest), KeepHijackedConns: true}
+	go server.Serve(ln)
+
+	client, _ := dialTestUser(t, ln, "alice")
+	client.join("lobby", "alice")
+
+	ready.Store(true)
+	shutdownServer(server)
+
+	if ready.Load() {
+		t.Error("server still reports ready after shutdown")
+	}
+	notice := client.expect("server-shutdown")
+	var payload struct {
+		ReconnectDelayMs int64 `json:"reconnectDelayMs"`
+	}
+	payloadOf(t, notice, &payload)
+	if payload.ReconnectDelayMs != 3000 {
+		t.Errorf("reconnectDelayMs = %d, want 3000", payload.ReconnectDelayMs)
+	}
+	if code := client.expectClosed(); code != websocket.CloseGoingAway {
+		t.Errorf("socket closed with %d, want %d", code, websocket.CloseGoingAway)
+	}
+}
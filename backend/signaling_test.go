@@ -0,0 +1,411 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+)
+
+func TestOfferRelayedOnlyToTarget(t *testing.T) {
+	setupTestDB(t)
+	ln := startTestServer(t)
+
+	alice, _ := dialTestUser(t, ln, "alice")
+	bob, bobID := dialTestUser(t, ln, "bob")
+	carol, _ := dialTestUser(t, ln, "carol")
+	alice.join("mesh", "alice")
+	bob.join("mesh", "bob")
+	carol.join("mesh", "carol")
+
+	alice.send("offer", "mesh", map[string]interface{}{"targetUserId": bobID, "sdp": "v=0"})
+	offer := bob.expect("offer")
+	var payload struct {
+		SDP string `json:"sdp"`
+	}
+	payloadOf(t, offer, &payload)
+	if payload.SDP != "v=0" {
+		t.Fatalf("bob got offer %s", offer.Payload)
+	}
+	carol.expectNone("offer", 300*time.Millisecond)
+
+	// Without a target the offer still goes to everyone else
+	alice.send("offer", "mesh", map[string]interface{}{"sdp": "v=0"})
+	bob.expect("offer")
+	carol.expect("offer")
+}
+
+func TestTypingScopeRelayed(t *testing.T) {
+	setupTestDB(t)
+	ln := startTestServer(t)
+
+	alice, _ := dialTestUser(t, ln, "alice")
+	bob, _ := dialTestUser(t, ln, "bob")
+	alice.join("room", "alice")
+	bob.join("room", "bob")
+
+	var typing TypingInfo
+	for _, scope := range []string{"chat", "call"} {
+		alice.send("typing", "room", TypingInfo{Scope: scope, IsTyping: true, UserName: "mallory"})
+		payloadOf(t, bob.expect("typing"), &typing)
+		if typing.Scope != scope || !typing.IsTyping || typing.UserName != "alice" {
+			t.Fatalf("relayed typing = %+v, want scope %s from alice", typing, scope)
+		}
+	}
+
+	// Unknown scopes aren't relayed
+	alice.send("typing", "room", TypingInfo{Scope: "whiteboard", IsTyping: true})
+	bob.expectNone("typing", 300*time.Millisecond)
+
+	// A late joiner learns who is typing where
+	carol, _ := dialTestUser(t, ln, "carol")
+	carol.send("join", "room", nil)
+	scopes := map[string]bool{}
+	for len(scopes) < 2 {
+		msg, ok := carol.next(5 * time.Second)
+		if !ok || msg.Event == "joined" {
+			t.Fatalf("late joiner learned about %v only", scopes)
+		}
+		if msg.Event != "typing" {
+			continue
+		}
+		payloadOf(t, msg, &typing)
+		if typing.UserName != "alice" || !typing.IsTyping {
+			t.Fatalf("replayed typing = %+v", typing)
+		}
+		scopes[typing.Scope] = true
+	}
+}
+
+// Relayed frames arrive intact whether or not each peer negotiated compression
+func TestRelayWithMixedCompression(t *testing.T) {
+	setupTestDB(t)
+	defer func(enabled bool) { upgrader.EnableCompression = enabled }(upgrader.EnableCompression)
+	upgrader.EnableCompression = true
+	ln := startTestServer(t)
+
+	_, aliceToken := createTestUser(t, "alice")
+	_, bobToken := createTestUser(t, "bob")
+	alice := dialTestClientWith(t, ln, aliceToken, true)
+	bob := dialTestClientWith(t, ln, bobToken, false)
+	alice.join("room", "alice")
+	bob.join("room", "bob")
+
+	sdp := "v=0\r\n" + strings.Repeat("a=candidate:1 1 udp 2122260223 192.0.2.1 54400 typ host\r\n", 64)
+	var payload struct {
+		SDP string `json:"sdp"`
+	}
+	for _, pair := range []struct{ from, to *testClient }{{alice, bob}, {bob, alice}} {
+		pair.from.send("offer", "room", map[string]interface{}{"sdp": sdp})
+		payloadOf(t, pair.to.expect("offer"), &payload)
+		if payload.SDP != sdp {
+			t.Fatalf("relayed SDP was altered: got %d bytes, want %d", len(payload.SDP), len(sdp))
+		}
+	}
+}
+
+// BenchmarkRelayCompression relays SDP-sized offers between two peers with and without permessage-deflate
+func BenchmarkRelayCompression(b *testing.B) {
+	setupTestDB(b)
+	defer func(enabled bool) { upgrader.EnableCompression = enabled }(upgrader.EnableCompression)
+	ln := startTestServer(b)
+	_, aliceToken := createTestUser(b, "alice")
+	_, bobToken := createTestUser(b, "bob")
+
+	offer := map[string]interface{}{
+		"sdp": "v=0\r\n" + strings.Repeat("a=candidate:1 1 udp 2122260223 192.0.2.1 54400 typ host\r\n", 64),
+	}
+	for _, compress := range []bool{false, true} {
+		name := "plain"
+		if compress {
+			name = "deflate"
+		}
+		b.Run(name, func(b *testing.B) {
+			upgrader.EnableCompression = compress
+			alice := dialTestClientWith(b, ln, aliceToken, compress)
+			bob := dialTestClientWith(b, ln, bobToken, compress)
+			alice.join(name, "alice")
+			bob.join(name, "bob")
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				alice.send("offer", name, offer)
+				bob.expect("offer")
+			}
+		})
+	}
+}
+
+func TestIceCompleteRelayedOnlyToTarget(t *testing.T) {
+	setupTestDB(t)
+	ln := startTestServer(t)
+
+	alice, _ := dialTestUser(t, ln, "alice")
+	bob, bobID := dialTestUser(t, ln, "bob")
+	carol, _ := dialTestUser(t, ln, "carol")
+	alice.join("mesh", "alice")
+	bob.join("mesh", "bob")
+	carol.join("mesh", "carol")
+
+	alice.send("ice-complete", "mesh", map[string]interface{}{"targetUserId": bobID})
+	msg := bob.expect("ice-complete")
+	if msg.RoomID != "mesh" {
+		t.Fatalf("bob got ice-complete for room %q", msg.RoomID)
+	}
+	carol.expectNone("ice-complete", 300*time.Millisecond)
+
+	// Without a target there's nobody to tell
+	alice.send("ice-complete", "mesh", nil)
+	bob.expectNone("ice-complete", 300*time.Millisecond)
+	carol.expectNone("ice-complete", 100*time.Millisecond)
+}
+
+func TestDTMFRelayedOnlyToTarget(t *testing.T) {
+	setupTestDB(t)
+	ln := startTestServer(t)
+
+	alice, aliceID := dialTestUser(t, ln, "alice")
+	bob, bobID := dialTestUser(t, ln, "bob")
+	carol, _ := dialTestUser(t, ln, "carol")
+	alice.join("phone", "alice")
+	bob.join("phone", "bob")
+	carol.join("phone", "carol")
+
+	// The sender is whoever the socket is signed in as, whatever the payload claims
+	alice.send("dtmf", "phone", map[string]interface{}{"tones": "12#,*A", "targetUserId": bobID, "fromUserName": "carol", "fromUserId": 42})
+	var dtmf DTMFInfo
+	payloadOf(t, bob.expect("dtmf"), &dtmf)
+	if dtmf.Tones != "12#,*A" || dtmf.FromUserName != "alice" || dtmf.FromUserID != aliceID || dtmf.isSet() {
+		t.Fatalf("bob got dtmf %+v, want alice's tones without a target", dtmf)
+	}
+	carol.expectNone("dtmf", 300*time.Millisecond)
+
+	// Anything outside the DTMF alphabet isn't forwarded
+	alice.send("dtmf", "phone", map[string]interface{}{"tones": "12E", "targetUserId": bobID})
+	bob.expectNone("dtmf", 300*time.Millisecond)
+}
+
+// A frame over WS_MAX_MESSAGE_SIZE closes the sender's connection and leaves the room as usual
+func TestOversizedFrameClosesConnection(t *testing.T) {
+	setupTestDB(t)
+	t.Setenv("WS_MAX_MESSAGE_SIZE", "1024")
+	t.Setenv("RESUME_GRACE_PERIOD", "0")
+	ln := startTestServer(t)
+
+	alice, _ := dialTestUser(t, ln, "alice")
+	bob, _ := dialTestUser(t, ln, "bob")
+	alice.join("limits", "alice")
+	bob.join("limits", "bob")
+
+	// Frames under the limit are fine
+	alice.send("chat", "limits", map[string]string{"text": "hello"})
+	bob.expect("chat")
+
+	alice.send("chat", "limits", map[string]string{"text": strings.Repeat("x", 2048)})
+	if code := alice.expectClosed(); code != websocket.CloseMessageTooBig {
+		t.Fatalf("close code %d, want %d", code, websocket.CloseMessageTooBig)
+	}
+	bob.expect("user-left")
+}
+
+func TestConnStateRelayedAndReplayed(t *testing.T) {
+	setupTestDB(t)
+	ln := startTestServer(t)
+
+	alice, _ := dialTestUser(t, ln, "alice")
+	bob, bobID := dialTestUser(t, ln, "bob")
+	carol, _ := dialTestUser(t, ln, "carol")
+	alice.join("mesh", "alice")
+	bob.join("mesh", "bob")
+	carol.join("mesh", "carol")
+
+	alice.send("conn-state", "mesh", map[string]string{"state": "failed", "userName": "mallory"})
+	for _, peer := range []*testClient{bob, carol} {
+		var info ConnStateInfo
+		payloadOf(t, peer.expect("conn-state"), &info)
+		if info.State != "failed" || info.UserName != "alice" {
+			t.Fatalf("relayed conn-state = %+v", info)
+		}
+	}
+	alice.expectNone("conn-state", 200*time.Millisecond)
+
+	// Unknown states go nowhere, and targeted ones reach only their target without being kept
+	alice.send("conn-state", "mesh", map[string]string{"state": "exploded"})
+	bob.expectNone("conn-state", 200*time.Millisecond)
+	alice.send("conn-state", "mesh", map[string]interface{}{"state": "disconnected", "targetUserId": bobID})
+	var targeted ConnStateInfo
+	payloadOf(t, bob.expect("conn-state"), &targeted)
+	if targeted.State != "disconnected" {
+		t.Fatalf("targeted conn-state = %+v", targeted)
+	}
+	carol.expectNone("conn-state", 200*time.Millisecond)
+
+	// A late joiner gets the last room-wide state with the rest of the participant snapshot
+	dave, _ := dialTestUser(t, ln, "dave")
+	dave.send("join", "mesh", UserInfo{UserName: "dave"})
+	var snapshot ConnStateInfo
+	payloadOf(t, dave.expect("conn-state"), &snapshot)
+	if snapshot.State != "failed" || snapshot.UserName != "alice" {
+		t.Fatalf("late joiner's conn-state = %+v", snapshot)
+	}
+	dave.expect("joined")
+}
+
+// ICE restarts that overlap one already in flight between the same peers follow RENEGOTIATION_POLICY
+func TestOverlappingICERestarts(t *testing.T) {
+	for _, policy := range []string{"reject", "defer", "off"} {
+		t.Run(policy, func(t *testing.T) {
+			setupTestDB(t)
+			t.Setenv("RENEGOTIATION_POLICY", policy)
+			ln := startTestServer(t)
+
+			alice, aliceID := dialTestUser(t, ln, "alice")
+			bob, bobID := dialTestUser(t, ln, "bob")
+			alice.join("restarts", "alice")
+			bob.join("restarts", "bob")
+
+			restart := func(targetID int64, sdp string) map[string]interface{} {
+				return map[string]interface{}{"targetUserId": targetID, "iceRestart": true, "sdp": sdp}
+			}
+			alice.send("offer", "restarts", restart(bobID, "alice-1"))
+			bob.expect("offer")
+
+			// Bob restarts too before answering alice
+			bob.send("offer", "restarts", restart(aliceID, "bob-1"))
+			if policy == "off" {
+				alice.expect("offer")
+				bob.expectNone("renegotiation-in-progress", 200*time.Millisecond)
+				return
+			}
+			bob.expect("renegotiation-in-progress")
+			alice.expectNone("offer", 200*time.Millisecond)
+
+			// Once alice's restart is answered, a deferred offer follows the answer by itself
+			bob.send("answer", "restarts", map[string]interface{}{"targetUserId": aliceID, "sdp": "bob-answer"})
+			if msg, ok := alice.next(5 * time.Second); !ok || msg.Event != "answer" {
+				t.Fatalf("alice got %q before the answer to her restart", msg.Event)
+			}
+			if policy == "defer" {
+				var offer struct {
+					SDP string `json:"sdp"`
+				}
+				payloadOf(t, alice.expect("offer"), &offer)
+				if offer.SDP != "bob-1" {
+					t.Fatalf("deferred offer carried %q", offer.SDP)
+				}
+				return
+			}
+			alice.expectNone("offer", 200*time.Millisecond)
+			bob.send("offer", "restarts", restart(aliceID, "bob-2"))
+			alice.expect("offer")
+		})
+	}
+}
+
+func TestBWEFeedbackTargetedAndThrottled(t *testing.T) {
+	setupTestDB(t)
+	t.Setenv("BWE_RATE_LIMIT", "2")
+	ln := startTestServer(t)
+
+	alice, _ := dialTestUser(t, ln, "alice")
+	bob, bobID := dialTestUser(t, ln, "bob")
+	carol, _ := dialTestUser(t, ln, "carol")
+	alice.join("mesh", "alice")
+	bob.join("mesh", "bob")
+	carol.join("mesh", "carol")
+
+	// A burst of estimates: only BWE_RATE_LIMIT of them get through in a second
+	for i := 0; i < 5; i++ {
+		alice.send("bwe-feedback", "mesh", map[string]interface{}{"bitrateKbps": 1000 + i, "packetLoss": 0.02, "targetUserId": bobID})
+	}
+	for i := 0; i < 2; i++ {
+		var feedback BWEFeedback
+		payloadOf(t, bob.expect("bwe-feedback"), &feedback)
+		if feedback.BitrateKbps != float64(1000+i) || feedback.FromUserName != "alice" {
+			t.Fatalf("bob got %+v", feedback)
+		}
+	}
+	bob.expectNone("bwe-feedback", 300*time.Millisecond)
+	carol.expectNone("bwe-feedback", 100*time.Millisecond)
+
+	// Implausible estimates are dropped even with budget to spare
+	time.Sleep(time.Second)
+	alice.send("bwe-feedback", "mesh", map[string]interface{}{"bitrateKbps": -5, "targetUserId": bobID})
+	alice.send("bwe-feedback", "mesh", map[string]interface{}{"bitrateKbps": 800, "targetUserId": bobID})
+	var next BWEFeedback
+	payloadOf(t, bob.expect("bwe-feedback"), &next)
+	if next.BitrateKbps != 800 {
+		t.Fatalf("bob got %+v after the window reset", next)
+	}
+}
+
+func TestReactionCaps(t *testing.T) {
+	t.Setenv("REACTION_MAX_PER_USER", "2")
+	t.Setenv("REACTION_MAX_EMOJIS_PER_MESSAGE", "3")
+	room := &Room{ID: "reactions"}
+	alice, bob, carol := newTestConnection("alice"), newTestConnection("bob"), newTestConnection("carol")
+	react := func(conn *Connection, emoji string, remove bool) string {
+		return room.trackReaction(conn, ReactionInfo{Emoji: emoji, MessageID: "m1", Remove: remove})
+	}
+
+	for _, emoji := range []string{"👍", "❤️"} {
+		if refused := react(alice, emoji, false); refused != "" {
+			t.Fatalf("alice's %s refused: %s", emoji, refused)
+		}
+	}
+	if react(alice, "😂", false) == "" {
+		t.Fatal("alice got a third reaction on the message")
+	}
+	// Repeating a reaction isn't a new one, and taking one back makes room for another
+	if refused := react(alice, "👍", false); refused != "" {
+		t.Fatalf("repeating a reaction refused: %s", refused)
+	}
+	react(alice, "👍", true)
+	if refused := react(alice, "😂", false); refused != "" {
+		t.Fatalf("reaction after removing one refused: %s", refused)
+	}
+
+	// Three distinct emoji is the most a message takes, but anyone can join in on one already there
+	if refused := react(bob, "🎉", false); refused != "" {
+		t.Fatalf("third emoji refused: %s", refused)
+	}
+	if react(carol, "🔥", false) == "" {
+		t.Fatal("a fourth distinct emoji was accepted")
+	}
+	if refused := react(carol, "🎉", false); refused != "" {
+		t.Fatalf("joining an existing reaction refused: %s", refused)
+	}
+}
+
+func TestReactionLimitOverWebSocket(t *testing.T) {
+	setupTestDB(t)
+	t.Setenv("REACTION_MAX_PER_USER", "1")
+	t.Setenv("REACTION_RATE_LIMIT", "10")
+	ln := startTestServer(t)
+
+	alice, _ := dialTestUser(t, ln, "alice")
+	bob, _ := dialTestUser(t, ln, "bob")
+	alice.join("party", "alice")
+	bob.join("party", "bob")
+
+	alice.send("reaction", "party", ReactionInfo{Emoji: "👍", MessageID: "m1"})
+	bob.expect("reaction")
+	alice.send("reaction", "party", ReactionInfo{Emoji: "❤️", MessageID: "m1"})
+	alice.expect("reaction-limit")
+	bob.expectNone("reaction", 200*time.Millisecond)
+
+	// Toggling off the first reaction frees the slot
+	alice.send("reaction", "party", ReactionInfo{Emoji: "👍", MessageID: "m1", Remove: true})
+	var removed ReactionInfo
+	payloadOf(t, bob.expect("reaction"), &removed)
+	if !removed.Remove || removed.Emoji != "👍" {
+		t.Fatalf("bob got %+v, want the removal", removed)
+	}
+	alice.send("reaction", "party", ReactionInfo{Emoji: "❤️", MessageID: "m1"})
+	var swapped ReactionInfo
+	payloadOf(t, bob.expect("reaction"), &swapped)
+	if swapped.Emoji != "❤️" || swapped.UserName != "alice" {
+		t.Fatalf("bob got %+v", swapped)
+	}
+}
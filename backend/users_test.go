@@ -0,0 +1,270 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestRoomQuotaMatchesOwnedRooms(t *testing.T) {
+	setupTestDB(t)
+	t.Setenv("MAX_ROOMS_PER_USER", "5")
+	aliceID, aliceToken := createTestUser(t, "alice")
+	bobID, bobToken := createTestUser(t, "bob")
+	createTestRoom(t, "alice-1", aliceID)
+	createTestRoom(t, "alice-2", aliceID)
+	createTestRoom(t, "bob-1", bobID)
+
+	ctx := doRequest("GET", "/users/alice/room-quota", aliceToken, nil)
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	var quota struct {
+		OwnedRooms int `json:"ownedRooms"`
+		MaxRooms   int `json:"maxRooms"`
+		Remaining  int `json:"remaining"`
+	}
+	decodeBody(t, ctx, &quota)
+	if quota.OwnedRooms != 2 || quota.MaxRooms != 5 || quota.Remaining != 3 {
+		t.Fatalf("quota = %+v, want 2 of 5 used", quota)
+	}
+
+	if ctx := doRequest("GET", "/users/alice/room-quota", bobToken, nil); ctx.Response.StatusCode() != fasthttp.StatusForbidden {
+		t.Fatalf("another user's quota: got %d, want 403", ctx.Response.StatusCode())
+	}
+}
+
+// Reaching the limit refuses new rooms over both the API and a join; deleting one frees a slot
+func TestRoomQuotaEnforced(t *testing.T) {
+	setupTestDB(t)
+	t.Setenv("MAX_ROOMS_PER_USER", "2")
+	ln := startTestServer(t)
+	aliceID, aliceToken := createTestUser(t, "alice")
+	createTestRoom(t, "alice-1", aliceID)
+	createTestRoom(t, "alice-2", aliceID)
+	alice := dialTestClient(t, ln, aliceToken)
+
+	if ctx := doRequest("POST", "/rooms", aliceToken, map[string]string{"name": "Third"}); ctx.Response.StatusCode() != fasthttp.StatusForbidden {
+		t.Fatalf("creating a room over the limit: got %d, want 403", ctx.Response.StatusCode())
+	}
+	alice.send("join", "alice-3", UserInfo{UserName: "alice"})
+	alice.expect("room-limit-reached")
+	if room, err := GetRoomByID("alice-3"); err != nil || room != nil {
+		t.Fatalf("room created over the limit: %+v, %v", room, err)
+	}
+
+	// Joining a room that already exists doesn't count against the limit
+	alice.join("alice-1", "alice")
+
+	if ctx := doRequest("DELETE", "/rooms/alice-2", aliceToken, nil); ctx.Response.StatusCode() != fasthttp.StatusNoContent {
+		t.Fatalf("deleting a room: got %d %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	alice.join("alice-3", "alice")
+	if room, err := GetRoomByID("alice-3"); err != nil || room == nil || room.CreatedBy != aliceID {
+		t.Fatalf("room after freeing a slot = %+v, %v", room, err)
+	}
+	if ctx := doRequest("POST", "/rooms", aliceToken, map[string]string{"name": "Fourth"}); ctx.Response.StatusCode() != fasthttp.StatusForbidden {
+		t.Fatalf("creating a room once the slot is used again: got %d, want 403", ctx.Response.StatusCode())
+	}
+}
+
+// Transfers check the room ID up front and can't take the new owner past the room limit
+func TestTransferRoomLimits(t *testing.T) {
+	setupTestDB(t)
+	t.Setenv("MAX_ROOMS_PER_USER", "2")
+	aliceID, aliceToken := createTestUser(t, "alice")
+	bobID, _ := createTestUser(t, "bob")
+	createTestRoom(t, "alice-1", aliceID)
+	createTestRoom(t, "alice-2", aliceID)
+	createTestRoom(t, "bob-1", bobID)
+
+	transfer := func(roomID string) *fasthttp.RequestCtx {
+		return doRequest("POST", "/rooms/"+roomID+"/transfer", aliceToken, map[string]string{"username": "bob"})
+	}
+	for _, roomID := range []string{"ab", "bad%20id", strings.Repeat("x", 51)} {
+		if ctx := transfer(roomID); ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+			t.Errorf("transferring room %q: got %d, want 400", roomID, ctx.Response.StatusCode())
+		}
+	}
+
+	if ctx := transfer("alice-1"); ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("transfer within the limit: got %d %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	if ctx := transfer("alice-2"); ctx.Response.StatusCode() != fasthttp.StatusConflict {
+		t.Fatalf("transfer past the limit: got %d, want 409", ctx.Response.StatusCode())
+	}
+	if room, err := GetRoomByID("alice-2"); err != nil || room == nil || room.CreatedBy != aliceID {
+		t.Fatalf("room refused by the limit = %+v, %v; want it still alice's", room, err)
+	}
+}
+
+// Deleting an account takes its rooms with it, all or nothing
+func TestDeleteUserRemovesRooms(t *testing.T) {
+	setupTestDB(t)
+	aliceID, aliceToken := createTestUser(t, "alice")
+	bobID, bobToken := createTestUser(t, "bob")
+	createTestRoom(t, "alice-1", aliceID)
+	createTestRoom(t, "alice-2", aliceID)
+	createTestRoom(t, "bob-1", bobID)
+
+	if ctx := doRequest("DELETE", "/users/alice", bobToken, nil); ctx.Response.StatusCode() != fasthttp.StatusForbidden {
+		t.Fatalf("deleting another user's account: got %d, want 403", ctx.Response.StatusCode())
+	}
+
+	// A failure part way through leaves the user and their rooms in place
+	if _, err := dbExec("DROP TABLE password_resets"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DeleteUser(aliceID); err == nil {
+		t.Fatal("DeleteUser succeeded without the password_resets table")
+	}
+	if owned, err := CountRoomsByUserID(aliceID); err != nil || owned != 2 {
+		t.Fatalf("after a failed deletion alice owns %d rooms (%v), want 2", owned, err)
+	}
+	for _, m := range migrations {
+		if m.Description == "create password_resets table" {
+			if err := m.Apply(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if ctx := doRequest("DELETE", "/users/alice", aliceToken, nil); ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	for _, roomID := range []string{"alice-1", "alice-2"} {
+		if room, err := GetRoomByID(roomID); err != nil || room != nil {
+			t.Errorf("room %s survived its owner's deletion (%v)", roomID, err)
+		}
+	}
+	if user, err := GetUserByID(aliceID); err != nil || user != nil {
+		t.Errorf("user survived deletion: %+v, %v", user, err)
+	}
+	if room, err := GetRoomByID("bob-1"); err != nil || room == nil {
+		t.Errorf("another user's room was deleted too (%v)", err)
+	}
+}
+
+func TestUsernameChange(t *testing.T) {
+	setupTestDB(t)
+	aliceID, aliceToken := createTestUser(t, "alice")
+	otherDevice, err := generateToken("alice", aliceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	createTestUser(t, "bob")
+
+	if ctx := doRequest("PUT", "/users/alice/profile", aliceToken, map[string]string{"username": "bob"}); ctx.Response.StatusCode() != fasthttp.StatusConflict {
+		t.Fatalf("taking bob's name: got %d, want 409", ctx.Response.StatusCode())
+	}
+	for _, name := range []string{"al", "alice smith", "<alice>", "alice!"} {
+		if ctx := doRequest("PUT", "/users/alice/profile", aliceToken, map[string]string{"username": name}); ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+			t.Errorf("renaming to %q: got %d, want 400", name, ctx.Response.StatusCode())
+		}
+	}
+
+	ctx := doRequest("PUT", "/users/alice/profile", aliceToken, map[string]string{"username": "alice_2"})
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("rename: got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	var resp struct {
+		Username string `json:"username"`
+		Token    string `json:"token"`
+	}
+	decodeBody(t, ctx, &resp)
+	if resp.Username != "alice_2" || resp.Token == "" {
+		t.Fatalf("rename response = %+v", resp)
+	}
+	claims, err := validateToken(resp.Token)
+	if err != nil || claims.Username != "alice_2" || claims.UserID != aliceID {
+		t.Fatalf("new token claims = %+v, %v", claims, err)
+	}
+	if _, err := validateToken(aliceToken); err == nil {
+		t.Error("the token for the old name still works")
+	}
+
+	// A session on another device carries the old name too, which someone else can now take
+	createTestUser(t, "alice")
+	if _, err := validateToken(otherDevice); err == nil {
+		t.Error("another session's token for the old name still works")
+	}
+	if ctx := doRequest("PUT", "/users/alice/profile", otherDevice, map[string]string{"bio": "taken over"}); ctx.Response.StatusCode() != fasthttp.StatusUnauthorized {
+		t.Errorf("editing the new alice with an old session's token: got %d, want 401", ctx.Response.StatusCode())
+	}
+}
+
+func TestBatchProfilesTruncateBios(t *testing.T) {
+	setupTestDB(t)
+	t.Setenv("PROFILE_BATCH_BIO_LENGTH", "10")
+	_, token := createTestUser(t, "alice")
+	createTestUser(t, "bob")
+	longBio := strings.Repeat("é", 25)
+	if err := UpdateUserProfile("alice", "alice", longBio, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := UpdateUserProfile("bob", "bob", "short", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := doRequest("GET", "/profiles?usernames=alice,bob", token, nil)
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("batch: got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	var batch []struct {
+		Username     string `json:"username"`
+		Bio          string `json:"bio"`
+		BioTruncated bool   `json:"bioTruncated"`
+	}
+	decodeBody(t, ctx, &batch)
+	if len(batch) != 2 {
+		t.Fatalf("got %d profiles, want 2", len(batch))
+	}
+	if alice := batch[0]; !alice.BioTruncated || alice.Bio != strings.Repeat("é", 10)+"…" {
+		t.Fatalf("alice's bio wasn't truncated to 10 characters: %+v", alice)
+	}
+	if bob := batch[1]; bob.BioTruncated || bob.Bio != "short" {
+		t.Fatalf("bob's short bio was changed: %+v", bob)
+	}
+
+	ctx = doRequest("GET", "/users/alice/profile", token, nil)
+	var single struct {
+		Bio string `json:"bio"`
+	}
+	decodeBody(t, ctx, &single)
+	if single.Bio != longBio {
+		t.Fatalf("single profile bio = %q, want the full bio", single.Bio)
+	}
+}
+
+func TestProfileUpdateValidation(t *testing.T) {
+	setupTestDB(t)
+	_, token := createTestUser(t, "alice")
+
+	ctx := doRequest("PUT", "/users/alice/profile", token, map[string]string{"bio": strings.Repeat("b", 501)})
+	if ctx.Response.StatusCode() != fasthttp.StatusBadRequest || !strings.Contains(string(ctx.Response.Body()), "500") {
+		t.Fatalf("oversized bio: got %d %s, want 400 naming the limit", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	for _, name := range []string{"ali\x00ce", "bob\nadmin", strings.Repeat("u", 33)} {
+		if ctx := doRequest("PUT", "/users/alice/profile", token, map[string]string{"username": name}); ctx.Response.StatusCode() != fasthttp.StatusBadRequest {
+			t.Errorf("username %q: got %d, want 400", name, ctx.Response.StatusCode())
+		}
+	}
+	if user, _ := GetUserByUsername("alice"); user == nil || user.Bio != "" {
+		t.Fatalf("rejected updates changed the profile: %+v", user)
+	}
+
+	// Control characters are stripped, and the limit counts characters rather than bytes
+	bio := "Hi\x07 there\x1b[31m\n" + strings.Repeat("é", 480)
+	ctx = doRequest("PUT", "/users/alice/profile", token, map[string]string{"bio": bio})
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("valid update: got %d %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	var profile struct {
+		Bio string `json:"bio"`
+	}
+	decodeBody(t, doRequest("GET", "/users/alice/profile", token, nil), &profile)
+	if want := "Hi there[31m\n" + strings.Repeat("é", 480); profile.Bio != want {
+		t.Fatalf("stored bio = %q, want %q", profile.Bio, want)
+	}
+}
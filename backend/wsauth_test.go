@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+// dialWS attempts an upgrade to /ws with the given query and headers, returning the HTTP status
+// of a refused handshake
+func dialWS(t testing.TB, ln *fasthttputil.InmemoryListener, query string, header http.Header) (*websocket.Conn, int) {
+	t.Helper()
+	dialer := websocket.Dialer{
+		NetDial:          func(network, addr string) (net.Conn, error) { return ln.Dial() },
+		HandshakeTimeout: 5 * time.Second,
+	}
+	url := "ws://monkeychat.test/ws"
+	if query != "" {
+		url += "?" + query
+	}
+	ws, resp, err := dialer.Dial(url, header)
+	if err != nil {
+		if resp == nil {
+			t.Fatalf("dialing WebSocket: %v", err)
+		}
+		return nil, resp.StatusCode
+	}
+	t.Cleanup(func() { ws.Close() })
+	return ws, http.StatusSwitchingProtocols
+}
+
+// roleOnJoin joins a room the user owns over ws, so "host" comes back only if the socket is signed in as them
+func roleOnJoin(t testing.TB, ws *websocket.Conn, roomID string) string {
+	t.Helper()
+	c := &testClient{t: t, ws: ws, frames: make(chan Message, 64), closed: make(chan struct{})}
+	go c.readLoop()
+	var joined struct {
+		Role string `json:"role"`
+	}
+	payloadOf(t, c.join(roomID, "alice"), &joined)
+	return joined.Role
+}
+
+func TestWebSocketAuthInProduction(t *testing.T) {
+	setupTestDB(t)
+	t.Setenv("ENV", "production")
+	t.Setenv("ALLOWED_ORIGINS", "https://monkeychat.app")
+	ln := startTestServer(t)
+	userID, token := createTestUser(t, "alice")
+	createTestRoom(t, "prod-room", userID)
+	origin := http.Header{"Origin": {"https://monkeychat.app"}}
+
+	if _, status := dialWS(t, ln, "", origin); status != http.StatusUnauthorized {
+		t.Fatalf("no token: got %d, want 401", status)
+	}
+	if _, status := dialWS(t, ln, "token=not-a-jwt", origin); status != http.StatusUnauthorized {
+		t.Fatalf("invalid token: got %d, want 401", status)
+	}
+
+	ws, status := dialWS(t, ln, "token="+token, origin)
+	if status != http.StatusSwitchingProtocols {
+		t.Fatalf("valid token: got %d, want an upgrade", status)
+	}
+	if role := roleOnJoin(t, ws, "prod-room"); role != roleHost {
+		t.Fatalf("owner joined as %q, want %q", role, roleHost)
+	}
+}
+
+func TestWebSocketAnonymousInDevelopment(t *testing.T) {
+	setupTestDB(t)
+	t.Setenv("ENV", "development")
+	ln := startTestServer(t)
+
+	if _, status := dialWS(t, ln, "", nil); status != http.StatusSwitchingProtocols {
+		t.Fatalf("anonymous connection in development: got %d, want an upgrade", status)
+	}
+}
+
+// Each way of passing credentials signs the socket in; tickets only work once
+func TestWebSocketCredentialMechanisms(t *testing.T) {
+	setupTestDB(t)
+	t.Setenv("WS_AUTH", "required")
+	ln := startTestServer(t)
+	userID, token := createTestUser(t, "alice")
+	createTestRoom(t, "creds-room", userID)
+
+	ctx := doRequest("POST", "/ws-ticket", token, nil)
+	var issued struct {
+		Ticket string `json:"ticket"`
+	}
+	decodeBody(t, ctx, &issued)
+	if issued.Ticket == "" {
+		t.Fatalf("no ticket issued: %d %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+
+	mechanisms := []struct {
+		name   string
+		query  string
+		header http.Header
+	}{
+		{"ticket", "ticket=" + issued.Ticket, nil},
+		{"subprotocol", "", http.Header{"Sec-WebSocket-Protocol": {wsTicketProtocol + ", " + token}}},
+		{"query parameter", "token=" + token, nil},
+	}
+	for _, m := range mechanisms {
+		ws, status := dialWS(t, ln, m.query, m.header)
+		if status != http.StatusSwitchingProtocols {
+			t.Fatalf("%s: got %d, want an upgrade", m.name, status)
+		}
+		if role := roleOnJoin(t, ws, "creds-room"); role != roleHost {
+			t.Fatalf("%s: owner joined as %q, want %q", m.name, role, roleHost)
+		}
+	}
+
+	if _, status := dialWS(t, ln, "ticket="+issued.Ticket, nil); status != http.StatusUnauthorized {
+		t.Fatalf("reused ticket: got %d, want 401", status)
+	}
+	if ctx := doRequest("POST", "/ws-ticket", "", nil); ctx.Response.StatusCode() != http.StatusUnauthorized {
+		t.Fatalf("ticket without a bearer token: got %d, want 401", ctx.Response.StatusCode())
+	}
+}
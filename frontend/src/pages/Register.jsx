@@ -20,8 +20,8 @@ const Register = ({ setIsAuthenticated }) => {
       return;
     }
 
-    if (password.length < 4) {
-      setError('Password must be at least 4 characters');
+    if (password.length < 8) {
+      setError('Password must be at least 8 characters');
       return;
     }
 
@@ -109,9 +109,9 @@ const Register = ({ setIsAuthenticated }) => {
               value={password}
               onChange={(e) => setPassword(e.target.value)}
               required
-              minLength={4}
+              minLength={8}
                       className="form-input"
-                      placeholder="Create a secure password (4+ characters)"
+                      placeholder="Create a secure password (8+ characters)"
             />
           </div>
                 </div>
@@ -128,7 +128,7 @@ const Register = ({ setIsAuthenticated }) => {
               value={confirmPassword}
               onChange={(e) => setConfirmPassword(e.target.value)}
               required
-              minLength={4}
+              minLength={8}
                       className={`form-input ${confirmPassword && password !== confirmPassword ? 'error' : ''}`}
                       placeholder="Confirm your password"
             />